@@ -17,6 +17,7 @@ limitations under the License.
 package main
 
 import (
+	"errors"
 	"os"
 	"runtime"
 
@@ -39,6 +40,12 @@ func main() {
 	}
 
 	if err := rootCmd.Execute(); err != nil {
+		// an interrupted operation exits like a command killed by the signal
+		if errors.Is(err, pkg.ErrInterrupted) {
+			klog.Errorln("error:", err)
+			logs.FlushLogs()
+			os.Exit(pkg.ExitCode(err))
+		}
 		klog.Fatalln("error:", err)
 	}
 }
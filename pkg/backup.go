@@ -17,20 +17,30 @@ limitations under the License.
 package pkg
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	api_v1beta1 "stash.appscode.dev/apimachinery/apis/stash/v1beta1"
 	stash "stash.appscode.dev/apimachinery/client/clientset/versioned"
 	"stash.appscode.dev/apimachinery/pkg/restic"
 	api_util "stash.appscode.dev/apimachinery/pkg/util"
 
+	"github.com/armon/circbuf"
 	"github.com/spf13/cobra"
 	license "go.bytebuilders.dev/license-verifier/kubernetes"
 	"gomodules.xyz/flags"
-	shell "gomodules.xyz/go-sh"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog/v2"
@@ -48,8 +58,43 @@ func NewCmdBackup() *cobra.Command {
 		masterURL      string
 		kubeconfigPath string
 		opt            = mariadbOptions{
-			myArgs:      "--all-databases",
-			waitTimeout: 300,
+			myArgs:                    "--all-databases",
+			waitTimeout:               300,
+			readinessPollInterval:     DefaultReadinessPollInterval,
+			readinessBackoffFactor:    1,
+			systemSchemas:             DefaultSystemSchemas,
+			includeTriggers:           true,
+			compression:               CompressionNone,
+			backupRetryBackoff:        DefaultBackupRetryBackoff,
+			maxUploadRetries:          DefaultUploadRetries,
+			maxConnectionErrorRetries: DefaultConnectionErrorRetries,
+			uploadRetryBackoff:        DefaultUploadRetryBackoff,
+			parallelism:               1,
+			allowReadOnlySource:       true,
+			maxReplicaLag:             DefaultMaxReplicaLag,
+			readLockTimeout:           DefaultReadLockTimeout,
+			maxDumpRate:               "0",
+			serverVariables:           DefaultServerVariables,
+			noTablespaces:             NoTablespacesAuto,
+			hexBlob:                   HexBlobAuto,
+			terminationGracePeriod:    DefaultTerminationGracePeriod,
+			dumpCmd:                   MariaDBDumpCMD,
+			clientCmd:                 MariaDBRestoreCMD,
+			defaultCharset:            DefaultCharset,
+			maxAllowedPacket:          DefaultMaxAllowedPacket,
+			excludeDatabases:          []string{"my_database", "test"},
+			sinks:                     []string{SinkRestic},
+			objectStorage: objectStorageOptions{
+				partSize: DefaultObjectStoragePartSize,
+			},
+			tlsOptions: tlsOptions{
+				verifyServerCert: true,
+			},
+			credentialOptions: credentialOptions{
+				userKey:     MariaDBUser,
+				passwordKey: MariaDBPassword,
+				authMode:    AuthModePassword,
+			},
 			setupOptions: restic.SetupOptions{
 				ScratchDir:  restic.DefaultScratchDir,
 				EnableCache: false,
@@ -65,9 +110,21 @@ func NewCmdBackup() *cobra.Command {
 		Use:               "backup-mariadb",
 		Short:             "Takes a backup of MariaDB DB",
 		DisableAutoGenTag: true,
-		RunE: func(cmd *cobra.Command, args []string) error {
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
 			flags.EnsureRequiredFlags(cmd, "appbinding", "provider", "storage-secret-name", "storage-secret-namespace")
 
+			// the summary is written however the backup ends
+			summary := newRunSummary(OperationBackup, cmd)
+			defer func() {
+				summary.Bytes = opt.dumpStats.BytesWritten
+				if opt.rowCountsByDatabase != nil {
+					summary.Rows = opt.rowCountsByDatabase
+					summary.TotalRows = opt.rowCountsByDatabase.total()
+					summary.RowCountsPrecise = opt.preciseRowCounts
+				}
+				opt.writeRunSummary(summary, err)
+			}()
+
 			// prepare client
 			config, err := clientcmd.BuildConfigFromFlags(masterURL, kubeconfigPath)
 			if err != nil {
@@ -93,9 +150,32 @@ func NewCmdBackup() *cobra.Command {
 				Name:       opt.appBindingName,
 				Namespace:  opt.appBindingNamespace,
 			}
+			opt.metrics = opt.newMetricsRecorder()
+			if err = opt.metrics.start(); err != nil {
+				return err
+			}
+			defer opt.metrics.stop()
+
+			ctx, cancel := opt.startOperation(cmd.Context())
+			defer cancel()
+
 			var backupOutput *restic.BackupOutput
-			backupOutput, err = opt.backupMariaDB(targetRef)
-			if err != nil {
+			startTime := time.Now()
+			backupOutput, err = opt.backupMariaDB(ctx, targetRef)
+			err = opt.operationError(ctx, err)
+			summary.Snapshots = backupSnapshots(backupOutput)
+			if opt.dryRun {
+				// nothing has been backed up, there is no output to write nor metric to observe
+				return err
+			}
+			opt.metrics.observeOperation(OperationBackup, time.Since(startTime), err)
+			if err != nil && backupOutput != nil {
+				// a partially failed backup reports the snapshots it took along with the failure
+				for i := range backupOutput.BackupTargetStatus.Stats {
+					backupOutput.BackupTargetStatus.Stats[i].Phase = api_v1beta1.HostBackupFailed
+					backupOutput.BackupTargetStatus.Stats[i].Error = err.Error()
+				}
+			} else if err != nil {
 				backupOutput = &restic.BackupOutput{
 					BackupTargetStatus: api_v1beta1.BackupTargetStatus{
 						Ref: targetRef,
@@ -118,8 +198,92 @@ func NewCmdBackup() *cobra.Command {
 		},
 	}
 
-	cmd.Flags().StringVar(&opt.myArgs, "mariadb-args", opt.myArgs, "Additional arguments")
+	cmd.Flags().StringVar(&opt.myArgs, "mariadb-args", opt.myArgs, "Additional arguments, taking precedence over the dump arguments of the "+DumpArgsAnnotation+" annotation of the AppBinding")
 	cmd.Flags().Int32Var(&opt.waitTimeout, "wait-timeout", opt.waitTimeout, "Time limit to wait for the database to be ready")
+	cmd.Flags().BoolVar(&opt.skipReadinessCheck, "skip-readiness-check", opt.skipReadinessCheck, "Do not wait for the database to be ready, for databases known to be up. The first of several hosts is used as is")
+	cmd.Flags().DurationVar(&opt.readinessPollInterval, "readiness-poll-interval", opt.readinessPollInterval, "Interval between two checks of the database readiness")
+	cmd.Flags().Float64Var(&opt.readinessBackoffFactor, "readiness-backoff-factor", opt.readinessBackoffFactor, "Factor the readiness poll interval is multiplied by after each check (1 polls at a fixed interval)")
+	cmd.Flags().DurationVar(&opt.maxReadinessPollInterval, "max-readiness-poll-interval", opt.maxReadinessPollInterval, "Upper bound of the readiness poll interval when it grows (0 for no bound but the wait timeout)")
+	cmd.Flags().DurationVar(&opt.connectTimeout, "connect-timeout", opt.connectTimeout, "Timeout to connect to the database, rounded up to seconds (0 uses the client default)")
+	cmd.Flags().StringVar(&opt.defaultCharset, "default-charset", opt.defaultCharset, "Character set of the connections to the database (empty uses the client default)")
+	cmd.Flags().StringVar(&opt.maxAllowedPacket, "max-allowed-packet", opt.maxAllowedPacket, "Largest packet exchanged with the database, in bytes or with a K, M or G suffix (empty uses the client default)")
+	cmd.Flags().DurationVar(&opt.operationTimeout, "operation-timeout", opt.operationTimeout, "Time limit of the whole backup, dump and upload included (0 disables the limit)")
+	cmd.Flags().DurationVar(&opt.terminationGracePeriod, "termination-grace-period", opt.terminationGracePeriod, "Time given to the commands to exit after SIGTERM when the operation times out, before they are killed")
+	cmd.Flags().BoolVar(&opt.allowReadOnlySource, "allow-read-only-source", opt.allowReadOnlySource, "Back up a read-only database, which is often a replica, with a warning instead of failing (disabling it is recommended)")
+	cmd.Flags().BoolVar(&opt.perDatabaseBackup, "per-database-backup", opt.perDatabaseBackup, "Take a separate snapshot for each database")
+	cmd.Flags().BoolVar(&opt.abortOnFirstFailure, "abort-on-first-failure", opt.abortOnFirstFailure, "Stop a per database backup at the first failed database and delete the snapshots it already took")
+	cmd.Flags().BoolVar(&opt.skipEmptyDatabases, "skip-empty-databases", opt.skipEmptyDatabases, "Do not take a snapshot of the databases without any table (per database backup only)")
+	cmd.Flags().BoolVar(&opt.replicaBackup, "replica-backup", opt.replicaBackup, "Back up a replica without blocking its primary: once its replication is checked healthy, each dump stops the SQL thread of the replica (--dump-slave), "+
+		"reads a consistent snapshot in a single transaction and records the position of the primary as --record-binlog-position does. The backup user needs the privilege to stop and start the replica")
+	cmd.Flags().DurationVar(&opt.maxReplicaLag, "max-replica-lag", opt.maxReplicaLag, "Abort a replica backup when the replica is further behind its primary (0 accepts any lag as long as the replication runs)")
+	cmd.Flags().BoolVar(&opt.consistentSnapshot, "consistent-snapshot", opt.consistentSnapshot, "Dump InnoDB tables in a single transaction (--single-transaction --skip-lock-tables)")
+	cmd.Flags().IntVar(&opt.dumpNetReadTimeout, "dump-net-read-timeout", opt.dumpNetReadTimeout, "net_read_timeout of the dump session in seconds, i.e. 3600 for multi-hour dumps (0 keeps the server default, usually 30)")
+	cmd.Flags().IntVar(&opt.dumpNetWriteTimeout, "dump-net-write-timeout", opt.dumpNetWriteTimeout, "net_write_timeout of the dump session in seconds, raise it (i.e. to 3600) when multi-hour dumps are disconnected while the upload is slower than the dump (0 keeps the server default, usually 60)")
+	cmd.Flags().DurationVar(&opt.dumpLockWaitTimeout, "dump-lock-wait-timeout", opt.dumpLockWaitTimeout, "Fail the dump when it waits longer than this for a metadata lock, e.g. held by a running DDL, rounded up to seconds (0 waits for the server lock_wait_timeout)")
+	cmd.Flags().BoolVar(&opt.verifyDump, "verify-dump", opt.verifyDump, "Fail the backup when a dump does not end with the completion marker of mariadb-dump, i.e. it was cut short by an OOM kill or a full disk")
+	cmd.Flags().BoolVar(&opt.includeRoutines, "include-routines", opt.includeRoutines, "Include stored procedures and functions in the dump")
+	cmd.Flags().BoolVar(&opt.includeTriggers, "include-triggers", opt.includeTriggers, "Include triggers in the dump")
+	cmd.Flags().BoolVar(&opt.includeEvents, "include-events", opt.includeEvents, "Include scheduled events in the dump")
+	cmd.Flags().StringSliceVar(&opt.serverVariables, "server-variables", opt.serverVariables, "Global variables recorded in "+ServerVariablesFileName+" next to the dumps (backups in the output directory only, empty to disable)")
+	cmd.Flags().BoolVar(&opt.dumpGrants, "dump-grants", opt.dumpGrants, "Record in grants.sql the accounts granted privileges on the dumped databases, these privileges and their roles (system accounts excluded)")
+	cmd.Flags().StringVar(&opt.hexBlob, "hex-blob", opt.hexBlob, "Whether --hex-blob is passed to the dump: on, off or auto (passed if a dumped database has BINARY, VARBINARY, BLOB or BIT columns). Hexadecimal doubles the size of the binary data in the dump, but restores it byte for byte")
+	cmd.Flags().StringVar(&opt.noTablespaces, "no-tablespaces", opt.noTablespaces, "Whether --no-tablespaces is passed to the dump: on, off or auto (passed if the backup user lacks the PROCESS privilege)")
+	cmd.Flags().BoolVar(&opt.disableColumnStatistics, "disable-column-statistics", opt.disableColumnStatistics, "Pass --column-statistics=0 to the dump binary, needed by the MySQL 8 mysqldump against MariaDB servers (mariadb-dump rejects the flag)")
+	cmd.Flags().BoolVar(&opt.recordBinlogPosition, "record-binlog-position", opt.recordBinlogPosition, "Record the binary log coordinates of the dump in binlog-position.json inside the output directory")
+	cmd.Flags().StringSliceVar(&opt.includeDatabases, "include-databases", opt.includeDatabases, "Back up only these databases (--exclude-databases is applied within this list)")
+	cmd.Flags().StringSliceVar(&opt.tableSelection, "tables", opt.tableSelection, "Back up only these tables, given as <database>.<table>, with the database quoted in backticks when it contains a dot (the database filters are ignored)")
+	cmd.Flags().StringVar(&opt.whereClause, "where", opt.whereClause, "Dump only the rows matching this WHERE condition, applied to every dumped table")
+	cmd.Flags().StringSliceVar(&opt.ignoreTables, "ignore-table", opt.ignoreTables, "Do not dump these tables, given as <database>.<table>, with the database quoted in backticks when it contains a dot")
+	cmd.Flags().StringSliceVar(&opt.excludeDatabases, "exclude-databases", opt.excludeDatabases, "Databases to skip during backup, supports glob patterns (i.e. tmp_*)")
+	cmd.Flags().StringVar(&opt.compression, "compression", opt.compression, "Compression applied to the dump before it is handed to restic (none, gzip or zstd)")
+	cmd.Flags().IntVar(&opt.compressionLevel, "compression-level", opt.compressionLevel, "Compression level, 1-9 for gzip and 1-19 for zstd (0 uses the default level of the algorithm)")
+	cmd.Flags().IntVar(&opt.maxBackupRetries, "max-backup-retries", opt.maxBackupRetries, "Number of times a dump is retried after a transient failure (connection refused/reset, broken pipe)")
+	cmd.Flags().DurationVar(&opt.backupRetryBackoff, "backup-retry-backoff", opt.backupRetryBackoff, "Initial wait before retrying a failed dump, doubled after each retry")
+	cmd.Flags().IntVar(&opt.maxConnectionErrorRetries, "max-connection-error-retries", opt.maxConnectionErrorRetries, "Number of times a dump refused with \"Too many connections\" (error 1040) is retried, waiting longer than after other failures (streaming backups are never retried)")
+	cmd.Flags().IntVar(&opt.maxUploadRetries, "max-upload-retries", opt.maxUploadRetries, "Number of times the upload of the dumps to the repository is retried on transient errors, without dumping again (streaming backups are never retried)")
+	cmd.Flags().DurationVar(&opt.uploadRetryBackoff, "upload-retry-backoff", opt.uploadRetryBackoff, "Initial wait before retrying a failed upload, doubled after each retry")
+	cmd.Flags().IntVar(&opt.parallelism, "parallelism", opt.parallelism, "Maximum number of databases dumped concurrently")
+	cmd.Flags().BoolVar(&opt.orderByPrimary, "order-by-primary", opt.orderByPrimary, "Sort the rows of the tables by primary key. Along with --skip-dump-date, unchanged data gives a byte identical dump. Sorting slows down the dump of large tables")
+	cmd.Flags().BoolVar(&opt.skipDumpDate, "skip-dump-date", opt.skipDumpDate, "Leave the date out of the dump, so that dumps of the same data are identical, which restic deduplicates. Along with --order-by-primary, the dumps are reproducible")
+	cmd.Flags().BoolVar(&opt.preciseRowCounts, "precise-row-counts", opt.preciseRowCounts, "Count the rows of the backed up databases with COUNT(*), reported in the logs, the summary and the metrics. Slow on large tables, the counts are otherwise estimated from information_schema, off by 40% or more for InnoDB")
+	cmd.Flags().StringSliceVar(&opt.orderByPrimaryDatabases, "order-by-primary-databases", opt.orderByPrimaryDatabases, "Sort the rows only in the dumps of these databases, to spare the cost of sorting the others (not with --stream)")
+	cmd.Flags().BoolVar(&opt.incremental, "incremental", opt.incremental, "Dump only the tables updated since the previous backup of the host according to their UPDATE_TIME, the databases whose update times are unknown are dumped whole. "+
+		"UPDATE_TIME is not tracked for every table (InnoDB forgets it on restart, it misses DDL and changes to views, routines and events), and a restore needs the last full snapshot followed by every incremental one")
+	cmd.Flags().StringVar(&opt.maxDumpRate, "max-dump-rate", opt.maxDumpRate, "Maximum rate the dumps are read at, in bytes per second with a K, M or G suffix (i.e. 50M), shared by the parallel dumps. "+
+		"The rate is that of the dump before compression, 0 does not limit it")
+	cmd.Flags().BoolVar(&opt.streamBackup, "stream", opt.streamBackup, "Pipe the dump directly into restic instead of writing it into the scratch directory first")
+	cmd.Flags().StringSliceVar(&opt.sinks, "sink", opt.sinks, "Where the dumps are sent, restic and/or object-storage, or fifo (a streamed dump goes to a single sink)")
+	cmd.Flags().StringVar(&opt.fifoPath, "fifo-path", opt.fifoPath, "Named pipe the fifo sink writes the streamed dump into, created when missing, for an external process to read it. "+
+		"The dump is compressed before it is written, use --compression=none for the reader to get SQL. The backup waits for a reader and fails when it disconnects before the end of the dump")
+	cmd.Flags().StringVar(&opt.objectStorage.bucket, "object-storage-bucket", opt.objectStorage.bucket, "Bucket the dumps are uploaded to by the object-storage sink")
+	cmd.Flags().StringVar(&opt.objectStorage.prefix, "object-storage-prefix", opt.objectStorage.prefix, "Prefix of the uploaded dumps in the bucket, followed by the start time of the backup")
+	cmd.Flags().StringVar(&opt.objectStorage.endpoint, "object-storage-endpoint", opt.objectStorage.endpoint, "URL of the S3 compatible API, e.g. https://storage.googleapis.com for GCS (defaults to the AWS S3 endpoint of the region)")
+	cmd.Flags().StringVar(&opt.objectStorage.region, "object-storage-region", opt.objectStorage.region, "Region of the bucket (defaults to AWS_REGION)")
+	cmd.Flags().StringVar(&opt.objectStorage.partSize, "object-storage-part-size", opt.objectStorage.partSize, "Size of the parts of the multipart uploads, with a K, M or G suffix (5M to 5G)")
+	cmd.Flags().StringVar(&opt.preBackupHook, "pre-backup-hook", opt.preBackupHook, "Shell command run before the dump, i.e. to quiesce an application or flush its caches. It gets the environment of the database clients without the password, its output is logged and its failure aborts the backup")
+	cmd.Flags().StringVar(&opt.postBackupHook, "post-backup-hook", opt.postBackupHook, "Shell command run after the backup even if it failed, like a finally block, with "+EnvBackupResult+" set to "+BackupSucceeded+" or "+BackupFailed+". Its failure fails a backup that succeeded")
+	cmd.Flags().StringVar(&opt.snapshotReadyHook, "snapshot-ready-hook", opt.snapshotReadyHook, "Instead of dumping, lock the tables with FLUSH TABLES WITH READ LOCK and run this shell command, which takes a snapshot of the storage of the database, "+
+		"then release the lock. The hook gets the binary log coordinates of the locked server in "+EnvBinlogFile+", "+EnvBinlogPosition+" and "+EnvGTIDPosition+". The backup user needs the RELOAD privilege")
+	cmd.Flags().DurationVar(&opt.readLockTimeout, "read-lock-timeout", opt.readLockTimeout, "Time after which the global read lock is released and the snapshot-ready hook killed whatever happens, failing the backup")
+	cmd.Flags().BoolVar(&opt.dryRun, "dry-run", opt.dryRun, "Print the commands the backup would run (with the credentials masked) without dumping or uploading anything")
+	cmd.Flags().StringSliceVar(&opt.systemSchemas, "system-schemas", opt.systemSchemas, "Schemas treated as system schemas and never dumped")
+	cmd.Flags().StringVar(&opt.dumpCmd, "dump-binary", opt.dumpCmd, "Name or path of the dump binary (i.e. mysqldump on images shipping the MySQL compatible client)")
+	cmd.Flags().StringVar(&opt.clientCmd, "client-binary", opt.clientCmd, "Name or path of the client binary used to query the database (i.e. mysql)")
+
+	cmd.Flags().BoolVar(&opt.tlsOptions.verifyServerCert, "tls-verify-server-cert", opt.tlsOptions.verifyServerCert, "Verify the server certificate against the CA bundle of the AppBinding (disable for self-signed internal hosts)")
+	cmd.Flags().StringVar(&opt.tlsOptions.minVersion, "tls-min-version", opt.tlsOptions.minVersion, "Minimum TLS version used to connect to the database (i.e. TLSv1.2)")
+
+	cmd.Flags().StringVar(&opt.credentialOptions.userKey, "user-key", opt.credentialOptions.userKey, "Key of the AppBinding secret holding the database username")
+	cmd.Flags().StringVar(&opt.credentialOptions.passwordKey, "password-key", opt.credentialOptions.passwordKey, "Key of the AppBinding secret holding the database password")
+	cmd.Flags().BoolVar(&opt.credentialOptions.useDefaultsFile, "use-defaults-file", opt.credentialOptions.useDefaultsFile, "Pass the password through a --defaults-extra-file instead of the MYSQL_PWD environment variable")
+	cmd.Flags().StringVar(&opt.credentialOptions.credentialsDir, "credentials-dir", opt.credentialOptions.credentialsDir, "Directory of mounted credential files named after --user-key and --password-key, read instead of the AppBinding secret")
+	cmd.Flags().StringVar(&opt.credentialOptions.authMode, "auth-mode", opt.credentialOptions.authMode, "Authentication of the database user, password (from the AppBinding secret) or aws-iam (RDS/Aurora IAM authentication token, requires TLS)")
+	cmd.Flags().StringVar(&opt.credentialOptions.awsRegion, "aws-region", opt.credentialOptions.awsRegion, "AWS region of the database for IAM authentication (defaults to AWS_REGION)")
+	cmd.Flags().StringVar(&opt.credentialOptions.awsEndpoint, "aws-endpoint", opt.credentialOptions.awsEndpoint, "host:port the IAM authentication token is signed for (defaults to the host and port of the AppBinding)")
+	cmd.Flags().StringToStringVar(&opt.extraEnv, "extra-env", opt.extraEnv, "Environment variables set for the database clients, given as <name>=<value> (i.e. LC_ALL=C.UTF-8). "+EnvMariaDBPassword+" and "+EnvMariaDBLoginFile+" can not be set")
+	cmd.Flags().StringVar(&opt.proxy.address, "socks5-proxy", opt.proxy.address, "Connect to the database through this SOCKS5 proxy, given as <host>:<port>")
+	cmd.Flags().StringVar(&opt.proxy.user, "socks5-user", opt.proxy.user, "User authenticating to the SOCKS5 proxy")
+	cmd.Flags().StringVar(&opt.proxy.password, "socks5-password", opt.proxy.password, "Password authenticating to the SOCKS5 proxy (defaults to "+EnvSOCKS5Password+")")
 
 	cmd.Flags().StringVar(&masterURL, "master", masterURL, "The address of the Kubernetes API server (overrides any value in kubeconfig)")
 	cmd.Flags().StringVar(&kubeconfigPath, "kubeconfig", kubeconfigPath, "Path to kubeconfig file with authorization information (the master location is set by the master flag).")
@@ -136,11 +300,13 @@ func NewCmdBackup() *cobra.Command {
 	cmd.Flags().BoolVar(&opt.setupOptions.InsecureTLS, "insecure-tls", opt.setupOptions.InsecureTLS, "InsecureTLS for TLS secure s3/s3 compatible backend")
 	cmd.Flags().StringVar(&opt.setupOptions.Region, "region", opt.setupOptions.Region, "Region for s3/s3 compatible backend")
 	cmd.Flags().StringVar(&opt.setupOptions.Path, "path", opt.setupOptions.Path, "Directory inside the bucket where backup will be stored")
-	cmd.Flags().StringVar(&opt.setupOptions.ScratchDir, "scratch-dir", opt.setupOptions.ScratchDir, "Temporary directory")
-	cmd.Flags().BoolVar(&opt.setupOptions.EnableCache, "enable-cache", opt.setupOptions.EnableCache, "Specify whether to enable caching for restic")
+	cmd.Flags().StringVar(&opt.setupOptions.ScratchDir, "scratch-dir", opt.setupOptions.ScratchDir, "Temporary directory of the dumps, TLS files and defaults files, created if missing. It must be writable, i.e. an emptyDir volume on a read-only root filesystem")
+	cmd.Flags().BoolVar(&opt.setupOptions.EnableCache, "enable-cache", opt.setupOptions.EnableCache, "Specify whether to enable caching for restic (restic runs with --no-cache otherwise, which suits one-shot jobs)")
+	cmd.Flags().StringVar(&opt.resticCacheDir, "restic-cache-dir", opt.resticCacheDir, "Directory of the restic cache, created if missing, instead of the scratch directory (i.e. a volume that outlives the pod). Requires --enable-cache")
 	cmd.Flags().Int64Var(&opt.setupOptions.MaxConnections, "max-connections", opt.setupOptions.MaxConnections, "Specify maximum concurrent connections for GCS, Azure and B2 backend")
 
 	cmd.Flags().StringVar(&opt.backupOptions.Host, "hostname", opt.backupOptions.Host, "Name of the host machine")
+	cmd.Flags().StringArrayVar(&opt.snapshotTags, "snapshot-tag", opt.snapshotTags, "Custom tag of the snapshots, e.g. for the retention policies to select them, along with the tags set by the backup (server version, databases, database count, dump mode full or per-database). Can be repeated")
 
 	cmd.Flags().Int64Var(&opt.backupOptions.RetentionPolicy.KeepLast, "retention-keep-last", opt.backupOptions.RetentionPolicy.KeepLast, "Specify value for retention strategy")
 	cmd.Flags().Int64Var(&opt.backupOptions.RetentionPolicy.KeepHourly, "retention-keep-hourly", opt.backupOptions.RetentionPolicy.KeepHourly, "Specify value for retention strategy")
@@ -152,18 +318,73 @@ func NewCmdBackup() *cobra.Command {
 	cmd.Flags().BoolVar(&opt.backupOptions.RetentionPolicy.Prune, "retention-prune", opt.backupOptions.RetentionPolicy.Prune, "Specify whether to prune old snapshot data")
 	cmd.Flags().BoolVar(&opt.backupOptions.RetentionPolicy.DryRun, "retention-dry-run", opt.backupOptions.RetentionPolicy.DryRun, "Specify whether to test retention policy without deleting actual data")
 
+	cmd.Flags().StringVar(&opt.metricsAddr, "metrics-addr", opt.metricsAddr, "Address serving the metrics of the backup on /metrics while it runs (i.e. :9090)")
+	cmd.Flags().StringVar(&opt.pushgatewayURL, "pushgateway-url", opt.pushgatewayURL, "URL of a Prometheus pushgateway the metrics are pushed to when the backup completes")
+
 	cmd.Flags().StringVar(&opt.outputDir, "output-dir", opt.outputDir, "Directory where output.json file will be written (keep empty if you don't need to write output in file)")
+	cmd.Flags().BoolVar(&opt.summaryStdout, "summary-stdout", opt.summaryStdout, "Print the JSON summary of the run, also written into "+RunSummaryFileName+" in the output directory, to stdout")
 
 	return cmd
 }
 
-func (opt *mariadbOptions) backupMariaDB(targetRef api_v1beta1.TargetRef) (*restic.BackupOutput, error) {
+func (opt *mariadbOptions) backupMariaDB(ctx context.Context, targetRef api_v1beta1.TargetRef) (_ *restic.BackupOutput, backupErr error) {
 	var err error
+	// the queries run through the restore client, so both binaries are needed
+	binaries := []string{opt.dumpCmd, opt.clientCmd}
+	if opt.compression == CompressionZstd {
+		binaries = append(binaries, ZstdCMD)
+	}
+	err = checkBinaries(binaries...)
+	if err != nil {
+		return nil, err
+	}
+
 	err = license.CheckLicenseEndpoint(opt.config, licenseApiService, SupportedProducts)
 	if err != nil {
 		return nil, err
 	}
 
+	err = opt.validateConnectionOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	err = opt.setupResticCache()
+	if err != nil {
+		return nil, err
+	}
+
+	err = opt.validateDumpOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	err = opt.validateSinkOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	opt.dumpLimiter, err = newDumpLimiter(opt.maxDumpRate)
+	if err != nil {
+		return nil, err
+	}
+
+	// a replica backup is a consistent snapshot recording the position of the primary
+	if opt.replicaBackup {
+		opt.consistentSnapshot = true
+		opt.recordBinlogPosition = true
+	}
+
+	opt.tables, err = parseTableSelection(opt.tableSelection)
+	if err != nil {
+		return nil, err
+	}
+
+	err = opt.validate(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
 	opt.setupOptions.StorageSecret, err = opt.kubeClient.CoreV1().Secrets(opt.storageSecret.Namespace).Get(context.TODO(), opt.storageSecret.Name, metav1.GetOptions{})
 	if err != nil {
 		return nil, err
@@ -176,14 +397,17 @@ func (opt *mariadbOptions) backupMariaDB(targetRef api_v1beta1.TargetRef) (*rest
 		BackupSessionName: opt.backupSessionName,
 		Namespace:         opt.namespace,
 	}
-	err = api_util.ExecutePreBackupActions(actionOptions)
-	if err != nil {
-		return nil, err
-	}
-	// wait until the backend repository has been initialized.
-	err = api_util.WaitForBackendRepository(actionOptions)
-	if err != nil {
-		return nil, err
+	// a dry run must not change anything, so the pre-backup actions are skipped
+	if !opt.dryRun {
+		err = api_util.ExecutePreBackupActions(actionOptions)
+		if err != nil {
+			return nil, err
+		}
+		// wait until the backend repository has been initialized.
+		err = api_util.WaitForBackendRepository(actionOptions)
+		if err != nil {
+			return nil, err
+		}
 	}
 	// apply nice, ionice settings from env
 	opt.setupOptions.Nice, err = v1.NiceSettingsFromEnv()
@@ -200,80 +424,1124 @@ func (opt *mariadbOptions) backupMariaDB(targetRef api_v1beta1.TargetRef) (*rest
 		return nil, err
 	}
 
-	session := opt.newSessionWrapper(MariaDBDumpCMD)
+	// the platform admins may recommend dump arguments on the AppBinding, the mariadb args take precedence
+	if defaults := appBinding.Annotations[DumpArgsAnnotation]; strings.TrimSpace(defaults) != "" {
+		opt.myArgs = mergeUserArgs(defaults, opt.myArgs)
+		err = opt.validateDumpOptions()
+		if err != nil {
+			return nil, fmt.Errorf("invalid dump arguments in the annotation %s of the AppBinding: %w", DumpArgsAnnotation, err)
+		}
+	}
 
-	err = session.setDatabaseCredentials(opt.kubeClient, appBinding)
+	session, err := opt.prepareSession(appBinding, opt.dumpCmd, opt.setupOptions.ScratchDir)
+	defer session.cleanup()
 	if err != nil {
 		return nil, err
 	}
 
-	err = session.setDatabaseConnectionParameters(appBinding)
+	err = opt.waitForDatabase(ctx, session)
 	if err != nil {
 		return nil, err
 	}
 
-	err = session.setTLSParameters(appBinding, opt.setupOptions.ScratchDir)
+	// the post-backup hook runs even when the pre-backup hook or the backup failed
+	finishBackupHooks, err := opt.startBackupHooks(session)
+	defer func() {
+		backupErr = finishBackupHooks(backupErr)
+	}()
 	if err != nil {
 		return nil, err
 	}
 
-	err = session.waitForDBReady(opt.waitTimeout)
+	// the version is recorded so that a restore can check it is compatible with its target
+	version, err := session.serverVersion()
 	if err != nil {
 		return nil, err
 	}
+	klog.Infof("Backing up %s server version %s", version.flavor(), version)
+	opt.backupOptions.Args = append(opt.backupOptions.Args, serverVersionTag(version)...)
+	if host := session.host(); host != "" {
+		opt.backupOptions.Args = append(opt.backupOptions.Args, "--tag", HostTagPrefix+host)
+	}
+	opt.backupOptions.Args = append(opt.backupOptions.Args, opt.snapshotTagArgs()...)
 
-	databases2exclude := map[string]bool{"information_schema": true, "my_database": true, "mysql": true, "performance_schema": true, "sys": true, "test": true}
-	databases, err := session.getDbNames()
-	var databases2dump []string
+	if opt.replicaBackup {
+		err = opt.prepareReplicaBackup(session)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err = opt.checkReadOnlySource(session)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the storage of the database is snapshotted outside of the plugin, which only freezes it meanwhile
+	if opt.snapshotReadyHook != "" {
+		if opt.dryRun {
+			return nil, opt.printStorageSnapshotPlan(os.Stdout)
+		}
+		err = opt.coordinateStorageSnapshot(session)
+		if err != nil {
+			return nil, err
+		}
+		return opt.sinkBackupOutput(targetRef), nil
+	}
+
+	if opt.recordBinlogPosition && !opt.replicaBackup {
+		opt.gtidEnabled, err = session.isGTIDEnabled()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = opt.setSkipTablespaces(session)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, db := range databases {
-		if db != "" && !databases2exclude[db] {
-			databases2dump = append(databases2dump, db)
+	var databases2dump []string
+	if len(opt.tables) > 0 {
+		// only the databases of the selected tables are dumped, the database filters do not apply
+		databases, err := session.getDbNames(nil)
+		if err != nil {
+			return nil, fmt.Errorf("aborting backup, unable to enumerate databases: %w", err)
+		}
+		databases2dump, err = includeDatabases(databases, tableDatabases(opt.tables))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		databases, err := session.getDbNames(opt.systemSchemas)
+		if err != nil {
+			return nil, fmt.Errorf("aborting backup, unable to enumerate databases: %w", err)
+		}
+		// when both lists are set, the include list is applied first and the exclude list filters within it
+		databases, err = includeDatabases(databases, opt.includeDatabases)
+		if err != nil {
+			return nil, err
+		}
+		databases2dump, err = excludeDatabases(databases, opt.excludeDatabases)
+		if err != nil {
+			return nil, err
 		}
 	}
 
+	if opt.skipEmptyDatabases {
+		databases2dump, err = opt.nonEmptyDatabases(session, databases2dump)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = opt.setHexBlob(session, databases2dump)
+	if err != nil {
+		return nil, err
+	}
+
 	klog.Infof("databases2dump : %v", databases2dump)
-	dumpdir := opt.setupOptions.ScratchDir + "/dumpsql"
+	opt.runDatabases = databases2dump
+	if opt.dryRun {
+		return nil, opt.printBackupPlan(os.Stdout, session, databases2dump, filepath.Join(opt.setupOptions.ScratchDir, MariaDBDumpDir))
+	}
+
+	var sink dumpSink
+	if opt.hasSink(SinkObjectStorage) {
+		sink, err = opt.newObjectStorageSink(time.Now())
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opt.hasSink(SinkFIFO) {
+		sink, err = opt.newFIFOSink()
+		if err != nil {
+			return nil, err
+		}
+	}
+	var resticWrapper *restic.ResticWrapper
+	if opt.hasSink(SinkRestic) {
+		resticWrapper, err = restic.NewResticWrapperFromShell(opt.setupOptions, session.sh)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opt.streamBackup {
+		opt.recordRowCounts(session, databases2dump)
+		if resticWrapper == nil {
+			// the dump is streamed to a single sink, which is not restic here
+			err = opt.streamToSink(ctx, session, sink, databases2dump)
+			if err != nil {
+				return nil, err
+			}
+			return opt.sinkBackupOutput(targetRef), nil
+		}
+		return opt.backupStream(session, resticWrapper, targetRef, databases2dump)
+	}
+
+	dumpdir := filepath.Join(opt.setupOptions.ScratchDir, MariaDBDumpDir)
 	err = os.Mkdir(dumpdir, 0750)
 	if err != nil {
 		return nil, err
 	}
 
-	tables2exclude := []string{"cache_hubber_persistent", "key_value_expire", "sessions"}
+	if opt.incremental {
+		databases2dump, err = opt.selectIncrementalDump(session, resticWrapper, databases2dump, dumpdir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	opt.recordRowCounts(session, databases2dump)
+
+	results, err := opt.dumpDatabases(ctx, appBinding, session, databases2dump, dumpdir)
+	if err != nil {
+		return nil, err
+	}
+	// the dumps were interrupted, don't upload what is left of them
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var backupOutput *restic.BackupOutput
+	if opt.perDatabaseBackup {
+		if resticWrapper != nil {
+			backupOutput, err = opt.backupPerDatabase(ctx, session, resticWrapper, targetRef, results)
+			if err != nil {
+				// the snapshots of the databases that succeeded are kept and reported
+				return backupOutput, err
+			}
+		}
+	} else {
+		var dumped []string
+		dumped, err = opt.dumpedDatabases(session, results)
+		if err != nil {
+			return nil, err
+		}
+
+		// the manifest is backed up along with the dumps to verify a restore against it
+		var manifest TableManifest
+		manifest, err = opt.buildTableManifest(session, dumped)
+		if err != nil {
+			return nil, err
+		}
+		err = manifest.writeToFile(tableManifestFile(dumpdir))
+		if err != nil {
+			return nil, err
+		}
+		if opt.dumpGrants {
+			err = session.writeGrants(dumpdir, dumped)
+			if err != nil {
+				return nil, err
+			}
+		}
+		// the dumps may be taken without CREATE DATABASE, the restore then creates the databases alike
+		charsets, err := session.databaseCharsets(dumped)
+		if err != nil {
+			return nil, err
+		}
+		err = charsets.writeToFile(databaseCharsetsFile(dumpdir))
+		if err != nil {
+			return nil, err
+		}
+		err = opt.dumpChecksums.writeToFile(checksumFile(dumpdir))
+		if err != nil {
+			return nil, err
+		}
+		if opt.incremental {
+			err = opt.tableUpdateTimes.writeToFile(tableUpdateTimesFile(dumpdir))
+			if err != nil {
+				return nil, err
+			}
+		}
+		// the settings of the server are kept for disaster recovery, to set up a replacement alike
+		if len(opt.serverVariables) > 0 {
+			variables, err := session.serverVariables(opt.serverVariables)
+			if err != nil {
+				return nil, err
+			}
+			err = variables.writeToFile(serverVariablesFile(dumpdir))
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if resticWrapper != nil {
+			opt.backupOptions.StdinPipeCommands = nil
+			opt.backupOptions.BackupPaths = []string{dumpdir}
+			opt.backupOptions.Args = append(opt.backupOptions.Args, opt.dumpStats.snapshotTags()...)
+			opt.backupOptions.Args = append(opt.backupOptions.Args, databasesTags(dumped)...)
+			if opt.incremental {
+				opt.backupOptions.Args = append(opt.backupOptions.Args, "--tag", BackupTypeTagPrefix+opt.backupType)
+			}
+
+			backupOutput, err = opt.runBackupWithRetry(ctx, resticWrapper, opt.backupOptions, targetRef)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if sink != nil {
+		err = opt.uploadDumps(ctx, sink, dumpdir, results)
+		if err != nil {
+			return nil, err
+		}
+		if backupOutput == nil {
+			backupOutput = opt.sinkBackupOutput(targetRef)
+		}
+	}
+
+	if opt.outputDir != "" {
+		err = opt.dumpStats.writeToFile(filepath.Join(opt.outputDir, DumpStatsFileName))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opt.recordBinlogPosition && opt.outputDir != "" {
+		err = writeBinlogPositions(filepath.Join(opt.outputDir, BinlogPositionFileName), opt.binlogPositions)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return backupOutput, nil
+}
+
+// dumpResult is the outcome of the dump of a single database
+type dumpResult struct {
+	db       string
+	dumpfile string
+	bytes    int64
+	err      error
+	// set on the failure that aborted the other dumps
+	firstFailure bool
+}
+
+// dumpedDatabases returns the databases dumped into the single snapshot of a full backup. A snapshot missing
+// a database must not be reported as a successful backup, so the failed dumps fail the backup, all of them
+// reported at once. The databases dropped since they were enumerated are skipped.
+func (opt *mariadbOptions) dumpedDatabases(session *sessionWrapper, results []dumpResult) ([]string, error) {
+	var (
+		dumped []string
+		failed []dumpResult
+	)
+	for _, result := range results {
+		if result.err != nil {
+			failed = append(failed, result)
+			continue
+		}
+		dumped = append(dumped, result.db)
+	}
+	if len(failed) == 0 {
+		return dumped, nil
+	}
+
+	current, err := session.getDbNames(opt.systemSchemas)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		names []string
+		errs  []error
+	)
+	for _, result := range failed {
+		if !current.has(result.db) {
+			klog.Warningf("Database %s does not exist anymore, skipping it", result.db)
+			_ = os.Remove(result.dumpfile)
+			continue
+		}
+		names = append(names, result.db)
+		errs = append(errs, fmt.Errorf("failed to dump database %s: %w", result.db, result.err))
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("backup failed for %d of %d databases (%s): %w", len(names), len(results), strings.Join(names, ", "), errors.NewAggregate(errs))
+	}
+	return dumped, nil
+}
+
+// dumpDatabases dumps the databases with up to opt.parallelism concurrent mariadb-dump processes.
+// A failed dump does not stop the others, the error is reported in the result of the database.
+// Each worker prepares its own session, the sessions write their TLS files into separate directories.
+func (opt *mariadbOptions) dumpDatabases(ctx context.Context, appBinding *appcatalog.AppBinding, session *sessionWrapper, databases []string, dumpdir string) ([]dumpResult, error) {
+	results := make([]dumpResult, len(databases))
+	for i, db := range databases {
+		results[i] = dumpResult{db: db, dumpfile: opt.databaseDumpFile(dumpdir, db)}
+	}
+	// the first failure cancels the dumps that are left
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var abort sync.Once
+	dump := func(session *sessionWrapper, i int) {
+		results[i].bytes, results[i].err = opt.dumpDatabaseWithRetry(ctx, session, results[i].db, results[i].dumpfile)
+		if results[i].err != nil && opt.abortOnFirstFailure {
+			abort.Do(func() {
+				results[i].firstFailure = true
+				cancel()
+			})
+		}
+	}
+
+	workers := opt.parallelism
+	if workers > len(databases) {
+		workers = len(databases)
+	}
+	if workers <= 1 {
+		for i := range results {
+			dump(session, i)
+		}
+		return results, nil
+	}
+
+	sessions := make([]*sessionWrapper, workers)
+	defer func() {
+		for _, s := range sessions {
+			if s != nil {
+				s.cleanup()
+			}
+		}
+	}()
+	for w := range sessions {
+		var err error
+		sessions[w], err = opt.prepareSession(appBinding, opt.dumpCmd, opt.setupOptions.ScratchDir)
+		if err != nil {
+			return nil, err
+		}
+		// the workers dump from the host selected while waiting for the database
+		sessions[w].useHost(session.host())
+	}
+
+	jobs := make(chan int)
+	wg := sync.WaitGroup{}
+	for w := range sessions {
+		wg.Add(1)
+		go func(workerSession *sessionWrapper) {
+			defer wg.Done()
+			for i := range jobs {
+				dump(workerSession, i)
+			}
+		}(sessions[w])
+	}
+	for i := range results {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results, nil
+}
+
+// dumpDatabaseWithRetry dumps a database, retrying transient failures with an exponential backoff
+func (opt *mariadbOptions) dumpDatabaseWithRetry(ctx context.Context, session *sessionWrapper, db, dumpfile string) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	var written int64
+	err := retryWithPolicies(ctx, func() error {
+		var err error
+		written, err = opt.dumpDatabase(session, db, dumpfile)
+		return err
+	}, opt.connectionErrorRetryPolicy(), retryPolicy{
+		retries:     opt.maxBackupRetries,
+		backoff:     opt.backupRetryBackoff,
+		maxBackoff:  MaxBackupRetryBackoff,
+		isRetryable: isRetryableError,
+	})
+	return written, err
+}
+
+// connectionErrorRetryPolicy retries the dumps refused by a server that reached max_connections.
+// The server is under load, so the dump waits longer than after other transient errors.
+func (opt *mariadbOptions) connectionErrorRetryPolicy() retryPolicy {
+	return retryPolicy{
+		retries:     opt.maxConnectionErrorRetries,
+		backoff:     opt.backupRetryBackoff * ConnectionErrorBackoffFactor,
+		maxBackoff:  MaxConnectionErrorBackoff,
+		isRetryable: isTooManyConnectionsError,
+	}
+}
+
+// runBackupWithRetry uploads the dumps already on disk into the repository, retrying failed uploads
+// with an exponential backoff so that a flaky object store does not waste the dumps
+func (opt *mariadbOptions) runBackupWithRetry(ctx context.Context, resticWrapper *restic.ResticWrapper, backupOptions restic.BackupOptions, targetRef api_v1beta1.TargetRef) (*restic.BackupOutput, error) {
+	var (
+		backupOutput *restic.BackupOutput
+		attempts     int
+	)
+	err := retryWithBackoff(ctx, opt.maxUploadRetries, opt.uploadRetryBackoff, MaxBackupRetryBackoff, isRetryableUploadError, func() error {
+		attempts++
+		var err error
+		backupOutput, err = resticWrapper.RunBackup(backupOptions, targetRef)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if attempts > 1 {
+		klog.Infof("Uploaded the dumps into the repository after %d attempts", attempts)
+	}
+	return backupOutput, nil
+}
+
+// dumpDatabase runs mariadb-dump for a single database, writes the output into dumpfile and returns the size of the dump
+func (opt *mariadbOptions) dumpDatabase(session *sessionWrapper, db, dumpfile string) (int64, error) {
+	sh := session.newShell()
+
+	args := opt.dumpArgs(session, db)
+	klog.Infof("Running : %s %v", session.cmd.Name, sanitizeArgs(args))
+
+	out, err := os.Create(dumpfile)
+	if err != nil {
+		return 0, err
+	}
+	// a failed or truncated dump is removed, so that it is never uploaded as if it were complete
+	completed := false
+	defer func() {
+		_ = out.Close()
+		if !completed {
+			_ = os.Remove(dumpfile)
+		}
+	}()
+
+	// the checksum is computed over the file as stored, while it is written
+	hash := sha256.New()
+	compressor, err := newCompressWriter(io.MultiWriter(out, hash), opt.compression, opt.compressionLevel)
+	if err != nil {
+		return 0, err
+	}
+
+	// the dump is counted and its header is captured before compression
+	startTime := time.Now()
+	header := &headerWriter{limit: dumpHeaderSize}
+	trailer := newTrailerWriter()
+	counter := &countingWriter{w: io.MultiWriter(compressor, header, trailer)}
+	sh.Stdout = throttle(counter, opt.dumpLimiter)
+	errBuff, err := circbuf.NewBuffer(stderrBufferSize)
+	if err != nil {
+		return 0, err
+	}
+	// stderr is kept apart from the dump, both pipes are drained concurrently by the command
+	sh.Stderr = errBuff
+	err = sh.Command(session.cmd.Name, args...).Run()
+	if err != nil {
+		_ = compressor.Close()
+		return 0, newCommandError(err, capturedStderr(errBuff))
+	}
+	// the dump succeeded, what it wrote on stderr are warnings
+	if stderr := strings.TrimSpace(capturedStderr(errBuff)); stderr != "" {
+		klog.V(4).Infof("%s wrote on stderr while dumping database %s:\n%s", session.cmd.Name, db, stderr)
+	}
+	if err = compressor.Close(); err != nil {
+		return 0, fmt.Errorf("failed to compress dump of database %s: %w", db, err)
+	}
+	if opt.verifyDump {
+		if err = checkDumpCompleted(trailer.Bytes()); err != nil {
+			return 0, fmt.Errorf("database %s: %w", db, err)
+		}
+	}
 
-	for _, db := range databases2dump {
-		dumpfile := dumpdir + "/" + db + ".sql"
+	var pos *BinlogPosition
+	if opt.recordBinlogPosition {
+		pos, err = parseBinlogPosition(bytes.NewReader(header.buf.Bytes()))
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse binary log coordinates from the dump of database %s: %w", db, err)
+		}
+	}
 
-		sh := shell.NewSession()
-		for k, v := range session.sh.Env {
-			sh.SetEnv(k, v)
+	// dumps may run concurrently, so the shared results are updated under lock
+	opt.mu.Lock()
+	defer opt.mu.Unlock()
+	opt.dumpStats.add(counter.count, time.Since(startTime))
+	opt.metrics.observeDump(counter.count, time.Since(startTime))
+	if opt.dumpChecksums == nil {
+		opt.dumpChecksums = DumpChecksums{}
+	}
+	opt.dumpChecksums[filepath.Base(dumpfile)] = hex.EncodeToString(hash.Sum(nil))
+	if pos != nil {
+		if opt.binlogPositions == nil {
+			opt.binlogPositions = map[string]BinlogPosition{}
 		}
+		opt.binlogPositions[db] = *pos
+	}
+	completed = true
+	return counter.count, nil
+}
+
+// ignoreTableDataArgs returns the arguments excluding the data of the volatile tables of db from its dump
+func ignoreTableDataArgs(db string) []interface{} {
+	tables2exclude := []string{"cache_hubber_persistent", "key_value_expire", "sessions"}
+
+	var args []interface{}
+	for _, table := range tables2exclude {
+		args = append(args, "--ignore-table-data="+db+"."+table)
+	}
+	return args
+}
 
-		args := session.cmd.Args
-		for _, table := range tables2exclude {
-			args = append(args, "--ignore-table-data="+db+"."+table)
+// dumpArgs returns the arguments of mariadb-dump to dump a single database
+func (opt *mariadbOptions) dumpArgs(session *sessionWrapper, db string) []interface{} {
+	args := append([]interface{}{}, session.cmd.Args...)
+	args = append(args, ignoreTableDataArgs(db)...)
+	args = append(args, opt.dumpFlags()...)
+	args = append(args, opt.orderByPrimaryArgs(db)...)
+	args = append(args, opt.userDumpArgs()...)
+	// the arguments are passed to mariadb-dump without going through a shell, so table names need no escaping.
+	// The options end before the database, whose name may start with a dash.
+	args = append(args, "--", db)
+	for _, table := range opt.tables[db] {
+		args = append(args, table)
+	}
+	return args
+}
+
+// userDumpArgs returns the additional arguments of mariadb-dump. The dumps select their databases explicitly,
+// so --all-databases is dropped: it would make mariadb-dump ignore the databases and dump all of them.
+func (opt *mariadbOptions) userDumpArgs() []interface{} {
+	var args []interface{}
+	for _, arg := range strings.Fields(opt.myArgs) {
+		if arg == "--all-databases" || arg == "-A" {
+			continue
 		}
+		args = append(args, arg)
+	}
+	return args
+}
 
-		args = append(args, opt.myArgs)
+// streamBackupOptions returns the restic options backing up the dump of the databases piped from mariadb-dump
+func (opt *mariadbOptions) streamBackupOptions(session *sessionWrapper, databases []string) restic.BackupOptions {
+	args := append([]interface{}{}, session.cmd.Args...)
+	for _, db := range databases {
+		args = append(args, ignoreTableDataArgs(db)...)
+	}
+	args = append(args, opt.dumpFlags()...)
+	// a single dump holds all the databases, so the ordering can not be restricted to some of them
+	args = append(args, opt.orderByPrimaryArgs("")...)
+	args = append(args, opt.userDumpArgs()...)
+	args = append(args, "--databases", "--")
+	for _, db := range databases {
 		args = append(args, db)
+	}
+
+	backupOptions := opt.backupOptions
+	backupOptions.BackupPaths = nil
+	backupOptions.Args = append(append([]string{}, opt.backupOptions.Args...), databasesTags(databases)...)
+	backupOptions.StdinPipeCommands = []restic.Command{{Name: session.cmd.Name, Args: args}}
+	if compressor := compressCommand(opt.compression, opt.compressionLevel); compressor != nil {
+		backupOptions.StdinPipeCommands = append(backupOptions.StdinPipeCommands, *compressor)
+	}
+	backupOptions.StdinFileName = opt.backupOptions.StdinFileName + compressionExtension(opt.compression)
+	return backupOptions
+}
 
-		klog.Infof("Running : %s %v", MariaDBDumpCMD, args)
+// backupStream pipes the dump of the databases directly into restic so that it never lands on disk.
+// restic commits whatever it has read once its stdin is closed, so when the dump fails mid-stream
+// the truncated snapshot is deleted before the error is reported.
+func (opt *mariadbOptions) backupStream(session *sessionWrapper, resticWrapper *restic.ResticWrapper, targetRef api_v1beta1.TargetRef, databases []string) (*restic.BackupOutput, error) {
+	if len(databases) == 0 {
+		return nil, fmt.Errorf("no database to back up")
+	}
 
-		err = sh.Command(MariaDBDumpCMD, args...).WriteStdout(dumpfile)
+	backupOptions := opt.streamBackupOptions(session, databases)
+	klog.Infof("Streaming : %s %v", backupOptions.StdinPipeCommands[0].Name, sanitizeArgs(backupOptions.StdinPipeCommands[0].Args))
+	if opt.verifyDump {
+		// the dump is checked before it is compressed, a truncated dump fails the pipeline
+		verifier, err := verifyDumpCommand()
 		if err != nil {
-			klog.Infof("Error dump database %s. Reason: %v.", err)
+			return nil, err
 		}
+		commands := append([]restic.Command{backupOptions.StdinPipeCommands[0], *verifier}, backupOptions.StdinPipeCommands[1:]...)
+		backupOptions.StdinPipeCommands = commands
+	}
+	if opt.dumpLimiter != nil {
+		// the output of mariadb-dump is throttled, so the rate is that of the uncompressed dump
+		throttler, err := throttleCommand(int64(opt.dumpLimiter.Limit()))
+		if err != nil {
+			return nil, err
+		}
+		commands := append([]restic.Command{backupOptions.StdinPipeCommands[0], *throttler}, backupOptions.StdinPipeCommands[1:]...)
+		backupOptions.StdinPipeCommands = commands
 	}
 
-	opt.backupOptions.StdinPipeCommands = nil
-	opt.backupOptions.BackupPaths = []string{dumpdir}
+	if err := session.refreshCredentials(); err != nil {
+		return nil, err
+	}
+	startTime := time.Now()
+	backupOutput, err := resticWrapper.RunBackup(backupOptions, targetRef)
+	if err != nil {
+		if cleanupErr := deleteTruncatedSnapshots(resticWrapper, backupOptions.Host, backupOptions.StdinFileName, startTime); cleanupErr != nil {
+			klog.Errorf("Failed to delete the snapshot of the aborted dump. Reason: %v", cleanupErr)
+		}
+		return nil, fmt.Errorf("streaming dump failed: %w", err)
+	}
+	return backupOutput, nil
+}
 
-	resticWrapper, err := restic.NewResticWrapperFromShell(opt.setupOptions, session.sh)
+// deleteTruncatedSnapshots deletes the snapshots of fileName taken for host since the given time
+func deleteTruncatedSnapshots(resticWrapper *restic.ResticWrapper, host, fileName string, since time.Time) error {
+	snapshots, err := resticWrapper.ListSnapshots(nil)
+	if err != nil {
+		return err
+	}
+
+	var ids []string
+	for _, snapshot := range snapshots {
+		if snapshot.Hostname == host && !snapshot.Time.Before(since) && containsString(snapshot.Paths, "/"+fileName) {
+			ids = append(ids, snapshot.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	klog.Warningf("Deleting truncated snapshots %v", ids)
+	_, err = resticWrapper.DeleteSnapshots(ids)
+	return err
+}
+
+// validateDumpOptions checks that the dump related options do not conflict with each other
+func (opt *mariadbOptions) validateDumpOptions() error {
+	if err := validateCompression(opt.compression); err != nil {
+		return err
+	}
+	if err := validateCompressionLevel(opt.compression, opt.compressionLevel); err != nil {
+		return err
+	}
+	if err := opt.validateDumpVerification(); err != nil {
+		return err
+	}
+	if opt.parallelism < 1 {
+		return fmt.Errorf("parallelism must be at least 1, got %d", opt.parallelism)
+	}
+	if opt.maxBackupRetries < 0 {
+		return fmt.Errorf("maximum backup retries must not be negative, got %d", opt.maxBackupRetries)
+	}
+	if opt.backupRetryBackoff <= 0 {
+		return fmt.Errorf("backup retry backoff must be positive, got %v", opt.backupRetryBackoff)
+	}
+	if opt.maxConnectionErrorRetries < 0 {
+		return fmt.Errorf("maximum connection error retries must not be negative, got %d", opt.maxConnectionErrorRetries)
+	}
+	if opt.maxUploadRetries < 0 {
+		return fmt.Errorf("maximum upload retries must not be negative, got %d", opt.maxUploadRetries)
+	}
+	if opt.uploadRetryBackoff <= 0 {
+		return fmt.Errorf("upload retry backoff must be positive, got %v", opt.uploadRetryBackoff)
+	}
+	if opt.streamBackup && opt.perDatabaseBackup {
+		return fmt.Errorf("streaming backup can not be used together with per database backup")
+	}
+	if _, err := parseTableSelection(opt.ignoreTables); err != nil {
+		return fmt.Errorf("invalid ignored table: %w", err)
+	}
+	if opt.whereClause != "" && strings.TrimSpace(opt.whereClause) == "" {
+		return fmt.Errorf("the where condition is blank")
+	}
+	if opt.abortOnFirstFailure && !opt.perDatabaseBackup {
+		return fmt.Errorf("aborting on the first failure only applies to per database backup")
+	}
+	if opt.skipEmptyDatabases && !opt.perDatabaseBackup {
+		return fmt.Errorf("empty databases can only be skipped by per database backup")
+	}
+	if opt.streamBackup && len(opt.tableSelection) > 0 {
+		return fmt.Errorf("streaming backup can not be used together with table selection")
+	}
+	if len(opt.orderByPrimaryDatabases) > 0 && !opt.orderByPrimary {
+		return fmt.Errorf("order-by-primary-databases requires --order-by-primary")
+	}
+	if len(opt.orderByPrimaryDatabases) > 0 && opt.streamBackup {
+		return fmt.Errorf("streaming backup dumps all the databases at once, the ordering by primary key can not be restricted to some of them")
+	}
+	if opt.incremental && (opt.streamBackup || opt.perDatabaseBackup || len(opt.tableSelection) > 0) {
+		return fmt.Errorf("incremental backup can not be used together with streaming, per database backup or table selection")
+	}
+	if opt.incremental && !opt.hasSink(SinkRestic) {
+		return fmt.Errorf("incremental backup requires the %s sink, the update times of the previous backup are read from it", SinkRestic)
+	}
+	if !containsString([]string{NoTablespacesAuto, NoTablespacesOn, NoTablespacesOff}, opt.noTablespaces) {
+		return fmt.Errorf("invalid no-tablespaces %q, must be one of %s, %s or %s", opt.noTablespaces, NoTablespacesAuto, NoTablespacesOn, NoTablespacesOff)
+	}
+	if !containsString([]string{HexBlobAuto, HexBlobOn, HexBlobOff}, opt.hexBlob) {
+		return fmt.Errorf("invalid hex-blob %q, must be one of %s, %s or %s", opt.hexBlob, HexBlobAuto, HexBlobOn, HexBlobOff)
+	}
+	if opt.dumpGrants && (opt.streamBackup || opt.perDatabaseBackup) {
+		return fmt.Errorf("grants can only be dumped along with the dumps in the output directory, not with streaming or per database backup")
+	}
+	if opt.streamBackup && opt.recordBinlogPosition {
+		return fmt.Errorf("streaming backup can not record the binary log position, the dump header is not captured")
+	}
+	userArgs := strings.Fields(opt.myArgs)
+	if opt.dumpLockWaitTimeout < 0 {
+		return fmt.Errorf("dump lock wait timeout must not be negative, got %v", opt.dumpLockWaitTimeout)
+	}
+	if opt.dumpLockWaitTimeout > 0 && hasArg(userArgs, "--init-command") {
+		return fmt.Errorf("the dump lock wait timeout is set with --init-command, it can not be combined with the --init-command of the mariadb args")
+	}
+	if opt.dumpNetReadTimeout < 0 {
+		return fmt.Errorf("dump net read timeout must be a positive number of seconds, got %d", opt.dumpNetReadTimeout)
+	}
+	if opt.dumpNetWriteTimeout < 0 {
+		return fmt.Errorf("dump net write timeout must be a positive number of seconds, got %d", opt.dumpNetWriteTimeout)
+	}
+	if (opt.dumpNetReadTimeout > 0 || opt.dumpNetWriteTimeout > 0) && hasArg(userArgs, "--init-command") {
+		return fmt.Errorf("the dump net timeouts are set with --init-command, they can not be combined with the --init-command of the mariadb args")
+	}
+	if opt.replicaBackup {
+		if opt.streamBackup {
+			return fmt.Errorf("a replica backup records the position of the primary from the dump header, which a streaming backup does not capture")
+		}
+		if opt.parallelism > 1 {
+			return fmt.Errorf("a replica backup stops the replication during each dump, the databases can not be dumped in parallel")
+		}
+		if hasArg(userArgs, "--master-data") || hasArg(userArgs, "--dump-slave") {
+			return fmt.Errorf("a replica backup records the position of the primary with --dump-slave, it can not be combined with --master-data or --dump-slave in the mariadb args")
+		}
+		if hasArg(userArgs, "--lock-all-tables") || hasArg(userArgs, "-x") {
+			return fmt.Errorf("a replica backup dumps a consistent snapshot (--single-transaction), it can not be used together with --lock-all-tables")
+		}
+	}
+	if err := validateSnapshotTags(opt.snapshotTags); err != nil {
+		return err
+	}
+	if err := validateDumpRate(opt.maxDumpRate); err != nil {
+		return err
+	}
+	if opt.readLockTimeout <= 0 {
+		return fmt.Errorf("read lock timeout must be positive, got %v", opt.readLockTimeout)
+	}
+	if opt.snapshotReadyHook != "" && (opt.streamBackup || opt.perDatabaseBackup || opt.incremental || opt.replicaBackup) {
+		return fmt.Errorf("the snapshot-ready hook replaces the dump by a snapshot of the storage, it can not be combined with streaming, per database, incremental or replica backups")
+	}
+	if opt.maxReplicaLag < 0 {
+		return fmt.Errorf("maximum replica lag must not be negative, got %v", opt.maxReplicaLag)
+	}
+	if opt.consistentSnapshot && (hasArg(userArgs, "--lock-all-tables") || hasArg(userArgs, "-x")) {
+		return fmt.Errorf("consistent snapshot (--single-transaction) can not be used together with --lock-all-tables")
+	}
+	return nil
+}
+
+// orderByPrimaryArgs returns the argument sorting the rows of the dump of db by primary key.
+// Along with --skip-dump-date, the same data then always gives the same dump.
+// Sorting makes mariadb-dump read the large tables through their index, which is much slower, hence
+// the ordering can be restricted to some databases. An empty db stands for the dump of all the databases.
+func (opt *mariadbOptions) orderByPrimaryArgs(db string) []interface{} {
+	if !opt.orderByPrimary || hasArg(strings.Fields(opt.myArgs), "--order-by-primary") {
+		return nil
+	}
+	if db != "" && len(opt.orderByPrimaryDatabases) > 0 && !containsString(opt.orderByPrimaryDatabases, db) {
+		return nil
+	}
+	return []interface{}{"--order-by-primary"}
+}
+
+// checkReadOnlySource warns about a read-only server, which is usually a replica whose data may lag behind
+// the primary, or refuses to back it up unless allowReadOnlySource is set
+func (opt *mariadbOptions) checkReadOnlySource(session *sessionWrapper) error {
+	readOnly, err := session.readOnlyVariables()
+	if err != nil {
+		return err
+	}
+	if len(readOnly) == 0 {
+		return nil
+	}
+	if !opt.allowReadOnlySource {
+		return fmt.Errorf("the database is read-only (%s), it is likely a replica; pass --allow-read-only-source (or --replica-backup) to back it up anyway", strings.Join(readOnly, ", "))
+	}
+	klog.Warningf("The database is read-only (%s), it is likely a replica whose data may be stale", strings.Join(readOnly, ", "))
+	return nil
+}
+
+// setSkipTablespaces decides whether the tablespaces are dumped, dumping them requires the PROCESS privilege.
+// The privilege is only queried when the decision is left to the plugin.
+func (opt *mariadbOptions) setSkipTablespaces(session *sessionWrapper) error {
+	switch opt.noTablespaces {
+	case NoTablespacesOn:
+		opt.skipTablespaces = true
+	case NoTablespacesAuto:
+		hasProcess, err := session.hasGlobalPrivilege("PROCESS")
+		if err != nil {
+			return err
+		}
+		if !hasProcess {
+			klog.Infoln("The backup user lacks the PROCESS privilege, the tablespaces are not dumped")
+		}
+		opt.skipTablespaces = !hasProcess
+	default:
+		opt.skipTablespaces = false
+	}
+	return nil
+}
+
+// setHexBlob decides whether the binary data is dumped in hexadecimal, as it may not survive the character set
+// conversions of the restore otherwise. The columns of the databases are only queried when the decision is left to the plugin.
+func (opt *mariadbOptions) setHexBlob(session *sessionWrapper, databases []string) error {
+	switch opt.hexBlob {
+	case HexBlobOn:
+		opt.useHexBlob = true
+	case HexBlobAuto:
+		hasBinary, err := session.hasBinaryColumns(databases)
+		if err != nil {
+			return err
+		}
+		if hasBinary {
+			klog.Infoln("The databases have binary columns, they are dumped in hexadecimal")
+		}
+		opt.useHexBlob = hasBinary
+	default:
+		opt.useHexBlob = false
+	}
+	return nil
+}
+
+// dumpFlags returns the mariadb-dump flags derived from the options.
+// Flags that the user has already passed through myArgs are skipped so that no flag is repeated.
+func (opt *mariadbOptions) dumpFlags() []interface{} {
+	var flags []string
+	if opt.consistentSnapshot {
+		flags = append(flags, "--single-transaction", "--skip-lock-tables")
+	}
+	if opt.includeRoutines {
+		flags = append(flags, "--routines")
+	}
+	if opt.includeTriggers {
+		flags = append(flags, "--triggers")
+	} else {
+		flags = append(flags, "--skip-triggers")
+	}
+	if opt.includeEvents {
+		flags = append(flags, "--events")
+	}
+	if opt.skipTablespaces {
+		flags = append(flags, "--no-tablespaces")
+	}
+	if opt.useHexBlob {
+		flags = append(flags, "--hex-blob")
+	}
+	if opt.skipDumpDate {
+		flags = append(flags, "--skip-dump-date")
+	}
+	if opt.replicaBackup {
+		// the coordinates of the primary the replica has applied, the SQL thread is stopped during the dump
+		flags = append(flags, "--dump-slave=2")
+		if opt.gtidEnabled {
+			flags = append(flags, "--gtid")
+		}
+	} else if opt.recordBinlogPosition {
+		flags = append(flags, "--master-data=2")
+		if opt.gtidEnabled {
+			flags = append(flags, "--gtid")
+		}
+	}
+
+	userArgs := strings.Fields(opt.myArgs)
+	var args []interface{}
+	for _, flag := range flags {
+		if !hasArg(userArgs, flag) {
+			args = append(args, flag)
+		}
+	}
+	// the user may have set the column statistics either way already
+	if opt.disableColumnStatistics && !hasArg(userArgs, "--column-statistics") && !hasArg(userArgs, "--skip-column-statistics") {
+		args = append(args, "--column-statistics=0")
+	}
+	// the client takes a single --init-command, the session variables of the dump share it
+	var sessionVariables []string
+	// a consistent snapshot takes no table locks, but the dump still waits on the metadata lock of each
+	// table it reads while a DDL holds it. Without it, the wait for LOCK TABLES is bounded the same way.
+	if opt.dumpLockWaitTimeout > 0 {
+		seconds := int64(math.Ceil(opt.dumpLockWaitTimeout.Seconds()))
+		sessionVariables = append(sessionVariables, fmt.Sprintf("lock_wait_timeout=%d", seconds))
+	}
+	// the server drops the connection of a dump stalled longer than the net timeouts, i.e. while a slow
+	// sink applies back pressure on a large table
+	if opt.dumpNetReadTimeout > 0 {
+		sessionVariables = append(sessionVariables, fmt.Sprintf("net_read_timeout=%d", opt.dumpNetReadTimeout))
+	}
+	if opt.dumpNetWriteTimeout > 0 {
+		sessionVariables = append(sessionVariables, fmt.Sprintf("net_write_timeout=%d", opt.dumpNetWriteTimeout))
+	}
+	if len(sessionVariables) > 0 {
+		args = append(args, "--init-command=SET SESSION "+strings.Join(sessionVariables, ", "))
+	}
+	// the arguments do not go through a shell, so the condition is passed as is without quoting
+	if opt.whereClause != "" {
+		args = append(args, "--where="+opt.whereClause)
+	}
+	// the selection is validated with the options, the client expects the database name unquoted
+	ignored, _ := parseTableSelection(opt.ignoreTables)
+	for _, db := range tableDatabases(ignored) {
+		for _, table := range ignored[db] {
+			args = append(args, "--ignore-table="+db+"."+table)
+		}
+	}
+	return args
+}
+
+// backupPerDatabase takes a separate snapshot of the dump of each database.
+// The snapshots are tagged with the database name so that they can be restored independently.
+// Databases that failed to dump do not prevent the others from being backed up, they are reported at the end
+// along with the snapshots that were taken. With abortOnFirstFailure, the first failure stops the backup instead
+// and the snapshots it already took are deleted.
+func (opt *mariadbOptions) backupPerDatabase(ctx context.Context, session *sessionWrapper, resticWrapper *restic.ResticWrapper, targetRef api_v1beta1.TargetRef, results []dumpResult) (*restic.BackupOutput, error) {
+	backupOutput := &restic.BackupOutput{
+		BackupTargetStatus: api_v1beta1.BackupTargetStatus{
+			Ref: targetRef,
+		},
+	}
+
+	// databases may be created or dropped after we enumerated them
+	current, err := session.getDbNames(opt.systemSchemas)
 	if err != nil {
 		return nil, err
 	}
-	return resticWrapper.RunBackup(opt.backupOptions, targetRef)
+
+	if opt.abortOnFirstFailure {
+		for _, result := range results {
+			if result.firstFailure {
+				return nil, fmt.Errorf("backup aborted, failed to dump database %s: %w", result.db, result.err)
+			}
+		}
+	}
+
+	// the charset of each database is stored as a tag, the databases without one are created with the default charset on restore
+	dumped := make([]string, 0, len(results))
+	for _, result := range results {
+		dumped = append(dumped, result.db)
+	}
+	charsets, err := session.databaseCharsets(dumped)
+	if err != nil {
+		klog.Warningf("The charsets of the databases are not recorded. Reason: %v", err)
+	}
+
+	var (
+		failed []string
+		errs   []error
+	)
+	for _, result := range results {
+		if err = ctx.Err(); err != nil {
+			return backupOutput, err
+		}
+		if result.err != nil {
+			if !current.has(result.db) {
+				klog.Warningf("Database %s does not exist anymore, skipping it", result.db)
+				_ = os.Remove(result.dumpfile)
+				continue
+			}
+			failed = append(failed, result.db)
+			errs = append(errs, fmt.Errorf("failed to dump database %s: %w", result.db, result.err))
+			continue
+		}
+
+		// a snapshot holds a single file, so the table count of the manifest is stored as a tag
+		manifest, err := opt.buildTableManifest(session, []string{result.db})
+		if err != nil {
+			if opt.abortOnFirstFailure {
+				return nil, abortBackup(resticWrapper, backupOutput, err)
+			}
+			failed = append(failed, result.db)
+			errs = append(errs, err)
+			continue
+		}
+		// the tables may have been dropped since they were counted
+		if opt.skipEmptyDatabases && manifest[result.db] == 0 {
+			klog.Infof("Database %s has no table anymore, skipping it", result.db)
+			opt.emptyDatabases = append(opt.emptyDatabases, result.db)
+			_ = os.Remove(result.dumpfile)
+			continue
+		}
+
+		backupOptions := opt.backupOptions
+		backupOptions.StdinPipeCommands = nil
+		backupOptions.BackupPaths = []string{result.dumpfile}
+		backupOptions.Args = append(append([]string{}, opt.backupOptions.Args...), "--tag", DatabaseTagPrefix+result.db)
+		backupOptions.Args = append(backupOptions.Args, "--tag", fmt.Sprintf("%s%d", DumpBytesTagPrefix, result.bytes))
+		backupOptions.Args = append(backupOptions.Args, "--tag", fmt.Sprintf("%s%d", TableCountTagPrefix, manifest[result.db]))
+		if checksum, ok := opt.dumpChecksums[filepath.Base(result.dumpfile)]; ok {
+			backupOptions.Args = append(backupOptions.Args, "--tag", ChecksumTagPrefix+checksum)
+		}
+		if charset, ok := charsets[result.db]; ok {
+			backupOptions.Args = append(backupOptions.Args, "--tag", CharsetTagPrefix+charset.tagValue())
+		}
+
+		out, err := opt.runBackupWithRetry(ctx, resticWrapper, backupOptions, targetRef)
+		if err != nil {
+			if opt.abortOnFirstFailure {
+				return nil, abortBackup(resticWrapper, backupOutput, fmt.Errorf("failed to take snapshot of database %s: %w", result.db, err))
+			}
+			failed = append(failed, result.db)
+			errs = append(errs, fmt.Errorf("failed to take snapshot of database %s: %w", result.db, err))
+			continue
+		}
+		mergeBackupOutput(backupOutput, out)
+	}
+
+	for _, db := range current {
+		found := false
+		for _, result := range results {
+			if result.db == db {
+				found = true
+				break
+			}
+		}
+		if !found && !opt.emptyDatabases.has(db) {
+			klog.Warningf("Database %s was created during the backup and has not been backed up", db)
+		}
+	}
+
+	if len(errs) > 0 {
+		return backupOutput, fmt.Errorf("backup failed for %d of %d databases (%s): %w", len(failed), len(results), strings.Join(failed, ", "), errors.NewAggregate(errs))
+	}
+	return backupOutput, nil
+}
+
+// abortBackup deletes the snapshots already taken by an all-or-nothing backup before reporting its failure
+func abortBackup(resticWrapper *restic.ResticWrapper, backupOutput *restic.BackupOutput, err error) error {
+	var ids []string
+	for _, stats := range backupOutput.BackupTargetStatus.Stats {
+		for _, snapshot := range stats.Snapshots {
+			ids = append(ids, snapshot.Name)
+		}
+	}
+	if len(ids) > 0 {
+		klog.Warningf("Deleting the snapshots %v taken before the failure", ids)
+		if _, deleteErr := resticWrapper.DeleteSnapshots(ids); deleteErr != nil {
+			return fmt.Errorf("backup aborted: %w; failed to delete the snapshots %v: %v", err, ids, deleteErr)
+		}
+	}
+	return fmt.Errorf("backup aborted: %w", err)
+}
+
+// nonEmptyDatabases returns the databases holding at least one table. The empty ones are logged and kept in opt.emptyDatabases.
+func (opt *mariadbOptions) nonEmptyDatabases(session *sessionWrapper, databases []string) ([]string, error) {
+	counts, err := session.countTables(databases)
+	if err != nil {
+		return nil, err
+	}
+	var nonEmpty []string
+	for _, db := range databases {
+		if counts[db] == 0 {
+			klog.Infof("Database %s has no table, skipping it", db)
+			opt.emptyDatabases = append(opt.emptyDatabases, db)
+			continue
+		}
+		nonEmpty = append(nonEmpty, db)
+	}
+	return nonEmpty, nil
+}
+
+// mergeBackupOutput appends the snapshots of out into the matching host stats of backupOutput
+func mergeBackupOutput(backupOutput, out *restic.BackupOutput) {
+	for _, hostStats := range out.BackupTargetStatus.Stats {
+		merged := false
+		for i := range backupOutput.BackupTargetStatus.Stats {
+			if backupOutput.BackupTargetStatus.Stats[i].Hostname == hostStats.Hostname {
+				backupOutput.BackupTargetStatus.Stats[i].Snapshots = append(backupOutput.BackupTargetStatus.Stats[i].Snapshots, hostStats.Snapshots...)
+				backupOutput.BackupTargetStatus.Stats[i].Duration = hostStats.Duration
+				merged = true
+			}
+		}
+		if !merged {
+			backupOutput.BackupTargetStatus.Stats = append(backupOutput.BackupTargetStatus.Stats, hostStats)
+		}
+	}
 }
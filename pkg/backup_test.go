@@ -0,0 +1,1305 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	api_v1beta1 "stash.appscode.dev/apimachinery/apis/stash/v1beta1"
+	"stash.appscode.dev/apimachinery/pkg/restic"
+
+	appcatalog "kmodules.xyz/custom-resources/apis/appcatalog/v1alpha1"
+)
+
+// newTestBackupOptions returns the options of a backup with the defaults of the backup command
+func newTestBackupOptions() *mariadbOptions {
+	return &mariadbOptions{
+		myArgs:                    "--all-databases",
+		waitTimeout:               300,
+		readinessPollInterval:     DefaultReadinessPollInterval,
+		readinessBackoffFactor:    1,
+		systemSchemas:             DefaultSystemSchemas,
+		includeTriggers:           true,
+		compression:               CompressionNone,
+		backupRetryBackoff:        DefaultBackupRetryBackoff,
+		maxUploadRetries:          DefaultUploadRetries,
+		maxConnectionErrorRetries: DefaultConnectionErrorRetries,
+		uploadRetryBackoff:        DefaultUploadRetryBackoff,
+		parallelism:               1,
+		allowReadOnlySource:       true,
+		maxReplicaLag:             DefaultMaxReplicaLag,
+		readLockTimeout:           DefaultReadLockTimeout,
+		maxDumpRate:               "0",
+		noTablespaces:             NoTablespacesAuto,
+		hexBlob:                   HexBlobAuto,
+		terminationGracePeriod:    DefaultTerminationGracePeriod,
+		dumpCmd:                   MariaDBDumpCMD,
+		clientCmd:                 MariaDBRestoreCMD,
+		defaultCharset:            DefaultCharset,
+		maxAllowedPacket:          DefaultMaxAllowedPacket,
+		sinks:                     []string{SinkRestic},
+		tlsOptions: tlsOptions{
+			verifyServerCert: true,
+		},
+		credentialOptions: credentialOptions{
+			userKey:     MariaDBUser,
+			passwordKey: MariaDBPassword,
+			authMode:    AuthModePassword,
+		},
+		backupOptions: restic.BackupOptions{
+			Host:          restic.DefaultHost,
+			StdinFileName: MariaDBDumpFile,
+		},
+	}
+}
+
+// countArg returns how many times arg is in args
+func countArg(args []interface{}, arg string) int {
+	count := 0
+	for _, a := range args {
+		if a == arg {
+			count++
+		}
+	}
+	return count
+}
+
+func TestDumpArgsSelectTheDatabase(t *testing.T) {
+	for _, myArgs := range []string{"--all-databases", "-A --skip-comments", "--skip-comments"} {
+		t.Run(myArgs, func(t *testing.T) {
+			opt := &mariadbOptions{myArgs: myArgs, tables: map[string][]string{"shop": {"orders"}}}
+			session := newFakeSession(t, opt, "mariadb-dump")
+
+			for _, args := range [][]interface{}{opt.dumpArgs(session, "shop"), opt.streamBackupOptions(session, []string{"shop"}).StdinPipeCommands[0].Args} {
+				for _, arg := range args {
+					if arg == "--all-databases" || arg == "-A" {
+						t.Errorf("dump arguments %v select all the databases", args)
+					}
+				}
+			}
+			args := opt.dumpArgs(session, "shop")
+			if tail := args[len(args)-3:]; !reflect.DeepEqual(tail, []interface{}{"--", "shop", "orders"}) {
+				t.Errorf("dump arguments end with %v, want the database and its tables", tail)
+			}
+		})
+	}
+}
+
+func TestConsistentSnapshotFlags(t *testing.T) {
+	for _, myArgs := range []string{"--all-databases", "--single-transaction", "--single-transaction --skip-lock-tables"} {
+		t.Run(myArgs, func(t *testing.T) {
+			opt := newTestBackupOptions()
+			opt.consistentSnapshot = true
+			opt.myArgs = myArgs
+			if err := opt.validateDumpOptions(); err != nil {
+				t.Fatalf("validateDumpOptions() error = %v", err)
+			}
+			args := opt.dumpArgs(newFakeSession(t, opt, "mariadb-dump"), "shop")
+			for _, flag := range []string{"--single-transaction", "--skip-lock-tables"} {
+				if n := countArg(args, flag); n != 1 {
+					t.Errorf("dump arguments %v have %s %d times, want once", args, flag, n)
+				}
+			}
+		})
+	}
+
+	opt := newTestBackupOptions()
+	args := opt.dumpArgs(newFakeSession(t, opt, "mariadb-dump"), "shop")
+	if n := countArg(args, "--single-transaction"); n != 0 {
+		t.Errorf("dump arguments %v have --single-transaction without a consistent snapshot", args)
+	}
+}
+
+func TestConsistentSnapshotExcludesLockAllTables(t *testing.T) {
+	for _, myArgs := range []string{"--lock-all-tables", "-x", "--lock-all-tables=1"} {
+		opt := newTestBackupOptions()
+		opt.consistentSnapshot = true
+		opt.myArgs = myArgs
+		err := opt.validateDumpOptions()
+		if err == nil || !strings.Contains(err.Error(), "--lock-all-tables") {
+			t.Errorf("validateDumpOptions() with %s error = %v, want the options to conflict", myArgs, err)
+		}
+	}
+}
+
+// flakyDumpCommand returns a fake mariadb-dump failing with stderr the first failures times, then dumping sampleDump,
+// and the file counting its runs
+func flakyDumpCommand(t *testing.T, failures int, stderr string) (string, string) {
+	t.Helper()
+	runs := filepath.Join(t.TempDir(), "runs")
+	dump := filepath.Join(t.TempDir(), "dump.sql")
+	if err := os.WriteFile(dump, sampleDump(10), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return fakeCommand(t, fmt.Sprintf(`echo run >> %[1]s
+if [ "$(wc -l < %[1]s)" -le %[2]d ]; then
+	echo %[3]q >&2
+	exit 2
+fi
+cat %[4]s`, runs, failures, stderr, dump)), runs
+}
+
+// countRuns returns how many times a fake command ran
+func countRuns(t *testing.T, runs string) int {
+	t.Helper()
+	data, err := os.ReadFile(runs)
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Count(string(data), "run\n")
+}
+
+func TestDumpDatabaseWithRetry(t *testing.T) {
+	const lostConnection = "mariadb-dump: Got error: 2013: Lost connection to server during query when dumping table `orders`"
+	tests := []struct {
+		name     string
+		failures int
+		stderr   string
+		wantRuns int
+		wantErr  string
+	}{
+		{name: "fails twice then succeeds", failures: 2, stderr: lostConnection, wantRuns: 3},
+		{name: "retries run out", failures: 5, stderr: lostConnection, wantRuns: 4, wantErr: "giving up after 4 attempts"},
+		{name: "fatal error", failures: 1, stderr: "mariadb-dump: Got error: 1045: Access denied for user 'backup'@'%'", wantRuns: 1, wantErr: "Access denied"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			command, runs := flakyDumpCommand(t, tt.failures, tt.stderr)
+			opt := newTestBackupOptions()
+			opt.maxBackupRetries = 3
+			opt.backupRetryBackoff = time.Millisecond
+			session := newFakeSession(t, opt, command)
+			dumpfile := filepath.Join(t.TempDir(), "shop.sql")
+
+			written, err := opt.dumpDatabaseWithRetry(context.Background(), session, "shop", dumpfile)
+			if got := countRuns(t, runs); got != tt.wantRuns {
+				t.Errorf("mariadb-dump ran %d times, want %d", got, tt.wantRuns)
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("dumpDatabaseWithRetry() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("dumpDatabaseWithRetry() error = %v", err)
+			}
+			data, err := os.ReadFile(dumpfile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, sampleDump(10)) || written != int64(len(data)) {
+				t.Errorf("dumpDatabaseWithRetry() wrote %d bytes, want the dump of the last attempt", written)
+			}
+		})
+	}
+}
+
+func TestExhaustedRetriesFailTheBackup(t *testing.T) {
+	command, _ := flakyDumpCommand(t, 5, "mariadb-dump: Got error: 2013: Lost connection to server during query")
+	opt := newTestBackupOptions()
+	opt.maxBackupRetries = 1
+	opt.backupRetryBackoff = time.Millisecond
+	session := newFakeSession(t, opt, command)
+
+	results, err := opt.dumpDatabases(context.Background(), nil, session, []string{"shop"}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.clientCmd = fakeCommand(t, `echo shop`)
+	if _, err = opt.dumpedDatabases(session, results); err == nil || !strings.Contains(err.Error(), "failed to dump database shop: giving up after 2 attempts") {
+		t.Errorf("dumpedDatabases() error = %v, want the backup to fail", err)
+	}
+}
+
+func TestRunBackupWithRetry(t *testing.T) {
+	tests := []struct {
+		name      string
+		failures  int
+		wantErr   bool
+		wantRetry string
+	}{
+		{name: "first attempt", failures: 0},
+		{name: "third attempt", failures: 2, wantRetry: "Uploaded the dumps into the repository after 3 attempts"},
+		{name: "retries exhausted", failures: 3, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := newTestBackupOptions()
+			opt.maxUploadRetries = 2
+			opt.uploadRetryBackoff = time.Millisecond
+			session := newFakeSession(t, opt, fakeCommand(t, `:`))
+			resticWrapper, repository := newFakeRestic(t, opt, session)
+			failFakeBackups(t, session, tt.failures)
+			dumpdir := filepath.Join(opt.setupOptions.ScratchDir, MariaDBDumpDir)
+			if err := os.MkdirAll(dumpdir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dumpdir, MariaDBDumpFile), sampleDump(1), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			var err error
+			logs := captureLogs(t, func() {
+				_, err = opt.runBackupWithRetry(context.Background(), resticWrapper, restic.BackupOptions{Host: restic.DefaultHost, BackupPaths: []string{dumpdir}}, api_v1beta1.TargetRef{})
+			})
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "503 Service Unavailable") {
+					t.Errorf("runBackupWithRetry() error = %v, want the upload error", err)
+				}
+				if snapshots := fakeSnapshots(t, repository); len(snapshots) != 0 {
+					t.Errorf("runBackupWithRetry() took %d snapshots after failing", len(snapshots))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if snapshots := fakeSnapshots(t, repository); len(snapshots) != 1 {
+				t.Errorf("runBackupWithRetry() took %d snapshots, want 1", len(snapshots))
+			}
+			retried := strings.Contains(logs, "Uploaded the dumps into the repository after")
+			if tt.wantRetry == "" && retried || tt.wantRetry != "" && !strings.Contains(logs, tt.wantRetry) {
+				t.Errorf("runBackupWithRetry() logged:\n%s\nwant %q", logs, tt.wantRetry)
+			}
+		})
+	}
+}
+
+func TestRunBackupWithRetryFailsOnAPermanentError(t *testing.T) {
+	opt := newTestBackupOptions()
+	opt.maxUploadRetries = 2
+	opt.uploadRetryBackoff = time.Millisecond
+	session := newFakeSession(t, opt, fakeCommand(t, `:`))
+	resticWrapper, repository := newFakeRestic(t, opt, session)
+	// the backup would succeed if it was retried
+	failFakeBackupsWith(t, session, 1, "Fatal: wrong password or no key found")
+	dumpdir := filepath.Join(opt.setupOptions.ScratchDir, MariaDBDumpDir)
+	if err := os.MkdirAll(dumpdir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dumpdir, MariaDBDumpFile), sampleDump(1), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := opt.runBackupWithRetry(context.Background(), resticWrapper, restic.BackupOptions{Host: restic.DefaultHost, BackupPaths: []string{dumpdir}}, api_v1beta1.TargetRef{})
+	if err == nil || !strings.Contains(err.Error(), "wrong password") || strings.Contains(err.Error(), "giving up") {
+		t.Errorf("runBackupWithRetry() error = %v, want the first error without retrying", err)
+	}
+	if snapshots := fakeSnapshots(t, repository); len(snapshots) != 0 {
+		t.Errorf("runBackupWithRetry() took %d snapshots, want the permanent error not retried", len(snapshots))
+	}
+}
+
+func TestUploadRetryOptions(t *testing.T) {
+	cmd := NewCmdBackup()
+	for flag, want := range map[string]string{"max-upload-retries": fmt.Sprint(DefaultUploadRetries), "upload-retry-backoff": DefaultUploadRetryBackoff.String()} {
+		if got := cmd.Flags().Lookup(flag).DefValue; got != want {
+			t.Errorf("--%s defaults to %s, want %s", flag, got, want)
+		}
+	}
+
+	opt := newTestBackupOptions()
+	opt.maxUploadRetries = -1
+	if err := opt.validateDumpOptions(); err == nil || !strings.Contains(err.Error(), "maximum upload retries") {
+		t.Errorf("validateDumpOptions() = %v, want the negative upload retries rejected", err)
+	}
+	opt = newTestBackupOptions()
+	opt.uploadRetryBackoff = 0
+	if err := opt.validateDumpOptions(); err == nil || !strings.Contains(err.Error(), "upload retry backoff") {
+		t.Errorf("validateDumpOptions() = %v, want the zero upload backoff rejected", err)
+	}
+}
+
+// newTestAppBinding returns an AppBinding of a database reached at db.demo.svc, its credentials served by the client of opt
+func newTestAppBinding(opt *mariadbOptions) *appcatalog.AppBinding {
+	appBinding, kubeClient := newCredentialsAppBinding(map[string][]byte{MariaDBUser: []byte("root"), MariaDBPassword: []byte("s3cret")})
+	url := "mysql://db.demo.svc:3306/"
+	appBinding.Spec.ClientConfig.URL = &url
+	opt.kubeClient = kubeClient
+	return appBinding
+}
+
+func TestParallelDumpFailuresAreAggregated(t *testing.T) {
+	dump := filepath.Join(t.TempDir(), "dump.sql")
+	if err := os.WriteFile(dump, sampleDump(10), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	opt := newTestBackupOptions()
+	opt.parallelism = 3
+	opt.maxConnectionErrorRetries = 0
+	opt.setupOptions.ScratchDir = t.TempDir()
+	opt.dumpCmd = fakeCommand(t, fmt.Sprintf(`for db; do :; done
+case "$db" in
+broken) echo "mariadb-dump: Got error: 1146: Table 'broken.orders' doesn't exist" >&2; exit 2 ;;
+dropped) echo "mariadb-dump: Got error: 1049: Unknown database 'dropped'" >&2; exit 2 ;;
+esac
+cat %s`, dump))
+	appBinding := newTestAppBinding(opt)
+	session, err := opt.prepareSession(appBinding, opt.dumpCmd, opt.setupOptions.ScratchDir)
+	defer session.cleanup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the databases left on the server once dumped
+	session.clientCmd = fakeCommand(t, `printf 'shop\nbroken\nusers\n'`)
+
+	dumpdir := t.TempDir()
+	results, err := opt.dumpDatabases(context.Background(), appBinding, session, []string{"shop", "broken", "dropped", "users"}, dumpdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range results {
+		if failed := result.db == "broken" || result.db == "dropped"; failed != (result.err != nil) {
+			t.Errorf("dump of %s error = %v", result.db, result.err)
+		}
+	}
+
+	_, err = opt.dumpedDatabases(session, results)
+	if err == nil || !strings.Contains(err.Error(), "backup failed for 1 of 4 databases (broken)") || !strings.Contains(err.Error(), "Table 'broken.orders' doesn't exist") {
+		t.Errorf("dumpedDatabases() error = %v, want the failure of broken", err)
+	}
+	if _, err = os.Stat(opt.databaseDumpFile(dumpdir, "dropped")); !os.IsNotExist(err) {
+		t.Errorf("the dump of the dropped database is kept")
+	}
+}
+
+func TestStreamedDumpFailingMidStreamLeavesNoSnapshot(t *testing.T) {
+	dump := filepath.Join(t.TempDir(), "dump.sql")
+	if err := os.WriteFile(dump, sampleDump(100), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		script    string
+		snapshots int
+	}{
+		{name: "complete dump", script: fmt.Sprintf(`cat %s`, dump), snapshots: 1},
+		{name: "dump failing mid-stream", script: fmt.Sprintf(`head -c 2000 %s
+echo "mariadb-dump: Error 2013: Lost connection to server during query when dumping table orders" >&2
+exit 2`, dump)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := newTestBackupOptions()
+			opt.streamBackup = true
+			session := newFakeSession(t, opt, fakeCommand(t, tt.script))
+			resticWrapper, repository := newFakeRestic(t, opt, session)
+
+			_, err := opt.backupStream(session, resticWrapper, api_v1beta1.TargetRef{}, []string{"shop"})
+			if (err != nil) != (tt.snapshots == 0) {
+				t.Fatalf("backupStream() error = %v", err)
+			}
+			snapshots := fakeSnapshots(t, repository)
+			if len(snapshots) != tt.snapshots {
+				t.Fatalf("the repository has %d snapshots, want %d", len(snapshots), tt.snapshots)
+			}
+			if tt.snapshots > 0 {
+				data, err := resticWrapper.DumpOnce(restic.DumpOptions{Snapshot: snapshots[0].ID, FileName: MariaDBDumpFile})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(data, sampleDump(100)) {
+					t.Errorf("the snapshot holds %d bytes, want the whole dump", len(data))
+				}
+			}
+		})
+	}
+}
+
+func TestDumpSelectedTables(t *testing.T) {
+	opt := newTestBackupOptions()
+	var err error
+	opt.tables, err = parseTableSelection([]string{"shop.orders", "shop.order items", "shop.o'reilly; DROP TABLE users", "shop.orders", "crm.contacts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the fake mariadb-dump dumps its arguments, one per line
+	session := newFakeSession(t, opt, fakeCommand(t, `for arg; do printf '%s\n' "$arg"; done`))
+	dumpfile := filepath.Join(t.TempDir(), "shop.sql")
+	if _, err = opt.dumpDatabase(session, "shop", dumpfile); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(dumpfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	want := []string{"--", "shop", "orders", "order items", "o'reilly; DROP TABLE users"}
+	if tail := args[len(args)-len(want):]; !reflect.DeepEqual(tail, want) {
+		t.Errorf("mariadb-dump got %q, want the arguments to end with %q", tail, want)
+	}
+
+	if _, err = includeDatabases([]string{"shop", "users"}, tableDatabases(opt.tables)); err == nil || !strings.Contains(err.Error(), "requested databases do not exist: crm") {
+		t.Errorf("includeDatabases() error = %v, want crm to be missing", err)
+	}
+}
+
+func TestSpecialDatabaseNames(t *testing.T) {
+	opt := newTestBackupOptions()
+	opt.ignoreTables = []string{"`my-db.test`.logs", "order.archive"}
+	var err error
+	opt.tables, err = parseTableSelection([]string{"`my-db.test`.orders", "order.items"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string][]string{"my-db.test": {"orders"}, "order": {"items"}}; !reflect.DeepEqual(opt.tables, want) {
+		t.Errorf("parseTableSelection() = %v, want %v", opt.tables, want)
+	}
+
+	session := newFakeSession(t, opt, fakeCommand(t, `printf 'mysql
+my-db.test
+order
+'`))
+	databases, err := session.getDbNames(DefaultSystemSchemas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (databaseNames{"my-db.test", "order"}); !reflect.DeepEqual(databases, want) {
+		t.Fatalf("getDbNames() = %q, want %q", databases, want)
+	}
+
+	// the fake mariadb-dump dumps its arguments, one per line
+	session.cmd.Name = fakeCommand(t, `for arg; do printf '%s\n' "$arg"; done`)
+	for _, db := range databases {
+		dumpfile := filepath.Join(t.TempDir(), "dump.sql")
+		if _, err = opt.dumpDatabase(session, db, dumpfile); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(dumpfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		args := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+		want := append([]string{"--", db}, opt.tables[db]...)
+		if tail := args[len(args)-len(want):]; !reflect.DeepEqual(tail, want) {
+			t.Errorf("mariadb-dump got %q, want the arguments to end with %q", tail, want)
+		}
+		// the client expects the database of the ignored tables unquoted
+		if !containsString(args, "--ignore-table=my-db.test.logs") || !containsString(args, "--ignore-table=order.archive") {
+			t.Errorf("mariadb-dump got %q, want the ignored tables", args)
+		}
+	}
+
+	if got, want := recreateDatabaseStatements("order"), "DROP DATABASE IF EXISTS `order`;\nCREATE DATABASE `order`;\n"; got != want {
+		t.Errorf("recreateDatabaseStatements() = %q, want %q", got, want)
+	}
+	if got, want := createDatabaseStatement("my-db.test", DatabaseCharset{}), "CREATE DATABASE IF NOT EXISTS `my-db.test`;"; got != want {
+		t.Errorf("createDatabaseStatement() = %q, want %q", got, want)
+	}
+}
+
+func TestSplitQualifiedTable(t *testing.T) {
+	tests := []struct {
+		entry     string
+		db, table string
+		wantErr   bool
+	}{
+		{entry: "shop.orders", db: "shop", table: "orders"},
+		{entry: "shop.orders.2024", db: "shop", table: "orders.2024"},
+		{entry: "`my-db.test`.orders", db: "my-db.test", table: "orders"},
+		{entry: "`my``db`.orders", db: "my`db", table: "orders"},
+		{entry: "order.items", db: "order", table: "items"},
+		{entry: "orders", wantErr: true},
+		{entry: "`my-db.test`", wantErr: true},
+		{entry: "`my-db.test.orders", wantErr: true},
+		{entry: "`my-db.test`orders", wantErr: true},
+		{entry: ".orders", wantErr: true},
+		{entry: "shop.", wantErr: true},
+	}
+	for _, tt := range tests {
+		db, table, ok := splitQualifiedTable(tt.entry)
+		if ok == tt.wantErr || db != tt.db || table != tt.table {
+			t.Errorf("splitQualifiedTable(%q) = %q, %q, %v, want %q, %q", tt.entry, db, table, ok, tt.db, tt.table)
+		}
+	}
+}
+
+// unstableDumpCommand returns a fake mariadb-dump writing the rows in another order on each run unless they are
+// ordered by primary key, and the date of the dump unless it is skipped
+func unstableDumpCommand(t *testing.T) string {
+	t.Helper()
+	runs := filepath.Join(t.TempDir(), "runs")
+	return fakeCommand(t, `ordered=false dated=true
+for arg; do
+	case "$arg" in
+	--order-by-primary) ordered=true ;;
+	--skip-dump-date) dated=false ;;
+	esac
+done
+echo run >> `+runs+`
+rows="1 2 3"
+if [ "$ordered" = false ]; then
+	case $(wc -l < `+runs+`) in
+	*[13579]) rows="2 3 1" ;;
+	*) rows="3 1 2" ;;
+	esac
+fi
+for id in $rows; do
+	echo "INSERT INTO orders VALUES ($id);"
+done
+if [ "$dated" = true ]; then
+	echo "-- Dump completed on $(date '+%Y-%m-%d %H:%M:%S.%N')"
+else
+	echo "-- Dump completed"
+fi`)
+}
+
+func TestOrderByPrimaryDumpsAreReproducible(t *testing.T) {
+	tests := []struct {
+		name           string
+		orderByPrimary bool
+		skipDumpDate   bool
+		wantIdentical  bool
+	}{
+		{name: "ordered without date", orderByPrimary: true, skipDumpDate: true, wantIdentical: true},
+		{name: "ordered with date", orderByPrimary: true},
+		{name: "unordered without date", skipDumpDate: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := newTestBackupOptions()
+			opt.orderByPrimary = tt.orderByPrimary
+			opt.skipDumpDate = tt.skipDumpDate
+			session := newFakeSession(t, opt, "")
+			session.cmd.Name = unstableDumpCommand(t)
+
+			var dumps [][]byte
+			for i := 0; i < 2; i++ {
+				dumpfile := filepath.Join(t.TempDir(), "shop.sql")
+				if _, err := opt.dumpDatabase(session, "shop", dumpfile); err != nil {
+					t.Fatal(err)
+				}
+				data, err := os.ReadFile(dumpfile)
+				if err != nil {
+					t.Fatal(err)
+				}
+				dumps = append(dumps, data)
+			}
+			if identical := bytes.Equal(dumps[0], dumps[1]); identical != tt.wantIdentical {
+				t.Errorf("the dumps of the same data are identical: %v, want %v\n%s\n%s", identical, tt.wantIdentical, dumps[0], dumps[1])
+			}
+		})
+	}
+}
+
+func TestSkipDumpDate(t *testing.T) {
+	if got := NewCmdBackup().Flags().Lookup("skip-dump-date").DefValue; got != "false" {
+		t.Errorf("--skip-dump-date defaults to %s, want the date kept", got)
+	}
+	for _, skipDumpDate := range []bool{false, true} {
+		t.Run(fmt.Sprintf("skip dump date %v", skipDumpDate), func(t *testing.T) {
+			opt := newTestBackupOptions()
+			opt.skipDumpDate = skipDumpDate
+			session := newFakeSession(t, opt, "")
+			session.cmd.Name = unstableDumpCommand(t)
+			if got := countArg(opt.dumpArgs(session, "shop"), "--skip-dump-date") == 1; got != skipDumpDate {
+				t.Errorf("--skip-dump-date is passed: %v, want %v", got, skipDumpDate)
+			}
+
+			dumpfile := filepath.Join(t.TempDir(), "shop.sql")
+			if _, err := opt.dumpDatabase(session, "shop", dumpfile); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(dumpfile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dated := regexp.MustCompile(`(?m)^-- Dump completed on \d{4}-\d{2}-\d{2}`).Match(data)
+			if dated == skipDumpDate {
+				t.Errorf("the dump holds a date: %v, want %v\n%s", dated, !skipDumpDate, data)
+			}
+		})
+	}
+}
+
+func TestOrderByPrimaryArgs(t *testing.T) {
+	tests := []struct {
+		name      string
+		databases []string
+		myArgs    string
+		db        string
+		want      []interface{}
+	}{
+		{name: "every database", db: "shop", want: []interface{}{"--order-by-primary"}},
+		{name: "selected database", databases: []string{"shop"}, db: "shop", want: []interface{}{"--order-by-primary"}},
+		{name: "other database", databases: []string{"shop"}, db: "crm"},
+		{name: "streamed dump of all the databases", databases: []string{"shop"}, db: "", want: []interface{}{"--order-by-primary"}},
+		{name: "flag given by the user", myArgs: "--all-databases --order-by-primary", db: "shop"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := newTestBackupOptions()
+			opt.orderByPrimary = true
+			opt.orderByPrimaryDatabases = tt.databases
+			if tt.myArgs != "" {
+				opt.myArgs = tt.myArgs
+			}
+			if got := opt.orderByPrimaryArgs(tt.db); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("orderByPrimaryArgs(%q) = %v, want %v", tt.db, got, tt.want)
+			}
+			// the flag is passed once, whether it comes from the option or the user
+			wantCount := 0
+			if len(tt.want) > 0 || tt.myArgs != "" {
+				wantCount = 1
+			}
+			if n := countArg(opt.dumpArgs(newFakeSession(t, opt, "mariadb-dump"), tt.db), "--order-by-primary"); tt.db != "" && n != wantCount {
+				t.Errorf("--order-by-primary is passed %d times, want %d", n, wantCount)
+			}
+		})
+	}
+
+	opt := newTestBackupOptions()
+	if got := opt.orderByPrimaryArgs("shop"); got != nil {
+		t.Errorf("orderByPrimaryArgs() without --order-by-primary = %v", got)
+	}
+	opt.orderByPrimaryDatabases = []string{"shop"}
+	if err := opt.validateDumpOptions(); err == nil || !strings.Contains(err.Error(), "requires --order-by-primary") {
+		t.Errorf("validateDumpOptions() = %v, want the databases rejected without --order-by-primary", err)
+	}
+	opt.orderByPrimary = true
+	opt.streamBackup = true
+	if err := opt.validateDumpOptions(); err == nil || !strings.Contains(err.Error(), "can not be restricted") {
+		t.Errorf("validateDumpOptions() = %v, want the databases rejected with --stream", err)
+	}
+}
+
+func TestConfiguredBinaries(t *testing.T) {
+	calls := filepath.Join(t.TempDir(), "calls")
+	opt := newTestBackupOptions()
+	opt.dumpCmd = fakeCommand(t, `echo mysqldump "$@" >> `+calls)
+	opt.clientCmd = fakeCommand(t, `echo mysql "$@" >> `+calls+`
+echo shop`)
+	opt.setupOptions.ScratchDir = t.TempDir()
+	session, err := opt.prepareSession(newTestAppBinding(opt), opt.dumpCmd, opt.setupOptions.ScratchDir)
+	defer session.cleanup()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = session.waitForDBReady(context.Background(), 5, opt.readinessBackoff()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = session.getDbNames(opt.systemSchemas); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = opt.dumpDatabase(session, "shop", filepath.Join(t.TempDir(), "shop.sql")); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	var binaries []string
+	for _, line := range lines {
+		binaries = append(binaries, strings.Fields(line)[0])
+	}
+	if want := []string{"mysql", "mysql", "mysqldump"}; !reflect.DeepEqual(binaries, want) {
+		t.Errorf("the backup ran %v, want %v:\n%s", binaries, want, data)
+	}
+	if !strings.HasSuffix(lines[2], "-- shop") {
+		t.Errorf("the dump binary ran with %q, want the dump of shop", lines[2])
+	}
+
+	err = checkBinaries(opt.dumpCmd, "mysqldump-missing")
+	if err == nil || !strings.Contains(err.Error(), `binary "mysqldump-missing" not found in PATH`) {
+		t.Errorf("checkBinaries() error = %v, want the missing binary to be named", err)
+	}
+}
+
+func TestColumnStatisticsFlag(t *testing.T) {
+	tests := []struct {
+		myArgs  string
+		disable bool
+		want    []string
+	}{
+		{myArgs: "--all-databases", want: nil},
+		{myArgs: "--all-databases", disable: true, want: []string{"--column-statistics=0"}},
+		{myArgs: "--column-statistics=0", disable: true, want: []string{"--column-statistics=0"}},
+		{myArgs: "--column-statistics=1", disable: true, want: []string{"--column-statistics=1"}},
+		{myArgs: "--skip-column-statistics", disable: true, want: []string{"--skip-column-statistics"}},
+	}
+	for _, tt := range tests {
+		opt := newTestBackupOptions()
+		opt.myArgs = tt.myArgs
+		opt.disableColumnStatistics = tt.disable
+		var got []string
+		for _, arg := range opt.dumpArgs(newFakeSession(t, opt, "mysqldump"), "shop") {
+			if s := arg.(string); strings.Contains(s, "column-statistics") {
+				got = append(got, s)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("dump arguments with %q (disabled %t) have %v, want %v", tt.myArgs, tt.disable, got, tt.want)
+		}
+	}
+}
+
+func TestNoTablespaces(t *testing.T) {
+	tests := []struct {
+		name          string
+		noTablespaces string
+		privileges    string
+		wantFlag      bool
+		wantQuery     bool
+	}{
+		{name: "auto with the PROCESS privilege", noTablespaces: NoTablespacesAuto, privileges: "1", wantQuery: true},
+		{name: "auto without the PROCESS privilege", noTablespaces: NoTablespacesAuto, privileges: "0", wantFlag: true, wantQuery: true},
+		{name: "forced on", noTablespaces: NoTablespacesOn, privileges: "1", wantFlag: true},
+		{name: "forced off", noTablespaces: NoTablespacesOff, privileges: "0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := newTestBackupOptions()
+			opt.noTablespaces = tt.noTablespaces
+			queries := filepath.Join(t.TempDir(), "queries")
+			session := newFakeSession(t, opt, fakeCommand(t, `eval query=\${$#}
+printf '%s\n' "$query" >> `+queries+`
+echo `+tt.privileges))
+
+			if err := opt.setSkipTablespaces(session); err != nil {
+				t.Fatal(err)
+			}
+			if got := countArg(opt.dumpFlags(), "--no-tablespaces") == 1; got != tt.wantFlag {
+				t.Errorf("--no-tablespaces is passed: %v, want %v", got, tt.wantFlag)
+			}
+			data, err := os.ReadFile(queries)
+			if tt.wantQuery != (err == nil) {
+				t.Fatalf("the privileges were queried: %v, want %v", err == nil, tt.wantQuery)
+			}
+			if tt.wantQuery && !strings.Contains(string(data), "PRIVILEGE_TYPE = 'PROCESS' AND GRANTEE = "+currentGrantee) {
+				t.Errorf("the privileges were queried with %q", data)
+			}
+		})
+	}
+}
+
+func TestNoTablespacesPrivilegeQueryFailure(t *testing.T) {
+	opt := newTestBackupOptions()
+	opt.noTablespaces = NoTablespacesAuto
+	session := newFakeSession(t, opt, fakeCommand(t, `echo "ERROR 2013 (HY000): Lost connection to server during query" >&2; exit 1`))
+	err := opt.setSkipTablespaces(session)
+	if err == nil || !strings.Contains(err.Error(), "failed to query the PROCESS privilege") {
+		t.Errorf("setSkipTablespaces() error = %v, want the query failure", err)
+	}
+}
+
+func TestNoTablespacesIgnoresThePrivilegesOfTheOtherAccounts(t *testing.T) {
+	opt := newTestBackupOptions()
+	opt.noTablespaces = NoTablespacesAuto
+	// the backup user reads the mysql schema, so it sees the PROCESS privilege of root
+	session := newFakeSession(t, opt, fakeCommand(t, `eval query=\${$#}
+case "$query" in
+*"PRIVILEGE_TYPE = 'PROCESS' AND GRANTEE = "*CURRENT_USER*) echo 0 ;;
+*"PRIVILEGE_TYPE = 'PROCESS'"*) echo 1 ;;
+*) exit 1 ;;
+esac`))
+
+	if err := opt.setSkipTablespaces(session); err != nil {
+		t.Fatal(err)
+	}
+	if countArg(opt.dumpFlags(), "--no-tablespaces") != 1 {
+		t.Errorf("the tablespaces are dumped by a backup user lacking the PROCESS privilege of another account")
+	}
+}
+
+func TestHexBlob(t *testing.T) {
+	tests := []struct {
+		name          string
+		hexBlob       string
+		binaryColumns string
+		wantFlag      bool
+		wantQuery     bool
+	}{
+		{name: "auto with binary columns", hexBlob: HexBlobAuto, binaryColumns: "3", wantFlag: true, wantQuery: true},
+		{name: "auto without binary columns", hexBlob: HexBlobAuto, binaryColumns: "0", wantQuery: true},
+		{name: "forced on", hexBlob: HexBlobOn, binaryColumns: "0", wantFlag: true},
+		{name: "forced off", hexBlob: HexBlobOff, binaryColumns: "3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := newTestBackupOptions()
+			opt.hexBlob = tt.hexBlob
+			queries := filepath.Join(t.TempDir(), "queries")
+			session := newFakeSession(t, opt, fakeCommand(t, `eval query=\${$#}
+printf '%s\n' "$query" >> `+queries+`
+echo `+tt.binaryColumns))
+
+			if err := opt.setHexBlob(session, []string{"shop", "crm"}); err != nil {
+				t.Fatal(err)
+			}
+			if got := countArg(opt.dumpArgs(session, "shop"), "--hex-blob") == 1; got != tt.wantFlag {
+				t.Errorf("--hex-blob is passed: %v, want %v", got, tt.wantFlag)
+			}
+			data, err := os.ReadFile(queries)
+			if tt.wantQuery != (err == nil) {
+				t.Fatalf("the columns were queried: %v, want %v", err == nil, tt.wantQuery)
+			}
+			if tt.wantQuery && (!strings.Contains(string(data), "TABLE_SCHEMA IN ('shop','crm')") || !strings.Contains(string(data), "'varbinary'") || !strings.Contains(string(data), "'longblob'")) {
+				t.Errorf("the columns were queried with %q", data)
+			}
+		})
+	}
+}
+
+func TestHexBlobColumnQueryFailure(t *testing.T) {
+	opt := newTestBackupOptions()
+	opt.hexBlob = HexBlobAuto
+	session := newFakeSession(t, opt, fakeCommand(t, `echo "ERROR 1142 (42000): SELECT command denied" >&2; exit 1`))
+	if err := opt.setHexBlob(session, []string{"shop"}); err == nil || !strings.Contains(err.Error(), "failed to look for binary columns") {
+		t.Errorf("setHexBlob() error = %v, want the query failure", err)
+	}
+	// without databases to dump there is nothing to look for
+	if err := opt.setHexBlob(session, nil); err != nil || opt.useHexBlob {
+		t.Errorf("setHexBlob() without databases = %v, hex blob %v", err, opt.useHexBlob)
+	}
+
+	opt.hexBlob = "yes"
+	if err := opt.validateDumpOptions(); err == nil || !strings.Contains(err.Error(), `invalid hex-blob "yes"`) {
+		t.Errorf("validateDumpOptions() error = %v, want the invalid value rejected", err)
+	}
+}
+
+func TestNonEmptyDatabases(t *testing.T) {
+	opt := newTestBackupOptions()
+	opt.skipEmptyDatabases = true
+	session := newFakeSession(t, opt, fakeCommand(t, `printf 'shop\t3\ncrm\t1\n'`))
+
+	got, err := opt.nonEmptyDatabases(session, []string{"shop", "empty", "crm", "bare"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"shop", "crm"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("nonEmptyDatabases() = %v, want %v", got, want)
+	}
+	if want := (databaseNames{"empty", "bare"}); !reflect.DeepEqual(opt.emptyDatabases, want) {
+		t.Errorf("the empty databases are %v, want %v", opt.emptyDatabases, want)
+	}
+}
+
+func TestSkipEmptyDatabasesRequiresPerDatabaseBackup(t *testing.T) {
+	opt := newTestBackupOptions()
+	opt.skipEmptyDatabases = true
+	if err := opt.validateDumpOptions(); err == nil || !strings.Contains(err.Error(), "empty databases can only be skipped by per database backup") {
+		t.Errorf("validateDumpOptions() error = %v, want the full backup to be rejected", err)
+	}
+	opt.perDatabaseBackup = true
+	if err := opt.validateDumpOptions(); err != nil {
+		t.Errorf("validateDumpOptions() error = %v", err)
+	}
+}
+
+func TestPerDatabaseBackupSkipsTheDatabasesEmptiedAfterTheyWereCounted(t *testing.T) {
+	opt := newTestBackupOptions()
+	opt.perDatabaseBackup = true
+	opt.skipEmptyDatabases = true
+	// the tables of crm were dropped between the count and the snapshot
+	session := newFakeSession(t, opt, fakeCommand(t, `eval query=\${$#}
+case "$query" in
+"SHOW DATABASES;") printf 'shop\ncrm\n' ;;
+*"information_schema.TABLES WHERE TABLE_SCHEMA IN ('shop')"*) printf 'shop\t2\n' ;;
+*"information_schema.TABLES"*) ;;
+*) exit 1 ;;
+esac`))
+	resticWrapper, repository := newFakeRestic(t, opt, session)
+
+	var results []dumpResult
+	dumpdir := t.TempDir()
+	for _, db := range []string{"shop", "crm"} {
+		dumpfile := filepath.Join(dumpdir, db+".sql")
+		if err := os.WriteFile(dumpfile, sampleDump(10), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, dumpResult{db: db, dumpfile: dumpfile, bytes: int64(len(sampleDump(10)))})
+	}
+
+	if _, err := opt.backupPerDatabase(context.Background(), session, resticWrapper, api_v1beta1.TargetRef{}, results); err != nil {
+		t.Fatal(err)
+	}
+	snapshots := fakeSnapshots(t, repository)
+	if len(snapshots) != 1 || !containsString(snapshots[0].Tags, DatabaseTagPrefix+"shop") || !containsString(snapshots[0].Tags, TableCountTagPrefix+"2") {
+		t.Fatalf("the backup took the snapshots %+v, want a single snapshot of shop", snapshots)
+	}
+	if !opt.emptyDatabases.has("crm") {
+		t.Errorf("the empty databases are %v, want crm", opt.emptyDatabases)
+	}
+	if _, err := os.Stat(results[1].dumpfile); !os.IsNotExist(err) {
+		t.Errorf("the dump of the empty database was kept")
+	}
+}
+
+func TestFilteredDump(t *testing.T) {
+	opt := newTestBackupOptions()
+	opt.whereClause = `created_at >= '2024-01-01' AND note <> "it's; DROP TABLE orders" AND id IN (SELECT id FROM ` + "`keep`" + `)`
+	opt.ignoreTables = []string{"shop.audit_log", "`my.db`.sessions", "shop.tmp_import", "shop.audit_log"}
+	if err := opt.validateDumpOptions(); err != nil {
+		t.Fatal(err)
+	}
+	args := filepath.Join(t.TempDir(), "args")
+	session := newFakeSession(t, opt, fakeCommand(t, `for arg; do printf '%s\n' "$arg"; done > `+args))
+	if _, err := opt.dumpDatabase(session, "shop", filepath.Join(t.TempDir(), "shop.sql")); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, arg := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		if strings.HasPrefix(arg, "--where") || strings.HasPrefix(arg, "--ignore-table=") {
+			got = append(got, arg)
+		}
+	}
+	// the condition reaches mariadb-dump unchanged, there is no shell to quote it for
+	want := []string{
+		"--where=" + opt.whereClause,
+		"--ignore-table=my.db.sessions",
+		"--ignore-table=shop.audit_log",
+		"--ignore-table=shop.tmp_import",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mariadb-dump ran with %q, want %q", got, want)
+	}
+}
+
+func TestInvalidDumpFilters(t *testing.T) {
+	tests := []struct {
+		name         string
+		where        string
+		ignoreTables []string
+		wantErr      string
+	}{
+		{name: "unqualified table", ignoreTables: []string{"shop.orders", "sessions"}, wantErr: `invalid ignored table: invalid table "sessions", must be of the form <database>.<table>`},
+		{name: "missing table", ignoreTables: []string{"shop."}, wantErr: `invalid table "shop."`},
+		{name: "missing database", ignoreTables: []string{".orders"}, wantErr: `invalid table ".orders"`},
+		{name: "unterminated quote", ignoreTables: []string{"`my.db.sessions"}, wantErr: "invalid table \"`my.db.sessions\""},
+		{name: "blank condition", where: "  ", wantErr: "the where condition is blank"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := newTestBackupOptions()
+			opt.whereClause = tt.where
+			opt.ignoreTables = tt.ignoreTables
+			if err := opt.validateDumpOptions(); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validateDumpOptions() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckReadOnlySource(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		allow   bool
+		wantErr string
+	}{
+		{name: "writable", script: `printf 'read_only\tOFF\n'`},
+		{name: "writable mysql", script: `printf 'read_only\tOFF\nsuper_read_only\tOFF\n'`},
+		{name: "read-only allowed", script: `printf 'read_only\tON\n'`, allow: true},
+		{
+			name:    "read-only",
+			script:  `printf 'read_only\tON\n'`,
+			wantErr: "the database is read-only (read_only), it is likely a replica; pass --allow-read-only-source (or --replica-backup) to back it up anyway",
+		},
+		{
+			name:    "super read-only",
+			script:  `printf 'read_only\t1\nsuper_read_only\tON\n'`,
+			wantErr: "the database is read-only (read_only, super_read_only)",
+		},
+		{
+			name:    "query failure",
+			script:  `echo "ERROR 2013 (HY000): Lost connection to server during query" >&2; exit 1`,
+			allow:   true,
+			wantErr: "failed to query the read-only state of the database",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := newTestBackupOptions()
+			opt.allowReadOnlySource = tt.allow
+			session := newFakeSession(t, opt, fakeCommand(t, tt.script))
+			err := opt.checkReadOnlySource(session)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("checkReadOnlySource() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadOnlySourceIsAllowedByDefault(t *testing.T) {
+	if got := NewCmdBackup().Flags().Lookup("allow-read-only-source").DefValue; got != "true" {
+		t.Errorf("--allow-read-only-source defaults to %s, want true", got)
+	}
+}
+
+// perDatabaseResults writes a dump for each database and returns the results of dumping them, failed for the
+// databases of failures
+func perDatabaseResults(t *testing.T, databases []string, failures map[string]error) []dumpResult {
+	t.Helper()
+	dumpdir := t.TempDir()
+	var results []dumpResult
+	for _, db := range databases {
+		dumpfile := filepath.Join(dumpdir, db+".sql")
+		if err := os.WriteFile(dumpfile, sampleDump(10), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, dumpResult{db: db, dumpfile: dumpfile, bytes: int64(len(sampleDump(10))), err: failures[db]})
+	}
+	return results
+}
+
+// snapshotDatabaseTags returns the databases of the per database snapshots of the repository
+func snapshotDatabaseTags(t *testing.T, repository string) []string {
+	t.Helper()
+	var databases []string
+	for _, snapshot := range fakeSnapshots(t, repository) {
+		if db, ok := snapshotTagValue(&snapshot, DatabaseTagPrefix); ok {
+			databases = append(databases, db)
+		}
+	}
+	sort.Strings(databases)
+	return databases
+}
+
+func TestPerDatabaseBackupKeepsTheSnapshotsOfTheOtherDatabases(t *testing.T) {
+	opt := newTestBackupOptions()
+	opt.perDatabaseBackup = true
+	session := newFakeSession(t, opt, fakeCommand(t, `eval query=\${$#}
+case "$query" in
+"SHOW DATABASES;") printf 'shop\ncrm\nhr\nbilling\n' ;;
+*"information_schema.TABLES"*) for db in shop crm hr billing; do case "$query" in *"'$db'"*) printf '%s\t2\n' $db ;; esac; done ;;
+*) exit 1 ;;
+esac`))
+	resticWrapper, repository := newFakeRestic(t, opt, session)
+	results := perDatabaseResults(t, []string{"shop", "crm", "hr", "billing"}, map[string]error{
+		"crm": errors.New("mariadb-dump: Got error: 1146: Table 'crm.contacts' doesn't exist"),
+		"hr":  errors.New("mariadb-dump: Got error: 2013: Lost connection to server during query"),
+	})
+
+	output, err := opt.backupPerDatabase(context.Background(), session, resticWrapper, api_v1beta1.TargetRef{}, results)
+	want := "backup failed for 2 of 4 databases (crm, hr): [failed to dump database crm: mariadb-dump: Got error: 1146: Table 'crm.contacts' doesn't exist, " +
+		"failed to dump database hr: mariadb-dump: Got error: 2013: Lost connection to server during query]"
+	if err == nil || err.Error() != want {
+		t.Errorf("backupPerDatabase() error = %v, want %q", err, want)
+	}
+	if got := snapshotDatabaseTags(t, repository); !reflect.DeepEqual(got, []string{"billing", "shop"}) {
+		t.Errorf("the repository holds the snapshots of %v, want billing and shop", got)
+	}
+	// the snapshots taken are reported along with the failure
+	if output == nil || len(output.BackupTargetStatus.Stats) != 1 || len(output.BackupTargetStatus.Stats[0].Snapshots) != 2 {
+		t.Errorf("backupPerDatabase() reported %+v, want the 2 snapshots taken", output)
+	}
+}
+
+func TestPerDatabaseBackupAbortsOnTheFirstFailure(t *testing.T) {
+	const script = `eval query=\${$#}
+case "$query" in
+"SHOW DATABASES;") printf 'shop\ncrm\nhr\n' ;;
+*"information_schema.TABLES WHERE TABLE_SCHEMA IN ('crm')"*) echo "ERROR 2013 (HY000): Lost connection to server during query" >&2; exit 1 ;;
+*"information_schema.TABLES"*) for db in shop crm hr; do case "$query" in *"'$db'"*) printf '%s\t2\n' $db ;; esac; done ;;
+*) exit 1 ;;
+esac`
+	tests := []struct {
+		name     string
+		failures map[string]error
+		first    string
+		wantErr  string
+	}{
+		{
+			name:     "failed dump",
+			failures: map[string]error{"crm": errors.New("mariadb-dump: Got error: 1146: Table 'crm.contacts' doesn't exist")},
+			first:    "crm",
+			wantErr:  "backup aborted, failed to dump database crm: mariadb-dump: Got error: 1146: Table 'crm.contacts' doesn't exist",
+		},
+		{
+			// the snapshot of shop is already taken when the tables of crm fail to be counted
+			name:    "failure after a snapshot",
+			wantErr: "backup aborted: failed to count the tables of the databases",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := newTestBackupOptions()
+			opt.perDatabaseBackup = true
+			opt.abortOnFirstFailure = true
+			session := newFakeSession(t, opt, fakeCommand(t, script))
+			resticWrapper, repository := newFakeRestic(t, opt, session)
+			results := perDatabaseResults(t, []string{"shop", "crm", "hr"}, tt.failures)
+			for i := range results {
+				results[i].firstFailure = results[i].db == tt.first
+			}
+
+			_, err := opt.backupPerDatabase(context.Background(), session, resticWrapper, api_v1beta1.TargetRef{}, results)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("backupPerDatabase() error = %v, want %q", err, tt.wantErr)
+			}
+			if got := snapshotDatabaseTags(t, repository); len(got) != 0 {
+				t.Errorf("the repository holds the snapshots of %v after the backup was aborted", got)
+			}
+		})
+	}
+}
+
+// initCommands returns the --init-command arguments of args
+func initCommands(args []interface{}) []string {
+	var commands []string
+	for _, arg := range args {
+		if s, ok := arg.(string); ok && strings.HasPrefix(s, "--init-command") {
+			commands = append(commands, s)
+		}
+	}
+	return commands
+}
+
+func TestDumpLockWaitTimeout(t *testing.T) {
+	tests := []struct {
+		name               string
+		timeout            time.Duration
+		consistentSnapshot bool
+		netReadTimeout     int
+		want               []string
+	}{
+		{name: "not set", consistentSnapshot: true},
+		{name: "consistent snapshot", timeout: 30 * time.Second, consistentSnapshot: true, want: []string{"--init-command=SET SESSION lock_wait_timeout=30"}},
+		{name: "table locks", timeout: 30 * time.Second, want: []string{"--init-command=SET SESSION lock_wait_timeout=30"}},
+		{name: "rounded up", timeout: 1500 * time.Millisecond, consistentSnapshot: true, want: []string{"--init-command=SET SESSION lock_wait_timeout=2"}},
+		{
+			name:               "shared with the net timeouts",
+			timeout:            time.Minute,
+			consistentSnapshot: true,
+			netReadTimeout:     600,
+			want:               []string{"--init-command=SET SESSION lock_wait_timeout=60, net_read_timeout=600"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := newTestBackupOptions()
+			opt.dumpLockWaitTimeout = tt.timeout
+			opt.consistentSnapshot = tt.consistentSnapshot
+			opt.dumpNetReadTimeout = tt.netReadTimeout
+			if err := opt.validateDumpOptions(); err != nil {
+				t.Fatal(err)
+			}
+			session := newFakeSession(t, opt, MariaDBDumpCMD)
+			for mode, args := range map[string][]interface{}{
+				"database dump": opt.dumpArgs(session, "shop"),
+				"streamed dump": opt.streamBackupOptions(session, []string{"shop"}).StdinPipeCommands[0].Args,
+			} {
+				if got := initCommands(args); !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("the %s runs with %q, want %q", mode, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestInvalidDumpLockWaitTimeout(t *testing.T) {
+	opt := newTestBackupOptions()
+	opt.dumpLockWaitTimeout = -time.Second
+	if err := opt.validateDumpOptions(); err == nil || !strings.Contains(err.Error(), "dump lock wait timeout must not be negative") {
+		t.Errorf("validateDumpOptions() error = %v, want the negative timeout to be rejected", err)
+	}
+
+	// the client takes a single --init-command
+	opt.dumpLockWaitTimeout = time.Second
+	opt.myArgs = "--all-databases --init-command=SET @@session.sql_mode=''"
+	if err := opt.validateDumpOptions(); err == nil || !strings.Contains(err.Error(), "can not be combined with the --init-command of the mariadb args") {
+		t.Errorf("validateDumpOptions() error = %v, want the --init-command of the user to be rejected", err)
+	}
+}
+
+func TestDumpNetTimeouts(t *testing.T) {
+	tests := []struct {
+		name         string
+		readTimeout  int
+		writeTimeout int
+		want         []string
+	}{
+		{name: "not set"},
+		{name: "read timeout", readTimeout: 3600, want: []string{"--init-command=SET SESSION net_read_timeout=3600"}},
+		{name: "write timeout", writeTimeout: 7200, want: []string{"--init-command=SET SESSION net_write_timeout=7200"}},
+		{name: "both timeouts", readTimeout: 3600, writeTimeout: 7200, want: []string{"--init-command=SET SESSION net_read_timeout=3600, net_write_timeout=7200"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := newTestBackupOptions()
+			opt.dumpNetReadTimeout = tt.readTimeout
+			opt.dumpNetWriteTimeout = tt.writeTimeout
+			if err := opt.validateDumpOptions(); err != nil {
+				t.Fatal(err)
+			}
+			session := newFakeSession(t, opt, MariaDBDumpCMD)
+			for mode, args := range map[string][]interface{}{
+				"database dump": opt.dumpArgs(session, "shop"),
+				"streamed dump": opt.streamBackupOptions(session, []string{"shop"}).StdinPipeCommands[0].Args,
+			} {
+				if got := initCommands(args); !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("the %s runs with %q, want %q", mode, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestInvalidDumpNetTimeouts(t *testing.T) {
+	tests := []struct {
+		name         string
+		readTimeout  int
+		writeTimeout int
+		myArgs       string
+		wantErr      string
+	}{
+		{name: "negative read timeout", readTimeout: -1, wantErr: "dump net read timeout must be a positive number of seconds, got -1"},
+		{name: "negative write timeout", writeTimeout: -30, wantErr: "dump net write timeout must be a positive number of seconds, got -30"},
+		{
+			// the client takes a single --init-command
+			name:        "init command of the mariadb args",
+			readTimeout: 3600,
+			myArgs:      "--all-databases --init-command=SET @@session.sql_mode=''",
+			wantErr:     "the dump net timeouts are set with --init-command, they can not be combined with the --init-command of the mariadb args",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := newTestBackupOptions()
+			opt.dumpNetReadTimeout = tt.readTimeout
+			opt.dumpNetWriteTimeout = tt.writeTimeout
+			opt.myArgs = tt.myArgs
+			if err := opt.validateDumpOptions(); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validateDumpOptions() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	BinlogPositionFileName = "binlog-position.json"
+
+	// values of the set-gtid-position restore option, analogous to the --set-gtid-purged option of mysqldump
+	GTIDPositionAuto = "auto"
+	GTIDPositionOn   = "on"
+	GTIDPositionOff  = "off"
+)
+
+var (
+	binlogFileRegex = regexp.MustCompile(`MASTER_LOG_FILE\s*=\s*'([^']+)'`)
+	binlogPosRegex  = regexp.MustCompile(`MASTER_LOG_POS\s*=\s*(\d+)`)
+	gtidPosRegex    = regexp.MustCompile(`gtid_slave_pos\s*=\s*'([^']*)'`)
+)
+
+// BinlogPosition holds the binary log coordinates recorded by mariadb-dump with --master-data
+type BinlogPosition struct {
+	File     string `json:"file,omitempty"`
+	Position int64  `json:"position,omitempty"`
+	GTID     string `json:"gtid,omitempty"`
+}
+
+// parseBinlogPosition extracts the binary log coordinates from the header of a dump.
+// mariadb-dump writes them either as a "-- " line comment (--master-data=2) or as a
+// plain/"/* */" wrapped statement (--master-data=1), so the comment markers are stripped before matching.
+func parseBinlogPosition(r io.Reader) (*BinlogPosition, error) {
+	reader := bufio.NewReader(r)
+	pos := &BinlogPosition{}
+	for {
+		line, err := reader.ReadString('\n')
+		stmt := strings.TrimSpace(line)
+		stmt = strings.TrimPrefix(stmt, "--")
+		stmt = strings.TrimPrefix(strings.TrimSpace(stmt), "/*")
+		stmt = strings.TrimSpace(strings.TrimSuffix(stmt, "*/"))
+
+		if strings.HasPrefix(stmt, "CHANGE MASTER TO") {
+			if m := binlogFileRegex.FindStringSubmatch(stmt); m != nil {
+				pos.File = m[1]
+			}
+			if m := binlogPosRegex.FindStringSubmatch(stmt); m != nil {
+				pos.Position, _ = strconv.ParseInt(m[1], 10, 64)
+			}
+		} else if strings.HasPrefix(stmt, "SET GLOBAL gtid_slave_pos") {
+			if m := gtidPosRegex.FindStringSubmatch(stmt); m != nil {
+				pos.GTID = m[1]
+			}
+		}
+		// the coordinates are written in the header, stop as soon as the data starts
+		if strings.HasPrefix(stmt, "CREATE TABLE") || strings.HasPrefix(stmt, "INSERT INTO") {
+			break
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if pos.File == "" && pos.GTID == "" {
+		return nil, errors.New("binary log coordinates not found in the dump, make sure binary logging is enabled on the server")
+	}
+	return pos, nil
+}
+
+// writeBinlogPositions writes the binary log coordinates of each dumped database in a json file
+func writeBinlogPositions(fileName string, positions map[string]BinlogPosition) error {
+	data, err := json.MarshalIndent(positions, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fileName, data, 0o644)
+}
+
+// isGTIDEnabled reports whether the server has a GTID binlog position to record
+func (session *sessionWrapper) isGTIDEnabled() (bool, error) {
+	output, err := session.executeQuery("SELECT @@GLOBAL.gtid_binlog_pos;")
+	if err != nil {
+		return false, fmt.Errorf("failed to query gtid_binlog_pos: %w", err)
+	}
+	gtid := strings.TrimSpace(string(output))
+	return gtid != "" && gtid != "NULL", nil
+}
+
+// gtidFilterMode translates the set-gtid-position option into the mode of the dump filter.
+// In auto mode the position is applied only if the target has no GTID in its binary logs,
+// since setting gtid_slave_pos would otherwise conflict with them.
+func (session *sessionWrapper) gtidFilterMode(setGTIDPosition string) (string, error) {
+	switch setGTIDPosition {
+	case GTIDPositionOn:
+		return gtidFilterReset, nil
+	case GTIDPositionOff:
+		return gtidFilterDrop, nil
+	case GTIDPositionAuto:
+		enabled, err := session.isGTIDEnabled()
+		if err != nil {
+			return "", err
+		}
+		if enabled {
+			klog.Infoln("The target server has GTIDs in its binary logs, the GTID position of the dump is not applied")
+			return gtidFilterDrop, nil
+		}
+		return gtidFilterApply, nil
+	}
+	return "", nil
+}
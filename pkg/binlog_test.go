@@ -0,0 +1,114 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGTIDFilterMode(t *testing.T) {
+	tests := []struct {
+		name        string
+		option      string
+		binlogPos   string
+		want        string
+		wantQueries int
+	}{
+		{name: "on", option: GTIDPositionOn, want: gtidFilterReset},
+		{name: "off", option: GTIDPositionOff, want: gtidFilterDrop},
+		{name: "auto without GTID on the target", option: GTIDPositionAuto, binlogPos: "", want: gtidFilterApply, wantQueries: 1},
+		{name: "auto with GTID on the target", option: GTIDPositionAuto, binlogPos: "0-1-100", want: gtidFilterDrop, wantQueries: 1},
+		{name: "unset", option: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := newTestRestoreOptions()
+			runs := filepath.Join(t.TempDir(), "runs")
+			session := newFakeSession(t, opt, fakeCommand(t, fmt.Sprintf("echo run >> %s\necho '%s'", runs, tt.binlogPos)))
+			got, err := session.gtidFilterMode(tt.option)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("gtidFilterMode(%q) = %q, want %q", tt.option, got, tt.want)
+			}
+			if n := countRuns(t, runs); n != tt.wantQueries {
+				t.Errorf("gtidFilterMode(%q) queried the server %d times, want %d", tt.option, n, tt.wantQueries)
+			}
+		})
+	}
+}
+
+func TestRewriteGTIDPosition(t *testing.T) {
+	const (
+		commented = "-- SET GLOBAL gtid_slave_pos='0-1-42';\n"
+		statement = "SET GLOBAL gtid_slave_pos='0-1-42';\n"
+	)
+	tests := []struct {
+		name string
+		dump string
+		mode string
+		want string
+	}{
+		// --master-data=2, as written when the backup records the binary log position
+		{name: "apply commented", dump: commented, mode: gtidFilterApply, want: commented + "SET GLOBAL gtid_slave_pos='0-1-42';\n"},
+		{name: "reset commented", dump: commented, mode: gtidFilterReset, want: "RESET MASTER;\n" + commented + "SET GLOBAL gtid_slave_pos='0-1-42';\n"},
+		{name: "drop commented", dump: commented, mode: gtidFilterDrop, want: commented},
+		// --master-data=1
+		{name: "apply statement", dump: statement, mode: gtidFilterApply, want: statement},
+		{name: "reset statement", dump: statement, mode: gtidFilterReset, want: "RESET MASTER;\n" + statement},
+		{name: "drop statement", dump: statement, mode: gtidFilterDrop, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dump := "/*!40101 SET NAMES utf8mb4 */;\n" + tt.dump + "CREATE TABLE t (id int);\n"
+			out := runFilterSQL(t, dump, sqlFilterOptions{gtidMode: tt.mode})
+			want := "/*!40101 SET NAMES utf8mb4 */;\n" + tt.want + "CREATE TABLE t (id int);\n"
+			if out != want {
+				t.Errorf("filterSQL() =\n%s\nwant\n%s", out, want)
+			}
+		})
+	}
+}
+
+func TestParseBinlogPositionOfTheDump(t *testing.T) {
+	dump := `-- MariaDB dump 10.19
+--
+-- Position to start replication or point-in-time recovery from
+--
+
+-- CHANGE MASTER TO MASTER_LOG_FILE='mariadb-bin.000012', MASTER_LOG_POS=3456;
+
+--
+-- GTID to start replication from
+--
+
+-- SET GLOBAL gtid_slave_pos='0-1-42';
+CREATE TABLE t (id int);
+-- SET GLOBAL gtid_slave_pos='9-9-9';
+`
+	pos, err := parseBinlogPosition(strings.NewReader(dump))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *pos != (BinlogPosition{File: "mariadb-bin.000012", Position: 3456, GTID: "0-1-42"}) {
+		t.Errorf("parseBinlogPosition() = %+v", *pos)
+	}
+}
@@ -0,0 +1,151 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// CharsetConversionLatin1 converts the latin1 declarations of a dump to utf8mb4, the only conversion supported
+const CharsetConversionLatin1 = "latin1:utf8mb4"
+
+var (
+	// CHARACTER SET latin1, CHARSET=latin1 and DEFAULT CHARSET=latin1 of the databases, tables and columns
+	charsetDeclarationRegex = regexp.MustCompile(`(?i)\b(CHARACTER\s+SET|CHARSET)(\s*=?\s*)latin1\b`)
+	// COLLATE latin1_swedish_ci, COLLATE=latin1_bin
+	collateDeclarationRegex = regexp.MustCompile(`(?i)\b(COLLATE)(\s*=?\s*)(latin1_\w+)`)
+	// the session variables set by mariadb-dump around the routines, triggers and events
+	charsetVariableRegex = regexp.MustCompile(`(?i)\b((?:character_set_\w+|collation_\w+)\s*=\s*)(latin1\w*)`)
+	setNamesRegex        = regexp.MustCompile(`(?i)\b(SET\s+NAMES\s+)latin1\b`)
+	// the charset of the connection a dump was taken with
+	connectionCharsetRegex = regexp.MustCompile(`(?i)\bSET\s+NAMES\s+(\w+)`)
+)
+
+// latin1Collations maps the latin1 collations of MariaDB to the closest utf8mb4 one
+var latin1Collations = map[string]string{
+	"latin1_bin":              "utf8mb4_bin",
+	"latin1_nopad_bin":        "utf8mb4_nopad_bin",
+	"latin1_general_cs":       "utf8mb4_bin",
+	"latin1_general_ci":       "utf8mb4_general_ci",
+	"latin1_swedish_ci":       "utf8mb4_general_ci",
+	"latin1_swedish_nopad_ci": "utf8mb4_general_nopad_ci",
+	"latin1_german1_ci":       "utf8mb4_general_ci",
+	"latin1_german2_ci":       "utf8mb4_german2_ci",
+	"latin1_danish_ci":        "utf8mb4_danish_ci",
+	"latin1_spanish_ci":       "utf8mb4_spanish_ci",
+}
+
+// cp1252 holds the characters of bytes 0x80 to 0x9F: the latin1 of MariaDB is Windows-1252, the five bytes
+// Windows-1252 leaves undefined are the C1 control characters
+var cp1252 = [32]rune{
+	'€', '\u0081', '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', '\u008d', 'Ž', '\u008f',
+	'\u0090', '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', '\u009d', 'ž', 'Ÿ',
+}
+
+// validateCharsetConversion checks the conversion is one the filter knows to perform
+func validateCharsetConversion(conversion string) error {
+	if conversion == "" || conversion == CharsetConversionLatin1 {
+		return nil
+	}
+	from, to, ok := strings.Cut(conversion, ":")
+	if !ok || from == "" || to == "" {
+		return fmt.Errorf("invalid charset conversion %q, must be given as <from>:<to>", conversion)
+	}
+	return fmt.Errorf("unsupported charset conversion from %s to %s, only %s is supported", from, to, CharsetConversionLatin1)
+}
+
+// convertCharsetDeclarations rewrites the latin1 charsets and collations declared by a statement to utf8mb4.
+// The charset of the connection (SET NAMES and the session variables around the routines and triggers) is
+// rewritten only when the bytes of the dump are transcoded, otherwise the server converts the latin1 data of
+// the connection into the utf8mb4 columns. The rows of INSERT statements are left untouched.
+func convertCharsetDeclarations(stmt sqlStatement, text string, transcoded bool) (string, error) {
+	if stmt.comment || isDataStatement(text) {
+		return text, nil
+	}
+	var unknown string
+	collation := func(name string) string {
+		if to, ok := latin1Collations[strings.ToLower(name)]; ok {
+			return to
+		}
+		if unknown == "" {
+			unknown = name
+		}
+		return name
+	}
+	text = charsetDeclarationRegex.ReplaceAllString(text, "${1}${2}utf8mb4")
+	text = collateDeclarationRegex.ReplaceAllStringFunc(text, func(s string) string {
+		m := collateDeclarationRegex.FindStringSubmatch(s)
+		return m[1] + m[2] + collation(m[3])
+	})
+	if transcoded {
+		text = setNamesRegex.ReplaceAllString(text, "${1}utf8mb4")
+		text = charsetVariableRegex.ReplaceAllStringFunc(text, func(s string) string {
+			m := charsetVariableRegex.FindStringSubmatch(s)
+			if strings.EqualFold(m[2], "latin1") {
+				return m[1] + "utf8mb4"
+			}
+			return m[1] + collation(m[2])
+		})
+	}
+	if unknown != "" {
+		return "", fmt.Errorf("line %d: no utf8mb4 equivalent of collation %s", stmt.line, unknown)
+	}
+	return text, nil
+}
+
+// checkTranscodable fails on the statement setting a connection charset other than latin1, whose bytes
+// would be encoded twice by the transcoding
+func checkTranscodable(stmt sqlStatement) error {
+	if stmt.comment {
+		return nil
+	}
+	if m := connectionCharsetRegex.FindStringSubmatch(stmt.text); m != nil && !strings.EqualFold(m[1], "latin1") {
+		return fmt.Errorf("line %d: the dump was taken with a %s connection, its data is not latin1, restore it without --transcode-data", stmt.line, m[1])
+	}
+	return nil
+}
+
+// transcodeLatin1 converts the latin1 bytes of the text to UTF-8. Binary data must be written in hexadecimal
+// (--hex-blob) for it to survive, the bytes of the string literals are transcoded all the same.
+func transcodeLatin1(text string) string {
+	ascii := true
+	for i := 0; i < len(text); i++ {
+		if text[i] >= utf8.RuneSelf {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return text
+	}
+	var out strings.Builder
+	out.Grow(len(text) + len(text)/8)
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case c < utf8.RuneSelf:
+			out.WriteByte(c)
+		case c < 0xA0:
+			out.WriteRune(cp1252[c-0x80])
+		default:
+			out.WriteRune(rune(c))
+		}
+	}
+	return out.String()
+}
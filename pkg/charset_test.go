@@ -0,0 +1,152 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// latin1Dump is a dump of a latin1 database taken with a latin1 connection, its rows hold the latin1 bytes
+// of "café", "naïve", "€5" (0x80 in Windows-1252) and "Straße"
+const latin1Dump = "/*!40101 SET NAMES latin1 */;\n" +
+	"CREATE DATABASE /*!32312 IF NOT EXISTS*/ `shop` /*!40100 DEFAULT CHARACTER SET latin1 COLLATE latin1_swedish_ci */;\n" +
+	"USE `shop`;\n" +
+	"CREATE TABLE `products` (\n" +
+	"  `id` int(11) NOT NULL,\n" +
+	"  `name` varchar(64) CHARACTER SET latin1 COLLATE latin1_german2_ci DEFAULT NULL,\n" +
+	"  `price` varchar(16) DEFAULT NULL,\n" +
+	"  PRIMARY KEY (`id`)\n" +
+	") ENGINE=InnoDB DEFAULT CHARSET=latin1 COLLATE=latin1_swedish_ci;\n" +
+	"INSERT INTO `products` VALUES (1,'caf\xe9','\x805'),(2,'na\xefve','CHARACTER SET latin1'),(3,'Stra\xdfe','0');\n" +
+	"DELIMITER ;;\n" +
+	"/*!50003 SET @saved_cs_client = @@character_set_client */ ;;\n" +
+	"/*!50003 SET character_set_client = latin1 */ ;;\n" +
+	"/*!50003 SET collation_connection = latin1_swedish_ci */ ;;\n" +
+	"/*!50003 CREATE*/ /*!50003 TRIGGER products_bi BEFORE INSERT ON products FOR EACH ROW SET NEW.name = TRIM(NEW.name) */;;\n" +
+	"DELIMITER ;\n" +
+	"-- Dump completed on 2024-05-01 10:00:00\n"
+
+func TestConvertCharset(t *testing.T) {
+	out := runFilterSQL(t, latin1Dump, sqlFilterOptions{convertCharset: CharsetConversionLatin1})
+	for _, s := range []string{
+		"/*!40100 DEFAULT CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci */",
+		"`name` varchar(64) CHARACTER SET utf8mb4 COLLATE utf8mb4_german2_ci DEFAULT NULL",
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;",
+		// the server converts the latin1 data of the connection into the utf8mb4 columns
+		"SET NAMES latin1",
+		"SET character_set_client = latin1",
+		"SET collation_connection = latin1_swedish_ci",
+		// the rows are left untouched, even when they look like a declaration
+		"INSERT INTO `products` VALUES (1,'caf\xe9','\x805'),(2,'na\xefve','CHARACTER SET latin1'),(3,'Stra\xdfe','0');",
+	} {
+		if !strings.Contains(out, s) {
+			t.Errorf("the converted dump lacks %q:\n%s", s, out)
+		}
+	}
+}
+
+func TestConvertCharsetTranscodesTheData(t *testing.T) {
+	out := runFilterSQL(t, latin1Dump, sqlFilterOptions{convertCharset: CharsetConversionLatin1, transcodeData: true})
+	if !utf8.ValidString(out) {
+		t.Fatalf("the transcoded dump is not valid UTF-8:\n%q", out)
+	}
+	for _, s := range []string{
+		"/*!40101 SET NAMES utf8mb4 */;",
+		"DEFAULT CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci",
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;",
+		"SET character_set_client = utf8mb4",
+		"SET collation_connection = utf8mb4_general_ci",
+		"INSERT INTO `products` VALUES (1,'café','€5'),(2,'naïve','CHARACTER SET latin1'),(3,'Straße','0');",
+	} {
+		if !strings.Contains(out, s) {
+			t.Errorf("the transcoded dump lacks %q:\n%s", s, out)
+		}
+	}
+}
+
+func TestConvertCharsetFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		dump    string
+		opt     sqlFilterOptions
+		wantErr string
+	}{
+		{
+			name:    "collation without equivalent",
+			dump:    "CREATE TABLE `t` (`c` text) DEFAULT CHARSET=latin1 COLLATE=latin1_unknown_ci;\n",
+			opt:     sqlFilterOptions{convertCharset: CharsetConversionLatin1},
+			wantErr: "line 1: no utf8mb4 equivalent of collation latin1_unknown_ci",
+		},
+		{
+			// the bytes of a utf8mb4 connection would be encoded twice
+			name:    "data of another connection charset",
+			dump:    "/*!40101 SET NAMES utf8mb4 */;\nINSERT INTO `t` VALUES ('caf\xc3\xa9');\n",
+			opt:     sqlFilterOptions{convertCharset: CharsetConversionLatin1, transcodeData: true},
+			wantErr: "line 1: the dump was taken with a utf8mb4 connection, its data is not latin1, restore it without --transcode-data",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := filterSQL(strings.NewReader(tt.dump), &out, tt.opt)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("filterSQL() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateCharsetConversion(t *testing.T) {
+	tests := []struct {
+		conversion string
+		wantErr    string
+	}{
+		{conversion: ""},
+		{conversion: CharsetConversionLatin1},
+		{conversion: "utf8mb4:latin1", wantErr: "unsupported charset conversion from utf8mb4 to latin1, only latin1:utf8mb4 is supported"},
+		{conversion: "latin2:utf8mb4", wantErr: "unsupported charset conversion from latin2 to utf8mb4"},
+		{conversion: "latin1", wantErr: "invalid charset conversion \"latin1\", must be given as <from>:<to>"},
+		{conversion: "latin1:", wantErr: "invalid charset conversion"},
+	}
+	for _, tt := range tests {
+		err := validateCharsetConversion(tt.conversion)
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("validateCharsetConversion(%q) error = %v, want %q", tt.conversion, err, tt.wantErr)
+		}
+	}
+}
+
+func TestTranscodeLatin1(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "plain ascii", want: "plain ascii"},
+		{in: "caf\xe9 \xff", want: "café ÿ"},
+		{in: "\x80 \x85 \x99 \x9f", want: "€ … ™ Ÿ"},
+		// the bytes left undefined by Windows-1252 are the C1 control characters
+		{in: "\x81\x8d\x8f\x90\x9d", want: "\u0081\u008d\u008f\u0090\u009d"},
+	}
+	for _, tt := range tests {
+		if got := transcodeLatin1(tt.in); got != tt.want {
+			t.Errorf("transcodeLatin1(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"k8s.io/klog/v2"
+	"stash.appscode.dev/apimachinery/pkg/restic"
+)
+
+const (
+	ChecksumCMD = "checksum-dump"
+
+	// ChecksumFileName holds the SHA-256 of the dump files in the format of sha256sum, so that sha256sum -c checks them
+	ChecksumFileName = "dump.sha256"
+	// the SHA-256 of the dump file of a per database snapshot
+	ChecksumTagPrefix = "sha256="
+)
+
+// DumpChecksums holds the SHA-256 of the dump files as stored, i.e. after compression, by file name
+type DumpChecksums map[string]string
+
+func checksumFile(dumpdir string) string {
+	return filepath.Join(dumpdir, ChecksumFileName)
+}
+
+func (checksums DumpChecksums) writeToFile(fileName string) error {
+	names := make([]string, 0, len(checksums))
+	for name := range checksums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s  %s\n", checksums[name], name)
+	}
+	return os.WriteFile(fileName, []byte(b.String()), 0o644)
+}
+
+// NewCmdChecksumDump returns the hidden command printing the SHA-256 of the dump read from stdin.
+// It is run after restic to verify a dump before it is restored.
+func NewCmdChecksumDump() *cobra.Command {
+	return &cobra.Command{
+		Use:               ChecksumCMD,
+		Short:             "Prints the SHA-256 of the dump read from stdin",
+		Hidden:            true,
+		DisableAutoGenTag: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			digest, err := sha256Reader(bufio.NewReader(os.Stdin))
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintln(os.Stdout, digest)
+			return err
+		},
+	}
+}
+
+// sha256Reader returns the hex encoded SHA-256 of everything read from r
+func sha256Reader(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checksumCommand returns the command printing the SHA-256 of the dump stream
+func checksumCommand() (*restic.Command, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate the plugin binary to checksum the dump: %w", err)
+	}
+	return &restic.Command{Name: self, Args: []interface{}{ChecksumCMD}}, nil
+}
+
+// verifyDumpChecksum reads the dump of the database from the snapshot and compares its SHA-256
+// with the one recorded at backup time, before anything is restored
+func verifyDumpChecksum(resticWrapper *restic.ResticWrapper, dumpOptions restic.DumpOptions, db string) error {
+	snapshot, err := findSnapshot(resticWrapper, dumpOptions, db)
+	if err != nil {
+		return err
+	}
+	expected, ok := snapshotTagValue(snapshot, ChecksumTagPrefix)
+	if !ok {
+		return fmt.Errorf("snapshot %s has no checksum, it was taken before the checksums were recorded", snapshot.ID)
+	}
+
+	checksum, err := checksumCommand()
+	if err != nil {
+		return err
+	}
+	dumpOptions.StdoutPipeCommands = []restic.Command{*checksum}
+	if dumpOptions.SourceHost == "" {
+		dumpOptions.SourceHost = dumpOptions.Host
+	}
+	output, err := resticWrapper.DumpOnce(dumpOptions)
+	if err != nil {
+		return fmt.Errorf("failed to read the dump to verify its checksum: %w", err)
+	}
+	if actual := strings.TrimSpace(string(output)); actual != expected {
+		return fmt.Errorf("checksum mismatch for the dump of database %s: recorded %s, got %s", db, expected, actual)
+	}
+	klog.Infof("The checksum of the dump of database %s matches the one recorded at backup time", db)
+	return nil
+}
@@ -0,0 +1,112 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	api_v1beta1 "stash.appscode.dev/apimachinery/apis/stash/v1beta1"
+)
+
+func TestDumpChecksum(t *testing.T) {
+	dump := filepath.Join(t.TempDir(), "dump.sql")
+	if err := os.WriteFile(dump, sampleDump(100), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	opt := newTestBackupOptions()
+	opt.compression = CompressionGzip
+	session := newFakeSession(t, opt, "")
+	session.cmd.Name = fakeCommand(t, `cat `+dump)
+	dumpdir := t.TempDir()
+	for _, db := range []string{"shop", "crm"} {
+		if _, err := opt.dumpDatabase(session, db, opt.databaseDumpFile(dumpdir, db)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the checksum is the one of the file as stored, i.e. compressed
+	var want strings.Builder
+	for _, db := range []string{"crm", "shop"} {
+		data, err := os.ReadFile(opt.databaseDumpFile(dumpdir, db))
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := filepath.Base(opt.databaseDumpFile(dumpdir, db))
+		if got := opt.dumpChecksums[name]; got != sha256Hex(data) {
+			t.Errorf("the checksum of %s is %s, want %s", name, got, sha256Hex(data))
+		}
+		want.WriteString(sha256Hex(data) + "  " + name + "\n")
+	}
+	if err := opt.dumpChecksums.writeToFile(checksumFile(dumpdir)); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(checksumFile(dumpdir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != want.String() {
+		t.Errorf("%s holds:\n%s\nwant:\n%s", ChecksumFileName, data, want.String())
+	}
+}
+
+func TestVerifyDumpChecksum(t *testing.T) {
+	dump := []byte("INSERT INTO orders VALUES (1);\n")
+	tests := []struct {
+		name    string
+		stored  []byte
+		tags    []string
+		wantErr string
+	}{
+		{name: "untouched dump", stored: dump, tags: []string{"--tag", ChecksumTagPrefix + sha256Hex(dump)}},
+		{name: "tampered dump", stored: []byte("DROP TABLE orders;\n"), tags: []string{"--tag", ChecksumTagPrefix + sha256Hex(dump)}, wantErr: "checksum mismatch for the dump of database shop"},
+		{name: "checksum not recorded", stored: dump, wantErr: "has no checksum"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := newTestRestoreOptions()
+			opt.verifyChecksum = true
+			client, applied := fakeClientCommand(t)
+			session := newFakeSession(t, opt, client)
+			resticWrapper, _ := newFakeRestic(t, opt, session)
+			dumpfile := opt.databaseDumpFile(filepath.Join(opt.setupOptions.ScratchDir, MariaDBDumpDir), "shop")
+			storeFakeSnapshot(t, resticWrapper, dumpfile, tt.stored, append([]string{"--tag", DatabaseTagPrefix + "shop"}, tt.tags...)...)
+
+			err := opt.restoreDatabaseSnapshot(context.Background(), session, resticWrapper, "shop", opt.sqlFilterOptions, "", api_v1beta1.TargetRef{})
+			data, readErr := os.ReadFile(applied)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("restoreDatabaseSnapshot() error = %v, want %q", err, tt.wantErr)
+				}
+				// the dump is verified before anything is replayed
+				if readErr == nil {
+					t.Errorf("the restore applied %q", data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != string(dump) {
+				t.Errorf("the restore applied %q, want %q", data, dump)
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/spf13/cobra"
+	"stash.appscode.dev/apimachinery/pkg/restic"
+)
+
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+
+	GzipCMD = "gzip"
+	ZstdCMD = "zstd"
+
+	DecompressCMD = "decompress"
+)
+
+// the magic bytes starting the compressed streams, the dumps are recognized by them
+// whatever their file name, so that dumps made by other tools can be restored as well
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// compressionLevels are the bounds of the compression levels of each algorithm
+var compressionLevels = map[string][2]int{
+	CompressionGzip: {gzip.BestSpeed, gzip.BestCompression},
+	CompressionZstd: {1, 19},
+}
+
+var compressionExtensions = map[string]string{
+	CompressionNone: "",
+	CompressionGzip: ".gz",
+	CompressionZstd: ".zst",
+}
+
+func validateCompression(algo string) error {
+	if _, ok := compressionExtensions[algo]; !ok {
+		return fmt.Errorf("unsupported compression %q, must be one of %s, %s or %s", algo, CompressionNone, CompressionGzip, CompressionZstd)
+	}
+	return nil
+}
+
+// validateCompressionLevel checks the level is supported by algo, 0 selects the default level of the algorithm
+func validateCompressionLevel(algo string, level int) error {
+	if level == 0 {
+		return nil
+	}
+	bounds, ok := compressionLevels[algo]
+	if !ok {
+		return fmt.Errorf("compression level can not be set without compression")
+	}
+	if level < bounds[0] || level > bounds[1] {
+		return fmt.Errorf("invalid %s compression level %d, must be between %d and %d", algo, level, bounds[0], bounds[1])
+	}
+	return nil
+}
+
+// compressionLevelArgs returns the flag setting the level of the compression command, if any
+func compressionLevelArgs(level int) []interface{} {
+	if level == 0 {
+		return nil
+	}
+	return []interface{}{fmt.Sprintf("-%d", level)}
+}
+
+// compressionExtension returns the file name extension of a dump compressed with algo
+func compressionExtension(algo string) string {
+	return compressionExtensions[algo]
+}
+
+// newCompressWriter wraps w so that everything written is compressed with algo at level (0 for the default level).
+// The returned writer must be closed to flush the compressed stream.
+func newCompressWriter(w io.Writer, algo string, level int) (io.WriteCloser, error) {
+	switch algo {
+	case CompressionNone, "":
+		return nopWriteCloser{w}, nil
+	case CompressionGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case CompressionZstd:
+		args := []string{"-c", "-q"}
+		if level != 0 {
+			args = append(args, fmt.Sprintf("-%d", level))
+		}
+		return newCommandWriter(w, ZstdCMD, args...)
+	}
+	return nil, validateCompression(algo)
+}
+
+// compressCommand returns the command compressing its stdin with algo at level (0 for the default level),
+// or nil if algo does not compress
+func compressCommand(algo string, level int) *restic.Command {
+	switch algo {
+	case CompressionGzip:
+		return &restic.Command{Name: GzipCMD, Args: append([]interface{}{"-c"}, compressionLevelArgs(level)...)}
+	case CompressionZstd:
+		return &restic.Command{Name: ZstdCMD, Args: append([]interface{}{"-c", "-q"}, compressionLevelArgs(level)...)}
+	}
+	return nil
+}
+
+// detectCompression returns the compression of a stream from its first bytes
+func detectCompression(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		return CompressionGzip
+	case bytes.HasPrefix(header, zstdMagic):
+		return CompressionZstd
+	}
+	return CompressionNone
+}
+
+// decompressStream copies r into w, decompressing it when it starts with the magic bytes of gzip or zstd.
+// A plain stream is copied unchanged.
+func decompressStream(w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	switch detectCompression(header) {
+	case CompressionGzip:
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("invalid gzip dump: %w", err)
+		}
+		// a truncated stream fails with an unexpected EOF instead of being restored partially
+		if _, err = io.Copy(w, zr); err != nil {
+			return fmt.Errorf("failed to decompress the gzip dump: %w", err)
+		}
+		return zr.Close()
+	case CompressionZstd:
+		// the standard library has no zstd decoder
+		cmd := exec.Command(ZstdCMD, "-d", "-c", "-q")
+		cmd.Stdin = br
+		cmd.Stdout = w
+		cmd.Stderr = os.Stderr
+		if err = cmd.Run(); err != nil {
+			return fmt.Errorf("failed to decompress the zstd dump with %s: %w", ZstdCMD, err)
+		}
+		return nil
+	}
+	_, err = io.Copy(w, br)
+	return err
+}
+
+// NewCmdDecompress returns the hidden command decompressing a dump read from stdin into stdout.
+// It is inserted by the restore command into the pipeline right after restic.
+func NewCmdDecompress() *cobra.Command {
+	return &cobra.Command{
+		Use:               DecompressCMD,
+		Short:             "Decompresses a gzip or zstd dump read from stdin, plain dumps are passed through",
+		Hidden:            true,
+		DisableAutoGenTag: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			out := bufio.NewWriter(os.Stdout)
+			if err := decompressStream(out, os.Stdin); err != nil {
+				return err
+			}
+			return out.Flush()
+		},
+	}
+}
+
+// decompressCommand returns the command decompressing the dump stream according to its magic bytes
+func decompressCommand() (*restic.Command, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate the plugin binary to decompress the dump: %w", err)
+	}
+	return &restic.Command{Name: self, Args: []interface{}{DecompressCMD}}, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// commandWriter feeds everything written to it into the stdin of an external command
+// whose stdout is written to the underlying writer
+type commandWriter struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+}
+
+func newCommandWriter(w io.Writer, name string, args ...string) (*commandWriter, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %s: %w", name, err)
+	}
+	return &commandWriter{cmd: cmd, stdin: stdin}, nil
+}
+
+func (cw *commandWriter) Write(p []byte) (int, error) {
+	return cw.stdin.Write(p)
+}
+
+func (cw *commandWriter) Close() error {
+	if err := cw.stdin.Close(); err != nil {
+		return err
+	}
+	return cw.cmd.Wait()
+}
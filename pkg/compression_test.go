@@ -0,0 +1,248 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+
+	"stash.appscode.dev/apimachinery/pkg/restic"
+)
+
+// sampleDump returns a dump of a table with the given number of rows
+func sampleDump(rows int) []byte {
+	var b strings.Builder
+	b.WriteString("-- MariaDB dump 10.19\n--\n-- Host: db    Database: shop\n\nUSE `shop`;\n")
+	b.WriteString("CREATE TABLE `orders` (\n  `id` int NOT NULL,\n  `note` varchar(64),\n  PRIMARY KEY (`id`)\n);\n")
+	for i := 0; i < rows; i++ {
+		fmt.Fprintf(&b, "INSERT INTO `orders` VALUES (%d,'order %d of the customer \\'%d\\'');\n", i, i, i%97)
+	}
+	b.WriteString("-- Dump completed on 2024-01-01 10:00:00\n")
+	return []byte(b.String())
+}
+
+// compress returns data compressed with algo at level
+func compress(t testing.TB, data []byte, algo string, level int) []byte {
+	t.Helper()
+	var compressed bytes.Buffer
+	w, err := newCompressWriter(&compressed, algo, level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return compressed.Bytes()
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	dump := sampleDump(10000)
+	for _, algo := range []string{CompressionNone, CompressionGzip} {
+		t.Run(algo, func(t *testing.T) {
+			compressed := compress(t, dump, algo, 0)
+			if algo != CompressionNone && len(compressed) >= len(dump) {
+				t.Errorf("compressed dump has %d bytes, the dump %d", len(compressed), len(dump))
+			}
+			var restored bytes.Buffer
+			if err := decompressStream(&restored, bytes.NewReader(compressed)); err != nil {
+				t.Fatalf("decompressStream() error = %v", err)
+			}
+			if !bytes.Equal(restored.Bytes(), dump) {
+				t.Errorf("the restored dump differs from the dump")
+			}
+		})
+	}
+}
+
+func TestCompressionLevelRoundTrip(t *testing.T) {
+	dump := sampleDump(10000)
+	for _, algo := range []string{CompressionGzip, CompressionZstd} {
+		if _, err := exec.LookPath(ZstdCMD); algo == CompressionZstd && err != nil {
+			t.Logf("skipping %s, %s is not installed", algo, ZstdCMD)
+			continue
+		}
+		bounds := compressionLevels[algo]
+		for _, level := range []int{bounds[0], bounds[1]} {
+			t.Run(fmt.Sprintf("%s level %d", algo, level), func(t *testing.T) {
+				if err := validateCompressionLevel(algo, level); err != nil {
+					t.Fatalf("validateCompressionLevel() error = %v", err)
+				}
+				compressed := compress(t, dump, algo, level)
+				var restored bytes.Buffer
+				if err := decompressStream(&restored, bytes.NewReader(compressed)); err != nil {
+					t.Fatalf("decompressStream() error = %v", err)
+				}
+				if !bytes.Equal(restored.Bytes(), dump) {
+					t.Errorf("the restored dump differs from the dump")
+				}
+			})
+		}
+	}
+}
+
+func TestValidateCompressionLevel(t *testing.T) {
+	tests := []struct {
+		algo    string
+		level   int
+		wantErr string
+	}{
+		{algo: CompressionGzip, level: 0},
+		{algo: CompressionGzip, level: 1},
+		{algo: CompressionGzip, level: 9},
+		{algo: CompressionGzip, level: 10, wantErr: "invalid gzip compression level 10, must be between 1 and 9"},
+		{algo: CompressionGzip, level: -1, wantErr: "invalid gzip compression level -1, must be between 1 and 9"},
+		{algo: CompressionZstd, level: 19},
+		{algo: CompressionZstd, level: 20, wantErr: "invalid zstd compression level 20, must be between 1 and 19"},
+		{algo: CompressionNone, level: 0},
+		{algo: CompressionNone, level: 3, wantErr: "compression level can not be set without compression"},
+	}
+	for _, tt := range tests {
+		err := validateCompressionLevel(tt.algo, tt.level)
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+			t.Errorf("validateCompressionLevel(%s, %d) error = %v, want %q", tt.algo, tt.level, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCompressCommand(t *testing.T) {
+	tests := []struct {
+		algo  string
+		level int
+		want  *restic.Command
+	}{
+		{algo: CompressionNone},
+		{algo: CompressionGzip, want: &restic.Command{Name: GzipCMD, Args: []interface{}{"-c"}}},
+		{algo: CompressionGzip, level: 9, want: &restic.Command{Name: GzipCMD, Args: []interface{}{"-c", "-9"}}},
+		{algo: CompressionZstd, level: 19, want: &restic.Command{Name: ZstdCMD, Args: []interface{}{"-c", "-q", "-19"}}},
+	}
+	for _, tt := range tests {
+		if got := compressCommand(tt.algo, tt.level); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("compressCommand(%s, %d) = %v, want %v", tt.algo, tt.level, got, tt.want)
+		}
+	}
+}
+
+// compressWithTool compresses data with the command line tool of algo, the way dumps are compressed by other tools
+func compressWithTool(t *testing.T, data []byte, algo string) []byte {
+	t.Helper()
+	tool := map[string]string{CompressionGzip: GzipCMD, CompressionZstd: ZstdCMD}[algo]
+	if _, err := exec.LookPath(tool); err != nil {
+		t.Skipf("%s is not installed", tool)
+	}
+	cmd := exec.Command(tool, "-c")
+	cmd.Stdin = bytes.NewReader(data)
+	compressed, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return compressed
+}
+
+func TestDecompressStream(t *testing.T) {
+	dump := sampleDump(1000)
+	tests := []struct {
+		name    string
+		input   func(t *testing.T) []byte
+		wantErr string
+	}{
+		{
+			name:  "plain",
+			input: func(t *testing.T) []byte { return dump },
+		},
+		{
+			name:  "gzip",
+			input: func(t *testing.T) []byte { return compressWithTool(t, dump, CompressionGzip) },
+		},
+		{
+			name:  "zstd",
+			input: func(t *testing.T) []byte { return compressWithTool(t, dump, CompressionZstd) },
+		},
+		{
+			name: "truncated gzip",
+			input: func(t *testing.T) []byte {
+				compressed := compressWithTool(t, dump, CompressionGzip)
+				return compressed[:len(compressed)/2]
+			},
+			wantErr: "failed to decompress the gzip dump: unexpected EOF",
+		},
+		{
+			name:    "gzip header only",
+			input:   func(t *testing.T) []byte { return gzipMagic },
+			wantErr: "invalid gzip dump",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var restored bytes.Buffer
+			err := decompressStream(&restored, bytes.NewReader(tt.input(t)))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("decompressStream() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decompressStream() error = %v", err)
+			}
+			if !bytes.Equal(restored.Bytes(), dump) {
+				t.Errorf("the restored dump differs from the dump")
+			}
+		})
+	}
+}
+
+func TestDecompressEmptyStream(t *testing.T) {
+	var restored bytes.Buffer
+	if err := decompressStream(&restored, bytes.NewReader(nil)); err != nil || restored.Len() != 0 {
+		t.Errorf("decompressStream() = %q, %v, want an empty stream", restored.String(), err)
+	}
+}
+
+func TestCompressionExtension(t *testing.T) {
+	for algo, want := range map[string]string{CompressionNone: "", CompressionGzip: ".gz", CompressionZstd: ".zst"} {
+		if got := "dumpfile.sql" + compressionExtension(algo); got != "dumpfile.sql"+want {
+			t.Errorf("file name of a %s dump = %s, want dumpfile.sql%s", algo, got, want)
+		}
+	}
+}
+
+// BenchmarkCompressionRoundTrip compares the dump and restore of a plain and a gzip dump
+func BenchmarkCompressionRoundTrip(b *testing.B) {
+	dump := sampleDump(10000)
+	for _, algo := range []string{CompressionNone, CompressionGzip} {
+		b.Run(algo, func(b *testing.B) {
+			b.SetBytes(int64(len(dump)))
+			var restored bytes.Buffer
+			for i := 0; i < b.N; i++ {
+				restored.Reset()
+				if err := decompressStream(&restored, bytes.NewReader(compress(b, dump, algo, 0))); err != nil {
+					b.Fatal(err)
+				}
+				if !bytes.Equal(restored.Bytes(), dump) {
+					b.Fatal("the restored dump differs from the dump")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+
+	"stash.appscode.dev/apimachinery/pkg/restic"
+
+	"github.com/spf13/cobra"
+	"gomodules.xyz/flags"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	appcatalog "kmodules.xyz/custom-resources/apis/appcatalog/v1alpha1"
+	appcatalog_cs "kmodules.xyz/custom-resources/client/clientset/versioned"
+)
+
+// ConnectionResult is the outcome of a connection test
+type ConnectionResult struct {
+	Connected     bool   `json:"connected"`
+	Host          string `json:"host,omitempty"`
+	ServerVersion string `json:"serverVersion,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+func NewCmdTestConnection() *cobra.Command {
+	var (
+		masterURL      string
+		kubeconfigPath string
+		opt            = mariadbOptions{
+			setupOptions: restic.SetupOptions{
+				ScratchDir: restic.DefaultScratchDir,
+			},
+			waitTimeout:            300,
+			readinessPollInterval:  DefaultReadinessPollInterval,
+			readinessBackoffFactor: 1,
+			clientCmd:              MariaDBRestoreCMD,
+			defaultCharset:         DefaultCharset,
+			maxAllowedPacket:       DefaultMaxAllowedPacket,
+			tlsOptions: tlsOptions{
+				verifyServerCert: true,
+			},
+			credentialOptions: credentialOptions{
+				userKey:     MariaDBUser,
+				passwordKey: MariaDBPassword,
+				authMode:    AuthModePassword,
+			},
+		}
+	)
+
+	cmd := &cobra.Command{
+		Use:               "test-connection",
+		Short:             "Checks the connectivity, credentials and TLS settings of the database of an AppBinding",
+		DisableAutoGenTag: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			flags.EnsureRequiredFlags(cmd, "appbinding")
+
+			config, err := clientcmd.BuildConfigFromFlags(masterURL, kubeconfigPath)
+			if err != nil {
+				return err
+			}
+			opt.config = config
+
+			opt.kubeClient, err = kubernetes.NewForConfig(config)
+			if err != nil {
+				return err
+			}
+			opt.catalogClient, err = appcatalog_cs.NewForConfig(config)
+			if err != nil {
+				return err
+			}
+
+			appBinding, err := opt.catalogClient.AppcatalogV1alpha1().AppBindings(opt.appBindingNamespace).Get(cmd.Context(), opt.appBindingName, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+
+			result := opt.TestConnection(appBinding)
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if err = encoder.Encode(result); err != nil {
+				return err
+			}
+			if !result.Connected {
+				return errors.New(result.Error)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&opt.myArgs, "mariadb-args", opt.myArgs, "Additional arguments")
+	cmd.Flags().DurationVar(&opt.connectTimeout, "connect-timeout", opt.connectTimeout, "Timeout to connect to the database, rounded up to seconds (0 uses the client default)")
+	cmd.Flags().StringVar(&opt.defaultCharset, "default-charset", opt.defaultCharset, "Character set of the connections to the database (empty uses the client default)")
+	cmd.Flags().StringVar(&opt.maxAllowedPacket, "max-allowed-packet", opt.maxAllowedPacket, "Largest packet exchanged with the database, in bytes or with a K, M or G suffix (empty uses the client default)")
+	cmd.Flags().StringVar(&opt.clientCmd, "client-binary", opt.clientCmd, "Name or path of the client binary used to connect to the database (i.e. mysql)")
+
+	cmd.Flags().BoolVar(&opt.tlsOptions.verifyServerCert, "tls-verify-server-cert", opt.tlsOptions.verifyServerCert, "Verify the server certificate against the CA bundle of the AppBinding (disable for self-signed internal hosts)")
+	cmd.Flags().StringVar(&opt.tlsOptions.minVersion, "tls-min-version", opt.tlsOptions.minVersion, "Minimum TLS version used to connect to the database (i.e. TLSv1.2)")
+
+	cmd.Flags().StringVar(&opt.credentialOptions.userKey, "user-key", opt.credentialOptions.userKey, "Key of the AppBinding secret holding the database username")
+	cmd.Flags().StringVar(&opt.credentialOptions.passwordKey, "password-key", opt.credentialOptions.passwordKey, "Key of the AppBinding secret holding the database password")
+	cmd.Flags().BoolVar(&opt.credentialOptions.useDefaultsFile, "use-defaults-file", opt.credentialOptions.useDefaultsFile, "Pass the password through a --defaults-extra-file instead of the MYSQL_PWD environment variable")
+	cmd.Flags().StringVar(&opt.credentialOptions.credentialsDir, "credentials-dir", opt.credentialOptions.credentialsDir, "Directory of mounted credential files named after --user-key and --password-key, read instead of the AppBinding secret")
+	cmd.Flags().StringVar(&opt.credentialOptions.authMode, "auth-mode", opt.credentialOptions.authMode, "Authentication of the database user, password (from the AppBinding secret) or aws-iam (RDS/Aurora IAM authentication token, requires TLS)")
+	cmd.Flags().StringVar(&opt.credentialOptions.awsRegion, "aws-region", opt.credentialOptions.awsRegion, "AWS region of the database for IAM authentication (defaults to AWS_REGION)")
+	cmd.Flags().StringVar(&opt.credentialOptions.awsEndpoint, "aws-endpoint", opt.credentialOptions.awsEndpoint, "host:port the IAM authentication token is signed for (defaults to the host and port of the AppBinding)")
+	cmd.Flags().StringToStringVar(&opt.extraEnv, "extra-env", opt.extraEnv, "Environment variables set for the database clients, given as <name>=<value> (i.e. LC_ALL=C.UTF-8). "+EnvMariaDBPassword+" and "+EnvMariaDBLoginFile+" can not be set")
+	cmd.Flags().StringVar(&opt.proxy.address, "socks5-proxy", opt.proxy.address, "Connect to the database through this SOCKS5 proxy, given as <host>:<port>")
+	cmd.Flags().StringVar(&opt.proxy.user, "socks5-user", opt.proxy.user, "User authenticating to the SOCKS5 proxy")
+	cmd.Flags().StringVar(&opt.proxy.password, "socks5-password", opt.proxy.password, "Password authenticating to the SOCKS5 proxy (defaults to "+EnvSOCKS5Password+")")
+
+	cmd.Flags().StringVar(&masterURL, "master", masterURL, "The address of the Kubernetes API server (overrides any value in kubeconfig)")
+	cmd.Flags().StringVar(&kubeconfigPath, "kubeconfig", kubeconfigPath, "Path to kubeconfig file with authorization information (the master location is set by the master flag).")
+	cmd.Flags().StringVar(&opt.appBindingName, "appbinding", opt.appBindingName, "Name of the app binding")
+	cmd.Flags().StringVar(&opt.appBindingNamespace, "appbinding-namespace", opt.appBindingNamespace, "Namespace of the app binding")
+	cmd.Flags().StringVar(&opt.setupOptions.ScratchDir, "scratch-dir", opt.setupOptions.ScratchDir, "Temporary directory of the dumps, TLS files and defaults files, created if missing. It must be writable, i.e. an emptyDir volume on a read-only root filesystem")
+
+	return cmd
+}
+
+// TestConnection connects once to the database of the AppBinding with the credentials and TLS settings
+// a backup or a restore would use, and reports the server version. It does not wait for the database.
+func (opt *mariadbOptions) TestConnection(appBinding *appcatalog.AppBinding) *ConnectionResult {
+	result := &ConnectionResult{}
+	err := opt.testConnection(appBinding, result)
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func (opt *mariadbOptions) testConnection(appBinding *appcatalog.AppBinding, result *ConnectionResult) error {
+	err := opt.validateConnectionOptions()
+	if err != nil {
+		return err
+	}
+	err = checkBinaries(opt.clientCmd)
+	if err != nil {
+		return err
+	}
+
+	session, err := opt.prepareSession(appBinding, opt.clientCmd, opt.setupOptions.ScratchDir)
+	defer session.cleanup()
+	if err != nil {
+		return err
+	}
+
+	err = session.pingHosts()
+	if err != nil {
+		return err
+	}
+	result.Connected = true
+	result.Host = session.host()
+
+	version, err := session.serverVersion()
+	if err != nil {
+		return err
+	}
+	result.ServerVersion = version.raw
+	return nil
+}
@@ -0,0 +1,120 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTestConnection(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   ConnectionResult
+		// the database is probed once, without waiting for it, then its version is queried
+		wantRuns int
+	}{
+		{
+			name: "connected",
+			script: `case "$*" in
+*"SELECT VERSION();"*) echo 10.11.6-MariaDB-log ;;
+esac`,
+			want:     ConnectionResult{Connected: true, Host: "db.demo.svc", ServerVersion: "10.11.6-MariaDB-log"},
+			wantRuns: 2,
+		},
+		{
+			name: "access denied",
+			script: `echo "ERROR 1045 (28000): Access denied for user 'root'@'10.0.0.7' (using password: YES)" >&2
+exit 1`,
+			want:     ConnectionResult{Error: "ERROR 1045 (28000): Access denied for user 'root'@'10.0.0.7' (using password: YES)"},
+			wantRuns: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runs := filepath.Join(t.TempDir(), "runs")
+			opt := newTestBackupOptions()
+			opt.clientCmd = fakeCommand(t, fmt.Sprintf("echo run >> %s\n%s", runs, tt.script))
+			opt.setupOptions.ScratchDir = t.TempDir()
+
+			result := opt.TestConnection(newTestAppBinding(opt))
+			if result.Connected != tt.want.Connected || result.Host != tt.want.Host || result.ServerVersion != tt.want.ServerVersion {
+				t.Errorf("TestConnection() = %+v, want %+v", *result, tt.want)
+			}
+			if !strings.Contains(result.Error, tt.want.Error) || (tt.want.Error == "") != (result.Error == "") {
+				t.Errorf("TestConnection() error = %q, want %q", result.Error, tt.want.Error)
+			}
+			if n := countRuns(t, runs); n != tt.wantRuns {
+				t.Errorf("the client ran %d times, want %d", n, tt.wantRuns)
+			}
+		})
+	}
+}
+
+func TestFailoverToTheNextHost(t *testing.T) {
+	calls := filepath.Join(t.TempDir(), "calls")
+	opt := newTestBackupOptions()
+	opt.clientCmd = fakeCommand(t, `echo "$@" >> `+calls+`
+case " $* " in
+*" -h db-0.demo.svc "*) echo "ERROR 2002 (HY000): Can't connect to server on 'db-0.demo.svc' (115)" >&2; exit 1 ;;
+esac`)
+	opt.dumpCmd = opt.clientCmd
+	opt.setupOptions.ScratchDir = t.TempDir()
+	appBinding := newTestAppBinding(opt)
+	url := "mysql://db-0.demo.svc,db-1.demo.svc,db-2.demo.svc:3306/"
+	appBinding.Spec.ClientConfig.URL = &url
+	session, err := opt.prepareSession(appBinding, opt.dumpCmd, opt.setupOptions.ScratchDir)
+	defer session.cleanup()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = session.waitForDBReady(context.Background(), 5, opt.readinessBackoff()); err != nil {
+		t.Fatal(err)
+	}
+	if host := session.host(); host != "db-1.demo.svc" {
+		t.Errorf("selected host = %s, want db-1.demo.svc", host)
+	}
+	if _, err = opt.dumpDatabase(session, "shop", filepath.Join(t.TempDir(), "shop.sql")); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	var hosts []string
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		for i, field := range fields {
+			if field == "-h" {
+				hosts = append(hosts, fields[i+1])
+			}
+		}
+	}
+	// the third host is never tried, the dump connects to the selected one
+	if want := []string{"db-0.demo.svc", "db-1.demo.svc", "db-1.demo.svc"}; !reflect.DeepEqual(hosts, want) {
+		t.Errorf("the client connected to %v, want %v", hosts, want)
+	}
+}
@@ -0,0 +1,221 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"k8s.io/klog/v2"
+	"stash.appscode.dev/apimachinery/pkg/restic"
+)
+
+const (
+	DatabaseCharsetsFileName = "database-charsets.json"
+	// the charset of the database of a per database snapshot, as <charset>/<collation>
+	CharsetTagPrefix = "charset="
+)
+
+// charsetNameRegex matches the names of the character sets and collations, which are not quoted in the statements
+var charsetNameRegex = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// DatabaseCharset is the default character set and collation of a database
+type DatabaseCharset struct {
+	Charset   string `json:"charset,omitempty"`
+	Collation string `json:"collation,omitempty"`
+}
+
+// DatabaseCharsets holds the charset of each dumped database, it is stored next to the dumps
+// so that a restore can create the databases a dump does not create
+type DatabaseCharsets map[string]DatabaseCharset
+
+// databaseCharsetsFile returns the path of the database charsets written into the dump directory
+func databaseCharsetsFile(dumpdir string) string {
+	return filepath.Join(dumpdir, DatabaseCharsetsFileName)
+}
+
+func validateCharsetName(kind, name string) error {
+	if name != "" && !charsetNameRegex.MatchString(name) {
+		return fmt.Errorf("invalid %s %q", kind, name)
+	}
+	return nil
+}
+
+// databaseCharsets queries the default charset and collation of the databases
+func (session *sessionWrapper) databaseCharsets(databases []string) (DatabaseCharsets, error) {
+	charsets := DatabaseCharsets{}
+	if len(databases) == 0 {
+		return charsets, nil
+	}
+	schemas := make([]string, 0, len(databases))
+	for _, db := range databases {
+		schemas = append(schemas, quoteString(db))
+	}
+	output, err := session.executeQuery(fmt.Sprintf("SELECT SCHEMA_NAME, DEFAULT_CHARACTER_SET_NAME, DEFAULT_COLLATION_NAME FROM information_schema.SCHEMATA WHERE SCHEMA_NAME IN (%s);", strings.Join(schemas, ",")))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the charsets of the databases: %w", err)
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 {
+			continue
+		}
+		charsets[unescapeBatchValue(fields[0])] = DatabaseCharset{Charset: strings.TrimSpace(fields[1]), Collation: strings.TrimSpace(fields[2])}
+	}
+	return charsets, nil
+}
+
+// tagValue formats the charset as the value of the charset tag of a snapshot
+func (charset DatabaseCharset) tagValue() string {
+	return charset.Charset + "/" + charset.Collation
+}
+
+// parseCharsetTag reads the value of the charset tag of a snapshot
+func parseCharsetTag(value string) DatabaseCharset {
+	charset, collation, _ := strings.Cut(value, "/")
+	return DatabaseCharset{Charset: charset, Collation: collation}
+}
+
+func (charsets DatabaseCharsets) writeToFile(fileName string) error {
+	data, err := json.MarshalIndent(charsets, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fileName, data, 0o644)
+}
+
+// readDatabaseCharsets reads the database charsets stored in the snapshot next to the dump
+func readDatabaseCharsets(resticWrapper *restic.ResticWrapper, dumpOptions restic.DumpOptions, fileName string) (DatabaseCharsets, error) {
+	data, err := readSnapshotFile(resticWrapper, dumpOptions, fileName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the database charsets %s from the snapshot: %w", fileName, err)
+	}
+	charsets := DatabaseCharsets{}
+	if err = json.Unmarshal(data, &charsets); err != nil {
+		return nil, fmt.Errorf("failed to parse the database charsets %s: %w", fileName, err)
+	}
+	return charsets, nil
+}
+
+// createDatabaseStatement returns the statement creating db with the charset, unless it exists
+func createDatabaseStatement(db string, charset DatabaseCharset) string {
+	stmt := "CREATE DATABASE IF NOT EXISTS " + quoteIdentifier(db)
+	if charset.Charset != "" {
+		stmt += " CHARACTER SET " + charset.Charset
+	}
+	if charset.Collation != "" {
+		stmt += " COLLATE " + charset.Collation
+	}
+	return stmt + ";"
+}
+
+// restoredDatabaseCharsets returns the databases the restore writes into, with the charset recorded at backup time.
+// The options give the charset of the databases backed up before the charsets were recorded.
+func (opt *mariadbOptions) restoredDatabaseCharsets(resticWrapper *restic.ResticWrapper) (DatabaseCharsets, error) {
+	fallback := DatabaseCharset{Charset: opt.databaseCharset, Collation: opt.databaseCollation}
+	charsets := DatabaseCharsets{}
+
+	// the snapshot of a single database records its charset as a tag
+	if databases := opt.perDatabaseRestores(); len(databases) > 0 {
+		for _, db := range databases {
+			charsets[db] = fallback
+			snapshot, err := findSnapshot(resticWrapper, opt.dumpOptions, db)
+			if err != nil {
+				return nil, err
+			}
+			if value, ok := snapshotTagValue(snapshot, CharsetTagPrefix); ok {
+				charsets[db] = parseCharsetTag(value)
+			}
+		}
+		return charsets, nil
+	}
+
+	dumpdir := filepath.Join(opt.setupOptions.ScratchDir, MariaDBDumpDir)
+	captured, err := readDatabaseCharsets(resticWrapper, opt.dumpOptions, databaseCharsetsFile(dumpdir))
+	if err != nil {
+		klog.V(4).Infof("The snapshot has no database charsets, the databases are created with the given charset. Reason: %v", err)
+		// the table manifest lists the databases of the older snapshots
+		manifest, err := readTableManifest(resticWrapper, opt.dumpOptions, tableManifestFile(dumpdir))
+		if err != nil {
+			return nil, fmt.Errorf("unable to find the databases to create: %w", err)
+		}
+		for db := range manifest {
+			charsets[db] = fallback
+		}
+	} else {
+		charsets = captured
+	}
+
+	if db := opt.sqlFilterOptions.database; db != "" {
+		charsets = DatabaseCharsets{db: charsets[db]}
+	}
+	// the databases are created under their new name
+	renamed := DatabaseCharsets{}
+	for db, charset := range charsets {
+		if to, ok := opt.sqlFilterOptions.databaseRename[db]; ok {
+			db = to
+		}
+		if charset.Charset == "" && charset.Collation == "" {
+			charset = fallback
+		}
+		renamed[db] = charset
+	}
+	return renamed, nil
+}
+
+// createMissingDatabases creates the databases of the restore that do not exist on the target,
+// for the dumps taken with --no-create-db which expect them to exist
+func (opt *mariadbOptions) createMissingDatabases(session *sessionWrapper, resticWrapper *restic.ResticWrapper) error {
+	charsets, err := opt.restoredDatabaseCharsets(resticWrapper)
+	if err != nil {
+		return err
+	}
+	existing, err := session.getDbNames(nil)
+	if err != nil {
+		return err
+	}
+
+	databases := make([]string, 0, len(charsets))
+	for db := range charsets {
+		databases = append(databases, db)
+	}
+	sort.Strings(databases)
+	for _, db := range databases {
+		if existing.has(db) {
+			klog.V(4).Infof("Database %s already exists", db)
+			continue
+		}
+		charset := charsets[db]
+		// the recorded names end up in the statement unquoted
+		if err := validateCharsetName("charset", charset.Charset); err != nil {
+			return fmt.Errorf("database %s: %w", db, err)
+		}
+		if err := validateCharsetName("collation", charset.Collation); err != nil {
+			return fmt.Errorf("database %s: %w", db, err)
+		}
+		klog.Infof("Creating database %s (charset %q, collation %q)", db, charset.Charset, charset.Collation)
+		if _, err := session.executeQuery(createDatabaseStatement(db, charset)); err != nil {
+			return fmt.Errorf("failed to create database %s: %w", db, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCreateMissingDatabases(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		data     string
+		existing string
+		database string
+		rename   map[string]string
+		want     []string
+	}{
+		{
+			name:     "recorded charsets",
+			file:     DatabaseCharsetsFileName,
+			data:     `{"shop": {"charset": "utf8mb4", "collation": "utf8mb4_unicode_ci"}, "hr": {"charset": "latin1", "collation": "latin1_swedish_ci"}, "crm": {}}`,
+			existing: "information_schema\nmysql\n",
+			want: []string{
+				"CREATE DATABASE IF NOT EXISTS `crm` CHARACTER SET utf8mb3 COLLATE utf8mb3_general_ci;",
+				"CREATE DATABASE IF NOT EXISTS `hr` CHARACTER SET latin1 COLLATE latin1_swedish_ci;",
+				"CREATE DATABASE IF NOT EXISTS `shop` CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci;",
+			},
+		},
+		{
+			name:     "existing databases",
+			file:     DatabaseCharsetsFileName,
+			data:     `{"shop": {"charset": "utf8mb4", "collation": "utf8mb4_unicode_ci"}, "hr": {"charset": "latin1", "collation": "latin1_swedish_ci"}}`,
+			existing: "information_schema\nshop\nhr\n",
+		},
+		{
+			name:     "charsets not recorded",
+			file:     TableManifestFileName,
+			data:     `{"shop": 12, "hr": 3}`,
+			existing: "shop\n",
+			want:     []string{"CREATE DATABASE IF NOT EXISTS `hr` CHARACTER SET utf8mb3 COLLATE utf8mb3_general_ci;"},
+		},
+		{
+			name:     "single database",
+			file:     DatabaseCharsetsFileName,
+			data:     `{"shop": {"charset": "utf8mb4", "collation": "utf8mb4_unicode_ci"}, "hr": {"charset": "latin1", "collation": "latin1_swedish_ci"}}`,
+			database: "hr",
+			want:     []string{"CREATE DATABASE IF NOT EXISTS `hr` CHARACTER SET latin1 COLLATE latin1_swedish_ci;"},
+		},
+		{
+			name:   "renamed database",
+			file:   DatabaseCharsetsFileName,
+			data:   `{"hr": {"charset": "latin1", "collation": "latin1_swedish_ci"}}`,
+			rename: map[string]string{"hr": "hr_copy"},
+			want:   []string{"CREATE DATABASE IF NOT EXISTS `hr_copy` CHARACTER SET latin1 COLLATE latin1_swedish_ci;"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := newTestRestoreOptions()
+			opt.databaseCharset = "utf8mb3"
+			opt.databaseCollation = "utf8mb3_general_ci"
+			opt.sqlFilterOptions.database = tt.database
+			opt.sqlFilterOptions.databaseRename = tt.rename
+			client, queries := fakeQueryClient(t, map[string]string{"SHOW DATABASES;": tt.existing, "*": ""})
+			session := newFakeSession(t, opt, client)
+			resticWrapper, _ := newFakeRestic(t, opt, session)
+			storeFakeSnapshot(t, resticWrapper, filepath.Join(opt.setupOptions.ScratchDir, MariaDBDumpDir, tt.file), []byte(tt.data))
+
+			if err := opt.createMissingDatabases(session, resticWrapper); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(queries)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the existing databases are listed first
+			want := "SHOW DATABASES;\n"
+			if len(tt.want) > 0 {
+				want += strings.Join(tt.want, "\n") + "\n"
+			}
+			if string(data) != want {
+				t.Errorf("createMissingDatabases() ran:\n%s\nwant:\n%s", data, want)
+			}
+		})
+	}
+}
+
+func TestCreateMissingDatabasesRejectsInvalidCharsets(t *testing.T) {
+	opt := newTestRestoreOptions()
+	client, queries := fakeQueryClient(t, map[string]string{"SHOW DATABASES;": "", "*": ""})
+	session := newFakeSession(t, opt, client)
+	resticWrapper, _ := newFakeRestic(t, opt, session)
+	storeFakeSnapshot(t, resticWrapper, databaseCharsetsFile(filepath.Join(opt.setupOptions.ScratchDir, MariaDBDumpDir)),
+		[]byte(`{"shop": {"charset": "utf8mb4; DROP DATABASE mysql"}}`))
+
+	if err := opt.createMissingDatabases(session, resticWrapper); err == nil || !strings.Contains(err.Error(), `invalid charset`) {
+		t.Errorf("createMissingDatabases() = %v, want an invalid charset error", err)
+	}
+	data, err := os.ReadFile(queries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "CREATE DATABASE") {
+		t.Errorf("createMissingDatabases() ran queries after an invalid charset:\n%s", data)
+	}
+}
+
+func TestCreateMissingDatabasesWithoutTheListOfDatabases(t *testing.T) {
+	opt := newTestRestoreOptions()
+	client, _ := fakeQueryClient(t, map[string]string{"SHOW DATABASES;": "", "*": ""})
+	session := newFakeSession(t, opt, client)
+	resticWrapper, _ := newFakeRestic(t, opt, session)
+	storeFakeSnapshot(t, resticWrapper, filepath.Join(opt.setupOptions.ScratchDir, MariaDBDumpDir, MariaDBDumpFile), sampleDump(1))
+
+	if err := opt.createMissingDatabases(session, resticWrapper); err == nil || !strings.Contains(err.Error(), "unable to find the databases to create") {
+		t.Errorf("createMissingDatabases() = %v, want an error", err)
+	}
+}
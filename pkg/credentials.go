@@ -0,0 +1,57 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"k8s.io/apimachinery/pkg/util/errors"
+)
+
+// credentialKeys returns the keys of the credentials read from the secret or the credentials directory.
+// The password is replaced by an IAM authentication token, only the user is read.
+func (credOpt credentialOptions) credentialKeys() []string {
+	if credOpt.authMode == AuthModeAWSIAM {
+		return []string{credOpt.userKey}
+	}
+	return []string{credOpt.userKey, credOpt.passwordKey}
+}
+
+// readCredentialFiles reads the credential files named after keys in dir, as projected by a secret volume.
+// All the files must exist and be non-empty, the trailing newline of a file written by hand is dropped.
+func readCredentialFiles(dir string, keys []string) (map[string][]byte, error) {
+	var errs []error
+	data := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		path := filepath.Join(dir, key)
+		content, err := os.ReadFile(path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to read credential file: %w", err))
+			continue
+		}
+		content = bytes.TrimRight(content, "\r\n")
+		if len(content) == 0 {
+			errs = append(errs, fmt.Errorf("credential file %s is empty", path))
+			continue
+		}
+		data[key] = content
+	}
+	return data, errors.NewAggregate(errs)
+}
@@ -0,0 +1,169 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	appcatalog "kmodules.xyz/custom-resources/apis/appcatalog/v1alpha1"
+)
+
+// writeCredentialFiles writes the files of a credentials directory, as projected by a secret volume
+func writeCredentialFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestReadCredentialFiles(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    map[string]string
+		authMode string
+		want     map[string][]byte
+		wantErrs []string
+	}{
+		{
+			name:  "projected secret",
+			files: map[string]string{"username": "root", "password": "s3cret"},
+			want:  map[string][]byte{"username": []byte("root"), "password": []byte("s3cret")},
+		},
+		{
+			name:  "written by hand",
+			files: map[string]string{"username": "root\n", "password": "s3cret \r\n"},
+			want:  map[string][]byte{"username": []byte("root"), "password": []byte("s3cret ")},
+		},
+		{
+			name:     "IAM authentication",
+			files:    map[string]string{"username": "iam_user"},
+			authMode: AuthModeAWSIAM,
+			want:     map[string][]byte{"username": []byte("iam_user")},
+		},
+		{
+			name:     "missing password",
+			files:    map[string]string{"username": "root"},
+			wantErrs: []string{"failed to read credential file", "password: no such file or directory"},
+		},
+		{
+			name:     "empty files",
+			files:    map[string]string{"username": "", "password": "\n"},
+			wantErrs: []string{"username is empty", "password is empty"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeCredentialFiles(t, tt.files)
+			credOpt := credentialOptions{userKey: MariaDBUser, passwordKey: MariaDBPassword, authMode: tt.authMode}
+			got, err := readCredentialFiles(dir, credOpt.credentialKeys())
+			if len(tt.wantErrs) > 0 {
+				for _, wantErr := range tt.wantErrs {
+					if err == nil || !strings.Contains(err.Error(), wantErr) {
+						t.Errorf("readCredentialFiles() error = %v, want %q", err, wantErr)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readCredentialFiles() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileCredentials(t *testing.T) {
+	dir := writeCredentialFiles(t, map[string]string{"db-user": "backup", "db-pass": "p4ss\n"})
+	// the AppBinding references no secret and the plugin can not read any
+	appBinding := &appcatalog.AppBinding{ObjectMeta: metav1.ObjectMeta{Name: "shop-db", Namespace: "demo"}}
+	credOpt := credentialOptions{userKey: "db-user", passwordKey: "db-pass", authMode: AuthModePassword, credentialsDir: dir}
+
+	session := newFakeSession(t, &mariadbOptions{}, "mariadb")
+	if err := session.setDatabaseCredentials(fake.NewSimpleClientset(), appBinding, t.TempDir(), credOpt); err != nil {
+		t.Fatalf("setDatabaseCredentials() error = %v", err)
+	}
+	if want := []interface{}{"-u", "backup"}; !reflect.DeepEqual(session.cmd.Args, want) {
+		t.Errorf("arguments = %v, want %v", session.cmd.Args, want)
+	}
+	if got := session.sh.Env[EnvMariaDBPassword]; got != "p4ss" {
+		t.Errorf("%s = %q, want the password of the file", EnvMariaDBPassword, got)
+	}
+
+	// the credential files replace the secret, even when the AppBinding references one
+	appBinding, kubeClient := newCredentialsAppBinding(map[string][]byte{MariaDBUser: []byte("root"), MariaDBPassword: []byte("s3cret")})
+	session = newFakeSession(t, &mariadbOptions{}, "mariadb")
+	if err := session.setDatabaseCredentials(kubeClient, appBinding, t.TempDir(), credOpt); err != nil {
+		t.Fatalf("setDatabaseCredentials() error = %v", err)
+	}
+	if !reflect.DeepEqual(session.cmd.Args, []interface{}{"-u", "backup"}) || session.sh.Env[EnvMariaDBPassword] != "p4ss" {
+		t.Errorf("the credentials are %v with the password %q, want those of the files", session.cmd.Args, session.sh.Env[EnvMariaDBPassword])
+	}
+
+	credOpt.credentialsDir = writeCredentialFiles(t, map[string]string{"db-user": "backup"})
+	session = newFakeSession(t, &mariadbOptions{}, "mariadb")
+	if err := session.setDatabaseCredentials(kubeClient, appBinding, t.TempDir(), credOpt); err == nil || !strings.Contains(err.Error(), "db-pass: no such file or directory") {
+		t.Errorf("setDatabaseCredentials() error = %v, want the missing password file", err)
+	}
+}
+
+func TestFileCredentialsDefaultsFile(t *testing.T) {
+	dir := writeCredentialFiles(t, map[string]string{"username": "root", "password": "s3cret"})
+	appBinding := &appcatalog.AppBinding{ObjectMeta: metav1.ObjectMeta{Name: "shop-db", Namespace: "demo"}}
+	credOpt := credentialOptions{userKey: MariaDBUser, passwordKey: MariaDBPassword, authMode: AuthModePassword, credentialsDir: dir, useDefaultsFile: true}
+
+	session := newFakeSession(t, &mariadbOptions{}, "mariadb")
+	if err := session.setDatabaseCredentials(fake.NewSimpleClientset(), appBinding, t.TempDir(), credOpt); err != nil {
+		t.Fatalf("setDatabaseCredentials() error = %v", err)
+	}
+	if _, ok := session.sh.Env[EnvMariaDBPassword]; ok {
+		t.Errorf("the password is passed in %s, want it in the defaults file", EnvMariaDBPassword)
+	}
+	if want := []interface{}{"--defaults-extra-file=" + session.defaultsFile, "-u", "root"}; !reflect.DeepEqual(session.cmd.Args, want) {
+		t.Errorf("arguments = %v, want %v", session.cmd.Args, want)
+	}
+	data, err := os.ReadFile(session.defaultsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "[client]\npassword=\"s3cret\"\n" {
+		t.Errorf("the defaults file holds %q, want the password of the file", data)
+	}
+}
+
+func TestCredentialsDirFlag(t *testing.T) {
+	for name, flags := range map[string]func() string{
+		"backup":          func() string { return NewCmdBackup().Flags().Lookup("credentials-dir").Usage },
+		"restore":         func() string { return NewCmdRestore().Flags().Lookup("credentials-dir").Usage },
+		"test-connection": func() string { return NewCmdTestConnection().Flags().Lookup("credentials-dir").Usage },
+	} {
+		if !strings.Contains(flags(), "read instead of the AppBinding secret") {
+			t.Errorf("the %s command has no --credentials-dir", name)
+		}
+	}
+}
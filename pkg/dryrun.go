@@ -0,0 +1,151 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"stash.appscode.dev/apimachinery/pkg/restic"
+)
+
+// formatCommand formats a command line for the dry run output, with the sensitive values masked.
+// Arguments that a shell would split or expand are quoted.
+func formatCommand(name string, args []interface{}) string {
+	parts := []string{name}
+	for _, arg := range sanitizeArgs(args) {
+		s := fmt.Sprint(arg)
+		if s == "" || strings.ContainsAny(s, " \t\n'\"`$\\;|&<>*?()") {
+			s = strconv.Quote(s)
+		}
+		parts = append(parts, s)
+	}
+	return strings.Join(parts, " ")
+}
+
+// formatPipeline formats commands piped into each other
+func formatPipeline(commands []restic.Command) string {
+	parts := make([]string, 0, len(commands))
+	for _, cmd := range commands {
+		parts = append(parts, formatCommand(cmd.Name, cmd.Args))
+	}
+	return strings.Join(parts, " | ")
+}
+
+// formatEnv formats the environment variables set on the session, their values are always masked
+func (session *sessionWrapper) formatEnv() string {
+	keys := make([]string, 0, len(session.sh.Env))
+	for k := range session.sh.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, k+"=****")
+	}
+	return strings.Join(parts, " ")
+}
+
+// resticBackupCommand describes the restic command backing up paths with the options
+func resticBackupCommand(options restic.BackupOptions, paths ...string) restic.Command {
+	args := []interface{}{"backup"}
+	for _, path := range paths {
+		args = append(args, path)
+	}
+	if len(options.StdinPipeCommands) > 0 {
+		args = append(args, "--stdin", "--stdin-filename", options.StdinFileName)
+	}
+	args = append(args, "--host", options.Host)
+	for _, arg := range options.Args {
+		args = append(args, arg)
+	}
+	return restic.Command{Name: restic.ResticCMD, Args: args}
+}
+
+// resticDumpCommand describes the restic command dumping the file of a snapshot to stdout
+func resticDumpCommand(options restic.DumpOptions) restic.Command {
+	snapshot := options.Snapshot
+	if snapshot == "" {
+		snapshot = "latest"
+	}
+	host := options.SourceHost
+	if host == "" {
+		host = options.Host
+	}
+	args := []interface{}{"dump", snapshot, options.FileName, "--host", host}
+	if options.Path != "" {
+		args = append(args, "--path", options.Path)
+	}
+	return restic.Command{Name: restic.ResticCMD, Args: args}
+}
+
+// printBackupPlan writes the commands a backup of the databases would run, without running them
+func (opt *mariadbOptions) printBackupPlan(w io.Writer, session *sessionWrapper, databases []string, dumpdir string) error {
+	var lines []string
+	lines = append(lines, "# databases: "+strings.Join(databases, ", "))
+	env := session.formatEnv()
+	if env != "" {
+		env += " "
+	}
+
+	switch {
+	case opt.streamBackup:
+		options := opt.streamBackupOptions(session, databases)
+		commands := append(options.StdinPipeCommands, resticBackupCommand(options))
+		lines = append(lines, env+formatPipeline(commands))
+	default:
+		for _, db := range databases {
+			lines = append(lines, env+formatCommand(session.cmd.Name, opt.dumpArgs(session, db))+" > "+opt.databaseDumpFile(dumpdir, db))
+		}
+		if opt.perDatabaseBackup {
+			for _, db := range databases {
+				options := opt.backupOptions
+				options.Args = append(append([]string{}, opt.backupOptions.Args...), "--tag", DatabaseTagPrefix+db)
+				cmd := resticBackupCommand(options, opt.databaseDumpFile(dumpdir, db))
+				lines = append(lines, formatCommand(cmd.Name, cmd.Args))
+			}
+		} else {
+			cmd := resticBackupCommand(opt.backupOptions, dumpdir)
+			lines = append(lines, formatCommand(cmd.Name, cmd.Args))
+		}
+	}
+
+	_, err := fmt.Fprintln(w, strings.Join(lines, "\n"))
+	return err
+}
+
+// printRestorePlan writes the commands a restore of the dump would run, without running them.
+// db is the database of a per database snapshot, empty for a full dump.
+func (opt *mariadbOptions) printRestorePlan(w io.Writer, session *sessionWrapper, dumpOptions restic.DumpOptions, db string) error {
+	var lines []string
+	env := session.formatEnv()
+	if env != "" {
+		env += " "
+	}
+	if db != "" && opt.cleanBeforeRestore {
+		lines = append(lines, env+formatCommand(session.clientCmd, append(append([]interface{}{}, session.cmd.Args...), "-e", recreateDatabaseStatements(db))))
+	}
+	commands := append([]restic.Command{resticDumpCommand(dumpOptions)}, dumpOptions.StdoutPipeCommands...)
+	lines = append(lines, env+formatPipeline(commands))
+
+	_, err := fmt.Fprintln(w, strings.Join(lines, "\n"))
+	return err
+}
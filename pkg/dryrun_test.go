@@ -0,0 +1,118 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"stash.appscode.dev/apimachinery/pkg/restic"
+)
+
+// preparePlanSession returns a session connected with the credentials of the test AppBinding, and
+// the function replacing its scratch directory in the printed plans so that they are stable
+func preparePlanSession(t *testing.T, opt *mariadbOptions, cmd string) (*sessionWrapper, func(string) string) {
+	t.Helper()
+	opt.setupOptions.ScratchDir = t.TempDir()
+	session, err := opt.prepareSession(newTestAppBinding(opt), cmd, opt.setupOptions.ScratchDir)
+	t.Cleanup(session.cleanup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session, func(plan string) string {
+		if strings.Contains(plan, "s3cret") {
+			t.Errorf("the plan shows the password:\n%s", plan)
+		}
+		return strings.ReplaceAll(plan, opt.setupOptions.ScratchDir, "/stash-tmp")
+	}
+}
+
+func TestPrintBackupPlan(t *testing.T) {
+	const connection = "MYSQL_PWD=**** PATH=**** mariadb-dump --default-character-set=utf8mb4 -u root -h db.demo.svc --port=3306"
+	tests := []struct {
+		name   string
+		modify func(opt *mariadbOptions)
+		want   string
+	}{
+		{
+			name: "full",
+			want: `# databases: shop, crm
+` + connection + ` --ignore-table-data=shop.cache_hubber_persistent --ignore-table-data=shop.key_value_expire --ignore-table-data=shop.sessions --triggers -- shop > /stash-tmp/dumpsql/shop.sql
+` + connection + ` --ignore-table-data=crm.cache_hubber_persistent --ignore-table-data=crm.key_value_expire --ignore-table-data=crm.sessions --triggers -- crm > /stash-tmp/dumpsql/crm.sql
+/bin/restic backup /stash-tmp/dumpsql --host host-0
+`,
+		},
+		{
+			name:   "per database",
+			modify: func(opt *mariadbOptions) { opt.perDatabaseBackup = true },
+			want: `# databases: shop, crm
+` + connection + ` --ignore-table-data=shop.cache_hubber_persistent --ignore-table-data=shop.key_value_expire --ignore-table-data=shop.sessions --triggers -- shop > /stash-tmp/dumpsql/shop.sql
+` + connection + ` --ignore-table-data=crm.cache_hubber_persistent --ignore-table-data=crm.key_value_expire --ignore-table-data=crm.sessions --triggers -- crm > /stash-tmp/dumpsql/crm.sql
+/bin/restic backup /stash-tmp/dumpsql/shop.sql --host host-0 --tag database=shop
+/bin/restic backup /stash-tmp/dumpsql/crm.sql --host host-0 --tag database=crm
+`,
+		},
+		{
+			name:   "stream",
+			modify: func(opt *mariadbOptions) { opt.streamBackup = true },
+			want: `# databases: shop, crm
+` + connection + ` --ignore-table-data=shop.cache_hubber_persistent --ignore-table-data=shop.key_value_expire --ignore-table-data=shop.sessions --ignore-table-data=crm.cache_hubber_persistent --ignore-table-data=crm.key_value_expire --ignore-table-data=crm.sessions --triggers --databases -- shop crm | /bin/restic backup --stdin --stdin-filename dumpfile.sql --host host-0 --tag "databases=shop;crm" --tag database-count=2
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := newTestBackupOptions()
+			if tt.modify != nil {
+				tt.modify(opt)
+			}
+			session, stable := preparePlanSession(t, opt, opt.dumpCmd)
+			var out bytes.Buffer
+			if err := opt.printBackupPlan(&out, session, []string{"shop", "crm"}, filepath.Join(opt.setupOptions.ScratchDir, MariaDBDumpDir)); err != nil {
+				t.Fatal(err)
+			}
+			if got := stable(out.String()); got != tt.want {
+				t.Errorf("printBackupPlan() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrintRestorePlan(t *testing.T) {
+	opt := newTestRestoreOptions()
+	opt.cleanBeforeRestore = true
+	session, stable := preparePlanSession(t, opt, opt.clientCmd)
+	dumpOptions := opt.dumpOptions
+	dumpOptions.FileName = "/stash-tmp/dumpsql/shop.sql"
+	dumpOptions.Path = dumpOptions.FileName
+	dumpOptions.StdoutPipeCommands = []restic.Command{
+		{Name: "stash-mariadb", Args: []interface{}{FilterSQLCMD, "--definer", DefinerStrip}},
+		{Name: session.cmd.Name, Args: append(append([]interface{}{}, session.cmd.Args...), "--database=shop")},
+	}
+
+	var out bytes.Buffer
+	if err := opt.printRestorePlan(&out, session, dumpOptions, "shop"); err != nil {
+		t.Fatal(err)
+	}
+	want := "MYSQL_PWD=**** PATH=**** mariadb --default-character-set=utf8mb4 -u root -h db.demo.svc --port=3306 -e \"DROP DATABASE IF EXISTS `shop`;\\nCREATE DATABASE `shop`;\\n\"\n" +
+		"MYSQL_PWD=**** PATH=**** /bin/restic dump latest /stash-tmp/dumpsql/shop.sql --host host-0 --path /stash-tmp/dumpsql/shop.sql | stash-mariadb filter-sql --definer strip | mariadb --default-character-set=utf8mb4 -u root -h db.demo.svc --port=3306 --database=shop\n"
+	if got := stable(out.String()); got != want {
+		t.Errorf("printRestorePlan() =\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,115 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// fifoPollInterval is how often the FIFO is reopened while no reader has opened it
+const fifoPollInterval = 100 * time.Millisecond
+
+// fifoSink writes the streamed dump into a named pipe read by an external process,
+// e.g. an anonymizer sitting between the dump and the storage.
+// The dump is written as it leaves the compressor, so the reader gets SQL only with --compression=none.
+type fifoSink struct {
+	path string
+	// written is set once the dump went through the FIFO, the later objects (i.e. the checksum) are only logged
+	written bool
+}
+
+// newFIFOSink returns the sink writing into the FIFO of the options, which is created when missing
+func (opt *mariadbOptions) newFIFOSink() (*fifoSink, error) {
+	info, err := os.Stat(opt.fifoPath)
+	if os.IsNotExist(err) {
+		if err = syscall.Mkfifo(opt.fifoPath, 0o600); err != nil {
+			return nil, fmt.Errorf("failed to create the FIFO %s: %w", opt.fifoPath, err)
+		}
+		return &fifoSink{path: opt.fifoPath}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode()&os.ModeNamedPipe == 0 {
+		return nil, fmt.Errorf("%s is not a FIFO", opt.fifoPath)
+	}
+	return &fifoSink{path: opt.fifoPath}, nil
+}
+
+func (s *fifoSink) upload(ctx context.Context, name string, r io.Reader) (int64, error) {
+	if s.written {
+		klog.Infof("Not writing %s into the FIFO %s: %s", name, s.path, strings.TrimSpace(readAtMost(r)))
+		return 0, nil
+	}
+	f, err := s.open(ctx)
+	if err != nil {
+		return 0, err
+	}
+	klog.Infof("Writing %s into the FIFO %s", name, s.path)
+	n, err := io.Copy(f, r)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if errors.Is(err, syscall.EPIPE) {
+		return n, fmt.Errorf("the reader of the FIFO %s disconnected after %s of the dump", s.path, formatBytes(n))
+	}
+	if err != nil {
+		return n, fmt.Errorf("failed to write into the FIFO %s: %w", s.path, err)
+	}
+	s.written = true
+	return n, nil
+}
+
+// open waits for a reader to open the FIFO. A blocking open could not be interrupted,
+// so the FIFO is opened in non blocking mode, which fails with ENXIO as long as there is no reader.
+func (s *fifoSink) open(ctx context.Context) (*os.File, error) {
+	logged := false
+	for {
+		f, err := os.OpenFile(s.path, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+		if err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, syscall.ENXIO) {
+			return nil, fmt.Errorf("failed to open the FIFO %s: %w", s.path, err)
+		}
+		if !logged {
+			klog.Infof("Waiting for a reader to open the FIFO %s", s.path)
+			logged = true
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("no reader opened the FIFO %s: %w", s.path, context.Cause(ctx))
+		case <-time.After(fifoPollInterval):
+		}
+	}
+}
+
+// readAtMost reads the small objects logged instead of written, such as the checksum
+func readAtMost(r io.Reader) string {
+	b, _ := io.ReadAll(io.LimitReader(r, 1024))
+	return string(b)
+}
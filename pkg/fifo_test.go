@@ -0,0 +1,174 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readFIFO reads the FIFO at path the way an external process would, until it is closed
+// or limit bytes were read when limit is positive
+func readFIFO(t *testing.T, path string, limit int64) <-chan []byte {
+	t.Helper()
+	read := make(chan []byte, 1)
+	go func() {
+		defer close(read)
+		f, err := os.Open(path)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer f.Close()
+		var r io.Reader = f
+		if limit > 0 {
+			r = io.LimitReader(f, limit)
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Error(err)
+		}
+		read <- data
+	}()
+	return read
+}
+
+func TestFIFOSink(t *testing.T) {
+	dump := sampleDump(1000)
+	dumpFile := filepath.Join(t.TempDir(), "dump.sql")
+	if err := os.WriteFile(dumpFile, dump, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, algo := range []string{CompressionNone, CompressionGzip} {
+		t.Run(algo, func(t *testing.T) {
+			opt := newTestBackupOptions()
+			opt.compression = algo
+			opt.fifoPath = filepath.Join(t.TempDir(), "dump.fifo")
+			session := newFakeSession(t, opt, fakeCommand(t, "cat "+dumpFile))
+			sink, err := opt.newFIFOSink()
+			if err != nil {
+				t.Fatal(err)
+			}
+			read := readFIFO(t, opt.fifoPath, 0)
+
+			if err := opt.streamToSink(context.Background(), session, sink, []string{"shop"}); err != nil {
+				t.Fatal(err)
+			}
+			// the dump is compressed before it is written into the FIFO
+			var restored bytes.Buffer
+			if err := decompressStream(&restored, bytes.NewReader(<-read)); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(restored.Bytes(), dump) {
+				t.Errorf("the reader of the FIFO got another dump than the dump")
+			}
+		})
+	}
+}
+
+func TestFIFOSinkReaderDisconnects(t *testing.T) {
+	dumpFile := filepath.Join(t.TempDir(), "dump.sql")
+	if err := os.WriteFile(dumpFile, sampleDump(20000), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	opt := newTestBackupOptions()
+	opt.fifoPath = filepath.Join(t.TempDir(), "dump.fifo")
+	session := newFakeSession(t, opt, fakeCommand(t, "cat "+dumpFile))
+	sink, err := opt.newFIFOSink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := readFIFO(t, opt.fifoPath, 4096)
+
+	err = opt.streamToSink(context.Background(), session, sink, []string{"shop"})
+	if err == nil || !strings.Contains(err.Error(), "the reader of the FIFO "+opt.fifoPath+" disconnected after") {
+		t.Errorf("streamToSink() error = %v, want the disconnection of the reader", err)
+	}
+	<-read
+}
+
+func TestFIFOSinkWaitsForAReader(t *testing.T) {
+	opt := newTestBackupOptions()
+	opt.fifoPath = filepath.Join(t.TempDir(), "dump.fifo")
+	sink, err := opt.newFIFOSink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	_, err = sink.upload(ctx, MariaDBDumpFile, strings.NewReader("USE `shop`;\n"))
+	if err == nil || !strings.Contains(err.Error(), "no reader opened the FIFO "+opt.fifoPath) {
+		t.Errorf("upload() error = %v, want the wait for a reader to stop", err)
+	}
+}
+
+func TestNewFIFOSink(t *testing.T) {
+	opt := newTestBackupOptions()
+	opt.fifoPath = filepath.Join(t.TempDir(), "dump.fifo")
+	for i := 0; i < 2; i++ {
+		// the FIFO is created once, then reused
+		if _, err := opt.newFIFOSink(); err != nil {
+			t.Fatal(err)
+		}
+		if info, err := os.Stat(opt.fifoPath); err != nil || info.Mode()&os.ModeNamedPipe == 0 {
+			t.Fatalf("%s is not a FIFO: %v", opt.fifoPath, err)
+		}
+	}
+
+	opt.fifoPath = filepath.Join(t.TempDir(), "dump.sql")
+	if err := os.WriteFile(opt.fifoPath, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := opt.newFIFOSink(); err == nil || !strings.Contains(err.Error(), opt.fifoPath+" is not a FIFO") {
+		t.Errorf("newFIFOSink() error = %v, want the regular file to be rejected", err)
+	}
+}
+
+func TestFIFOSinkOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		sinks    []string
+		stream   bool
+		fifoPath string
+		wantErr  string
+	}{
+		{name: "streamed dump", sinks: []string{SinkFIFO}, stream: true, fifoPath: "/tmp/dump.fifo"},
+		{name: "dump files", sinks: []string{SinkFIFO}, fifoPath: "/tmp/dump.fifo", wantErr: "the fifo sink requires --stream"},
+		{name: "several sinks", sinks: []string{SinkFIFO, SinkRestic}, stream: true, fifoPath: "/tmp/dump.fifo", wantErr: "the fifo sink can not be combined with others"},
+		{name: "no path", sinks: []string{SinkFIFO}, stream: true, wantErr: "--fifo-path is required by the fifo sink"},
+		{name: "path of another sink", sinks: []string{SinkRestic}, stream: true, fifoPath: "/tmp/dump.fifo", wantErr: "--fifo-path requires --sink=fifo"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := newTestBackupOptions()
+			opt.sinks = tt.sinks
+			opt.streamBackup = tt.stream
+			opt.fifoPath = tt.fifoPath
+			err := opt.validateSinkOptions()
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validateSinkOptions() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,658 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"stash.appscode.dev/apimachinery/pkg/restic"
+
+	"github.com/spf13/cobra"
+	"k8s.io/klog/v2"
+)
+
+const (
+	FilterSQLCMD     = "filter-sql"
+	DefaultDelimiter = ";"
+
+	// gtidFilterApply executes the GTID position even if the dump has it commented out (--master-data=2)
+	gtidFilterApply = "apply"
+	// gtidFilterReset clears the binary logs of the target with RESET MASTER before applying the GTID position
+	gtidFilterReset = "reset"
+	// gtidFilterDrop removes the statement setting the GTID position
+	gtidFilterDrop = "drop"
+
+	// DefinerStrip removes the DEFINER clauses, the objects are then owned by the restoring user
+	DefinerStrip = "strip"
+	// DefinerCurrentUser rewrites the DEFINER clauses to DEFINER=CURRENT_USER
+	DefinerCurrentUser = "current-user"
+)
+
+// a database or table name, quoted or not
+const sqlTableName = "`(?:[^`]|``)+`|[^\\s`.(;,*/]+"
+
+// a user or host name of a DEFINER clause, quoted or not
+const definerAccount = "`(?:[^`]|``)*`" + `|'(?:[^'\\]|\\.|'')*'|"(?:[^"\\]|\\.|"")*"|[\w$.%-]+`
+
+var (
+	useDatabaseRegex     = regexp.MustCompile("(?is)^USE\\s+(`(?:[^`]|``)+`|[^\\s;]+)")
+	createDatabaseRegex  = regexp.MustCompile("(?is)^CREATE\\s+(?:DATABASE|SCHEMA)\\s+(?:/\\*!\\d*\\s*)?(?:IF\\s+NOT\\s+EXISTS\\s*)?(?:\\*/\\s*)?(`(?:[^`]|``)+`|[^\\s;]+)")
+	currentDatabaseRegex = regexp.MustCompile("^--\\s*Current Database:\\s*(`(?:[^`]|``)+`|\\S+)")
+	delimiterRegex       = regexp.MustCompile(`(?i)^DELIMITER\s+(\S+)`)
+	gtidSlavePosRegex    = regexp.MustCompile(`(?i)^(--\s*)?(SET\s+GLOBAL\s+gtid_slave_pos\s*=\s*'[^']*'\s*;)`)
+	// the opening of a versioned comment, which MariaDB executes as a statement: /*!40000 or /*M!100101
+	conditionalCommentRegex = regexp.MustCompile(`^/\*M?!\d*\s*`)
+	// the statements loading the rows of the tables, along with the key and lock handling around them
+	dataStatementRegex = regexp.MustCompile(`(?is)^(?:INSERT|REPLACE|LOAD\s+(?:DATA|XML)|LOCK\s+TABLES|UNLOCK\s+TABLES|ALTER\s+TABLE\s+\S+\s+(?:DISABLE|ENABLE)\s+KEYS)\b`)
+	// the statements loading the rows of a table, and the statement disabling its keys beforehand
+	rowStatementRegex = regexp.MustCompile(`(?is)^(?:INSERT|REPLACE|LOAD\s+DATA)\b`)
+	disableKeysRegex  = regexp.MustCompile(`(?is)^ALTER\s+TABLE\s+\S+\s+DISABLE\s+KEYS\b`)
+	// the statements creating, locking or loading a table, which mariadb-dump names unqualified
+	tableStatementRegex = regexp.MustCompile(`(?is)^(?:DROP\s+TABLE\s+(?:IF\s+EXISTS\s+)?|CREATE\s+(?:OR\s+REPLACE\s+)?TABLE\s+(?:IF\s+NOT\s+EXISTS\s+)?|LOCK\s+TABLES\s+|ALTER\s+TABLE\s+|(?:INSERT|REPLACE)\s+(?:(?:LOW_PRIORITY|DELAYED|HIGH_PRIORITY|IGNORE)\s+)*INTO\s+|LOAD\s+DATA\s+.*?\bINTO\s+TABLE\s+)(?:(` + sqlTableName + `)\.)?(` + sqlTableName + `)`)
+	// the table of a trigger, whose definition mariadb-dump splits with versioned comments
+	triggerTableRegex = regexp.MustCompile(`(?is)\bTRIGGER\s+(?:` + sqlTableName + `)(?:\.(?:` + sqlTableName + `))?\s+(?:\*/\s*)?(?:BEFORE|AFTER)\s+\w+(?:\s+OR\s+\w+)*\s+ON\s+(?:(` + sqlTableName + `)\.)?(` + sqlTableName + `)`)
+	// DEFINER=`user`@`host`, 'user'@'host', user@host, a role without host or CURRENT_USER
+	definerRegex = regexp.MustCompile(`(?i)\bDEFINER\s*=\s*(?:CURRENT_USER(?:\s*\(\s*\))?|(?:` + definerAccount + `)(?:\s*@\s*(?:` + definerAccount + `))?)\s*`)
+)
+
+// sqlFilterOptions selects the statements of a dump that are replayed during restore
+type sqlFilterOptions struct {
+	database string
+	// drop and create again every database of the dump before its statements are replayed
+	recreateDatabases bool
+	systemSchemas     []string
+	// restore the databases of the dump under another name
+	databaseRename map[string]string
+	// log the bytes consumed from the dump at this interval, totalBytes is the size of the dump if known
+	progressInterval time.Duration
+	totalBytes       int64
+	// how the GTID position recorded in the dump is applied, one of the gtidFilter* values
+	gtidMode string
+	// how the DEFINER clauses of the views, triggers, routines and events are rewritten, one of the Definer* values
+	definerMode string
+	// drop the rows of the tables, keeping the structure, the routines and the views
+	schemaOnly bool
+	// drop the statements creating and loading these tables, along with their triggers, given as <database>.<table>
+	excludeTables []string
+	// the database of the statements written before the dump switches to any, i.e. of a per database dump
+	defaultDatabase string
+	// convert the charset declarations of the dump, given as <from>:<to>, and the bytes of the dump if transcodeData
+	convertCharset string
+	transcodeData  bool
+	// wrap the rows of each table with ALTER TABLE ... DISABLE KEYS and ENABLE KEYS, unless the dump already does
+	disableKeys bool
+}
+
+// enabled reports whether the dump stream has to go through the filter
+func (o sqlFilterOptions) enabled() bool {
+	return o.rewrites() || o.progressInterval > 0
+}
+
+// rewrites reports whether any statement has to be filtered out or rewritten
+func (o sqlFilterOptions) rewrites() bool {
+	return o.database != "" || o.recreateDatabases || len(o.databaseRename) > 0 || o.gtidMode != "" || o.definerMode != "" || o.schemaOnly || o.convertCharset != "" || len(o.excludeTables) > 0 || o.disableKeys
+}
+
+// args returns the flags of the filter-sql command matching the options
+func (o sqlFilterOptions) args() []interface{} {
+	var args []interface{}
+	if o.database != "" {
+		args = append(args, "--database", o.database)
+	}
+	if o.recreateDatabases {
+		args = append(args, "--recreate-databases", "--system-schemas", strings.Join(o.systemSchemas, ","))
+	}
+	if len(o.databaseRename) > 0 {
+		renames := make([]string, 0, len(o.databaseRename))
+		for from, to := range o.databaseRename {
+			renames = append(renames, from+"="+to)
+		}
+		sort.Strings(renames)
+		args = append(args, "--rename-database", strings.Join(renames, ","))
+	}
+	if o.gtidMode != "" {
+		args = append(args, "--gtid-mode", o.gtidMode)
+	}
+	if o.definerMode != "" {
+		args = append(args, "--definer", o.definerMode)
+	}
+	if o.schemaOnly {
+		args = append(args, "--schema-only")
+	}
+	for _, table := range o.excludeTables {
+		args = append(args, "--exclude-table", table)
+	}
+	if o.defaultDatabase != "" {
+		args = append(args, "--default-database", o.defaultDatabase)
+	}
+	if o.convertCharset != "" {
+		args = append(args, "--convert-charset", o.convertCharset)
+		if o.transcodeData {
+			args = append(args, "--transcode-data")
+		}
+	}
+	if o.disableKeys {
+		args = append(args, "--disable-keys")
+	}
+	if o.progressInterval > 0 {
+		args = append(args, "--progress-interval", o.progressInterval.String(), "--total-bytes", strconv.FormatInt(o.totalBytes, 10))
+	}
+	return args
+}
+
+// NewCmdFilterSQL returns the hidden command filtering a dump read from stdin into stdout.
+// It is inserted by the restore command into the pipeline between restic and the database client.
+func NewCmdFilterSQL() *cobra.Command {
+	var opt sqlFilterOptions
+
+	cmd := &cobra.Command{
+		Use:               FilterSQLCMD,
+		Short:             "Filters the statements of a MariaDB dump read from stdin",
+		Hidden:            true,
+		DisableAutoGenTag: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := validateCharsetConversion(opt.convertCharset); err != nil {
+				return err
+			}
+			var in io.Reader = os.Stdin
+			if opt.progressInterval > 0 {
+				in = newProgressReader(in, opt.progressInterval, opt.totalBytes)
+			}
+			out := bufio.NewWriter(os.Stdout)
+			if err := filterSQL(in, out, opt); err != nil {
+				return err
+			}
+			return out.Flush()
+		},
+	}
+
+	cmd.Flags().StringVar(&opt.database, "database", opt.database, "Keep only the statements of this database")
+	cmd.Flags().BoolVar(&opt.recreateDatabases, "recreate-databases", opt.recreateDatabases, "Drop and create again each database before its statements")
+	cmd.Flags().StringSliceVar(&opt.systemSchemas, "system-schemas", opt.systemSchemas, "Schemas that are never dropped")
+	cmd.Flags().StringToStringVar(&opt.databaseRename, "rename-database", opt.databaseRename, "Rename the databases of the dump, given as <from>=<to>")
+	cmd.Flags().StringVar(&opt.gtidMode, "gtid-mode", opt.gtidMode, "Apply (apply), reset the binary logs and apply (reset) or drop (drop) the GTID position of the dump")
+	cmd.Flags().StringVar(&opt.definerMode, "definer", opt.definerMode, "Remove (strip) or replace with CURRENT_USER (current-user) the DEFINER clauses of the dump")
+	cmd.Flags().BoolVar(&opt.schemaOnly, "schema-only", opt.schemaOnly, "Drop the statements loading the rows of the tables")
+	cmd.Flags().StringArrayVar(&opt.excludeTables, "exclude-table", opt.excludeTables, "Drop the statements creating and loading this table, given as <database>.<table>")
+	cmd.Flags().StringVar(&opt.defaultDatabase, "default-database", opt.defaultDatabase, "Database of the statements before the dump switches to any")
+	cmd.Flags().StringVar(&opt.convertCharset, "convert-charset", opt.convertCharset, "Convert the charset declarations of the dump, given as <from>:<to> (only "+CharsetConversionLatin1+")")
+	cmd.Flags().BoolVar(&opt.transcodeData, "transcode-data", opt.transcodeData, "Transcode the bytes of the dump along with the declarations")
+	cmd.Flags().BoolVar(&opt.disableKeys, "disable-keys", opt.disableKeys, "Disable the keys of each table while its rows are loaded, unless the dump already does")
+	cmd.Flags().DurationVar(&opt.progressInterval, "progress-interval", opt.progressInterval, "Interval between two reports of the bytes consumed (0 disables the reports)")
+	cmd.Flags().Int64Var(&opt.totalBytes, "total-bytes", opt.totalBytes, "Size of the dump used to report a percentage (0 if unknown)")
+
+	return cmd
+}
+
+// sqlFilterCommand returns the command filtering the dump stream, or nil if no filter is requested
+func sqlFilterCommand(o sqlFilterOptions) (*restic.Command, error) {
+	if !o.enabled() {
+		return nil, nil
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate the plugin binary to filter the dump: %w", err)
+	}
+	return &restic.Command{Name: self, Args: append([]interface{}{FilterSQLCMD}, o.args()...)}, nil
+}
+
+// sqlStatement is a statement of a dump, or a run of comment and blank lines between two statements
+type sqlStatement struct {
+	text    string
+	line    int
+	comment bool
+}
+
+// sqlScanner splits a dump into statements. mariadb-dump escapes the line breaks inside string
+// literals, so a statement ends with the first line ending with the current delimiter.
+type sqlScanner struct {
+	reader    *bufio.Reader
+	delimiter string
+	line      int
+	stmt      sqlStatement
+	err       error
+}
+
+func newSQLScanner(r io.Reader) *sqlScanner {
+	return &sqlScanner{reader: bufio.NewReader(r), delimiter: DefaultDelimiter}
+}
+
+// Scan advances to the next statement, it returns false at the end of the dump or on error
+func (s *sqlScanner) Scan() bool {
+	var buf strings.Builder
+	start := s.line + 1
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			s.err = err
+			return false
+		}
+		if line == "" {
+			if buf.Len() == 0 {
+				return false
+			}
+			// an unterminated statement at the end of the dump is passed through as is
+			s.stmt = sqlStatement{text: buf.String(), line: start}
+			return true
+		}
+		s.line++
+
+		trimmed := strings.TrimSpace(line)
+		if buf.Len() == 0 && isCommentLine(trimmed) {
+			s.stmt = sqlStatement{text: line, line: start, comment: true}
+			return true
+		}
+		buf.WriteString(line)
+		if m := delimiterRegex.FindStringSubmatch(trimmed); m != nil && buf.Len() == len(line) {
+			s.delimiter = m[1]
+			s.stmt = sqlStatement{text: buf.String(), line: start, comment: true}
+			return true
+		}
+		if strings.HasSuffix(trimmed, s.delimiter) || err == io.EOF {
+			s.stmt = sqlStatement{text: buf.String(), line: start}
+			return true
+		}
+	}
+}
+
+// Statement returns the statement read by the last call to Scan
+func (s *sqlScanner) Statement() sqlStatement {
+	return s.stmt
+}
+
+// Err returns the first read error
+func (s *sqlScanner) Err() error {
+	return s.err
+}
+
+func isCommentLine(line string) bool {
+	return line == "" || strings.HasPrefix(line, "--") || strings.HasPrefix(line, "#")
+}
+
+// unquoteIdentifier strips the backticks around an identifier
+func unquoteIdentifier(name string) string {
+	if len(name) >= 2 && strings.HasPrefix(name, "`") && strings.HasSuffix(name, "`") {
+		return strings.ReplaceAll(name[1:len(name)-1], "``", "`")
+	}
+	return name
+}
+
+// statementDatabase returns the database a statement switches to, if any
+func statementDatabase(stmt sqlStatement) (string, bool) {
+	start, end, ok := statementDatabaseIndex(stmt)
+	if !ok {
+		return "", false
+	}
+	return unquoteIdentifier(stmt.text[start:end]), true
+}
+
+// statementDatabaseIndex returns the position in the statement text of the name of the database it switches to
+func statementDatabaseIndex(stmt sqlStatement) (int, int, bool) {
+	offset := len(stmt.text) - len(strings.TrimLeftFunc(stmt.text, unicode.IsSpace))
+	text := stmt.text[offset:]
+	regex := useDatabaseRegex
+	if stmt.comment {
+		regex = currentDatabaseRegex
+	} else if createDatabaseRegex.MatchString(text) {
+		regex = createDatabaseRegex
+	}
+	if m := regex.FindStringSubmatchIndex(text); m != nil {
+		return offset + m[2], offset + m[3], true
+	}
+	return 0, 0, false
+}
+
+// renameDatabases rewrites the names of the renamed databases in a statement: the database it switches to
+// and the qualified names (db.table) outside of the string literals. The rows of INSERT statements are
+// left untouched, mariadb-dump never qualifies their table name.
+func renameDatabases(stmt sqlStatement, rename map[string]string) string {
+	if start, end, ok := statementDatabaseIndex(stmt); ok {
+		if to, ok := rename[unquoteIdentifier(stmt.text[start:end])]; ok {
+			return stmt.text[:start] + quoteIdentifier(to) + stmt.text[end:]
+		}
+		return stmt.text
+	}
+	if stmt.comment || strings.HasPrefix(strings.TrimSpace(stmt.text), "INSERT") {
+		return stmt.text
+	}
+
+	text := stmt.text
+	var out strings.Builder
+	for i := 0; i < len(text); {
+		switch c := text[i]; {
+		case c == '\'' || c == '"':
+			// copy the string literal, quotes are escaped with a backslash or doubled
+			j := i + 1
+			for j < len(text) {
+				if text[j] == '\\' {
+					j += 2
+					continue
+				}
+				if text[j] == c {
+					if j+1 < len(text) && text[j+1] == c {
+						j += 2
+						continue
+					}
+					break
+				}
+				j++
+			}
+			if j >= len(text) {
+				j = len(text) - 1
+			}
+			out.WriteString(text[i : j+1])
+			i = j + 1
+		case c == '`' || isIdentifierChar(c):
+			j := i + 1
+			if c == '`' {
+				for j < len(text) && (text[j] != '`' || (j+1 < len(text) && text[j+1] == '`')) {
+					if text[j] == '`' {
+						j++
+					}
+					j++
+				}
+				if j < len(text) {
+					j++
+				}
+			} else {
+				for j < len(text) && isIdentifierChar(text[j]) {
+					j++
+				}
+			}
+			name := text[i:j]
+			qualifier := j < len(text) && text[j] == '.' && (i == 0 || text[i-1] != '.')
+			if to, ok := rename[unquoteIdentifier(name)]; ok && qualifier {
+				out.WriteString(quoteIdentifier(to))
+			} else {
+				out.WriteString(name)
+			}
+			i = j
+		default:
+			out.WriteByte(c)
+			i++
+		}
+	}
+	return out.String()
+}
+
+// rewriteGTIDPosition applies the GTID mode to the statement setting the GTID position of the dump.
+// mariadb-dump writes it as a comment with --master-data=2 and as a statement with --master-data=1.
+func rewriteGTIDPosition(stmt sqlStatement, text, mode string) string {
+	m := gtidSlavePosRegex.FindStringSubmatch(strings.TrimSpace(stmt.text))
+	if m == nil {
+		return text
+	}
+	commented := m[1] != ""
+	switch mode {
+	case gtidFilterDrop:
+		if commented {
+			return text
+		}
+		klog.Infoln("Dropping the GTID position of the dump")
+		return ""
+	case gtidFilterApply, gtidFilterReset:
+		if commented {
+			// keep the comment and execute the statement it holds
+			text += m[2] + "\n"
+		}
+		klog.Infof("Applying the GTID position of the dump: %s", m[2])
+		if mode == gtidFilterReset {
+			text = "RESET MASTER;\n" + text
+		}
+	}
+	return text
+}
+
+// rewriteDefiner applies the definer mode to the DEFINER clause of a CREATE statement. Only the first
+// clause is rewritten, the ones that may follow are in the body of the object. The rows of INSERT
+// statements are left untouched.
+func rewriteDefiner(stmt sqlStatement, text, mode string) string {
+	if stmt.comment || strings.HasPrefix(strings.TrimSpace(text), "INSERT") {
+		return text
+	}
+	loc := definerRegex.FindStringIndex(text)
+	if loc == nil {
+		return text
+	}
+	switch mode {
+	case DefinerStrip:
+		return text[:loc[0]] + text[loc[1]:]
+	case DefinerCurrentUser:
+		return text[:loc[0]] + "DEFINER=CURRENT_USER " + text[loc[1]:]
+	}
+	return text
+}
+
+// isDataStatement reports whether the statement loads rows: the INSERT statements, extended or not, LOAD DATA
+// and the LOCK TABLES and DISABLE/ENABLE KEYS around them. A statement wrapped in versioned comments is
+// classified by the statement they hold. The bodies of the routines and triggers are part of their CREATE
+// statement, so the INSERT statements they hold are kept.
+func isDataStatement(text string) bool {
+	return dataStatementRegex.MatchString(stripConditionalComments(text))
+}
+
+// stripConditionalComments returns the statement without the versioned comments it starts with
+func stripConditionalComments(text string) string {
+	text = strings.TrimSpace(text)
+	for {
+		loc := conditionalCommentRegex.FindStringIndex(text)
+		if loc == nil {
+			return text
+		}
+		text = text[loc[1]:]
+	}
+}
+
+// statementTable returns the table a statement creates, drops, locks, alters or loads, or the table of the
+// trigger it creates. Unqualified names are tables of the current database.
+func statementTable(stmt sqlStatement, current string) (string, string, bool) {
+	if stmt.comment {
+		return "", "", false
+	}
+	text := stripConditionalComments(stmt.text)
+	m := tableStatementRegex.FindStringSubmatch(text)
+	if m == nil && strings.HasPrefix(strings.ToUpper(text), "CREATE") {
+		m = triggerTableRegex.FindStringSubmatch(text)
+	}
+	if m == nil {
+		return "", "", false
+	}
+	db := current
+	if m[1] != "" {
+		db = unquoteIdentifier(m[1])
+	}
+	return db, unquoteIdentifier(m[2]), true
+}
+
+// parseExcludedTables returns the excluded tables by database, the table names may be quoted with backticks
+func parseExcludedTables(entries []string) (map[string][]string, error) {
+	tables, err := parseTableSelection(entries)
+	if err != nil {
+		return nil, err
+	}
+	for db := range tables {
+		for i, table := range tables[db] {
+			tables[db][i] = unquoteIdentifier(table)
+		}
+	}
+	return tables, nil
+}
+
+// keysWrapper disables the keys of the tables while their rows are loaded, so that MyISAM and Aria
+// rebuild their non-unique indexes once per table instead of updating them row by row
+type keysWrapper struct {
+	// the table whose keys are disabled, as a qualified and quoted name
+	loading string
+	// the tables whose keys the dump disables itself
+	disabledByDump map[string]bool
+}
+
+// wrap returns the statements to write before stmt: ENABLE KEYS once the rows of the loading table
+// are written, DISABLE KEYS before the first row of a table. The statements between two INSERT statements
+// of a table are comments, so the keys are enabled again before the UNLOCK TABLES following its rows.
+func (k *keysWrapper) wrap(stmt sqlStatement, current string, rename map[string]string) string {
+	if stmt.comment {
+		return ""
+	}
+	db, table, ok := statementTable(stmt, current)
+	var name string
+	if ok {
+		if to, renamed := rename[db]; renamed {
+			db = to
+		}
+		name = quoteIdentifier(table)
+		if db != "" {
+			name = quoteIdentifier(db) + "." + name
+		}
+	}
+	text := stripConditionalComments(stmt.text)
+	if ok && disableKeysRegex.MatchString(text) {
+		if k.disabledByDump == nil {
+			k.disabledByDump = map[string]bool{}
+		}
+		k.disabledByDump[name] = true
+	}
+	rows := ok && rowStatementRegex.MatchString(text)
+
+	var wrap string
+	if k.loading != "" && (!rows || name != k.loading) {
+		wrap += k.close()
+	}
+	if rows && k.loading == "" && !k.disabledByDump[name] {
+		k.loading = name
+		wrap += "ALTER TABLE " + name + " DISABLE KEYS;\n"
+	}
+	return wrap
+}
+
+// close returns the statement enabling the keys of the loading table, if any
+func (k *keysWrapper) close() string {
+	if k.loading == "" {
+		return ""
+	}
+	stmt := "ALTER TABLE " + k.loading + " ENABLE KEYS;\n"
+	k.loading = ""
+	return stmt
+}
+
+func isIdentifierChar(c byte) bool {
+	return c == '_' || c == '$' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+// filterSQL copies the statements of the dump read from r that match the options into w.
+// Statements written before the dump switches to any database (session settings) are always kept.
+// From then on, a statement is kept only if the database it applies to is the requested one.
+// The CREATE DATABASE statement of a database opens its block, so it is kept along with it.
+// When the databases are recreated, the DROP/CREATE statements are written before the first
+// statement of each database, so only the databases the dump writes to are dropped.
+// The databases are selected by their name in the dump, renaming applies to the statements written.
+func filterSQL(r io.Reader, w io.Writer, opt sqlFilterOptions) error {
+	if !opt.rewrites() {
+		_, err := io.Copy(w, r)
+		return err
+	}
+
+	excluded, err := parseExcludedTables(opt.excludeTables)
+	if err != nil {
+		return err
+	}
+
+	scanner := newSQLScanner(r)
+	var (
+		current   = opt.defaultDatabase
+		switched  bool
+		recreated = map[string]bool{}
+		keys      keysWrapper
+	)
+	for scanner.Scan() {
+		stmt := scanner.Statement()
+		if db, ok := statementDatabase(stmt); ok {
+			current, switched = db, true
+		}
+		if opt.database != "" && switched && current != opt.database {
+			continue
+		}
+		if opt.schemaOnly && !stmt.comment && isDataStatement(stmt.text) {
+			continue
+		}
+		if len(excluded) > 0 {
+			if db, table, ok := statementTable(stmt, current); ok && containsString(excluded[db], table) {
+				continue
+			}
+		}
+		target := current
+		if to, ok := opt.databaseRename[current]; ok {
+			target = to
+		}
+		if opt.recreateDatabases && switched && !stmt.comment && !recreated[target] {
+			recreated[target] = true
+			if containsString(opt.systemSchemas, target) {
+				return fmt.Errorf("refusing to drop system schema %s", target)
+			}
+			klog.Warningf("Dropping database %s before restore", target)
+			if _, err := io.WriteString(w, recreateDatabaseStatements(target)); err != nil {
+				return err
+			}
+		}
+
+		if opt.disableKeys {
+			if _, err := io.WriteString(w, keys.wrap(stmt, current, opt.databaseRename)); err != nil {
+				return err
+			}
+		}
+
+		text := stmt.text
+		if len(opt.databaseRename) > 0 {
+			text = renameDatabases(stmt, opt.databaseRename)
+		}
+		if opt.gtidMode != "" {
+			text = rewriteGTIDPosition(stmt, text, opt.gtidMode)
+		}
+		if opt.definerMode != "" {
+			text = rewriteDefiner(stmt, text, opt.definerMode)
+		}
+		if opt.convertCharset != "" {
+			if opt.transcodeData {
+				if err := checkTranscodable(stmt); err != nil {
+					return err
+				}
+				text = transcodeLatin1(text)
+			}
+			text, err = convertCharsetDeclarations(stmt, text, opt.transcodeData)
+			if err != nil {
+				return err
+			}
+		}
+		if _, err := io.WriteString(w, text); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, keys.close())
+	return err
+}
@@ -0,0 +1,524 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// multiDatabaseDump is a dump of the shop and crm databases, as written by mariadb-dump --databases
+const multiDatabaseDump = `-- MariaDB dump 10.19  Distrib 10.11.6-MariaDB, for Linux (x86_64)
+--
+-- Host: db.demo.svc    Database:
+-- ------------------------------------------------------
+/*!40101 SET @OLD_CHARACTER_SET_CLIENT=@@CHARACTER_SET_CLIENT */;
+/*!40101 SET NAMES utf8mb4 */;
+/*!40014 SET @OLD_UNIQUE_CHECKS=@@UNIQUE_CHECKS, UNIQUE_CHECKS=0 */;
+
+--
+-- Current Database: ` + "`shop`" + `
+--
+
+CREATE DATABASE /*!32312 IF NOT EXISTS*/ ` + "`shop`" + ` /*!40100 DEFAULT CHARACTER SET utf8mb4 */;
+
+USE ` + "`shop`" + `;
+
+--
+-- Table structure for table ` + "`orders`" + `
+--
+
+DROP TABLE IF EXISTS ` + "`orders`" + `;
+CREATE TABLE ` + "`orders`" + ` (
+  ` + "`id`" + ` int(11) NOT NULL,
+  ` + "`customer`" + ` varchar(64) DEFAULT NULL,
+  PRIMARY KEY (` + "`id`" + `)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+LOCK TABLES ` + "`orders`" + ` WRITE;
+INSERT INTO ` + "`orders`" + ` VALUES (1,'USE crm;'),(2,'bob');
+UNLOCK TABLES;
+
+--
+-- Current Database: ` + "`crm`" + `
+--
+
+CREATE DATABASE IF NOT EXISTS ` + "`crm`" + `;
+
+USE ` + "`crm`" + `;
+
+DROP TABLE IF EXISTS ` + "`contacts`" + `;
+CREATE TABLE ` + "`contacts`" + ` (
+  ` + "`id`" + ` int(11) NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+LOCK TABLES ` + "`contacts`" + ` WRITE;
+INSERT INTO ` + "`contacts`" + ` VALUES (1);
+UNLOCK TABLES;
+/*!40014 SET UNIQUE_CHECKS=@OLD_UNIQUE_CHECKS */;
+
+-- Dump completed on 2024-05-01 10:00:00
+`
+
+// runFilterSQL returns the statements of dump kept by the filter
+func runFilterSQL(t *testing.T, dump string, opt sqlFilterOptions) string {
+	t.Helper()
+	var out bytes.Buffer
+	if err := filterSQL(strings.NewReader(dump), &out, opt); err != nil {
+		t.Fatalf("filterSQL() error = %v", err)
+	}
+	return out.String()
+}
+
+func TestFilterSingleDatabase(t *testing.T) {
+	tests := []struct {
+		database string
+		keep     []string
+		drop     []string
+	}{
+		{
+			database: "shop",
+			keep:     []string{"SET NAMES utf8mb4", "CREATE DATABASE /*!32312 IF NOT EXISTS*/ `shop`", "USE `shop`;", "CREATE TABLE `orders`", "VALUES (1,'USE crm;'),(2,'bob');"},
+			drop:     []string{"`crm`", "contacts", "SET UNIQUE_CHECKS=@OLD_UNIQUE_CHECKS"},
+		},
+		{
+			database: "crm",
+			keep:     []string{"SET NAMES utf8mb4", "CREATE DATABASE IF NOT EXISTS `crm`;", "USE `crm`;", "INSERT INTO `contacts` VALUES (1);", "SET UNIQUE_CHECKS=@OLD_UNIQUE_CHECKS"},
+			drop:     []string{"`shop`", "orders"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.database, func(t *testing.T) {
+			out := runFilterSQL(t, multiDatabaseDump, sqlFilterOptions{database: tt.database})
+			for _, s := range tt.keep {
+				if !strings.Contains(out, s) {
+					t.Errorf("the restore of %s lacks %q", tt.database, s)
+				}
+			}
+			for _, s := range tt.drop {
+				if strings.Contains(out, s) {
+					t.Errorf("the restore of %s replays %q", tt.database, s)
+				}
+			}
+		})
+	}
+}
+
+func TestFilterUnknownDatabaseKeepsOnlyTheHeader(t *testing.T) {
+	out := runFilterSQL(t, multiDatabaseDump, sqlFilterOptions{database: "billing"})
+	if strings.Contains(out, "CREATE") || strings.Contains(out, "INSERT") {
+		t.Errorf("the restore of a database missing from the dump replays:\n%s", out)
+	}
+	if !strings.HasPrefix(out, "-- MariaDB dump") {
+		t.Errorf("the restore dropped the statements before any USE:\n%s", out)
+	}
+}
+
+func TestRenameDatabases(t *testing.T) {
+	rename := map[string]string{"prod": "staging", "my-db": "my db"}
+	tests := []struct {
+		stmt string
+		want string
+	}{
+		{stmt: "USE `prod`;\n", want: "USE `staging`;\n"},
+		{stmt: "USE prod;\n", want: "USE `staging`;\n"},
+		{stmt: "CREATE DATABASE /*!32312 IF NOT EXISTS*/ `prod` /*!40100 DEFAULT CHARACTER SET utf8mb4 */;\n", want: "CREATE DATABASE /*!32312 IF NOT EXISTS*/ `staging` /*!40100 DEFAULT CHARACTER SET utf8mb4 */;\n"},
+		{stmt: "CREATE DATABASE IF NOT EXISTS prod;\n", want: "CREATE DATABASE IF NOT EXISTS `staging`;\n"},
+		{stmt: "USE `my-db`;\n", want: "USE `my db`;\n"},
+		{stmt: "USE `shop`;\n", want: "USE `shop`;\n"},
+		{
+			stmt: "CREATE VIEW `v` AS select `prod`.`orders`.`id` AS `id` from prod.orders join `my-db`.`users`;\n",
+			want: "CREATE VIEW `v` AS select `staging`.`orders`.`id` AS `id` from `staging`.orders join `my db`.`users`;\n",
+		},
+		// a table named like the database, a qualified table named like it and the string literals are kept
+		{stmt: "DROP TABLE IF EXISTS `prod`;\n", want: "DROP TABLE IF EXISTS `prod`;\n"},
+		{stmt: "SELECT * FROM `shop`.`prod`.x;\n", want: "SELECT * FROM `shop`.`prod`.x;\n"},
+		{stmt: "UPDATE t SET note = 'moved from prod.orders', `x` = \"prod.y\";\n", want: "UPDATE t SET note = 'moved from prod.orders', `x` = \"prod.y\";\n"},
+		{stmt: "INSERT INTO `orders` VALUES (1,'prod.orders');\n", want: "INSERT INTO `orders` VALUES (1,'prod.orders');\n"},
+	}
+	for _, tt := range tests {
+		if got := renameDatabases(sqlStatement{text: tt.stmt}, rename); got != tt.want {
+			t.Errorf("renameDatabases(%q) = %q, want %q", tt.stmt, got, tt.want)
+		}
+	}
+
+	comment := sqlStatement{text: "-- Current Database: `prod`\n", comment: true}
+	if got := renameDatabases(comment, rename); got != "-- Current Database: `staging`\n" {
+		t.Errorf("renameDatabases(%q) = %q", comment.text, got)
+	}
+}
+
+func TestFilterRenamesTheDatabasesOfTheDump(t *testing.T) {
+	out := runFilterSQL(t, multiDatabaseDump, sqlFilterOptions{databaseRename: map[string]string{"shop": "staging"}})
+	if strings.Contains(out, "`shop`") {
+		t.Errorf("the restore still writes to shop:\n%s", out)
+	}
+	for _, s := range []string{"CREATE DATABASE /*!32312 IF NOT EXISTS*/ `staging`", "USE `staging`;", "USE `crm`;"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("the restore lacks %q", s)
+		}
+	}
+}
+
+func TestRewriteDefiners(t *testing.T) {
+	dump := "USE `shop`;\n" +
+		"/*!50001 CREATE ALGORITHM=UNDEFINED */\n" +
+		"/*!50013 DEFINER=`app`@`%` SQL SECURITY DEFINER */\n" +
+		"/*!50001 VIEW `recent_orders` AS select `orders`.`id` AS `id` from `orders` */;\n" +
+		"DELIMITER ;;\n" +
+		"CREATE DEFINER=`root`@`localhost` PROCEDURE `archive`(IN days INT)\n" +
+		"BEGIN\n" +
+		"  INSERT INTO audit VALUES ('DEFINER=`root`@`localhost`');\n" +
+		"END ;;\n" +
+		"DELIMITER ;\n" +
+		"/*!50003 CREATE*/ /*!50017 DEFINER=app@localhost*/ /*!50003 TRIGGER orders_ai AFTER INSERT ON orders FOR EACH ROW SET @n = @n + 1 */;\n" +
+		"CREATE DEFINER='report'@'10.0.%' EVENT purge ON SCHEDULE EVERY 1 DAY DO DELETE FROM sessions;\n" +
+		"CREATE DEFINER=`app_role` FUNCTION f() RETURNS INT RETURN 1;\n" +
+		"CREATE DEFINER=CURRENT_USER() VIEW v2 AS SELECT 1;\n" +
+		"INSERT INTO `notes` VALUES (1,'DEFINER=`root`@`localhost`');\n"
+
+	tests := []struct {
+		mode string
+		want []string
+	}{
+		{
+			mode: DefinerStrip,
+			want: []string{
+				"/*!50013 SQL SECURITY DEFINER */",
+				"CREATE PROCEDURE `archive`(IN days INT)",
+				"/*!50017 */ /*!50003 TRIGGER orders_ai",
+				"CREATE EVENT purge",
+				"CREATE FUNCTION f()",
+				"CREATE VIEW v2",
+			},
+		},
+		{
+			mode: DefinerCurrentUser,
+			want: []string{
+				"/*!50013 DEFINER=CURRENT_USER SQL SECURITY DEFINER */",
+				"CREATE DEFINER=CURRENT_USER PROCEDURE `archive`(IN days INT)",
+				"/*!50017 DEFINER=CURRENT_USER */ /*!50003 TRIGGER orders_ai",
+				"CREATE DEFINER=CURRENT_USER EVENT purge",
+				"CREATE DEFINER=CURRENT_USER FUNCTION f()",
+				"CREATE DEFINER=CURRENT_USER VIEW v2",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			out := runFilterSQL(t, dump, sqlFilterOptions{definerMode: tt.mode})
+			for _, s := range tt.want {
+				if !strings.Contains(out, s) {
+					t.Errorf("the restore lacks %q:\n%s", s, out)
+				}
+			}
+			// the body of the procedure and the rows are kept as they are
+			for _, s := range []string{"INSERT INTO audit VALUES ('DEFINER=`root`@`localhost`');", "INSERT INTO `notes` VALUES (1,'DEFINER=`root`@`localhost`');"} {
+				if !strings.Contains(out, s) {
+					t.Errorf("the restore rewrote %q:\n%s", s, out)
+				}
+			}
+			for _, s := range []string{"`app`@`%`", "app@localhost", "'report'@'10.0.%'", "`app_role`"} {
+				if strings.Contains(out, s) {
+					t.Errorf("the restore keeps the definer %s:\n%s", s, out)
+				}
+			}
+		})
+	}
+}
+
+func TestSchemaOnly(t *testing.T) {
+	dump := "/*!40101 SET NAMES utf8mb4 */;\n" +
+		"USE `shop`;\n" +
+		"DROP TABLE IF EXISTS `orders`;\n" +
+		"CREATE TABLE `orders` (\n  `id` int(11) NOT NULL,\n  `note` text,\n  PRIMARY KEY (`id`)\n) ENGINE=InnoDB;\n" +
+		"ALTER TABLE `orders` ADD INDEX `note_idx` (`note`(16));\n" +
+		"LOCK TABLES `orders` WRITE;\n" +
+		"/*!40000 ALTER TABLE `orders` DISABLE KEYS */;\n" +
+		"INSERT INTO `orders` VALUES (1,'first; CREATE TABLE fake (id int);'),\n(2,'second'),\n(3,'it''s /*!40000 not a comment */');\n" +
+		"/*!40000 ALTER TABLE `orders` ENABLE KEYS */;\n" +
+		"UNLOCK TABLES;\n" +
+		"REPLACE INTO `orders` VALUES (4,'replaced');\n" +
+		"LOAD DATA LOCAL INFILE '/tmp/orders.csv' INTO TABLE `orders`;\n" +
+		"/*!50001 CREATE VIEW `recent_orders` AS select `orders`.`id` AS `id` from `orders` */;\n" +
+		"DELIMITER ;;\n" +
+		"/*!50003 CREATE*/ /*!50003 TRIGGER orders_ai AFTER INSERT ON orders FOR EACH ROW INSERT INTO audit VALUES (NEW.id) */;;\n" +
+		"CREATE PROCEDURE `archive`()\nBEGIN\n  INSERT INTO archive SELECT * FROM orders;\nEND ;;\n" +
+		"DELIMITER ;\n" +
+		"-- Dump completed on 2024-05-01 10:00:00\n"
+
+	out := runFilterSQL(t, dump, sqlFilterOptions{schemaOnly: true})
+	for _, s := range []string{
+		"SET NAMES utf8mb4",
+		"DROP TABLE IF EXISTS `orders`;",
+		"CREATE TABLE `orders` (",
+		"ALTER TABLE `orders` ADD INDEX `note_idx`",
+		"CREATE VIEW `recent_orders`",
+		"TRIGGER orders_ai AFTER INSERT ON orders FOR EACH ROW INSERT INTO audit VALUES (NEW.id)",
+		"INSERT INTO archive SELECT * FROM orders;",
+	} {
+		if !strings.Contains(out, s) {
+			t.Errorf("the schema-only restore lacks %q:\n%s", s, out)
+		}
+	}
+	for _, s := range []string{"first", "second", "not a comment", "CREATE TABLE fake", "LOCK TABLES", "UNLOCK TABLES", "DISABLE KEYS", "ENABLE KEYS", "replaced", "LOAD DATA"} {
+		if strings.Contains(out, s) {
+			t.Errorf("the schema-only restore replays %q:\n%s", s, out)
+		}
+	}
+
+	// without the option the dump is replayed whole
+	if out := runFilterSQL(t, dump, sqlFilterOptions{definerMode: DefinerStrip}); !strings.Contains(out, "(2,'second')") || !strings.Contains(out, "LOAD DATA") {
+		t.Errorf("the restore dropped the rows:\n%s", out)
+	}
+}
+
+func TestIsDataStatement(t *testing.T) {
+	tests := map[string]bool{
+		"INSERT INTO `orders` VALUES (1),(2);":                     true,
+		"insert ignore into orders values (1);":                    true,
+		"REPLACE INTO `orders` VALUES (1);":                        true,
+		"LOAD DATA INFILE 'orders.csv' INTO TABLE orders;":         true,
+		"LOAD XML INFILE 'orders.xml' INTO TABLE orders;":          true,
+		"LOCK TABLES `orders` WRITE;":                              true,
+		"UNLOCK TABLES;":                                           true,
+		"/*!40000 ALTER TABLE `orders` DISABLE KEYS */;":           true,
+		"/*M!100101 /*!40000 ALTER TABLE `orders` ENABLE KEYS */;": true,
+		"ALTER TABLE `orders` ADD INDEX `idx` (`note`);":           false,
+		"CREATE TABLE `inserts` (`id` int);":                       false,
+		"/*!50001 CREATE VIEW `v` AS SELECT 1 */;":                 false,
+		"CREATE PROCEDURE p() BEGIN INSERT INTO t VALUES (1); END": false,
+		"/*!40101 SET NAMES utf8mb4 */;":                           false,
+		"INSERTED_AT_DEFAULT;":                                     false,
+	}
+	for stmt, want := range tests {
+		if got := isDataStatement(stmt); got != want {
+			t.Errorf("isDataStatement(%q) = %v, want %v", stmt, got, want)
+		}
+	}
+}
+
+func TestSchemaOnlyArgs(t *testing.T) {
+	o := sqlFilterOptions{schemaOnly: true}
+	if !o.enabled() || countArg(o.args(), "--schema-only") != 1 {
+		t.Errorf("the filter of a schema-only restore is enabled: %v, with %v", o.enabled(), o.args())
+	}
+}
+
+func TestExcludeTables(t *testing.T) {
+	dump := "/*!40101 SET NAMES utf8mb4 */;\n" +
+		"CREATE DATABASE /*!32312 IF NOT EXISTS*/ `shop`;\n" +
+		"USE `shop`;\n" +
+		"DROP TABLE IF EXISTS `audit_log`;\n" +
+		"CREATE TABLE `audit_log` (\n  `id` int(11) NOT NULL,\n  `entry` text\n) ENGINE=InnoDB;\n" +
+		"LOCK TABLES `audit_log` WRITE;\n" +
+		"/*!40000 ALTER TABLE `audit_log` DISABLE KEYS */;\n" +
+		"INSERT INTO `audit_log` VALUES (1,'huge'),\n(2,'huger');\n" +
+		"/*!40000 ALTER TABLE `audit_log` ENABLE KEYS */;\n" +
+		"UNLOCK TABLES;\n" +
+		"DROP TABLE IF EXISTS `audit_log_archive`;\n" +
+		"CREATE TABLE `audit_log_archive` (`id` int(11) NOT NULL) ENGINE=InnoDB;\n" +
+		"INSERT INTO `audit_log_archive` VALUES (3);\n" +
+		"DROP TABLE IF EXISTS `orders`;\n" +
+		"CREATE TABLE `orders` (\n  `id` int(11) NOT NULL,\n  `note` text\n) ENGINE=InnoDB;\n" +
+		"LOCK TABLES `orders` WRITE;\n" +
+		"INSERT INTO `orders` VALUES (1,'INSERT INTO `audit_log` VALUES (9)'),(2,'second order');\n" +
+		"UNLOCK TABLES;\n" +
+		"CREATE TABLE `odd.name` (`id` int(11) NOT NULL) ENGINE=InnoDB;\n" +
+		"INSERT INTO `odd.name` VALUES (4);\n" +
+		"CREATE TABLE `odd` (`id` int(11) NOT NULL) ENGINE=InnoDB;\n" +
+		"INSERT INTO `odd` VALUES (5);\n" +
+		"DELIMITER ;;\n" +
+		"/*!50003 CREATE*/ /*!50017 DEFINER=`root`@`%`*/ /*!50003 TRIGGER audit_log_bi BEFORE INSERT ON `audit_log` FOR EACH ROW SET NEW.entry = TRIM(NEW.entry) */;;\n" +
+		"/*!50003 CREATE*/ /*!50017 DEFINER=`root`@`%`*/ /*!50003 TRIGGER orders_ai AFTER INSERT ON `orders` FOR EACH ROW INSERT INTO audit_log VALUES (NEW.id, 'order') */;;\n" +
+		"DELIMITER ;\n" +
+		"/*!50001 CREATE VIEW `recent_audit` AS select `audit_log`.`id` AS `id` from `audit_log` */;\n" +
+		"CREATE DATABASE /*!32312 IF NOT EXISTS*/ `crm`;\n" +
+		"USE `crm`;\n" +
+		"CREATE TABLE `audit_log` (`id` int(11) NOT NULL) ENGINE=InnoDB;\n" +
+		"INSERT INTO `audit_log` VALUES (6);\n" +
+		"INSERT INTO shop.orders VALUES (7,'cross database');\n" +
+		"INSERT INTO `shop`.`audit_log` VALUES (8,'cross database');\n" +
+		"-- Dump completed on 2024-05-01 10:00:00\n"
+
+	out := runFilterSQL(t, dump, sqlFilterOptions{excludeTables: []string{"shop.audit_log", "shop.`odd.name`"}})
+	for _, s := range []string{
+		"DROP TABLE IF EXISTS `audit_log`;",
+		"CREATE TABLE `audit_log` (\n",
+		"LOCK TABLES `audit_log` WRITE;",
+		"ALTER TABLE `audit_log` DISABLE KEYS",
+		"(1,'huge')",
+		"TRIGGER audit_log_bi",
+		"CREATE TABLE `odd.name`",
+		"(4)",
+		"(8,'cross database')",
+	} {
+		if strings.Contains(out, s) {
+			t.Errorf("the restore replays %q of an excluded table:\n%s", s, out)
+		}
+	}
+	for _, s := range []string{
+		"USE `shop`;",
+		"CREATE TABLE `audit_log_archive`",
+		"INSERT INTO `audit_log_archive` VALUES (3);",
+		"CREATE TABLE `orders` (",
+		"LOCK TABLES `orders` WRITE;",
+		"INSERT INTO `orders` VALUES (1,'INSERT INTO `audit_log` VALUES (9)'),(2,'second order');",
+		"CREATE TABLE `odd` (",
+		"INSERT INTO `odd` VALUES (5);",
+		// the trigger of another table keeps the statements of its body
+		"TRIGGER orders_ai AFTER INSERT ON `orders` FOR EACH ROW INSERT INTO audit_log VALUES (NEW.id, 'order')",
+		"CREATE VIEW `recent_audit`",
+		// the table of the same name in another database
+		"CREATE TABLE `audit_log` (`id` int(11) NOT NULL) ENGINE=InnoDB;",
+		"INSERT INTO `audit_log` VALUES (6);",
+		"INSERT INTO shop.orders VALUES (7,'cross database');",
+		"-- Dump completed on",
+	} {
+		if !strings.Contains(out, s) {
+			t.Errorf("the restore lacks %q:\n%s", s, out)
+		}
+	}
+}
+
+func TestExcludeTablesOfADatabaseDump(t *testing.T) {
+	// the dump of a single database never switches to it
+	dump := "CREATE TABLE `audit_log` (`id` int(11) NOT NULL) ENGINE=InnoDB;\n" +
+		"INSERT INTO `audit_log` VALUES (1);\n" +
+		"CREATE TABLE `orders` (`id` int(11) NOT NULL) ENGINE=InnoDB;\n" +
+		"INSERT INTO `orders` VALUES (2);\n"
+
+	out := runFilterSQL(t, dump, sqlFilterOptions{excludeTables: []string{"shop.audit_log"}, defaultDatabase: "shop"})
+	if want := "CREATE TABLE `orders` (`id` int(11) NOT NULL) ENGINE=InnoDB;\nINSERT INTO `orders` VALUES (2);\n"; out != want {
+		t.Errorf("the restore replays:\n%s\nwant:\n%s", out, want)
+	}
+	if out := runFilterSQL(t, dump, sqlFilterOptions{excludeTables: []string{"shop.audit_log"}, defaultDatabase: "crm"}); out != dump {
+		t.Errorf("the restore of another database replays:\n%s\nwant:\n%s", out, dump)
+	}
+}
+
+func TestStatementTable(t *testing.T) {
+	tests := []struct {
+		text      string
+		wantDB    string
+		wantTable string
+		wantOK    bool
+	}{
+		{text: "CREATE TABLE `orders` (`id` int);", wantDB: "shop", wantTable: "orders", wantOK: true},
+		{text: "CREATE OR REPLACE TABLE IF NOT EXISTS crm.contacts (id int);", wantDB: "crm", wantTable: "contacts", wantOK: true},
+		{text: "DROP TABLE IF EXISTS `we``ird`;", wantDB: "shop", wantTable: "we`ird", wantOK: true},
+		{text: "INSERT IGNORE INTO `crm`.`odd.name` VALUES (1);", wantDB: "crm", wantTable: "odd.name", wantOK: true},
+		{text: "REPLACE INTO orders VALUES (1);", wantDB: "shop", wantTable: "orders", wantOK: true},
+		{text: "/*!40000 ALTER TABLE `orders` DISABLE KEYS */;", wantDB: "shop", wantTable: "orders", wantOK: true},
+		{text: "LOAD DATA LOCAL INFILE '/tmp/orders.csv' INTO TABLE `orders`;", wantDB: "shop", wantTable: "orders", wantOK: true},
+		{text: "/*!50003 CREATE*/ /*!50003 TRIGGER `shop`.`orders_ai` AFTER INSERT ON `orders` FOR EACH ROW SET @n = 1 */;;", wantDB: "shop", wantTable: "orders", wantOK: true},
+		{text: "/*!50001 CREATE VIEW `recent` AS select `orders`.`id` AS `id` from `orders` */;"},
+		{text: "CREATE PROCEDURE `archive`()\nBEGIN\n  INSERT INTO archive SELECT * FROM orders;\nEND ;;"},
+		{text: "SELECT 'CREATE TABLE orders';"},
+	}
+	for _, tt := range tests {
+		db, table, ok := statementTable(sqlStatement{text: tt.text}, "shop")
+		if db != tt.wantDB || table != tt.wantTable || ok != tt.wantOK {
+			t.Errorf("statementTable(%q) = %q, %q, %v, want %q, %q, %v", tt.text, db, table, ok, tt.wantDB, tt.wantTable, tt.wantOK)
+		}
+	}
+	if _, _, ok := statementTable(sqlStatement{text: "-- CREATE TABLE `orders`", comment: true}, "shop"); ok {
+		t.Errorf("statementTable() found the table of a comment")
+	}
+}
+
+func TestInvalidExcludedTables(t *testing.T) {
+	for _, entry := range []string{"audit_log", "shop.", "`shop`audit_log"} {
+		var out bytes.Buffer
+		if err := filterSQL(strings.NewReader("SELECT 1;\n"), &out, sqlFilterOptions{excludeTables: []string{entry}}); err == nil || !strings.Contains(err.Error(), "must be of the form <database>.<table>") {
+			t.Errorf("filterSQL() with the excluded table %q error = %v, want the entry to be rejected", entry, err)
+		}
+	}
+}
+
+// keysDump loads the rows of a MyISAM table dumped with --skip-disable-keys, of an Aria table whose keys
+// mariadb-dump disables itself and of a table whose rows end the dump
+const keysDump = "USE `shop`;\n" +
+	"CREATE TABLE `orders` (`id` int(11) NOT NULL, KEY `id` (`id`)) ENGINE=MyISAM;\n" +
+	"LOCK TABLES `orders` WRITE;\n" +
+	"INSERT INTO `orders` VALUES (1),(2);\n" +
+	"-- more rows\n" +
+	"INSERT INTO `orders` VALUES (3);\n" +
+	"UNLOCK TABLES;\n" +
+	"CREATE TABLE `items` (`id` int(11) NOT NULL, KEY `id` (`id`)) ENGINE=Aria;\n" +
+	"LOCK TABLES `items` WRITE;\n" +
+	"/*!40000 ALTER TABLE `items` DISABLE KEYS */;\n" +
+	"INSERT INTO `items` VALUES (1);\n" +
+	"/*!40000 ALTER TABLE `items` ENABLE KEYS */;\n" +
+	"UNLOCK TABLES;\n" +
+	"CREATE TABLE `notes` (`id` int(11) NOT NULL) ENGINE=MyISAM;\n" +
+	"INSERT INTO `notes` VALUES (1);\n"
+
+func TestDisableKeys(t *testing.T) {
+	want := "USE `shop`;\n" +
+		"CREATE TABLE `orders` (`id` int(11) NOT NULL, KEY `id` (`id`)) ENGINE=MyISAM;\n" +
+		"LOCK TABLES `orders` WRITE;\n" +
+		"ALTER TABLE `shop`.`orders` DISABLE KEYS;\n" +
+		"INSERT INTO `orders` VALUES (1),(2);\n" +
+		"-- more rows\n" +
+		"INSERT INTO `orders` VALUES (3);\n" +
+		"ALTER TABLE `shop`.`orders` ENABLE KEYS;\n" +
+		"UNLOCK TABLES;\n" +
+		"CREATE TABLE `items` (`id` int(11) NOT NULL, KEY `id` (`id`)) ENGINE=Aria;\n" +
+		"LOCK TABLES `items` WRITE;\n" +
+		"/*!40000 ALTER TABLE `items` DISABLE KEYS */;\n" +
+		"INSERT INTO `items` VALUES (1);\n" +
+		"/*!40000 ALTER TABLE `items` ENABLE KEYS */;\n" +
+		"UNLOCK TABLES;\n" +
+		"CREATE TABLE `notes` (`id` int(11) NOT NULL) ENGINE=MyISAM;\n" +
+		"ALTER TABLE `shop`.`notes` DISABLE KEYS;\n" +
+		"INSERT INTO `notes` VALUES (1);\n" +
+		"ALTER TABLE `shop`.`notes` ENABLE KEYS;\n"
+	if out := runFilterSQL(t, keysDump, sqlFilterOptions{disableKeys: true}); out != want {
+		t.Errorf("the restore replays:\n%s\nwant:\n%s", out, want)
+	}
+
+	// the keys of the renamed database are disabled
+	out := runFilterSQL(t, keysDump, sqlFilterOptions{disableKeys: true, databaseRename: map[string]string{"shop": "shop_copy"}})
+	for _, s := range []string{"ALTER TABLE `shop_copy`.`orders` DISABLE KEYS;\n", "ALTER TABLE `shop_copy`.`orders` ENABLE KEYS;\nUNLOCK TABLES;\n"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("the restore into shop_copy replays:\n%s\nwant %q", out, s)
+		}
+	}
+	if strings.Contains(out, "`shop`.") {
+		t.Errorf("the restore into shop_copy disables the keys of shop:\n%s", out)
+	}
+
+	if out := runFilterSQL(t, keysDump, sqlFilterOptions{}); out != keysDump {
+		t.Errorf("the restore without a fast load replays:\n%s\nwant the dump unchanged", out)
+	}
+}
+
+func TestDisableKeysFilterArgs(t *testing.T) {
+	opt := sqlFilterOptions{disableKeys: true}
+	if !opt.rewrites() || countArg(opt.args(), "--disable-keys") != 1 {
+		t.Errorf("the filter of a fast load runs with %q, want --disable-keys", opt.args())
+	}
+	cmd := NewCmdFilterSQL()
+	if err := cmd.Flags().Parse([]string{"--disable-keys"}); err != nil {
+		t.Fatal(err)
+	}
+	if disableKeys, err := cmd.Flags().GetBool("disable-keys"); err != nil || !disableKeys {
+		t.Errorf("filter-sql --disable-keys = %v, %v", disableKeys, err)
+	}
+}
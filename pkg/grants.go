@@ -0,0 +1,243 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"stash.appscode.dev/apimachinery/pkg/restic"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	GrantsFileName = "grants.sql"
+)
+
+// accounts of the server itself, their grants and credentials are never dumped
+var systemAccounts = []string{"", "root", "mysql", "mariadb.sys", "mysql.sys", "mysql.session", "mysql.infoschema"}
+
+var (
+	// a grantee as listed by information_schema, i.e. 'app'@'%', or 'role' for a role
+	granteeRegex = regexp.MustCompile(`^'((?:[^']|'')*)'(?:@'((?:[^']|'')*)')?$`)
+	// the database of the object of a GRANT statement, i.e. GRANT SELECT ON `app`.* TO ...
+	grantDatabaseRegex = regexp.MustCompile("(?i)^GRANT\\s.*?\\sON\\s+(?:(?:TABLE|FUNCTION|PROCEDURE|PACKAGE\\s+BODY|PACKAGE)\\s+)?(`(?:[^`]|``)+`|[^\\s.`*]+)\\.")
+	// the role granted by a membership grant, i.e. GRANT `reporting` TO `app`@`%`
+	grantRoleRegex = regexp.MustCompile("(?i)^GRANT\\s+(`(?:[^`]|``)+`)\\s+TO\\s")
+	// the default role of an account, i.e. SET DEFAULT ROLE `reporting` FOR `app`@`%`
+	defaultRoleRegex = regexp.MustCompile("(?i)^SET\\s+DEFAULT\\s+ROLE\\s+(`(?:[^`]|``)+`)\\s+FOR\\s")
+)
+
+// grantee is an account or a role holding privileges on the dumped databases
+type grantee struct {
+	user string
+	host string
+	role bool
+}
+
+func (g grantee) String() string {
+	if g.role {
+		return quoteIdentifier(g.user)
+	}
+	return quoteIdentifier(g.user) + "@" + quoteIdentifier(g.host)
+}
+
+func parseGrantee(s string) (grantee, bool) {
+	m := granteeRegex.FindStringSubmatchIndex(s)
+	if m == nil {
+		return grantee{}, false
+	}
+	g := grantee{user: strings.ReplaceAll(s[m[2]:m[3]], "''", "'")}
+	if m[4] < 0 {
+		g.role = true
+	} else {
+		g.host = strings.ReplaceAll(s[m[4]:m[5]], "''", "'")
+	}
+	return g, true
+}
+
+// grantees returns the accounts and roles, other than the system accounts, holding privileges on the databases
+func (session *sessionWrapper) grantees(databases []string) ([]grantee, error) {
+	if len(databases) == 0 {
+		return nil, nil
+	}
+	schemas := make([]string, 0, len(databases))
+	for _, db := range databases {
+		schemas = append(schemas, quoteString(db))
+	}
+	in := strings.Join(schemas, ",")
+	query := fmt.Sprintf("SELECT GRANTEE FROM information_schema.SCHEMA_PRIVILEGES WHERE TABLE_SCHEMA IN (%[1]s) "+
+		"UNION SELECT GRANTEE FROM information_schema.TABLE_PRIVILEGES WHERE TABLE_SCHEMA IN (%[1]s) "+
+		"UNION SELECT GRANTEE FROM information_schema.COLUMN_PRIVILEGES WHERE TABLE_SCHEMA IN (%[1]s);", in)
+	output, err := session.executeQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the accounts granted privileges on the databases: %w", err)
+	}
+
+	var grantees []grantee
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		g, ok := parseGrantee(line)
+		if !ok {
+			return nil, fmt.Errorf("invalid grantee %q", line)
+		}
+		if !g.role && containsString(systemAccounts, g.user) {
+			continue
+		}
+		grantees = append(grantees, g)
+	}
+	sort.Slice(grantees, func(i, j int) bool { return grantees[i].String() < grantees[j].String() })
+	return grantees, nil
+}
+
+// grantDatabase returns the position in the statement of the database a GRANT statement applies to, if any
+func grantDatabase(stmt string) (int, int, bool) {
+	m := grantDatabaseRegex.FindStringSubmatchIndex(stmt)
+	if m == nil {
+		return 0, 0, false
+	}
+	return m[2], m[3], true
+}
+
+// grantedRole returns the role a membership grant or a default role statement applies to, if any
+func grantedRole(stmt string) (string, bool) {
+	for _, r := range []*regexp.Regexp{grantRoleRegex, defaultRoleRegex} {
+		if m := r.FindStringSubmatch(stmt); m != nil {
+			return unquoteIdentifier(m[1]), true
+		}
+	}
+	return "", false
+}
+
+// dumpGrants returns the statements creating the grantees of the databases and granting them their
+// privileges on these databases. Global privileges are not dumped. The accounts are created before
+// any privilege is granted, without replacing the accounts that exist on the target. The memberships
+// of the roles among the grantees and the default roles are granted last, once the roles exist.
+func (session *sessionWrapper) dumpGrants(databases []string) (string, error) {
+	grantees, err := session.grantees(databases)
+	if err != nil {
+		return "", err
+	}
+	var roles []string
+	for _, g := range grantees {
+		if g.role {
+			roles = append(roles, g.user)
+		}
+	}
+
+	var creates, grants, memberships, defaultRoles []string
+	for _, g := range grantees {
+		if g.role {
+			creates = append(creates, fmt.Sprintf("CREATE ROLE IF NOT EXISTS %s;", g))
+		} else {
+			output, err := session.executeQuery(fmt.Sprintf("SHOW CREATE USER %s;", g))
+			if err != nil {
+				return "", fmt.Errorf("failed to read the account %s: %w", g, err)
+			}
+			create := strings.TrimSpace(string(output))
+			creates = append(creates, "CREATE USER IF NOT EXISTS "+strings.TrimPrefix(create, "CREATE USER ")+";")
+		}
+
+		output, err := session.executeQuery(fmt.Sprintf("SHOW GRANTS FOR %s;", g))
+		if err != nil {
+			return "", fmt.Errorf("failed to read the grants of %s: %w", g, err)
+		}
+		for _, grant := range strings.Split(string(output), "\n") {
+			grant = strings.TrimSpace(grant)
+			if role, ok := grantedRole(grant); ok {
+				if !containsString(roles, role) {
+					continue
+				}
+				if strings.HasPrefix(strings.ToUpper(grant), "SET") {
+					defaultRoles = append(defaultRoles, grant+";")
+				} else {
+					memberships = append(memberships, grant+";")
+				}
+				continue
+			}
+			start, end, ok := grantDatabase(grant)
+			if !ok || !containsString(databases, unquoteIdentifier(grant[start:end])) {
+				continue
+			}
+			grants = append(grants, grant+";")
+		}
+	}
+
+	var script strings.Builder
+	script.WriteString("-- Accounts granted privileges on the dumped databases\n")
+	statements := append(creates, grants...)
+	statements = append(statements, memberships...)
+	statements = append(statements, defaultRoles...)
+	for _, stmt := range statements {
+		script.WriteString(stmt + "\n")
+	}
+	return script.String(), nil
+}
+
+// writeGrants writes the grants of the databases into the dump directory
+func (session *sessionWrapper) writeGrants(dumpdir string, databases []string) error {
+	script, err := session.dumpGrants(databases)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dumpdir, GrantsFileName), []byte(script), 0o600)
+}
+
+// filterGrants keeps the statements of the script applying to the database, if any, and renames the databases.
+// The statements creating the accounts and granting them their roles are always kept.
+func filterGrants(script, database string, rename map[string]string) string {
+	var out strings.Builder
+	for _, stmt := range strings.Split(script, "\n") {
+		if start, end, ok := grantDatabase(stmt); ok {
+			db := unquoteIdentifier(stmt[start:end])
+			if database != "" && db != database {
+				continue
+			}
+			if to, ok := rename[db]; ok {
+				stmt = stmt[:start] + quoteIdentifier(to) + stmt[end:]
+			}
+		}
+		if strings.TrimSpace(stmt) != "" {
+			out.WriteString(stmt + "\n")
+		}
+	}
+	return out.String()
+}
+
+// replayGrants replays the grants recorded in the snapshot, once the data has been restored
+// so that the privileges on tables and routines find their objects
+func (opt *mariadbOptions) replayGrants(session *sessionWrapper, resticWrapper *restic.ResticWrapper) error {
+	fileName := filepath.Join(opt.setupOptions.ScratchDir, MariaDBDumpDir, GrantsFileName)
+	data, err := readSnapshotFile(resticWrapper, opt.dumpOptions, fileName)
+	if err != nil {
+		return fmt.Errorf("failed to read the grants, was the backup taken with --dump-grants? %w", err)
+	}
+	script := filterGrants(string(data), opt.sqlFilterOptions.database, opt.sqlFilterOptions.databaseRename)
+	klog.Infoln("Restoring the grants of the databases....")
+	if _, err = session.executeQuery(script); err != nil {
+		return fmt.Errorf("failed to restore the grants: %w", err)
+	}
+	return nil
+}
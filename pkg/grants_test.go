@@ -0,0 +1,173 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeGrantsClient returns a fake mariadb client answering the queries listing the grantees of the databases
+// and their grants, and the file recording the queries it ran
+func fakeGrantsClient(t *testing.T) (string, string) {
+	t.Helper()
+	return fakeQueryClient(t, map[string]string{
+		"SELECT GRANTEE*":             "'app'@'%'\n'root'@'localhost'\n'mariadb.sys'@'localhost'\n'reporting'\n''@'localhost'\n",
+		"SHOW CREATE USER `app`@`%`;": "CREATE USER `app`@`%` IDENTIFIED BY PASSWORD '*0F1E'\n",
+		"SHOW GRANTS FOR `app`@`%`;": "GRANT USAGE ON *.* TO `app`@`%`\n" +
+			"GRANT SELECT, INSERT ON `shop`.* TO `app`@`%`\n" +
+			"GRANT ALL PRIVILEGES ON `hr`.* TO `app`@`%`\n" +
+			"GRANT `reporting` TO `app`@`%`\n" +
+			"GRANT `auditor` TO `app`@`%` WITH ADMIN OPTION\n" +
+			"SET DEFAULT ROLE `reporting` FOR `app`@`%`\n",
+		"SHOW GRANTS FOR `reporting`;": "GRANT SELECT ON `shop`.`orders` TO `reporting`\n" +
+			"GRANT EXECUTE ON PROCEDURE `crm`.`report` TO `reporting`\n",
+	})
+}
+
+func TestDumpGrants(t *testing.T) {
+	opt := &mariadbOptions{}
+	client, queries := fakeGrantsClient(t)
+	session := newFakeSession(t, opt, client)
+
+	script, err := session.dumpGrants([]string{"shop", "crm"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "-- Accounts granted privileges on the dumped databases\n" +
+		"CREATE USER IF NOT EXISTS `app`@`%` IDENTIFIED BY PASSWORD '*0F1E';\n" +
+		"CREATE ROLE IF NOT EXISTS `reporting`;\n" +
+		"GRANT SELECT, INSERT ON `shop`.* TO `app`@`%`;\n" +
+		"GRANT SELECT ON `shop`.`orders` TO `reporting`;\n" +
+		"GRANT EXECUTE ON PROCEDURE `crm`.`report` TO `reporting`;\n" +
+		"GRANT `reporting` TO `app`@`%`;\n" +
+		"SET DEFAULT ROLE `reporting` FOR `app`@`%`;\n"
+	// the auditor role holds no privilege on the databases, so neither is it created nor granted
+	if script != want {
+		t.Errorf("dumpGrants() =\n%s\nwant:\n%s", script, want)
+	}
+
+	// neither the credentials nor the grants of the system accounts are read
+	data, err := os.ReadFile(queries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, account := range []string{"`root`@", "`mariadb.sys`@", "``@"} {
+		if strings.Contains(string(data), account) {
+			t.Errorf("the system account %s was queried:\n%s", account, data)
+		}
+	}
+}
+
+func TestDumpGrantsWithoutDatabases(t *testing.T) {
+	opt := &mariadbOptions{}
+	client, queries := fakeGrantsClient(t)
+	session := newFakeSession(t, opt, client)
+
+	script, err := session.dumpGrants(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "-- Accounts granted privileges on the dumped databases\n"; script != want {
+		t.Errorf("dumpGrants() = %q, want %q", script, want)
+	}
+	if _, err := os.Stat(queries); !os.IsNotExist(err) {
+		t.Errorf("the server was queried without databases to dump the grants of")
+	}
+}
+
+func TestReplayGrants(t *testing.T) {
+	const grants = "-- Accounts granted privileges on the dumped databases\n" +
+		"CREATE USER IF NOT EXISTS `app`@`%` IDENTIFIED BY PASSWORD '*0F1E';\n" +
+		"CREATE ROLE IF NOT EXISTS `reporting`;\n" +
+		"GRANT SELECT, INSERT ON `shop`.* TO `app`@`%`;\n" +
+		"GRANT SELECT ON `shop`.`orders` TO `reporting`;\n" +
+		"GRANT EXECUTE ON PROCEDURE `crm`.`report` TO `reporting`;\n" +
+		"GRANT `reporting` TO `app`@`%`;\n" +
+		"SET DEFAULT ROLE `reporting` FOR `app`@`%`;\n"
+	tests := []struct {
+		name     string
+		database string
+		rename   map[string]string
+		want     string
+	}{
+		{
+			name: "all databases",
+			want: grants,
+		},
+		{
+			name:     "filtered database",
+			database: "crm",
+			want: "-- Accounts granted privileges on the dumped databases\n" +
+				"CREATE USER IF NOT EXISTS `app`@`%` IDENTIFIED BY PASSWORD '*0F1E';\n" +
+				"CREATE ROLE IF NOT EXISTS `reporting`;\n" +
+				"GRANT EXECUTE ON PROCEDURE `crm`.`report` TO `reporting`;\n" +
+				"GRANT `reporting` TO `app`@`%`;\n" +
+				"SET DEFAULT ROLE `reporting` FOR `app`@`%`;\n",
+		},
+		{
+			name:   "renamed database",
+			rename: map[string]string{"shop": "shop_copy"},
+			want: "-- Accounts granted privileges on the dumped databases\n" +
+				"CREATE USER IF NOT EXISTS `app`@`%` IDENTIFIED BY PASSWORD '*0F1E';\n" +
+				"CREATE ROLE IF NOT EXISTS `reporting`;\n" +
+				"GRANT SELECT, INSERT ON `shop_copy`.* TO `app`@`%`;\n" +
+				"GRANT SELECT ON `shop_copy`.`orders` TO `reporting`;\n" +
+				"GRANT EXECUTE ON PROCEDURE `crm`.`report` TO `reporting`;\n" +
+				"GRANT `reporting` TO `app`@`%`;\n" +
+				"SET DEFAULT ROLE `reporting` FOR `app`@`%`;\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := newTestRestoreOptions()
+			opt.sqlFilterOptions.database = tt.database
+			opt.sqlFilterOptions.databaseRename = tt.rename
+			replayed := filepath.Join(t.TempDir(), "replayed.sql")
+			session := newFakeSession(t, opt, fakeCommand(t, `eval query=\${$#}
+printf '%s' "$query" > `+replayed))
+			resticWrapper, _ := newFakeRestic(t, opt, session)
+			storeFakeSnapshot(t, resticWrapper, filepath.Join(opt.setupOptions.ScratchDir, MariaDBDumpDir, GrantsFileName), []byte(grants))
+
+			if err := opt.replayGrants(session, resticWrapper); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(replayed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the accounts exist before any privilege is granted to them
+			if string(data) != tt.want {
+				t.Errorf("replayGrants() replayed:\n%s\nwant:\n%s", data, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplayGrantsOfABackupWithoutGrants(t *testing.T) {
+	opt := newTestRestoreOptions()
+	session := newFakeSession(t, opt, fakeCommand(t, "exit 0"))
+	resticWrapper, _ := newFakeRestic(t, opt, session)
+	storeFakeSnapshot(t, resticWrapper, filepath.Join(opt.setupOptions.ScratchDir, MariaDBDumpDir, MariaDBDumpFile), []byte("CREATE TABLE orders (id int);\n"))
+
+	err := opt.replayGrants(session, resticWrapper)
+	if err == nil || !strings.Contains(err.Error(), "was the backup taken with --dump-grants?") {
+		t.Errorf("replayGrants() error = %v, want the grants to be missing", err)
+	}
+}
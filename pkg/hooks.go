@@ -0,0 +1,137 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// EnvBackupResult tells the post-backup hook whether the backup succeeded
+	EnvBackupResult = "MARIADB_BACKUP_RESULT"
+	BackupSucceeded = "succeeded"
+	BackupFailed    = "failed"
+)
+
+// startBackupHooks runs the pre-backup hook and returns the function finishing the backup, which runs the
+// post-backup hook even if the pre-backup hook failed. It returns the error of the backup, or the failure of
+// the post-backup hook when the backup succeeded. A dry run must not change anything, so the hooks are skipped.
+func (opt *mariadbOptions) startBackupHooks(session *sessionWrapper) (func(backupErr error) error, error) {
+	if opt.dryRun {
+		if opt.preBackupHook != "" || opt.postBackupHook != "" {
+			klog.Infoln("Skipping the backup hooks of the dry run")
+		}
+		return func(backupErr error) error { return backupErr }, nil
+	}
+	finish := func(backupErr error) error {
+		if err := opt.runPostBackupHook(session, backupErr); err != nil {
+			if backupErr == nil {
+				return err
+			}
+			klog.Errorln(err)
+		}
+		return backupErr
+	}
+	return finish, opt.runPreBackupHook(session)
+}
+
+// runPreBackupHook runs the pre-backup hook, i.e. to quiesce an application, a failure aborts the backup
+func (opt *mariadbOptions) runPreBackupHook(session *sessionWrapper) error {
+	if opt.preBackupHook == "" {
+		return nil
+	}
+	if err := session.runHook("pre-backup", opt.preBackupHook, nil, 0); err != nil {
+		return fmt.Errorf("pre-backup hook failed, the backup is aborted: %w", err)
+	}
+	return nil
+}
+
+// runPostBackupHook runs the post-backup hook whether the backup succeeded or not, like a finally block,
+// so that what the pre-backup hook disabled is enabled again. The hook gets the result in MARIADB_BACKUP_RESULT.
+func (opt *mariadbOptions) runPostBackupHook(session *sessionWrapper, backupErr error) error {
+	if opt.postBackupHook == "" {
+		return nil
+	}
+	result := BackupSucceeded
+	if backupErr != nil {
+		result = BackupFailed
+	}
+	if err := session.runHook("post-backup", opt.postBackupHook, map[string]string{EnvBackupResult: result}, 0); err != nil {
+		return fmt.Errorf("post-backup hook failed: %w", err)
+	}
+	return nil
+}
+
+// runHook runs command with sh, with the environment of the database clients but their credentials.
+// The output of the hook is logged line by line. A positive timeout kills the hook when it expires.
+func (session *sessionWrapper) runHook(name, command string, env map[string]string, timeout time.Duration) error {
+	sh := session.newShell()
+	for _, key := range reservedEnv {
+		sh.SetEnv(key, "")
+	}
+	for key, value := range env {
+		sh.SetEnv(key, value)
+	}
+	output := &hookLogWriter{name: name}
+	sh.Stdout = output
+	sh.Stderr = output
+	if timeout > 0 {
+		sh.SetTimeout(timeout)
+	}
+
+	klog.Infof("Running the %s hook: %s", name, command)
+	err := sh.Command("sh", "-c", command).Run()
+	output.flush()
+	if err != nil {
+		return err
+	}
+	klog.Infof("The %s hook succeeded", name)
+	return nil
+}
+
+// hookLogWriter logs each line written by a hook, prefixed with the name of the hook
+type hookLogWriter struct {
+	name string
+	buf  bytes.Buffer
+}
+
+func (w *hookLogWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	for {
+		line, err := w.buf.ReadString('\n')
+		if err != nil {
+			// keep the incomplete line until the rest of it is written
+			w.buf.Reset()
+			w.buf.WriteString(line)
+			return len(p), nil
+		}
+		klog.Infof("[%s hook] %s", w.name, strings.TrimRight(line, "\r\n"))
+	}
+}
+
+// flush logs the last line of the output when it does not end with a newline
+func (w *hookLogWriter) flush() {
+	if w.buf.Len() > 0 {
+		klog.Infof("[%s hook] %s", w.name, w.buf.String())
+		w.buf.Reset()
+	}
+}
@@ -0,0 +1,164 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runBackupWithHooks runs a backup between the backup hooks the way backupMariaDB does, the backup appends to
+// the journal file the hooks append to too and fails with backupErr
+func runBackupWithHooks(t *testing.T, opt *mariadbOptions, session *sessionWrapper, journal string, backupErr error) (err error) {
+	t.Helper()
+	finish, err := opt.startBackupHooks(session)
+	defer func() {
+		err = finish(err)
+	}()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(journal, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString("backup\n"); err != nil {
+		t.Fatal(err)
+	}
+	return backupErr
+}
+
+func TestBackupHooks(t *testing.T) {
+	tests := []struct {
+		name        string
+		preHook     string
+		postHook    string
+		backupErr   error
+		dryRun      bool
+		wantJournal string
+		wantErr     string
+	}{
+		{
+			name:        "succeeded",
+			preHook:     `echo pre >> "$JOURNAL"`,
+			postHook:    `echo "post $MARIADB_BACKUP_RESULT" >> "$JOURNAL"`,
+			wantJournal: "pre\nbackup\npost succeeded\n",
+		},
+		{
+			name:        "backup failed",
+			preHook:     `echo pre >> "$JOURNAL"`,
+			postHook:    `echo "post $MARIADB_BACKUP_RESULT" >> "$JOURNAL"`,
+			backupErr:   errors.New("upload failed"),
+			wantJournal: "pre\nbackup\npost failed\n",
+			wantErr:     "upload failed",
+		},
+		{
+			name:        "pre-backup hook failed",
+			preHook:     `echo pre >> "$JOURNAL"; exit 3`,
+			postHook:    `echo "post $MARIADB_BACKUP_RESULT" >> "$JOURNAL"`,
+			wantJournal: "pre\npost failed\n",
+			wantErr:     "pre-backup hook failed, the backup is aborted",
+		},
+		{
+			name:        "post-backup hook failed",
+			postHook:    `echo "post $MARIADB_BACKUP_RESULT" >> "$JOURNAL"; exit 1`,
+			wantJournal: "backup\npost succeeded\n",
+			wantErr:     "post-backup hook failed",
+		},
+		{
+			name:        "post-backup hook failed after the backup",
+			postHook:    `echo "post $MARIADB_BACKUP_RESULT" >> "$JOURNAL"; exit 1`,
+			backupErr:   errors.New("upload failed"),
+			wantJournal: "backup\npost failed\n",
+			wantErr:     "upload failed",
+		},
+		{
+			name:        "no hooks",
+			wantJournal: "backup\n",
+		},
+		{
+			name:        "dry run",
+			preHook:     `echo pre >> "$JOURNAL"; exit 3`,
+			postHook:    `echo "post $MARIADB_BACKUP_RESULT" >> "$JOURNAL"`,
+			dryRun:      true,
+			wantJournal: "backup\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := newTestBackupOptions()
+			opt.preBackupHook = tt.preHook
+			opt.postBackupHook = tt.postHook
+			opt.dryRun = tt.dryRun
+			session := newFakeSession(t, opt, MariaDBDumpCMD)
+			journal := filepath.Join(t.TempDir(), "journal")
+			session.sh.SetEnv("JOURNAL", journal)
+
+			err := runBackupWithHooks(t, opt, session, journal, tt.backupErr)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("the backup failed with %v, want %q", err, tt.wantErr)
+			}
+			data, err := os.ReadFile(journal)
+			if err != nil && !os.IsNotExist(err) {
+				t.Fatal(err)
+			}
+			if string(data) != tt.wantJournal {
+				t.Errorf("the hooks and the backup ran in the order %q, want %q", data, tt.wantJournal)
+			}
+		})
+	}
+}
+
+func TestBackupHooksRunWithoutThePassword(t *testing.T) {
+	opt := newTestBackupOptions()
+	opt.preBackupHook = `echo "host=$MARIADB_TEST_HOST password=${MYSQL_PWD:-none}"`
+	session := newFakeSession(t, opt, MariaDBDumpCMD)
+	session.sh.SetEnv(EnvMariaDBPassword, "s3cret")
+	session.sh.SetEnv("MARIADB_TEST_HOST", "db-0")
+
+	logs := captureLogs(t, func() {
+		if err := opt.runPreBackupHook(session); err != nil {
+			t.Error(err)
+		}
+	})
+	if !strings.Contains(logs, "[pre-backup hook] host=db-0 password=none") {
+		t.Errorf("the pre-backup hook logged:\n%s\nwant the environment of the clients without the password", logs)
+	}
+	if strings.Contains(logs, "s3cret") {
+		t.Errorf("the password leaked into the logs of the hook:\n%s", logs)
+	}
+}
+
+func TestHookOutputIsLogged(t *testing.T) {
+	opt := newTestBackupOptions()
+	session := newFakeSession(t, opt, MariaDBDumpCMD)
+	logs := captureLogs(t, func() {
+		err := session.runHook("post-backup", `echo flushed the caches; printf 'warning: ' >&2; echo slow >&2; printf done; exit 2`, nil, 0)
+		if err == nil {
+			t.Error("runHook() succeeded, want the exit status of the hook")
+		}
+	})
+	for _, line := range []string{"[post-backup hook] flushed the caches", "[post-backup hook] warning: slow", "[post-backup hook] done"} {
+		if !strings.Contains(logs, line+"\n") {
+			t.Errorf("the hook logged:\n%s\nwant %q", logs, line)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	AuthModePassword = "password"
+	AuthModeAWSIAM   = "aws-iam"
+
+	// an RDS authentication token is valid for 15 minutes, it is renewed well before it expires
+	iamTokenTTL          = 15 * time.Minute
+	iamTokenRefreshAfter = 10 * time.Minute
+
+	iamService = "rds-db"
+)
+
+// authTokenProvider generates the token used as the password of user on the database listening on endpoint (host:port)
+type authTokenProvider interface {
+	authToken(endpoint, user string) (string, error)
+}
+
+// rdsTokenProvider builds RDS IAM authentication tokens, which are presigned rds-db:connect requests,
+// with the credentials of the standard AWS_* environment variables
+type rdsTokenProvider struct {
+	region      string
+	credentials awsCredentials
+	now         func() time.Time
+}
+
+func newRDSTokenProvider(region string) (*rdsTokenProvider, error) {
+	region, err := resolveAWSRegion(region)
+	if err != nil {
+		return nil, fmt.Errorf("IAM authentication: %w", err)
+	}
+	credentials, err := awsCredentialsFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("IAM authentication: %w", err)
+	}
+	return &rdsTokenProvider{
+		region:      region,
+		credentials: credentials,
+		now:         time.Now,
+	}, nil
+}
+
+func (p *rdsTokenProvider) authToken(endpoint, user string) (string, error) {
+	if endpoint == "" || user == "" {
+		return "", fmt.Errorf("the endpoint and the user are required to generate an IAM authentication token")
+	}
+	now := p.now().UTC()
+	amzDate := now.Format(awsDateFormat)
+	scope := awsScope(now, p.region, iamService)
+
+	query := map[string]string{
+		"Action":              "connect",
+		"DBUser":              user,
+		"X-Amz-Algorithm":     awsSignAlgorithm,
+		"X-Amz-Credential":    p.credentials.accessKey + "/" + scope,
+		"X-Amz-Date":          amzDate,
+		"X-Amz-Expires":       strconv.Itoa(int(iamTokenTTL.Seconds())),
+		"X-Amz-SignedHeaders": "host",
+	}
+	if p.credentials.sessionToken != "" {
+		query["X-Amz-Security-Token"] = p.credentials.sessionToken
+	}
+	canonicalQuery := canonicalQueryString(query)
+
+	canonicalRequest := strings.Join([]string{
+		"GET",
+		"/",
+		canonicalQuery,
+		"host:" + endpoint + "\n",
+		"host",
+		sha256Hex(nil),
+	}, "\n")
+	signature := p.credentials.sign(now, p.region, iamService, canonicalRequest)
+	return endpoint + "/?" + canonicalQuery + "&X-Amz-Signature=" + signature, nil
+}
+
+// iamAuth holds what a session needs to renew its IAM authentication token
+type iamAuth struct {
+	provider authTokenProvider
+	user     string
+	// endpoint the token is signed for, defaults to the host and port the session connects to
+	endpoint        string
+	port            int32
+	scratchDir      string
+	useDefaultsFile bool
+
+	// the endpoint the current token was signed for and when it was issued
+	signedFor string
+	issuedAt  time.Time
+}
+
+func (auth *iamAuth) currentEndpoint(host string) string {
+	if auth.endpoint != "" {
+		return auth.endpoint
+	}
+	port := auth.port
+	if port == 0 {
+		port = MariaDBDefaultPort
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port)))
+}
+
+// refreshCredentials renews the IAM authentication token of the session when it is about to expire
+// or was signed for another host. It does nothing for sessions authenticated with a static password.
+func (session *sessionWrapper) refreshCredentials() error {
+	auth := session.auth
+	if auth == nil {
+		return nil
+	}
+	if session.socket != "" && auth.endpoint == "" {
+		return fmt.Errorf("IAM authentication requires a TCP connection, set --aws-endpoint to connect through a unix socket")
+	}
+	endpoint := auth.currentEndpoint(session.host())
+	if endpoint == auth.signedFor && time.Since(auth.issuedAt) < iamTokenRefreshAfter {
+		return nil
+	}
+
+	issuedAt := time.Now()
+	token, err := auth.provider.authToken(endpoint, auth.user)
+	if err != nil {
+		return fmt.Errorf("failed to generate the IAM authentication token: %w", err)
+	}
+	if err := session.setPassword(auth.scratchDir, token, auth.useDefaultsFile); err != nil {
+		return err
+	}
+	if auth.signedFor != "" {
+		klog.V(4).Infof("Renewed the IAM authentication token for %s", endpoint)
+	}
+	auth.signedFor = endpoint
+	auth.issuedAt = issuedAt
+	return nil
+}
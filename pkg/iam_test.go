@@ -0,0 +1,133 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// fakeTokenProvider issues numbered tokens recording the endpoint and the user they are for
+type fakeTokenProvider struct {
+	issued int
+}
+
+func (p *fakeTokenProvider) authToken(endpoint, user string) (string, error) {
+	p.issued++
+	return fmt.Sprintf("token-%d for %s as %s", p.issued, user, endpoint), nil
+}
+
+// passwordOfTheClient runs the client of the session, which prints the password it connects with
+func passwordOfTheClient(t *testing.T, session *sessionWrapper) string {
+	t.Helper()
+	output, err := session.executeQuery("SELECT 1;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(output))
+}
+
+func TestIAMAuthentication(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY")
+	t.Setenv("AWS_SESSION_TOKEN", "")
+	for _, useDefaultsFile := range []bool{false, true} {
+		t.Run(fmt.Sprintf("defaults file %v", useDefaultsFile), func(t *testing.T) {
+			opt := newTestBackupOptions()
+			opt.setupOptions.ScratchDir = t.TempDir()
+			opt.credentialOptions.authMode = AuthModeAWSIAM
+			opt.credentialOptions.awsRegion = "eu-west-1"
+			opt.credentialOptions.useDefaultsFile = useDefaultsFile
+			// the client prints the password of its defaults file, or of the environment
+			client := fakeCommand(t, `case "$1" in
+--defaults-extra-file=*) sed -n 's/^password="\(.*\)"$/\1/p' "${1#--defaults-extra-file=}" ;;
+*) echo "$MYSQL_PWD" ;;
+esac`)
+			opt.clientCmd = client
+			session, err := opt.prepareSession(newTestAppBinding(opt), client, opt.setupOptions.ScratchDir)
+			defer session.cleanup()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the token of RDS is used as the password instead of the password of the secret
+			token := passwordOfTheClient(t, session)
+			if !strings.HasPrefix(token, "db.demo.svc:3306/?Action=connect&DBUser=root&X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Credential=AKIDEXAMPLE%2F") ||
+				!strings.Contains(token, "%2Feu-west-1%2Frds-db%2Faws4_request&") || !strings.Contains(token, "&X-Amz-Expires=900&") ||
+				!strings.Contains(token, "&X-Amz-Signature=") {
+				t.Fatalf("the client connected with the password %q, want an RDS authentication token", token)
+			}
+
+			// the token is kept while it is fresh, then renewed before it expires
+			provider := &fakeTokenProvider{}
+			session.auth.provider = provider
+			if got := passwordOfTheClient(t, session); got != token {
+				t.Errorf("the client connected with %q, want the token still valid %q", got, token)
+			}
+			session.auth.issuedAt = time.Now().Add(-iamTokenRefreshAfter)
+			for i := 0; i < 2; i++ {
+				if got, want := passwordOfTheClient(t, session), "token-1 for root as db.demo.svc:3306"; got != want {
+					t.Errorf("the client connected with %q, want the renewed token %q", got, want)
+				}
+			}
+			if provider.issued != 1 {
+				t.Errorf("%d tokens were issued, want 1", provider.issued)
+			}
+		})
+	}
+}
+
+func TestIAMAuthenticationWithoutAWSCredentials(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	opt := newTestBackupOptions()
+	opt.setupOptions.ScratchDir = t.TempDir()
+	opt.credentialOptions.authMode = AuthModeAWSIAM
+	opt.credentialOptions.awsRegion = "eu-west-1"
+	session, err := opt.prepareSession(newTestAppBinding(opt), fakeCommand(t, "exit 0"), opt.setupOptions.ScratchDir)
+	defer session.cleanup()
+	if err == nil || !strings.Contains(err.Error(), "AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set") {
+		t.Errorf("prepareSession() error = %v, want the AWS credentials to be missing", err)
+	}
+}
+
+func TestPasswordAuthenticationIsTheDefault(t *testing.T) {
+	for _, cmd := range []*cobra.Command{NewCmdBackup(), NewCmdRestore(), NewCmdTestConnection()} {
+		if got := cmd.Flags().Lookup("auth-mode").DefValue; got != AuthModePassword {
+			t.Errorf("%s --auth-mode defaults to %q, want %s", cmd.Name(), got, AuthModePassword)
+		}
+	}
+
+	opt := newTestBackupOptions()
+	opt.setupOptions.ScratchDir = t.TempDir()
+	opt.clientCmd = fakeCommand(t, `echo "$MYSQL_PWD"`)
+	session, err := opt.prepareSession(newTestAppBinding(opt), opt.clientCmd, opt.setupOptions.ScratchDir)
+	defer session.cleanup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.auth != nil {
+		t.Errorf("the session renews an IAM token, want the static password")
+	}
+	if got := passwordOfTheClient(t, session); got != "s3cret" {
+		t.Errorf("the client connected with %q, want the password of the secret", got)
+	}
+}
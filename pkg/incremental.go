@@ -0,0 +1,220 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"k8s.io/klog/v2"
+	"stash.appscode.dev/apimachinery/pkg/restic"
+)
+
+const (
+	TableUpdateTimesFileName = "table-update-times.json"
+	// BackupTypeTagPrefix tells the full snapshots from the incremental ones, which only hold the changed tables
+	BackupTypeTagPrefix   = "backup-type="
+	BackupTypeFull        = "full"
+	BackupTypeIncremental = "incremental"
+)
+
+// TableUpdateTimes holds the UPDATE_TIME of the tables by database and table. An empty time means
+// the server does not track the updates of the table, i.e. InnoDB tables once the server restarted.
+type TableUpdateTimes map[string]map[string]string
+
+// TableUpdateTimesRecord is what a backup records for the next incremental one: the update times of the tables
+// and the time of the server they were captured at. Only the changes made before that time are in the dump.
+type TableUpdateTimesRecord struct {
+	CapturedAt string           `json:"capturedAt"`
+	Tables     TableUpdateTimes `json:"tables"`
+}
+
+// IncrementalSelection is what an incremental backup dumps, compared to the update times of the previous backup
+type IncrementalSelection struct {
+	// the databases dumped whole
+	Full []string
+	// the changed tables of the other databases
+	Tables map[string][]string
+	// the databases without any change, which are not dumped
+	Unchanged []string
+}
+
+func tableUpdateTimesFile(dumpdir string) string {
+	return filepath.Join(dumpdir, TableUpdateTimesFileName)
+}
+
+// tableUpdateTimes queries the last update time of the base tables of the databases, along with the time of the
+// server, captured first in the same format. UPDATE_TIME only has a one second resolution, so a table written
+// during the second of the capture may have changed after it.
+func (session *sessionWrapper) tableUpdateTimes(databases []string) (*TableUpdateTimesRecord, error) {
+	record := &TableUpdateTimesRecord{Tables: TableUpdateTimes{}}
+	if len(databases) == 0 {
+		return record, nil
+	}
+	schemas := make([]string, 0, len(databases))
+	for _, db := range databases {
+		schemas = append(schemas, quoteString(db))
+		record.Tables[db] = map[string]string{}
+	}
+	output, err := session.executeQuery(fmt.Sprintf("SELECT DATE_FORMAT(NOW(), '%%Y-%%m-%%d %%H:%%i:%%s');\n"+
+		"SELECT TABLE_SCHEMA, TABLE_NAME, IFNULL(DATE_FORMAT(UPDATE_TIME, '%%Y-%%m-%%d %%H:%%i:%%s'), '') FROM information_schema.TABLES WHERE TABLE_SCHEMA IN (%s) AND TABLE_TYPE = 'BASE TABLE';", strings.Join(schemas, ",")))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the update times of the tables: %w", err)
+	}
+	capturedAt, rows, _ := strings.Cut(string(output), "\n")
+	record.CapturedAt = strings.TrimSpace(capturedAt)
+	if record.CapturedAt == "" {
+		return nil, fmt.Errorf("failed to query the update times of the tables: the time of the server is missing")
+	}
+	return record, parseTableUpdateTimes(rows, record.Tables)
+}
+
+// parseTableUpdateTimes reads the rows "<database>\t<table>\t<update time>" of the update time query into times
+func parseTableUpdateTimes(output string, times TableUpdateTimes) error {
+	for _, line := range strings.Split(output, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 {
+			return fmt.Errorf("invalid table update time %q", line)
+		}
+		db, table := unescapeBatchValue(fields[0]), unescapeBatchValue(fields[1])
+		if times[db] == nil {
+			times[db] = map[string]string{}
+		}
+		times[db][table] = strings.TrimSpace(fields[2])
+	}
+	return nil
+}
+
+func (record *TableUpdateTimesRecord) writeToFile(fileName string) error {
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fileName, data, 0o644)
+}
+
+// readTableUpdateTimes reads the update times recorded by the latest backup of the host. The backups
+// recording the times without the time of their capture have a record holding the times only.
+func readTableUpdateTimes(resticWrapper *restic.ResticWrapper, dumpOptions restic.DumpOptions, fileName string) (*TableUpdateTimesRecord, error) {
+	data, err := readSnapshotFile(resticWrapper, dumpOptions, fileName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the table update times %s from the snapshot: %w", fileName, err)
+	}
+	record := &TableUpdateTimesRecord{}
+	if err = json.Unmarshal(data, record); err == nil && record.CapturedAt != "" {
+		return record, nil
+	}
+	record = &TableUpdateTimesRecord{Tables: TableUpdateTimes{}}
+	if err = json.Unmarshal(data, &record.Tables); err != nil {
+		return nil, fmt.Errorf("failed to parse the table update times %s: %w", fileName, err)
+	}
+	return record, nil
+}
+
+// selectChangedTables compares the update times of the tables with the ones of the previous backup.
+// A table changed when it was updated during or after the second the previous times were captured at,
+// since the writes of that second may have been made after the capture. Without the time of the capture,
+// a table changed when it was updated after its previous update time.
+// A database is dumped whole when it is new, a table was dropped or the update time of any of its
+// tables is unknown, since the changes can not be told apart from the times then.
+// The times have the fixed width format of DATE_FORMAT, so they compare as strings.
+func selectChangedTables(previousRecord *TableUpdateTimesRecord, current TableUpdateTimes) IncrementalSelection {
+	previous, capturedAt := previousRecord.Tables, previousRecord.CapturedAt
+	selection := IncrementalSelection{Tables: map[string][]string{}}
+
+	databases := make([]string, 0, len(current))
+	for db := range current {
+		databases = append(databases, db)
+	}
+	sort.Strings(databases)
+
+	for _, db := range databases {
+		tables, before := current[db], previous[db]
+		full := before == nil
+		var changed []string
+		for table, updated := range tables {
+			if updated == "" {
+				full = true
+				break
+			}
+			last, ok := before[table]
+			if !ok || last == "" || capturedAt != "" && updated >= capturedAt || capturedAt == "" && updated > last {
+				changed = append(changed, table)
+			}
+		}
+		for table := range before {
+			if _, ok := tables[table]; !ok {
+				full = true
+			}
+		}
+
+		switch {
+		case full || len(changed) == len(tables):
+			selection.Full = append(selection.Full, db)
+		case len(changed) == 0:
+			selection.Unchanged = append(selection.Unchanged, db)
+		default:
+			sort.Strings(changed)
+			selection.Tables[db] = changed
+		}
+	}
+	return selection
+}
+
+// selectIncrementalDump narrows the dump to what changed since the latest backup of the host and returns
+// the databases left to dump. The update times of all the tables are kept in opt.tableUpdateTimes to be
+// recorded along with the dump. Without previous times, the backup is a full one.
+func (opt *mariadbOptions) selectIncrementalDump(session *sessionWrapper, resticWrapper *restic.ResticWrapper, databases []string, dumpdir string) ([]string, error) {
+	// the times are queried before dumping, so the changes made during the dump are caught by the next backup
+	current, err := session.tableUpdateTimes(databases)
+	if err != nil {
+		return nil, err
+	}
+	opt.tableUpdateTimes = current
+	opt.backupType = BackupTypeFull
+
+	dumpOptions := restic.DumpOptions{Host: opt.backupOptions.Host}
+	previous, err := readTableUpdateTimes(resticWrapper, dumpOptions, tableUpdateTimesFile(dumpdir))
+	if err != nil {
+		klog.Infof("No update times recorded by the previous backup, taking a full backup. Reason: %v", err)
+		return databases, nil
+	}
+
+	selection := selectChangedTables(previous, current.Tables)
+	for _, db := range selection.Unchanged {
+		klog.Infof("Database %s is unchanged since the previous backup, skipping it", db)
+	}
+	var selected []string
+	for _, db := range databases {
+		if containsString(selection.Full, db) {
+			selected = append(selected, db)
+		} else if tables, ok := selection.Tables[db]; ok {
+			klog.Infof("Database %s: dumping the changed tables %v", db, tables)
+			selected = append(selected, db)
+		}
+	}
+	opt.tables = selection.Tables
+	opt.backupType = BackupTypeIncremental
+	return selected, nil
+}
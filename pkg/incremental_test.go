@@ -0,0 +1,244 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"stash.appscode.dev/apimachinery/pkg/restic"
+)
+
+func TestSelectChangedTables(t *testing.T) {
+	previous := TableUpdateTimes{
+		"shop": {"orders": "2024-01-01 10:00:00", "customers": "2024-01-01 09:00:00", "products": "2023-12-01 08:00:00"},
+		"crm":  {"contacts": "2024-01-01 10:00:00"},
+	}
+	// the previous times were captured a second after the last update
+	previousRecord := &TableUpdateTimesRecord{CapturedAt: "2024-01-01 10:00:01", Tables: previous}
+	tests := []struct {
+		name    string
+		current TableUpdateTimes
+		want    IncrementalSelection
+	}{
+		{
+			name:    "unchanged",
+			current: TableUpdateTimes{"shop": previous["shop"], "crm": previous["crm"]},
+			want:    IncrementalSelection{Tables: map[string][]string{}, Unchanged: []string{"crm", "shop"}},
+		},
+		{
+			name: "changed tables",
+			current: TableUpdateTimes{
+				"shop": {"orders": "2024-01-02 10:00:00", "customers": "2024-01-01 09:00:00", "products": "2024-01-02 08:00:00"},
+				"crm":  previous["crm"],
+			},
+			want: IncrementalSelection{Tables: map[string][]string{"shop": {"orders", "products"}}, Unchanged: []string{"crm"}},
+		},
+		{
+			name: "every table changed",
+			current: TableUpdateTimes{
+				"shop": previous["shop"],
+				"crm":  {"contacts": "2024-01-02 10:00:00"},
+			},
+			want: IncrementalSelection{Full: []string{"crm"}, Tables: map[string][]string{}, Unchanged: []string{"shop"}},
+		},
+		{
+			name: "new table",
+			current: TableUpdateTimes{
+				"shop": {"orders": "2024-01-01 10:00:00", "customers": "2024-01-01 09:00:00", "products": "2023-12-01 08:00:00", "refunds": "2023-12-01 08:00:00"},
+			},
+			want: IncrementalSelection{Tables: map[string][]string{"shop": {"refunds"}}},
+		},
+		{
+			name: "dropped table",
+			current: TableUpdateTimes{
+				"shop": {"orders": "2024-01-01 10:00:00", "customers": "2024-01-01 09:00:00"},
+			},
+			want: IncrementalSelection{Full: []string{"shop"}, Tables: map[string][]string{}},
+		},
+		{
+			name: "new database",
+			current: TableUpdateTimes{
+				"crm":     previous["crm"],
+				"billing": {"invoices": "2023-01-01 00:00:00"},
+			},
+			want: IncrementalSelection{Full: []string{"billing"}, Tables: map[string][]string{}, Unchanged: []string{"crm"}},
+		},
+		{
+			name: "updated during the second of the capture",
+			current: TableUpdateTimes{
+				"shop": {"orders": "2024-01-01 10:00:00", "customers": "2024-01-01 09:00:00", "products": "2024-01-01 10:00:01"},
+			},
+			want: IncrementalSelection{Tables: map[string][]string{"shop": {"products"}}},
+		},
+		{
+			name: "update time unknown",
+			current: TableUpdateTimes{
+				"shop": {"orders": "", "customers": "2024-01-01 09:00:00", "products": "2023-12-01 08:00:00"},
+			},
+			want: IncrementalSelection{Full: []string{"shop"}, Tables: map[string][]string{}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := selectChangedTables(previousRecord, tt.current); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("selectChangedTables() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectChangedTablesUpdatedDuringTheCaptureSecond(t *testing.T) {
+	// orders was written at 10:00:00.7, after the times were captured at 10:00:00.2 and in the same second,
+	// so its update time did not change although the previous dump misses the write
+	previous := &TableUpdateTimesRecord{
+		CapturedAt: "2024-01-01 10:00:00",
+		Tables:     TableUpdateTimes{"shop": {"orders": "2024-01-01 10:00:00", "customers": "2024-01-01 09:00:00"}},
+	}
+	current := TableUpdateTimes{"shop": {"orders": "2024-01-01 10:00:00", "customers": "2024-01-01 09:00:00"}}
+	want := IncrementalSelection{Tables: map[string][]string{"shop": {"orders"}}}
+	if got := selectChangedTables(previous, current); !reflect.DeepEqual(got, want) {
+		t.Errorf("selectChangedTables() = %+v, want the table written during the capture second", got)
+	}
+
+	// once captured after the write, the table is unchanged
+	previous = &TableUpdateTimesRecord{CapturedAt: "2024-01-01 11:00:00", Tables: current}
+	want = IncrementalSelection{Tables: map[string][]string{}, Unchanged: []string{"shop"}}
+	if got := selectChangedTables(previous, current); !reflect.DeepEqual(got, want) {
+		t.Errorf("selectChangedTables() = %+v, want %+v", got, want)
+	}
+}
+
+func TestSelectChangedTablesWithoutCaptureTime(t *testing.T) {
+	// the records of the previous versions only hold the update times
+	previous := &TableUpdateTimesRecord{Tables: TableUpdateTimes{"shop": {"orders": "2024-01-01 10:00:00", "customers": "2024-01-01 09:00:00"}}}
+	current := TableUpdateTimes{"shop": {"orders": "2024-01-01 10:00:00", "customers": "2024-01-01 09:00:01"}}
+	want := IncrementalSelection{Tables: map[string][]string{"shop": {"customers"}}}
+	if got := selectChangedTables(previous, current); !reflect.DeepEqual(got, want) {
+		t.Errorf("selectChangedTables() = %+v, want %+v", got, want)
+	}
+}
+
+func TestSelectChangedTablesAfterAnUnknownUpdateTime(t *testing.T) {
+	// the update time was unknown at the previous backup, the table is dumped again once it is known
+	previous := &TableUpdateTimesRecord{CapturedAt: "2024-01-01 10:00:00", Tables: TableUpdateTimes{"shop": {"orders": "", "customers": "2024-01-01 09:00:00"}}}
+	current := TableUpdateTimes{"shop": {"orders": "2023-06-01 00:00:00", "customers": "2024-01-01 09:00:00"}}
+	want := IncrementalSelection{Tables: map[string][]string{"shop": {"orders"}}}
+	if got := selectChangedTables(previous, current); !reflect.DeepEqual(got, want) {
+		t.Errorf("selectChangedTables() = %+v, want %+v", got, want)
+	}
+}
+
+func TestParseTableUpdateTimes(t *testing.T) {
+	times := TableUpdateTimes{"shop": {}, "crm": {}}
+	if err := parseTableUpdateTimes("shop\torders\t2024-01-01 10:00:00\nshop\torder\\titems\t\n\n", times); err != nil {
+		t.Fatal(err)
+	}
+	want := TableUpdateTimes{"shop": {"orders": "2024-01-01 10:00:00", "order\titems": ""}, "crm": {}}
+	if !reflect.DeepEqual(times, want) {
+		t.Errorf("parseTableUpdateTimes() = %v, want %v", times, want)
+	}
+	if err := parseTableUpdateTimes("shop\torders\n", TableUpdateTimes{}); err == nil {
+		t.Errorf("parseTableUpdateTimes() accepted a row without update time")
+	}
+}
+
+func TestSelectIncrementalDump(t *testing.T) {
+	// the time of the server comes first
+	current := "2024-01-02 12:00:00\nshop\torders\t2024-01-02 10:00:00\nshop\tcustomers\t2024-01-01 09:00:00\ncrm\tcontacts\t2024-01-01 10:00:00\nhr\tstaff\t\n"
+	tests := []struct {
+		name       string
+		previous   string
+		want       []string
+		wantTables map[string][]string
+		wantType   string
+	}{
+		{
+			name:     "first backup",
+			want:     []string{"shop", "crm", "hr"},
+			wantType: BackupTypeFull,
+		},
+		{
+			name:       "following backup",
+			previous:   `{"capturedAt": "2024-01-01 10:00:00", "tables": {"shop": {"orders": "2024-01-01 09:30:00", "customers": "2024-01-01 09:00:00"}, "crm": {"contacts": "2024-01-01 10:00:00"}, "hr": {"staff": ""}}}`,
+			want:       []string{"shop", "crm", "hr"},
+			wantTables: map[string][]string{"shop": {"orders"}},
+			wantType:   BackupTypeIncremental,
+		},
+		{
+			name:       "following a backup without capture time",
+			previous:   `{"shop": {"orders": "2024-01-01 10:00:00", "customers": "2024-01-01 09:00:00"}, "crm": {"contacts": "2024-01-01 10:00:00"}, "hr": {"staff": ""}}`,
+			want:       []string{"shop", "hr"},
+			wantTables: map[string][]string{"shop": {"orders"}},
+			wantType:   BackupTypeIncremental,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := newTestBackupOptions()
+			opt.backupOptions.Host = restic.DefaultHost
+			session := newFakeSession(t, opt, fakeCommand(t, `printf '`+strings.ReplaceAll(current, "\t", `\t`)+`'`))
+			resticWrapper, _ := newFakeRestic(t, opt, session)
+			dumpdir := filepath.Join(opt.setupOptions.ScratchDir, MariaDBDumpDir)
+			if tt.previous != "" {
+				storeFakeSnapshot(t, resticWrapper, tableUpdateTimesFile(dumpdir), []byte(tt.previous))
+			}
+
+			got, err := opt.selectIncrementalDump(session, resticWrapper, []string{"shop", "crm", "hr"}, dumpdir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("selectIncrementalDump() = %v, want %v", got, tt.want)
+			}
+			if len(opt.tables) != len(tt.wantTables) || len(tt.wantTables) > 0 && !reflect.DeepEqual(opt.tables, tt.wantTables) {
+				t.Errorf("the selected tables are %v, want %v", opt.tables, tt.wantTables)
+			}
+			if opt.backupType != tt.wantType {
+				t.Errorf("the backup type is %q, want %q", opt.backupType, tt.wantType)
+			}
+			// the times of every table are recorded for the next backup
+			if record := opt.tableUpdateTimes; record.CapturedAt != "2024-01-02 12:00:00" || len(record.Tables) != 3 || record.Tables["shop"]["orders"] != "2024-01-02 10:00:00" {
+				t.Errorf("the recorded update times are %+v", record)
+			}
+		})
+	}
+}
+
+func TestTableUpdateTimesCaptureTheTimeOfTheServerFirst(t *testing.T) {
+	opt := newTestBackupOptions()
+	session := newFakeSession(t, opt, fakeCommand(t, `eval query=\${$#}
+case "$query" in
+"SELECT DATE_FORMAT(NOW(), "*"SELECT TABLE_SCHEMA"*) printf '2024-01-02 12:00:00\nshop\torders\t2024-01-02 10:00:00\n' ;;
+*) exit 1 ;;
+esac`))
+	record, err := session.tableUpdateTimes([]string{"shop"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &TableUpdateTimesRecord{CapturedAt: "2024-01-02 12:00:00", Tables: TableUpdateTimes{"shop": {"orders": "2024-01-02 10:00:00"}}}
+	if !reflect.DeepEqual(record, want) {
+		t.Errorf("tableUpdateTimes() = %+v, want %+v", record, want)
+	}
+
+	session = newFakeSession(t, opt, fakeCommand(t, `true`))
+	if _, err := session.tableUpdateTimes([]string{"shop"}); err == nil || !strings.Contains(err.Error(), "the time of the server is missing") {
+		t.Errorf("tableUpdateTimes() error = %v, want the missing time of the server", err)
+	}
+}
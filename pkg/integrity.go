@@ -0,0 +1,107 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/armon/circbuf"
+	"github.com/spf13/cobra"
+	"stash.appscode.dev/apimachinery/pkg/restic"
+)
+
+const (
+	VerifyDumpCMD = "verify-dump"
+
+	// mariadb-dump ends a complete dump with this comment, followed by the date unless --skip-dump-date is set
+	DumpCompletedMarker = "-- Dump completed"
+	// the number of the last bytes of a dump searched for the completion marker
+	dumpTrailerSize = 4096
+)
+
+// errDumpTruncated is returned when a dump does not end with the completion marker,
+// i.e. mariadb-dump was killed (OOM) or the disk got full while the dump was written
+var errDumpTruncated = fmt.Errorf("the dump does not end with %q, it is truncated", DumpCompletedMarker)
+
+// newTrailerWriter returns a writer keeping the last bytes of a dump
+func newTrailerWriter() *circbuf.Buffer {
+	// the size is positive, so the buffer is always created
+	buf, _ := circbuf.NewBuffer(dumpTrailerSize)
+	return buf
+}
+
+// checkDumpCompleted verifies that the last line of the dump is the completion marker of mariadb-dump
+func checkDumpCompleted(trailer []byte) error {
+	trailer = bytes.TrimRight(trailer, " \t\r\n")
+	if i := bytes.LastIndexByte(trailer, '\n'); i >= 0 {
+		trailer = trailer[i+1:]
+	}
+	if !bytes.HasPrefix(trailer, []byte(DumpCompletedMarker)) {
+		return errDumpTruncated
+	}
+	return nil
+}
+
+// validateDumpVerification fails when the arguments of mariadb-dump remove the completion marker
+func (opt *mariadbOptions) validateDumpVerification() error {
+	if !opt.verifyDump {
+		return nil
+	}
+	userArgs := strings.Fields(opt.myArgs)
+	for _, arg := range []string{"--skip-comments", "--compact"} {
+		if hasArg(userArgs, arg) {
+			return fmt.Errorf("--verify-dump can not be used with %s, which removes the completion marker of the dump", arg)
+		}
+	}
+	return nil
+}
+
+// NewCmdVerifyDump returns the hidden command copying a dump from stdin into stdout, which fails when the
+// dump is truncated. It is inserted by the streaming backup into the pipeline right after mariadb-dump.
+func NewCmdVerifyDump() *cobra.Command {
+	return &cobra.Command{
+		Use:               VerifyDumpCMD,
+		Short:             "Passes a dump read from stdin through, failing if it does not end with the completion marker",
+		Hidden:            true,
+		DisableAutoGenTag: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			out := bufio.NewWriter(os.Stdout)
+			trailer := newTrailerWriter()
+			if _, err := io.Copy(io.MultiWriter(out, trailer), os.Stdin); err != nil {
+				return err
+			}
+			if err := out.Flush(); err != nil {
+				return err
+			}
+			return checkDumpCompleted(trailer.Bytes())
+		},
+	}
+}
+
+// verifyDumpCommand returns the command checking the dump stream for the completion marker
+func verifyDumpCommand() (*restic.Command, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate the plugin binary to verify the dump: %w", err)
+	}
+	return &restic.Command{Name: self, Args: []interface{}{VerifyDumpCMD}}, nil
+}
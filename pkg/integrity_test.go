@@ -0,0 +1,197 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	api_v1beta1 "stash.appscode.dev/apimachinery/apis/stash/v1beta1"
+)
+
+// truncatedDump returns the sample dump cut in the middle of its rows
+func truncatedDump() []byte {
+	dump := sampleDump(100)
+	return dump[:len(dump)/2]
+}
+
+func TestCheckDumpCompleted(t *testing.T) {
+	tests := []struct {
+		name    string
+		trailer string
+		wantErr bool
+	}{
+		{name: "complete dump", trailer: "INSERT INTO `orders` VALUES (1);\n-- Dump completed on 2024-01-01 10:00:00\n"},
+		{name: "without the dump date", trailer: "UNLOCK TABLES;\n\n-- Dump completed\n"},
+		{name: "trailing blank lines", trailer: "-- Dump completed on 2024-01-01 10:00:00\r\n\n\n"},
+		{name: "truncated dump", trailer: "INSERT INTO `orders` VALUES (1),(2", wantErr: true},
+		{name: "marker before the last line", trailer: "-- Dump completed on 2024-01-01 10:00:00\nINSERT INTO `orders` VALUES (1);\n", wantErr: true},
+		{name: "empty dump", trailer: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkDumpCompleted([]byte(tt.trailer))
+			if tt.wantErr != errors.Is(err, errDumpTruncated) || !tt.wantErr && err != nil {
+				t.Errorf("checkDumpCompleted() = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyDump(t *testing.T) {
+	complete := filepath.Join(t.TempDir(), "complete.sql")
+	if err := os.WriteFile(complete, sampleDump(100), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	truncated := filepath.Join(t.TempDir(), "truncated.sql")
+	if err := os.WriteFile(truncated, truncatedDump(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		dump        string
+		compression string
+		verifyDump  bool
+		wantErr     bool
+	}{
+		{name: "complete dump", dump: complete, verifyDump: true},
+		{name: "complete compressed dump", dump: complete, compression: CompressionGzip, verifyDump: true},
+		{name: "truncated dump", dump: truncated, verifyDump: true, wantErr: true},
+		{name: "truncated compressed dump", dump: truncated, compression: CompressionZstd, verifyDump: true, wantErr: true},
+		{name: "truncated dump not verified", dump: truncated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := newTestBackupOptions()
+			opt.compression = tt.compression
+			opt.verifyDump = tt.verifyDump
+			// the dump is cut short without mariadb-dump failing, as when the disk gets full
+			session := newFakeSession(t, opt, "")
+			session.cmd.Name = fakeCommand(t, `cat `+tt.dump)
+			dumpfile := filepath.Join(t.TempDir(), "shop.sql"+compressionExtension(tt.compression))
+
+			_, err := opt.dumpDatabase(session, "shop", dumpfile)
+			if tt.wantErr {
+				if !errors.Is(err, errDumpTruncated) || !strings.Contains(err.Error(), "database shop") {
+					t.Errorf("dumpDatabase() error = %v, want the dump of shop truncated", err)
+				}
+				if _, err := os.Stat(dumpfile); !os.IsNotExist(err) {
+					t.Errorf("the truncated dump is kept")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(dumpfile); err != nil {
+				t.Errorf("the dump is not kept: %v", err)
+			}
+		})
+	}
+}
+
+func TestFailedDumpIsRemoved(t *testing.T) {
+	dump := filepath.Join(t.TempDir(), "dump.sql")
+	if err := os.WriteFile(dump, sampleDump(100), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	opt := newTestBackupOptions()
+	session := newFakeSession(t, opt, "")
+	session.cmd.Name = fakeCommand(t, fmt.Sprintf(`head -c 2000 %s
+echo "mariadb-dump: Error 2013: Lost connection to server during query when dumping table orders" >&2
+exit 2`, dump))
+	dumpfile := filepath.Join(t.TempDir(), "shop.sql")
+
+	if _, err := opt.dumpDatabase(session, "shop", dumpfile); err == nil || !strings.Contains(err.Error(), "Lost connection") {
+		t.Fatalf("dumpDatabase() error = %v, want the dump to fail", err)
+	}
+	if _, err := os.Stat(dumpfile); !os.IsNotExist(err) {
+		t.Errorf("the partial dump is kept")
+	}
+}
+
+func TestVerifyDumpCommand(t *testing.T) {
+	verifier, err := verifyDumpCommand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, dump := range map[string][]byte{"complete dump": sampleDump(100), "truncated dump": truncatedDump()} {
+		t.Run(name, func(t *testing.T) {
+			args := make([]string, 0, len(verifier.Args))
+			for _, arg := range verifier.Args {
+				args = append(args, fmt.Sprint(arg))
+			}
+			cmd := exec.Command(verifier.Name, args...)
+			cmd.Stdin = bytes.NewReader(dump)
+			var stdout bytes.Buffer
+			cmd.Stdout = &stdout
+			err := cmd.Run()
+			// the dump passes through whole, even when it is truncated
+			if !bytes.Equal(stdout.Bytes(), dump) {
+				t.Errorf("verify-dump wrote %d bytes, want the %d bytes of the dump", stdout.Len(), len(dump))
+			}
+			if truncated := name == "truncated dump"; truncated != (err != nil) {
+				t.Errorf("verify-dump error = %v, want a failure %v", err, truncated)
+			}
+		})
+	}
+}
+
+func TestVerifyStreamedDump(t *testing.T) {
+	truncated := filepath.Join(t.TempDir(), "truncated.sql")
+	if err := os.WriteFile(truncated, truncatedDump(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, compression := range []string{CompressionNone, CompressionGzip} {
+		t.Run(compression, func(t *testing.T) {
+			opt := newTestBackupOptions()
+			opt.streamBackup = true
+			opt.verifyDump = true
+			opt.compression = compression
+			session := newFakeSession(t, opt, fakeCommand(t, `cat `+truncated))
+			resticWrapper, repository := newFakeRestic(t, opt, session)
+
+			if _, err := opt.backupStream(session, resticWrapper, api_v1beta1.TargetRef{}, []string{"shop"}); err == nil {
+				t.Errorf("backupStream() succeeded with a truncated dump")
+			}
+			if snapshots := fakeSnapshots(t, repository); len(snapshots) != 0 {
+				t.Errorf("the repository has %d snapshots of the truncated dump", len(snapshots))
+			}
+		})
+	}
+}
+
+func TestVerifyDumpRejectsTheArgsRemovingTheMarker(t *testing.T) {
+	for _, myArgs := range []string{"--all-databases --skip-comments", "--compact"} {
+		opt := newTestBackupOptions()
+		opt.verifyDump = true
+		opt.myArgs = myArgs
+		if err := opt.validateDumpVerification(); err == nil || !strings.Contains(err.Error(), "removes the completion marker") {
+			t.Errorf("validateDumpVerification() with %q = %v, want an error", myArgs, err)
+		}
+		opt.verifyDump = false
+		if err := opt.validateDumpVerification(); err != nil {
+			t.Errorf("validateDumpVerification() without --verify-dump = %v", err)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"stash.appscode.dev/apimachinery/pkg/restic"
+)
+
+const (
+	TableManifestFileName = "tables-manifest.json"
+	TableCountTagPrefix   = "tables="
+)
+
+// TableManifest holds the number of tables of each dumped database, it is stored next to the dumps
+// so that a restore can be verified against it
+type TableManifest map[string]int
+
+// tableManifestFile returns the path of the manifest written into the dump directory
+func tableManifestFile(dumpdir string) string {
+	return filepath.Join(dumpdir, TableManifestFileName)
+}
+
+// countTables returns the number of tables and views of each database with a single query.
+// The databases without any table are counted with 0.
+func (session *sessionWrapper) countTables(databases []string) (map[string]int, error) {
+	counts := make(map[string]int, len(databases))
+	if len(databases) == 0 {
+		return counts, nil
+	}
+	schemas := make([]string, 0, len(databases))
+	for _, db := range databases {
+		counts[db] = 0
+		schemas = append(schemas, quoteString(db))
+	}
+	output, err := session.executeQuery(fmt.Sprintf("SELECT TABLE_SCHEMA, COUNT(*) FROM information_schema.TABLES WHERE TABLE_SCHEMA IN (%s) GROUP BY TABLE_SCHEMA;", strings.Join(schemas, ",")))
+	if err != nil {
+		return nil, fmt.Errorf("failed to count the tables of the databases: %w", err)
+	}
+	return counts, parseTableCounts(string(output), counts)
+}
+
+// parseTableCounts reads the rows "<database>\t<count>" of the table count query into counts
+func parseTableCounts(output string, counts map[string]int) error {
+	for _, line := range strings.Split(output, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		i := strings.LastIndex(line, "\t")
+		if i < 0 {
+			return fmt.Errorf("invalid table count %q", line)
+		}
+		count, err := strconv.Atoi(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return fmt.Errorf("invalid table count %q", line)
+		}
+		counts[unescapeBatchValue(line[:i])] = count
+	}
+	return nil
+}
+
+// buildTableManifest counts the tables of the databases. When tables are selected,
+// only the selected tables of a database are dumped so they are counted instead.
+func (opt *mariadbOptions) buildTableManifest(session *sessionWrapper, databases []string) (TableManifest, error) {
+	manifest := TableManifest{}
+	var counted []string
+	for _, db := range databases {
+		if tables, ok := opt.tables[db]; ok {
+			manifest[db] = len(tables)
+			continue
+		}
+		counted = append(counted, db)
+	}
+	counts, err := session.countTables(counted)
+	if err != nil {
+		return nil, err
+	}
+	for db, count := range counts {
+		manifest[db] = count
+	}
+	return manifest, nil
+}
+
+func (manifest TableManifest) writeToFile(fileName string) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fileName, data, 0o644)
+}
+
+// readTableManifest reads the manifest stored in the snapshot next to the dump
+func readTableManifest(resticWrapper *restic.ResticWrapper, dumpOptions restic.DumpOptions, fileName string) (TableManifest, error) {
+	data, err := readSnapshotFile(resticWrapper, dumpOptions, fileName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the table manifest %s from the snapshot: %w", fileName, err)
+	}
+	manifest := TableManifest{}
+	if err = json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse the table manifest %s: %w", fileName, err)
+	}
+	return manifest, nil
+}
+
+// readTableCountTag reads the table count of a per database snapshot from its tags
+func readTableCountTag(resticWrapper *restic.ResticWrapper, dumpOptions restic.DumpOptions, db string) (TableManifest, error) {
+	snapshot, err := findSnapshot(resticWrapper, dumpOptions, db)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := snapshotTagValue(snapshot, TableCountTagPrefix)
+	if !ok {
+		return nil, fmt.Errorf("snapshot %s has no table count, it was taken before manifests were recorded", snapshot.ID)
+	}
+	count, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid table count %q on snapshot %s", value, snapshot.ID)
+	}
+	return TableManifest{db: count}, nil
+}
+
+// verifyTableCounts compares the number of tables of the restored databases with the manifest.
+// Only the databases in the list are checked, or every database of the manifest if it is empty.
+func (session *sessionWrapper) verifyTableCounts(manifest TableManifest, databases []string) error {
+	if len(databases) == 0 {
+		for db := range manifest {
+			databases = append(databases, db)
+		}
+		sort.Strings(databases)
+	}
+
+	for _, db := range databases {
+		if _, ok := manifest[db]; !ok {
+			return fmt.Errorf("database %s is not in the table manifest of the snapshot", db)
+		}
+	}
+	counts, err := session.countTables(databases)
+	if err != nil {
+		return err
+	}
+
+	var mismatches []string
+	for _, db := range databases {
+		expected, actual := manifest[db], counts[db]
+		if actual != expected {
+			mismatches = append(mismatches, fmt.Sprintf("%s: expected %d tables, found %d", db, expected, actual))
+		}
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("restore verification failed, %s", strings.Join(mismatches, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCountTables(t *testing.T) {
+	client, queries := fakeQueryClient(t, map[string]string{"*information_schema.TABLES*": "shop\t12\ncrm\t3\nmy\\tdb\t1\n"})
+	session := newFakeSession(t, &mariadbOptions{}, client)
+
+	got, err := session.countTables([]string{"shop", "crm", "empty", "my\tdb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"shop": 12, "crm": 3, "empty": 0, "my\tdb": 1}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("countTables() = %v, want %v", got, want)
+	}
+
+	// the tables of all the databases are counted in a single round trip
+	data, err := os.ReadFile(queries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantQuery := "SELECT TABLE_SCHEMA, COUNT(*) FROM information_schema.TABLES WHERE TABLE_SCHEMA IN ('shop','crm','empty','my\tdb') GROUP BY TABLE_SCHEMA;\n"
+	if string(data) != wantQuery {
+		t.Errorf("countTables() ran:\n%s\nwant:\n%s", data, wantQuery)
+	}
+}
+
+func TestCountTablesWithoutDatabases(t *testing.T) {
+	client, queries := fakeQueryClient(t, map[string]string{"*information_schema.TABLES*": "shop\t12\n"})
+	session := newFakeSession(t, &mariadbOptions{}, client)
+
+	got, err := session.countTables(nil)
+	if err != nil || len(got) != 0 {
+		t.Errorf("countTables() = %v, %v, want no count", got, err)
+	}
+	if _, err := os.Stat(queries); !os.IsNotExist(err) {
+		t.Errorf("the tables were counted without databases")
+	}
+}
+
+func TestCountTablesErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		wantErr string
+	}{
+		{
+			name:    "invalid row",
+			script:  `printf 'shop\t12\ncrm\n'`,
+			wantErr: `invalid table count "crm"`,
+		},
+		{
+			name:    "invalid count",
+			script:  `printf 'shop\tmany\n'`,
+			wantErr: `invalid table count "shop\tmany"`,
+		},
+		{
+			name:    "query failure",
+			script:  `echo "ERROR 1045 (28000): Access denied for user 'backup'@'%'" >&2; exit 1`,
+			wantErr: "failed to count the tables of the databases",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newFakeSession(t, &mariadbOptions{}, fakeCommand(t, tt.script))
+			_, err := session.countTables([]string{"shop", "crm"})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("countTables() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBuildTableManifest(t *testing.T) {
+	client, queries := fakeQueryClient(t, map[string]string{"*information_schema.TABLES*": "shop\t12\n"})
+	opt := &mariadbOptions{tables: map[string][]string{"crm": {"contacts", "deals"}}}
+	session := newFakeSession(t, opt, client)
+
+	got, err := opt.buildTableManifest(session, []string{"shop", "crm"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (TableManifest{"shop": 12, "crm": 2}); !reflect.DeepEqual(got, want) {
+		t.Errorf("buildTableManifest() = %v, want %v", got, want)
+	}
+	// the database of the selected tables is not counted on the server
+	data, err := os.ReadFile(queries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "IN ('shop')") {
+		t.Errorf("buildTableManifest() ran %q", data)
+	}
+}
+
+func TestVerifyTableCounts(t *testing.T) {
+	manifest := TableManifest{"shop": 12, "crm": 3}
+	tests := []struct {
+		name      string
+		rows      string
+		databases []string
+		wantErr   string
+	}{
+		{name: "matching counts", rows: "shop\t12\ncrm\t3\n"},
+		{name: "missing tables", rows: "shop\t10\n", wantErr: "restore verification failed, crm: expected 3 tables, found 0; shop: expected 12 tables, found 10"},
+		{name: "selected database", rows: "crm\t3\n", databases: []string{"crm"}},
+		{name: "database outside the manifest", databases: []string{"hr"}, wantErr: "database hr is not in the table manifest of the snapshot"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := fakeQueryClient(t, map[string]string{"*information_schema.TABLES*": tt.rows})
+			session := newFakeSession(t, &mariadbOptions{}, client)
+			err := session.verifyTableCounts(manifest, tt.databases)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Errorf("verifyTableCounts() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
+	"k8s.io/klog/v2"
+)
+
+const (
+	MetricsNamespace = "stash_mariadb"
+	MetricsJobName   = "stash-mariadb"
+
+	OperationBackup  = "backup"
+	OperationRestore = "restore"
+
+	metricsPushTimeout = 30 * time.Second
+)
+
+// metricsRecorder records the outcome of a backup or a restore. It is nil when metrics are disabled,
+// its methods do nothing then.
+type metricsRecorder struct {
+	registry *prometheus.Registry
+	server   *http.Server
+	pushURL  string
+
+	operations        *prometheus.CounterVec
+	operationDuration *prometheus.HistogramVec
+	dumpDuration      prometheus.Histogram
+	dumpBytes         prometheus.Counter
+	databases         prometheus.Counter
+	rows              prometheus.Counter
+}
+
+// newMetricsRecorder returns a recorder labelling the metrics with the AppBinding,
+// or nil if neither a metrics address nor a pushgateway is configured
+func (opt *mariadbOptions) newMetricsRecorder() *metricsRecorder {
+	if opt.metricsAddr == "" && opt.pushgatewayURL == "" {
+		return nil
+	}
+	labels := prometheus.Labels{"namespace": opt.appBindingNamespace, "appbinding": opt.appBindingName}
+	m := &metricsRecorder{
+		registry: prometheus.NewRegistry(),
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   MetricsNamespace,
+			Name:        "operations_total",
+			Help:        "Number of backups and restores by outcome",
+			ConstLabels: labels,
+		}, []string{"operation", "status"}),
+		operationDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   MetricsNamespace,
+			Name:        "operation_duration_seconds",
+			Help:        "Duration of the backups and restores",
+			ConstLabels: labels,
+			Buckets:     prometheus.ExponentialBuckets(1, 2, 16),
+		}, []string{"operation"}),
+		dumpDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace:   MetricsNamespace,
+			Name:        "dump_duration_seconds",
+			Help:        "Duration of the dump of a database",
+			ConstLabels: labels,
+			Buckets:     prometheus.ExponentialBuckets(1, 2, 16),
+		}),
+		dumpBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   MetricsNamespace,
+			Name:        "dump_bytes_total",
+			Help:        "Number of bytes dumped, before compression",
+			ConstLabels: labels,
+		}),
+		databases: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   MetricsNamespace,
+			Name:        "databases_dumped_total",
+			Help:        "Number of databases dumped successfully",
+			ConstLabels: labels,
+		}),
+		rows: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   MetricsNamespace,
+			Name:        "rows_total",
+			Help:        "Number of rows of the backed up databases, approximate unless counted precisely",
+			ConstLabels: labels,
+		}),
+	}
+	m.registry.MustRegister(m.operations, m.operationDuration, m.dumpDuration, m.dumpBytes, m.databases, m.rows)
+
+	if opt.pushgatewayURL != "" {
+		// the metrics of each AppBinding are kept in their own group of the pushgateway
+		m.pushURL = fmt.Sprintf("%s/metrics/job/%s/namespace/%s/appbinding/%s", strings.TrimSuffix(opt.pushgatewayURL, "/"),
+			MetricsJobName, url.PathEscape(opt.appBindingNamespace), url.PathEscape(opt.appBindingName))
+	}
+	if opt.metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+		m.server = &http.Server{Addr: opt.metricsAddr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	}
+	return m
+}
+
+// start serves the metrics on the metrics address, if any
+func (m *metricsRecorder) start() error {
+	if m == nil || m.server == nil {
+		return nil
+	}
+	listener, err := net.Listen("tcp", m.server.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to serve the metrics on %s: %w", m.server.Addr, err)
+	}
+	go func() {
+		if err := m.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			klog.Errorf("Failed to serve the metrics. Reason: %v", err)
+		}
+	}()
+	klog.Infof("Serving metrics on %s/metrics", m.server.Addr)
+	return nil
+}
+
+// stop pushes the metrics to the pushgateway, if any, and stops serving them.
+// Metrics are best effort, so failures are logged and don't fail the operation.
+func (m *metricsRecorder) stop() {
+	if m == nil {
+		return
+	}
+	if m.pushURL != "" {
+		if err := m.push(); err != nil {
+			klog.Warningf("Failed to push the metrics to %s. Reason: %v", m.pushURL, err)
+		}
+	}
+	if m.server != nil {
+		_ = m.server.Close()
+	}
+}
+
+// push replaces the metrics of the group in the pushgateway
+func (m *metricsRecorder) push() error {
+	families, err := m.registry.Gather()
+	if err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	encoder := expfmt.NewEncoder(buf, expfmt.FmtText)
+	for _, family := range families {
+		if err = encoder.Encode(family); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), metricsPushTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, m.pushURL, buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", string(expfmt.FmtText))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// observeOperation records the outcome and the duration of a backup or a restore
+func (m *metricsRecorder) observeOperation(operation string, elapsed time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	status := "success"
+	if err != nil {
+		status = "failure"
+	}
+	m.operations.WithLabelValues(operation, status).Inc()
+	m.operationDuration.WithLabelValues(operation).Observe(elapsed.Seconds())
+}
+
+// observeDump records the successful dump of a database
+func (m *metricsRecorder) observeDump(bytes int64, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+	m.dumpDuration.Observe(elapsed.Seconds())
+	m.dumpBytes.Add(float64(bytes))
+	m.databases.Inc()
+}
+
+// observeRows records the number of rows of the backed up databases
+func (m *metricsRecorder) observeRows(rows int64) {
+	if m == nil {
+		return
+	}
+	m.rows.Add(float64(rows))
+}
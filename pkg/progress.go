@@ -0,0 +1,105 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// MinProgressInterval is the shortest interval between two progress reports, so that fast restores do not flood the logs
+const MinProgressInterval = time.Second
+
+// progressReader logs the number of bytes read through it at most once per interval
+type progressReader struct {
+	r        io.Reader
+	interval time.Duration
+	// total is the expected size of the stream, 0 if unknown
+	total int64
+
+	read       int64
+	start      time.Time
+	lastReport time.Time
+}
+
+func newProgressReader(r io.Reader, interval time.Duration, total int64) *progressReader {
+	now := time.Now()
+	return &progressReader{r: r, interval: interval, total: total, start: now, lastReport: now}
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	pr.read += int64(n)
+	if now := time.Now(); now.Sub(pr.lastReport) >= pr.interval {
+		pr.lastReport = now
+		klog.Infoln(pr.progress(now))
+	}
+	return n, err
+}
+
+// progress describes the bytes consumed so far, with a percentage when the total is known
+func (pr *progressReader) progress(now time.Time) string {
+	elapsed := now.Sub(pr.start).Round(time.Second)
+	if pr.total > 0 {
+		return fmt.Sprintf("Restore progress: %s of %s consumed in %v (%.1f%%)", formatBytes(pr.read), formatBytes(pr.total), elapsed, float64(pr.read)*100/float64(pr.total))
+	}
+	return fmt.Sprintf("Restore progress: %s consumed in %v", formatBytes(pr.read), elapsed)
+}
+
+// parseBytes parses a size given in bytes or with a binary unit suffix (K, M or G, as the client does), i.e. 256M
+func parseBytes(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		}
+		if multiplier != 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * multiplier, nil
+}
+
+// formatBytes formats a size with a binary unit
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,343 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	EnvSOCKS5Password = "SOCKS5_PASSWORD"
+
+	socks5Version       = 0x05
+	socks5NoAuth        = 0x00
+	socks5UserPass      = 0x02
+	socks5NoAcceptable  = 0xff
+	socks5UserPassAuth  = 0x01
+	socks5Connect       = 0x01
+	socks5AddrIPv4      = 0x01
+	socks5AddrDomain    = 0x03
+	socks5AddrIPv6      = 0x04
+	socks5Succeeded     = 0x00
+	socks5HandshakeTime = 30 * time.Second
+
+	// the clients connect to the local end of the forward over TCP, "localhost" would make them use a unix socket
+	proxyListenHost = "127.0.0.1"
+)
+
+// proxyOptions locate the SOCKS5 proxy the connections to the database go through
+type proxyOptions struct {
+	address  string
+	user     string
+	password string
+}
+
+func (o proxyOptions) enabled() bool {
+	return o.address != ""
+}
+
+func (o proxyOptions) validate() error {
+	if !o.enabled() {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(o.address); err != nil {
+		return fmt.Errorf("invalid SOCKS5 proxy address %q, must be <host>:<port>: %w", o.address, err)
+	}
+	if len(o.user) > 255 || len(o.password) > 255 {
+		return errors.New("the SOCKS5 proxy user and password must not be longer than 255 bytes")
+	}
+	return nil
+}
+
+// socksForward listens on a local port and forwards each connection to the database through the proxy.
+// The database clients connect to the local port, so they need no support for proxies.
+type socksForward struct {
+	opts     proxyOptions
+	listener net.Listener
+
+	mu sync.Mutex
+	// the database host the connections are forwarded to, it changes when the session switches host
+	host string
+	port int
+	// the connections in progress, closed along with the forward
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+func newSOCKSForward(opts proxyOptions, host string, port int) (*socksForward, error) {
+	listener, err := net.Listen("tcp", net.JoinHostPort(proxyListenHost, "0"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for the SOCKS5 forward: %w", err)
+	}
+	f := &socksForward{
+		opts:     opts,
+		listener: listener,
+		host:     host,
+		port:     port,
+		conns:    map[net.Conn]struct{}{},
+	}
+	f.wg.Add(1)
+	go f.serve()
+	return f, nil
+}
+
+// localPort returns the port the database clients connect to
+func (f *socksForward) localPort() int {
+	return f.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (f *socksForward) target() (string, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.host, f.port
+}
+
+func (f *socksForward) setHost(host string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.host = host
+}
+
+func (f *socksForward) serve() {
+	defer f.wg.Done()
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			// the listener is closed when the session is cleaned up
+			return
+		}
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			f.forward(conn)
+		}()
+	}
+}
+
+func (f *socksForward) forward(local net.Conn) {
+	host, port := f.target()
+	remote, err := dialSOCKS5(f.opts, host, port)
+	if err != nil {
+		klog.Errorf("Failed to connect to %s through the SOCKS5 proxy %s. Reason: %v", net.JoinHostPort(host, strconv.Itoa(port)), f.opts.address, err)
+		_ = local.Close()
+		return
+	}
+	if !f.track(local, remote) {
+		return
+	}
+	defer f.untrack(local, remote)
+
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn) {
+		_, _ = io.Copy(dst, src)
+		// let the other side see the end of the stream
+		if tcp, ok := dst.(*net.TCPConn); ok {
+			_ = tcp.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	go pipe(remote, local)
+	go pipe(local, remote)
+	<-done
+	<-done
+}
+
+// track records the connections of a forward, or closes them if the forward is already closed
+func (f *socksForward) track(conns ...net.Conn) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.conns == nil {
+		for _, c := range conns {
+			_ = c.Close()
+		}
+		return false
+	}
+	for _, c := range conns {
+		f.conns[c] = struct{}{}
+	}
+	return true
+}
+
+func (f *socksForward) untrack(conns ...net.Conn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range conns {
+		_ = c.Close()
+		delete(f.conns, c)
+	}
+}
+
+// close stops the forward and the connections going through it
+func (f *socksForward) close() {
+	_ = f.listener.Close()
+	f.mu.Lock()
+	for c := range f.conns {
+		_ = c.Close()
+	}
+	f.conns = nil
+	f.mu.Unlock()
+	f.wg.Wait()
+}
+
+// dialSOCKS5 opens a connection to host:port through the SOCKS5 proxy (RFC 1928), authenticating
+// with the user and password of the options (RFC 1929) when they are set
+func dialSOCKS5(opts proxyOptions, host string, port int) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", opts.address, socks5HandshakeTime)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(socks5HandshakeTime))
+	if err = socks5Handshake(conn, opts, host, port); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func socks5Handshake(conn io.ReadWriter, opts proxyOptions, host string, port int) error {
+	methods := []byte{socks5NoAuth}
+	if opts.user != "" {
+		methods = []byte{socks5UserPass}
+	}
+	if _, err := conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("invalid SOCKS5 greeting: %w", err)
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("the proxy does not speak SOCKS5, got version %d", reply[0])
+	}
+	switch reply[1] {
+	case socks5NoAuth:
+	case socks5UserPass:
+		if opts.user == "" {
+			return errors.New("the SOCKS5 proxy requires a user and password")
+		}
+		req := []byte{socks5UserPassAuth, byte(len(opts.user))}
+		req = append(req, opts.user...)
+		req = append(req, byte(len(opts.password)))
+		req = append(req, opts.password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return fmt.Errorf("invalid SOCKS5 authentication reply: %w", err)
+		}
+		if reply[1] != socks5Succeeded {
+			return errors.New("the SOCKS5 proxy rejected the user and password")
+		}
+	case socks5NoAcceptable:
+		return errors.New("the SOCKS5 proxy accepts none of the authentication methods")
+	default:
+		return fmt.Errorf("unsupported SOCKS5 authentication method %d", reply[1])
+	}
+
+	// the host is resolved by the proxy, which is often the only one able to resolve it
+	req := []byte{socks5Version, socks5Connect, 0x00}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		req = append(append(req, socks5AddrIPv4), ip.To4()...)
+	} else if ip != nil {
+		req = append(append(req, socks5AddrIPv6), ip.To16()...)
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("host %q is too long for SOCKS5", host)
+		}
+		req = append(append(req, socks5AddrDomain, byte(len(host))), host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("invalid SOCKS5 connect reply: %w", err)
+	}
+	if header[1] != socks5Succeeded {
+		return fmt.Errorf("the SOCKS5 proxy failed to connect, reply code %d", header[1])
+	}
+	// skip the bound address of the reply
+	var addrLen int
+	switch header[3] {
+	case socks5AddrIPv4:
+		addrLen = net.IPv4len
+	case socks5AddrIPv6:
+		addrLen = net.IPv6len
+	case socks5AddrDomain:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return err
+		}
+		addrLen = int(l[0])
+	default:
+		return fmt.Errorf("invalid SOCKS5 address type %d", header[3])
+	}
+	_, err := io.ReadFull(conn, make([]byte, addrLen+2))
+	return err
+}
+
+// setProxy makes the clients of the session connect to the database through a local forward over the proxy.
+// The session keeps reporting the database host, switching host changes where the forward connects to.
+func (session *sessionWrapper) setProxy(opts proxyOptions, port int32) error {
+	if !opts.enabled() {
+		return nil
+	}
+	if session.hostArg == 0 {
+		return errors.New("the SOCKS5 proxy requires a TCP connection to the database, not a unix socket")
+	}
+	if opts.password == "" {
+		opts.password = os.Getenv(EnvSOCKS5Password)
+	}
+	targetPort := int(port)
+	if targetPort == 0 {
+		targetPort = MariaDBDefaultPort
+	}
+	forward, err := newSOCKSForward(opts, session.host(), targetPort)
+	if err != nil {
+		return err
+	}
+	session.proxy = forward
+
+	session.cmd.Args[session.hostArg] = proxyListenHost
+	portArg := fmt.Sprintf("--port=%d", forward.localPort())
+	replaced := false
+	for i, arg := range session.cmd.Args {
+		if s, ok := arg.(string); ok && strings.HasPrefix(s, "--port=") {
+			session.cmd.Args[i] = portArg
+			replaced = true
+		}
+	}
+	if !replaced {
+		session.cmd.Args = append(session.cmd.Args, portArg)
+	}
+	klog.Infof("Connecting to the database through the SOCKS5 proxy %s", opts.address)
+	return nil
+}
@@ -0,0 +1,259 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTCPClientEnv tells the test binary to act as a database client connecting over TCP
+const fakeTCPClientEnv = "GO_WANT_FAKE_TCP_CLIENT"
+
+// fakeTCPClient returns a fake mariadb client printing what the server sends when it connects to the host and port
+// of its arguments, so that it really goes through the network
+func fakeTCPClient(t *testing.T) string {
+	t.Helper()
+	return fakeCommand(t, fmt.Sprintf(`%s=1 exec %s -test.run=^TestFakeTCPClient$ -- "$@"`, fakeTCPClientEnv, os.Args[0]))
+}
+
+// TestFakeTCPClient is not a test, it is the client fakeTCPClient runs
+func TestFakeTCPClient(t *testing.T) {
+	if os.Getenv(fakeTCPClientEnv) != "1" {
+		return
+	}
+	var host, port string
+	for i, arg := range os.Args {
+		switch {
+		case arg == "-h" && i+1 < len(os.Args):
+			host = os.Args[i+1]
+		case strings.HasPrefix(arg, "--port="):
+			port = strings.TrimPrefix(arg, "--port=")
+		}
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), 5*time.Second)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR 2002 (HY000): Can't connect to server on '%s' (%v)\n", host, err)
+		os.Exit(1)
+	}
+	greeting, _ := io.ReadAll(conn)
+	if len(greeting) == 0 {
+		fmt.Fprintln(os.Stderr, "ERROR 2013 (HY000): Lost connection to server at 'handshake: reading initial communication packet'")
+		os.Exit(1)
+	}
+	fmt.Print(string(greeting))
+	os.Exit(0)
+}
+
+// fakeSOCKS5 is a SOCKS5 proxy answering the connections it is asked to open itself, as the database
+type fakeSOCKS5 struct {
+	listener net.Listener
+	user     string
+	password string
+
+	mu sync.Mutex
+	// the addresses the clients asked to connect to
+	targets []string
+}
+
+func newFakeSOCKS5(t *testing.T, user, password string) *fakeSOCKS5 {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakeSOCKS5{listener: listener, user: user, password: password}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return p
+}
+
+func (p *fakeSOCKS5) connections() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string{}, p.targets...)
+}
+
+func (p *fakeSOCKS5) serve(conn net.Conn) {
+	defer conn.Close()
+	// a short read leaves zeroes and fails the exchange, the client is gone anyway
+	var failed bool
+	read := func(n int) []byte {
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			failed = true
+		}
+		return buf
+	}
+
+	greeting := read(2)
+	methods := read(int(greeting[1]))
+	if failed {
+		return
+	}
+	method := byte(socks5NoAuth)
+	if p.user != "" {
+		method = socks5UserPass
+	}
+	if !strings.ContainsRune(string(methods), rune(method)) {
+		_, _ = conn.Write([]byte{socks5Version, socks5NoAcceptable})
+		return
+	}
+	_, _ = conn.Write([]byte{socks5Version, method})
+	if p.user != "" {
+		user := read(int(read(2)[1]))
+		password := read(int(read(1)[0]))
+		if string(user) != p.user || string(password) != p.password {
+			_, _ = conn.Write([]byte{socks5UserPassAuth, 0x01})
+			return
+		}
+		_, _ = conn.Write([]byte{socks5UserPassAuth, socks5Succeeded})
+	}
+
+	request := read(4)
+	if failed {
+		return
+	}
+	var host string
+	switch request[3] {
+	case socks5AddrIPv4:
+		host = net.IP(read(net.IPv4len)).String()
+	case socks5AddrDomain:
+		host = string(read(int(read(1)[0])))
+	}
+	port := binary.BigEndian.Uint16(read(2))
+	if failed {
+		return
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	p.mu.Lock()
+	p.targets = append(p.targets, target)
+	p.mu.Unlock()
+
+	_, _ = conn.Write([]byte{socks5Version, socks5Succeeded, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	fmt.Fprintf(conn, "MariaDB %s\n", target)
+}
+
+func TestSOCKS5Proxy(t *testing.T) {
+	tests := []struct {
+		name     string
+		user     string
+		password string
+	}{
+		{name: "no authentication"},
+		{name: "user and password", user: "bastion", password: "s3cret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := newFakeSOCKS5(t, tt.user, tt.password)
+			opt := newTestBackupOptions()
+			opt.setupOptions.ScratchDir = t.TempDir()
+			opt.proxy = proxyOptions{address: proxy.listener.Addr().String(), user: tt.user}
+			t.Setenv(EnvSOCKS5Password, tt.password)
+			opt.clientCmd = fakeTCPClient(t)
+			session, err := opt.prepareSession(newTestAppBinding(opt), opt.clientCmd, opt.setupOptions.ScratchDir)
+			if err != nil {
+				session.cleanup()
+				t.Fatal(err)
+			}
+
+			// the readiness check goes through the proxy, as the queries
+			if err = opt.waitForDatabase(context.Background(), session); err != nil {
+				t.Fatal(err)
+			}
+			output, err := session.executeQuery("SELECT 1;")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(output); got != "MariaDB db.demo.svc:3306\n" {
+				t.Errorf("the client reached %q, want the database behind the proxy", got)
+			}
+			if got, want := proxy.connections(), []string{"db.demo.svc:3306", "db.demo.svc:3306"}; strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Errorf("the proxy opened %v, want %v", got, want)
+			}
+			if session.host() != "db.demo.svc" {
+				t.Errorf("the session reports the host %q, want the database host", session.host())
+			}
+
+			// the forward is torn down along with the session
+			local := net.JoinHostPort(proxyListenHost, strconv.Itoa(session.proxy.localPort()))
+			session.cleanup()
+			if conn, err := net.DialTimeout("tcp", local, time.Second); err == nil {
+				conn.Close()
+				t.Errorf("the forward still listens on %s after the cleanup of the session", local)
+			}
+		})
+	}
+}
+
+func TestSOCKS5ProxyRejectsTheCredentials(t *testing.T) {
+	proxy := newFakeSOCKS5(t, "bastion", "s3cret")
+	opt := newTestBackupOptions()
+	opt.setupOptions.ScratchDir = t.TempDir()
+	opt.proxy = proxyOptions{address: proxy.listener.Addr().String(), user: "bastion", password: "wrong"}
+	opt.clientCmd = fakeTCPClient(t)
+	session, err := opt.prepareSession(newTestAppBinding(opt), opt.clientCmd, opt.setupOptions.ScratchDir)
+	defer session.cleanup()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = session.executeQuery("SELECT 1;"); err == nil || !strings.Contains(err.Error(), "Lost connection to server") {
+		t.Errorf("executeQuery() error = %v, want the connection to be dropped", err)
+	}
+	if got := proxy.connections(); len(got) != 0 {
+		t.Errorf("the proxy opened %v without authentication", got)
+	}
+}
+
+func TestProxyOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		proxy   proxyOptions
+		wantErr string
+	}{
+		{name: "no proxy"},
+		{name: "proxy", proxy: proxyOptions{address: "bastion.demo.svc:1080", user: "bastion"}},
+		{name: "missing port", proxy: proxyOptions{address: "bastion.demo.svc"}, wantErr: `invalid SOCKS5 proxy address "bastion.demo.svc"`},
+		{name: "long user", proxy: proxyOptions{address: "bastion.demo.svc:1080", user: strings.Repeat("u", 256)}, wantErr: "must not be longer than 255 bytes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.proxy.validate()
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validate() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/armon/circbuf"
+	shell "gomodules.xyz/go-sh"
+	"k8s.io/klog/v2"
+)
+
+const (
+	DefaultReadLockTimeout = 5 * time.Minute
+
+	// the binary log coordinates of the locked server, passed to the snapshot-ready hook
+	EnvBinlogFile     = "MARIADB_BINLOG_FILE"
+	EnvBinlogPosition = "MARIADB_BINLOG_POSITION"
+	EnvGTIDPosition   = "MARIADB_GTID_POSITION"
+
+	// gtidMarker starts the last line of the output of the lock statements
+	gtidMarker = "gtid"
+)
+
+// lockStatements acquire the global read lock and report the binary log coordinates it froze.
+// SHOW MASTER STATUS prints nothing when binary logging is disabled, so the GTID line marks the end.
+var lockStatements = "FLUSH TABLES WITH READ LOCK;\nSHOW MASTER STATUS;\nSELECT '" + gtidMarker + "', @@GLOBAL.gtid_binlog_pos;\n"
+
+// globalReadLock is a client connection holding FLUSH TABLES WITH READ LOCK. The server releases
+// the lock when the connection closes, so killing the client always releases it.
+type globalReadLock struct {
+	sh      *shell.Session
+	stdin   *os.File
+	errBuff *circbuf.Buffer
+	done    chan error
+}
+
+// startGlobalReadLock starts the client that will hold the lock, reading its statements from a pipe
+func (session *sessionWrapper) startGlobalReadLock() (*globalReadLock, *os.File, error) {
+	errBuff, err := circbuf.NewBuffer(stderrBufferSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the client gets the ends of os pipes, so that it is reaped as soon as it exits, whatever is left in the pipes
+	stdinReader, stdinWriter, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	stdoutReader, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		_ = stdinReader.Close()
+		_ = stdinWriter.Close()
+		return nil, nil, err
+	}
+	sh := session.newShell()
+	sh.Stdin = stdinReader
+	sh.Stdout = stdoutWriter
+	sh.Stderr = errBuff
+
+	// --unbuffered prints the result of each statement as soon as it ran
+	args := append(append([]interface{}{}, session.cmd.Args...), "-s", "-N", "--unbuffered")
+	err = sh.Command(session.clientCmd, args...).Start()
+	// the client holds its own copies of its ends, the output ends once it exits
+	_ = stdinReader.Close()
+	_ = stdoutWriter.Close()
+	if err != nil {
+		_ = stdinWriter.Close()
+		_ = stdoutReader.Close()
+		return nil, nil, err
+	}
+	lock := &globalReadLock{sh: sh, stdin: stdinWriter, errBuff: errBuff, done: make(chan error, 1)}
+	go func() {
+		lock.done <- sh.Wait()
+	}()
+	return lock, stdoutReader, nil
+}
+
+// acquire locks the tables and returns the binary log coordinates of the locked server
+func (lock *globalReadLock) acquire(output *bufio.Reader) (*BinlogPosition, error) {
+	if _, err := io.WriteString(lock.stdin, lockStatements); err != nil {
+		return nil, lock.exitError(fmt.Errorf("failed to send the lock statements: %w", err))
+	}
+	var lines []string
+	for {
+		line, err := output.ReadString('\n')
+		if err != nil {
+			// the client exited, i.e. the lock was refused or the safety timeout killed it
+			return nil, lock.exitError(errors.New("the client exited before locking the tables"))
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if strings.HasPrefix(line, gtidMarker+"\t") {
+			return parseLockedPosition(lines, strings.TrimPrefix(line, gtidMarker+"\t"))
+		}
+		lines = append(lines, line)
+	}
+}
+
+// parseLockedPosition parses the output of SHOW MASTER STATUS, file and position separated by a tab, and the GTID position
+func parseLockedPosition(masterStatus []string, gtid string) (*BinlogPosition, error) {
+	pos := &BinlogPosition{}
+	if gtid != "NULL" {
+		pos.GTID = gtid
+	}
+	for _, line := range masterStatus {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 2 {
+			continue
+		}
+		n, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid binary log position %q", fields[1])
+		}
+		pos.File, pos.Position = fields[0], n
+	}
+	return pos, nil
+}
+
+// release unlocks the tables and waits for the client to exit
+func (lock *globalReadLock) release() error {
+	_, err := io.WriteString(lock.stdin, "UNLOCK TABLES;\n")
+	_ = lock.stdin.Close()
+	if exitErr := <-lock.done; exitErr != nil {
+		return newCommandError(exitErr, capturedStderr(lock.errBuff))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to send UNLOCK TABLES: %w", err)
+	}
+	return nil
+}
+
+// forceRelease kills the client, the server then releases the lock of its connection
+func (lock *globalReadLock) forceRelease() {
+	lock.sh.Kill(syscall.SIGKILL)
+}
+
+// exitError waits for the client to exit and returns its error, or err if it exited cleanly
+func (lock *globalReadLock) exitError(err error) error {
+	_ = lock.stdin.Close()
+	if exitErr := <-lock.done; exitErr != nil {
+		return newCommandError(exitErr, capturedStderr(lock.errBuff))
+	}
+	return err
+}
+
+// coordinateStorageSnapshot freezes the database for a snapshot of its storage taken outside of the plugin:
+// it locks the tables with FLUSH TABLES WITH READ LOCK, runs the snapshot-ready hook with the binary log
+// coordinates of the locked server and releases the lock. Whatever happens, the lock is released once the
+// read lock timeout expires, failing the backup since the snapshot may then be inconsistent.
+func (opt *mariadbOptions) coordinateStorageSnapshot(session *sessionWrapper) error {
+	lock, output, err := session.startGlobalReadLock()
+	if err != nil {
+		return fmt.Errorf("failed to start the client locking the tables: %w", err)
+	}
+	defer output.Close()
+	expired := make(chan struct{})
+	timer := time.AfterFunc(opt.readLockTimeout, func() {
+		close(expired)
+		klog.Warningf("Releasing the global read lock held for the read lock timeout of %v", opt.readLockTimeout)
+		lock.forceRelease()
+	})
+	defer timer.Stop()
+
+	klog.Infoln("Locking the tables with FLUSH TABLES WITH READ LOCK....")
+	startTime := time.Now()
+	pos, err := lock.acquire(bufio.NewReader(output))
+	if err != nil {
+		select {
+		case <-expired:
+			return fmt.Errorf("failed to lock the tables within the read lock timeout of %v", opt.readLockTimeout)
+		default:
+		}
+		return fmt.Errorf("failed to lock the tables: %w", err)
+	}
+	klog.Infof("Tables locked at binary log position %s:%d, GTID %q", pos.File, pos.Position, pos.GTID)
+
+	env := map[string]string{EnvBinlogFile: pos.File, EnvGTIDPosition: pos.GTID}
+	if pos.File != "" {
+		env[EnvBinlogPosition] = strconv.FormatInt(pos.Position, 10)
+	}
+	// the hook is killed along with the lock when the timeout expires
+	hookErr := session.runHook("snapshot-ready", opt.snapshotReadyHook, env, max(opt.readLockTimeout-time.Since(startTime), time.Millisecond))
+
+	if !timer.Stop() {
+		<-expired
+		return fmt.Errorf("the global read lock was released after the read lock timeout of %v before the snapshot-ready hook completed, the snapshot may be inconsistent", opt.readLockTimeout)
+	}
+	releaseErr := lock.release()
+	if releaseErr == nil {
+		klog.Infof("Tables unlocked after %v", time.Since(startTime).Round(time.Millisecond))
+	}
+	if hookErr != nil {
+		return fmt.Errorf("snapshot-ready hook failed: %w", hookErr)
+	}
+	if releaseErr != nil {
+		return fmt.Errorf("failed to release the global read lock: %w", releaseErr)
+	}
+	return nil
+}
+
+// printStorageSnapshotPlan prints the statements a storage snapshot coordination would run
+func (opt *mariadbOptions) printStorageSnapshotPlan(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "%s# within %v: run the snapshot-ready hook: %s\nUNLOCK TABLES;\n", lockStatements, opt.readLockTimeout, opt.snapshotReadyHook)
+	return err
+}
@@ -0,0 +1,220 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeLockClient returns a client journaling the statements it reads, then its disconnection, into $JOURNAL.
+// It runs onFlush when it gets FLUSH TABLES WITH READ LOCK and writes its pid into $JOURNAL.pid.
+func fakeLockClient(t *testing.T, onFlush string) string {
+	return fakeCommand(t, `echo $$ > "$JOURNAL.pid"
+while IFS= read -r statement; do
+	echo "$statement" >> "$JOURNAL"
+	case "$statement" in
+	"FLUSH TABLES WITH READ LOCK;") `+onFlush+` ;;
+	"SHOW MASTER STATUS;") printf 'mysql-bin.000042\t1337\t\t\n' ;;
+	"SELECT 'gtid'"*) printf 'gtid\t0-1-100\n' ;;
+	esac
+done
+echo disconnected >> "$JOURNAL"`)
+}
+
+// newStorageSnapshotSession returns the options and session of a storage snapshot coordination with the given
+// lock client and snapshot-ready hook, journaling into the returned file
+func newStorageSnapshotSession(t *testing.T, client, hook string, timeout time.Duration) (*mariadbOptions, *sessionWrapper, string) {
+	opt := newTestBackupOptions()
+	opt.snapshotReadyHook = hook
+	opt.readLockTimeout = timeout
+	session := newFakeSession(t, opt, client)
+	journal := filepath.Join(t.TempDir(), "journal")
+	session.sh.SetEnv("JOURNAL", journal)
+	return opt, session, journal
+}
+
+func readJournal(t *testing.T, journal string) string {
+	t.Helper()
+	data, err := os.ReadFile(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// checkLockClientExited fails the test unless the lock client exits within a second
+func checkLockClientExited(t *testing.T, journal string) {
+	t.Helper()
+	pid, err := os.ReadFile(journal + ".pid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(filepath.Join("/proc", strings.TrimSpace(string(pid)))); os.IsNotExist(err) {
+			return
+		}
+	}
+	t.Errorf("the client holding the global read lock is still running")
+}
+
+const lockJournal = "FLUSH TABLES WITH READ LOCK;\nSHOW MASTER STATUS;\nSELECT 'gtid', @@GLOBAL.gtid_binlog_pos;\n"
+
+func TestCoordinateStorageSnapshot(t *testing.T) {
+	opt, session, journal := newStorageSnapshotSession(t, fakeLockClient(t, ":"),
+		`echo "snapshot $MARIADB_BINLOG_FILE $MARIADB_BINLOG_POSITION $MARIADB_GTID_POSITION password=${MYSQL_PWD:-none}" >> "$JOURNAL"`, time.Minute)
+	session.sh.SetEnv(EnvMariaDBPassword, "s3cret")
+
+	if err := opt.coordinateStorageSnapshot(session); err != nil {
+		t.Fatal(err)
+	}
+	// the hook runs with the tables locked, the lock is released once it completed
+	want := lockJournal + "snapshot mysql-bin.000042 1337 0-1-100 password=none\nUNLOCK TABLES;\ndisconnected\n"
+	if got := readJournal(t, journal); got != want {
+		t.Errorf("the coordination ran:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestCoordinateStorageSnapshotReleasesTheLockWhenTheHookFails(t *testing.T) {
+	opt, session, journal := newStorageSnapshotSession(t, fakeLockClient(t, ":"), `echo snapshot >> "$JOURNAL"; exit 1`, time.Minute)
+
+	if err := opt.coordinateStorageSnapshot(session); err == nil || !strings.Contains(err.Error(), "snapshot-ready hook failed") {
+		t.Errorf("coordinateStorageSnapshot() error = %v, want the failure of the hook", err)
+	}
+	if got, want := readJournal(t, journal), lockJournal+"snapshot\nUNLOCK TABLES;\ndisconnected\n"; got != want {
+		t.Errorf("the coordination ran:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestCoordinateStorageSnapshotTimeoutReleasesTheLock(t *testing.T) {
+	opt, session, journal := newStorageSnapshotSession(t, fakeLockClient(t, ":"), `echo snapshot >> "$JOURNAL"; exec sleep 10`, 300*time.Millisecond)
+
+	startTime := time.Now()
+	err := opt.coordinateStorageSnapshot(session)
+	if err == nil || !strings.Contains(err.Error(), "the global read lock was released after the read lock timeout of 300ms") {
+		t.Errorf("coordinateStorageSnapshot() error = %v, want the lock released by the timeout", err)
+	}
+	if elapsed := time.Since(startTime); elapsed > 5*time.Second {
+		t.Errorf("the coordination took %v, want the hook killed by the read lock timeout", elapsed)
+	}
+	// the client is killed, so the server releases the lock of its connection without UNLOCK TABLES
+	if got, want := readJournal(t, journal), lockJournal+"snapshot\n"; got != want {
+		t.Errorf("the coordination ran:\n%s\nwant:\n%s", got, want)
+	}
+	checkLockClientExited(t, journal)
+}
+
+func TestCoordinateStorageSnapshotTimeoutWhileLocking(t *testing.T) {
+	// the lock waits for a long running query to complete
+	opt, session, journal := newStorageSnapshotSession(t, fakeLockClient(t, "exec sleep 10"), `echo snapshot >> "$JOURNAL"`, 300*time.Millisecond)
+
+	err := opt.coordinateStorageSnapshot(session)
+	if err == nil || !strings.Contains(err.Error(), "failed to lock the tables within the read lock timeout of 300ms") {
+		t.Errorf("coordinateStorageSnapshot() error = %v, want the lock to time out", err)
+	}
+	if got, want := readJournal(t, journal), "FLUSH TABLES WITH READ LOCK;\n"; got != want {
+		t.Errorf("the coordination ran:\n%s\nwant no snapshot:\n%s", got, want)
+	}
+	checkLockClientExited(t, journal)
+}
+
+func TestCoordinateStorageSnapshotLockRefused(t *testing.T) {
+	client := fakeCommand(t, `echo "ERROR 1227 (42000) at line 1: Access denied; you need (at least one of) the RELOAD privilege(s) for this operation" >&2; exit 1`)
+	opt, session, journal := newStorageSnapshotSession(t, client, `echo snapshot >> "$JOURNAL"`, time.Minute)
+
+	err := opt.coordinateStorageSnapshot(session)
+	if err == nil || !strings.Contains(err.Error(), "failed to lock the tables") || !strings.Contains(err.Error(), "RELOAD privilege") {
+		t.Errorf("coordinateStorageSnapshot() error = %v, want the refusal of the server", err)
+	}
+	if _, err := os.Stat(journal); !os.IsNotExist(err) {
+		t.Errorf("the snapshot-ready hook ran without the lock")
+	}
+}
+
+func TestParseLockedPosition(t *testing.T) {
+	tests := []struct {
+		name         string
+		masterStatus []string
+		gtid         string
+		want         *BinlogPosition
+		wantErr      bool
+	}{
+		{name: "binary log", masterStatus: []string{"mysql-bin.000042\t1337\t\t"}, gtid: "0-1-100", want: &BinlogPosition{File: "mysql-bin.000042", Position: 1337, GTID: "0-1-100"}},
+		{name: "no GTID", masterStatus: []string{"mysql-bin.000042\t1337\t\t"}, gtid: "", want: &BinlogPosition{File: "mysql-bin.000042", Position: 1337}},
+		{name: "binary log disabled", gtid: "NULL", want: &BinlogPosition{}},
+		{name: "invalid position", masterStatus: []string{"mysql-bin.000042\tend"}, gtid: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseLockedPosition(tt.masterStatus, tt.gtid)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseLockedPosition() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseLockedPosition() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStorageSnapshotOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(opt *mariadbOptions)
+		wantErr string
+	}{
+		{name: "full backup", prepare: func(opt *mariadbOptions) {}},
+		{name: "no timeout", prepare: func(opt *mariadbOptions) { opt.readLockTimeout = 0 }, wantErr: "read lock timeout must be positive"},
+		{name: "streamed", prepare: func(opt *mariadbOptions) { opt.streamBackup = true }, wantErr: "it can not be combined with streaming"},
+		{name: "per database", prepare: func(opt *mariadbOptions) { opt.perDatabaseBackup = true }, wantErr: "it can not be combined with streaming"},
+		{name: "incremental", prepare: func(opt *mariadbOptions) { opt.incremental = true }, wantErr: "it can not be combined with streaming"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := newTestBackupOptions()
+			opt.snapshotReadyHook = "take-snapshot"
+			opt.readLockTimeout = time.Minute
+			tt.prepare(opt)
+			err := opt.validateDumpOptions()
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validateDumpOptions() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+	if got := NewCmdBackup().Flags().Lookup("read-lock-timeout").DefValue; got != DefaultReadLockTimeout.String() {
+		t.Errorf("--read-lock-timeout defaults to %s, want %v", got, DefaultReadLockTimeout)
+	}
+}
+
+func TestPrintStorageSnapshotPlan(t *testing.T) {
+	opt := newTestBackupOptions()
+	opt.snapshotReadyHook = "take-snapshot"
+	opt.readLockTimeout = time.Minute
+	var out bytes.Buffer
+	if err := opt.printStorageSnapshotPlan(&out); err != nil {
+		t.Fatal(err)
+	}
+	want := lockJournal + "# within 1m0s: run the snapshot-ready hook: take-snapshot\nUNLOCK TABLES;\n"
+	if out.String() != want {
+		t.Errorf("printStorageSnapshotPlan() printed:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
@@ -0,0 +1,131 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const DefaultMaxReplicaLag = 5 * time.Minute
+
+// replicaStatus is the state of the replication of the default connection of a replica, from SHOW SLAVE STATUS
+type replicaStatus struct {
+	masterHost       string
+	ioRunning        bool
+	sqlRunning       bool
+	masterLogFile    string
+	execMasterLogPos int64
+	gtidSlavePos     string
+	// lag is nil when the server does not know it, i.e. when a replication thread is stopped
+	lag *time.Duration
+}
+
+// replicaStatus returns the replication status of the server, nil if it does not replicate from a primary
+func (session *sessionWrapper) replicaStatus() (*replicaStatus, error) {
+	// the vertical output labels each column, whichever the version of the server
+	output, err := session.executeQuery(`SHOW SLAVE STATUS\G`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the replication status: %w", err)
+	}
+	return parseReplicaStatus(output)
+}
+
+// parseReplicaStatus parses the "Name: value" lines of the vertical output of SHOW SLAVE STATUS
+func parseReplicaStatus(output []byte) (*replicaStatus, error) {
+	fields := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok || strings.HasPrefix(strings.TrimSpace(name), "*") {
+			continue
+		}
+		fields[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	status := &replicaStatus{
+		masterHost:    fields["Master_Host"],
+		ioRunning:     fields["Slave_IO_Running"] == "Yes",
+		sqlRunning:    fields["Slave_SQL_Running"] == "Yes",
+		masterLogFile: fields["Relay_Master_Log_File"],
+		gtidSlavePos:  fields["Gtid_Slave_Pos"],
+	}
+	if pos := fields["Exec_Master_Log_Pos"]; pos != "" {
+		n, err := strconv.ParseInt(pos, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Exec_Master_Log_Pos %q", pos)
+		}
+		status.execMasterLogPos = n
+	}
+	if lag := fields["Seconds_Behind_Master"]; lag != "" && lag != "NULL" {
+		seconds, err := strconv.ParseInt(lag, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Seconds_Behind_Master %q", lag)
+		}
+		d := time.Duration(seconds) * time.Second
+		status.lag = &d
+	}
+	return status, nil
+}
+
+// checkReplicaLag fails when the data of the replica is too far behind its primary to be backed up.
+// A replica that is not replicating, or whose lag is unknown, may be arbitrarily stale. A zero maxLag
+// accepts any lag as long as the replication runs.
+func checkReplicaLag(status *replicaStatus, maxLag time.Duration) error {
+	if status == nil {
+		return fmt.Errorf("the database is not a replica, SHOW SLAVE STATUS is empty")
+	}
+	if !status.ioRunning || !status.sqlRunning {
+		return fmt.Errorf("the replication from %s is stopped (IO thread running: %t, SQL thread running: %t)", status.masterHost, status.ioRunning, status.sqlRunning)
+	}
+	if status.lag == nil {
+		return fmt.Errorf("the lag of the replica behind %s is unknown", status.masterHost)
+	}
+	if maxLag > 0 && *status.lag > maxLag {
+		return fmt.Errorf("the replica is %v behind %s, more than the maximum replica lag of %v", *status.lag, status.masterHost, maxLag)
+	}
+	return nil
+}
+
+// prepareReplicaBackup checks that the replication of the database is healthy before it is backed up.
+// The dumps then stop the SQL thread of the replica with --dump-slave, so that their single transaction
+// reads a consistent snapshot matching the position of the primary they record.
+func (opt *mariadbOptions) prepareReplicaBackup(session *sessionWrapper) error {
+	status, err := session.replicaStatus()
+	if err != nil {
+		return err
+	}
+	if err = checkReplicaLag(status, opt.maxReplicaLag); err != nil {
+		return err
+	}
+	klog.Infof("Backing up a replica of %s, %v behind at %s:%d", status.masterHost, *status.lag, status.masterLogFile, status.execMasterLogPos)
+	// the dumps record the GTID position of the replica along with the coordinates of the primary
+	opt.gtidEnabled = status.gtidSlavePos != ""
+	return nil
+}
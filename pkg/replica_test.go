@@ -0,0 +1,216 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// replicaStatusOutput returns the vertical output of SHOW SLAVE STATUS of a replica of db-0
+func replicaStatusOutput(ioRunning, sqlRunning, secondsBehind, gtidSlavePos string) string {
+	return `*************************** 1. row ***************************
+                Slave_IO_State: Waiting for master to send event
+                   Master_Host: db-0.db-pods.demo.svc
+                   Master_User: repl
+                   Master_Port: 3306
+         Relay_Master_Log_File: mysql-bin.000042
+              Slave_IO_Running: ` + ioRunning + `
+             Slave_SQL_Running: ` + sqlRunning + `
+           Exec_Master_Log_Pos: 1337
+         Seconds_Behind_Master: ` + secondsBehind + `
+                Gtid_Slave_Pos: ` + gtidSlavePos + `
+`
+}
+
+func TestParseReplicaStatus(t *testing.T) {
+	status, err := parseReplicaStatus([]byte(replicaStatusOutput("Yes", "Yes", "12", "0-1-100")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.masterHost != "db-0.db-pods.demo.svc" || !status.ioRunning || !status.sqlRunning ||
+		status.masterLogFile != "mysql-bin.000042" || status.execMasterLogPos != 1337 || status.gtidSlavePos != "0-1-100" {
+		t.Errorf("parseReplicaStatus() = %+v", status)
+	}
+	if status.lag == nil || *status.lag != 12*time.Second {
+		t.Errorf("parseReplicaStatus() lag = %v, want 12s", status.lag)
+	}
+
+	// the lag is unknown while a replication thread is stopped
+	status, err = parseReplicaStatus([]byte(replicaStatusOutput("No", "Yes", "NULL", "")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.ioRunning || status.lag != nil {
+		t.Errorf("parseReplicaStatus() = %+v, want the IO thread stopped and the lag unknown", status)
+	}
+
+	// a server that does not replicate has no status
+	if status, err := parseReplicaStatus(nil); status != nil || err != nil {
+		t.Errorf("parseReplicaStatus() of a primary = %+v, %v, want no status", status, err)
+	}
+
+	for _, output := range []string{replicaStatusOutput("Yes", "Yes", "a while", ""), strings.Replace(replicaStatusOutput("Yes", "Yes", "0", ""), "1337", "end", 1)} {
+		if _, err := parseReplicaStatus([]byte(output)); err == nil {
+			t.Errorf("parseReplicaStatus() accepted the invalid status:\n%s", output)
+		}
+	}
+}
+
+func TestCheckReplicaLag(t *testing.T) {
+	lag := func(d time.Duration) *time.Duration { return &d }
+	tests := []struct {
+		name    string
+		status  *replicaStatus
+		maxLag  time.Duration
+		wantErr string
+	}{
+		{
+			name:   "in sync",
+			status: &replicaStatus{masterHost: "db-0", ioRunning: true, sqlRunning: true, lag: lag(0)},
+			maxLag: time.Minute,
+		},
+		{
+			name:   "behind within the limit",
+			status: &replicaStatus{masterHost: "db-0", ioRunning: true, sqlRunning: true, lag: lag(time.Minute)},
+			maxLag: time.Minute,
+		},
+		{
+			name:    "too far behind",
+			status:  &replicaStatus{masterHost: "db-0", ioRunning: true, sqlRunning: true, lag: lag(61 * time.Second)},
+			maxLag:  time.Minute,
+			wantErr: "the replica is 1m1s behind db-0, more than the maximum replica lag of 1m0s",
+		},
+		{
+			name:   "any lag accepted",
+			status: &replicaStatus{masterHost: "db-0", ioRunning: true, sqlRunning: true, lag: lag(24 * time.Hour)},
+		},
+		{
+			name:    "IO thread stopped",
+			status:  &replicaStatus{masterHost: "db-0", sqlRunning: true},
+			maxLag:  time.Minute,
+			wantErr: "the replication from db-0 is stopped (IO thread running: false, SQL thread running: true)",
+		},
+		{
+			name:    "SQL thread stopped",
+			status:  &replicaStatus{masterHost: "db-0", ioRunning: true},
+			wantErr: "the replication from db-0 is stopped (IO thread running: true, SQL thread running: false)",
+		},
+		{
+			name:    "unknown lag",
+			status:  &replicaStatus{masterHost: "db-0", ioRunning: true, sqlRunning: true},
+			maxLag:  time.Minute,
+			wantErr: "the lag of the replica behind db-0 is unknown",
+		},
+		{
+			name:    "not a replica",
+			maxLag:  time.Minute,
+			wantErr: "the database is not a replica",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkReplicaLag(tt.status, tt.maxLag)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("checkReplicaLag() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPrepareReplicaBackup(t *testing.T) {
+	tests := []struct {
+		name     string
+		output   string
+		maxLag   time.Duration
+		wantErr  string
+		wantGTID bool
+	}{
+		{name: "replica with GTIDs", output: replicaStatusOutput("Yes", "Yes", "3", "0-1-100"), maxLag: time.Minute, wantGTID: true},
+		{name: "replica without GTIDs", output: replicaStatusOutput("Yes", "Yes", "3", ""), maxLag: time.Minute},
+		{name: "lagging replica", output: replicaStatusOutput("Yes", "Yes", "600", "0-1-100"), maxLag: time.Minute, wantErr: "the replica is 10m0s behind"},
+		{name: "primary", maxLag: time.Minute, wantErr: "the database is not a replica"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := newTestBackupOptions()
+			opt.replicaBackup = true
+			opt.maxReplicaLag = tt.maxLag
+			session := newFakeSession(t, opt, fakeCommand(t, `eval query=\${$#}
+case "$query" in
+"SHOW SLAVE STATUS\G") printf '%s' '`+tt.output+`' ;;
+*) exit 1 ;;
+esac`))
+
+			err := opt.prepareReplicaBackup(session)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("prepareReplicaBackup() error = %v, want %q", err, tt.wantErr)
+			}
+			if err == nil && opt.gtidEnabled != tt.wantGTID {
+				t.Errorf("the dumps record the GTID position: %v, want %v", opt.gtidEnabled, tt.wantGTID)
+			}
+		})
+	}
+}
+
+func TestReplicaBackupDumpFlags(t *testing.T) {
+	opt := newTestBackupOptions()
+	opt.replicaBackup = true
+	opt.consistentSnapshot = true
+	opt.recordBinlogPosition = true
+	opt.gtidEnabled = true
+	if err := opt.validateDumpOptions(); err != nil {
+		t.Fatal(err)
+	}
+	session := newFakeSession(t, opt, MariaDBDumpCMD)
+
+	args := opt.dumpArgs(session, "shop")
+	for _, arg := range []string{"--dump-slave=2", "--gtid", "--single-transaction"} {
+		if countArg(args, arg) != 1 {
+			t.Errorf("the dump of a replica runs with %q, want %s once", args, arg)
+		}
+	}
+	// the position of the replica itself is not the one a restore replicates from
+	if countArg(args, "--master-data=2") != 0 {
+		t.Errorf("the dump of a replica runs with %q, want no --master-data", args)
+	}
+}
+
+func TestInvalidReplicaBackup(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(opt *mariadbOptions)
+		wantErr string
+	}{
+		{name: "streamed", prepare: func(opt *mariadbOptions) { opt.streamBackup = true }, wantErr: "which a streaming backup does not capture"},
+		{name: "parallel", prepare: func(opt *mariadbOptions) { opt.parallelism = 2 }, wantErr: "the databases can not be dumped in parallel"},
+		{name: "master data", prepare: func(opt *mariadbOptions) { opt.myArgs = "--all-databases --master-data=1" }, wantErr: "it can not be combined with --master-data or --dump-slave"},
+		{name: "lock all tables", prepare: func(opt *mariadbOptions) { opt.myArgs = "--all-databases -x" }, wantErr: "it can not be used together with --lock-all-tables"},
+		{name: "negative lag", prepare: func(opt *mariadbOptions) { opt.maxReplicaLag = -time.Second }, wantErr: "maximum replica lag must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := newTestBackupOptions()
+			opt.replicaBackup = true
+			tt.prepare(opt)
+			if err := opt.validateDumpOptions(); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validateDumpOptions() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
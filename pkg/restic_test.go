@@ -0,0 +1,335 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	api_v1beta1 "stash.appscode.dev/apimachinery/apis/stash/v1beta1"
+	"stash.appscode.dev/apimachinery/pkg/restic"
+
+	core "k8s.io/api/core/v1"
+	storage "kmodules.xyz/objectstore-api/api/v1"
+)
+
+const (
+	// fakeResticEnv tells the test binary to act as restic
+	fakeResticEnv = "GO_WANT_FAKE_RESTIC"
+	// fakeResticFailuresEnv names the file holding the number of the next backups the fake restic fails
+	fakeResticFailuresEnv = "GO_FAKE_RESTIC_FAILURES"
+)
+
+// newFakeRestic returns a restic wrapper running its commands in the shell of session with the test binary acting
+// as restic, and the directory of its repository
+func newFakeRestic(t *testing.T, opt *mariadbOptions, session *sessionWrapper) (*restic.ResticWrapper, string) {
+	t.Helper()
+	repository := t.TempDir()
+	opt.setupOptions.Provider = storage.ProviderLocal
+	opt.setupOptions.Bucket = repository
+	opt.setupOptions.ScratchDir = t.TempDir()
+	opt.setupOptions.StorageSecret = &core.Secret{Data: map[string][]byte{restic.RESTIC_PASSWORD: []byte("not-so-secret")}}
+	session.sh.Alias(restic.ResticCMD, os.Args[0], "-test.run=^TestFakeRestic$", "--")
+	session.sh.SetEnv(fakeResticEnv, "1")
+	resticWrapper, err := restic.NewResticWrapperFromShell(opt.setupOptions, session.sh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resticWrapper, repository
+}
+
+// TestFakeRestic is not a test, it is the restic the fake restic wrapper runs
+func TestFakeRestic(t *testing.T) {
+	if os.Getenv(fakeResticEnv) != "1" {
+		return
+	}
+	args := os.Args
+	for i, arg := range args {
+		if arg == "--" {
+			args = args[i+1:]
+			break
+		}
+	}
+	if err := runFakeRestic(os.Getenv(restic.RESTIC_REPOSITORY), args); err != nil {
+		fmt.Fprintln(os.Stderr, "Fatal:", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// fakeResticFlags are the flags of restic taking a value
+var fakeResticFlags = map[string]bool{
+	"--stdin-filename": true,
+	"--host":           true,
+	"--tag":            true,
+	"--path":           true,
+	"--exclude":        true,
+	"--cache-dir":      true,
+	"--cacert":         true,
+	"--option":         true,
+}
+
+// runFakeRestic runs the restic command args against a repository made of a list of snapshots and a directory per
+// snapshot holding its files
+func runFakeRestic(repository string, args []string) error {
+	var positional []string
+	flags := map[string][]string{}
+	for i := 1; i < len(args); i++ {
+		if !strings.HasPrefix(args[i], "--") {
+			positional = append(positional, args[i])
+			continue
+		}
+		if fakeResticFlags[args[i]] && i+1 < len(args) {
+			flags[args[i]] = append(flags[args[i]], args[i+1])
+			i++
+			continue
+		}
+		flags[args[i]] = append(flags[args[i]], "")
+	}
+	first := func(flag string) string {
+		if len(flags[flag]) == 0 {
+			return ""
+		}
+		return flags[flag][0]
+	}
+
+	// like restic, mark the cache directory it is given
+	if cacheDir := first("--cache-dir"); cacheDir != "" {
+		if err := os.MkdirAll(cacheDir, 0o700); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(cacheDir, "CACHEDIR.TAG"), []byte("Signature: 8a477f597d28d172789f06886806bc55\n"), 0o600); err != nil {
+			return err
+		}
+	}
+
+	snapshots, err := readFakeSnapshots(repository)
+	if err != nil {
+		return err
+	}
+	switch args[0] {
+	case "backup":
+		if err := failFakeBackup(os.Getenv(fakeResticFailuresEnv)); err != nil {
+			return err
+		}
+		id := make([]byte, 32)
+		if _, err := rand.Read(id); err != nil {
+			return err
+		}
+		snapshot := restic.Snapshot{ID: hex.EncodeToString(id), Time: time.Now(), Hostname: first("--host"), Tags: flags["--tag"]}
+		dir := filepath.Join(repository, snapshot.ID)
+		var size int64
+		if _, ok := flags["--stdin"]; ok {
+			path := "/" + first("--stdin-filename")
+			size, err = writeFakeFile(filepath.Join(dir, path), os.Stdin)
+			snapshot.Paths = []string{path}
+		} else {
+			size, err = copyFakeTree(positional[0], dir)
+			snapshot.Paths = positional
+		}
+		if err != nil {
+			return err
+		}
+		if err := writeFakeSnapshots(repository, append(snapshots, snapshot)); err != nil {
+			return err
+		}
+		return json.NewEncoder(os.Stdout).Encode(map[string]interface{}{
+			"message_type":          "summary",
+			"data_added":            size,
+			"total_bytes_processed": size,
+			"snapshot_id":           snapshot.ID,
+		})
+	case "snapshots":
+		matching := []restic.Snapshot{}
+		for _, snapshot := range snapshots {
+			if len(positional) == 0 {
+				matching = append(matching, snapshot)
+			}
+		}
+		// the snapshots may be given by a prefix of their id
+		for _, id := range positional {
+			found := false
+			for _, snapshot := range snapshots {
+				if strings.HasPrefix(snapshot.ID, id) {
+					matching, found = append(matching, snapshot), true
+				}
+			}
+			if !found {
+				fmt.Fprintf(os.Stderr, "Ignoring %q: no matching ID found for prefix %q\n", id, id)
+			}
+		}
+		return json.NewEncoder(os.Stdout).Encode(matching)
+	case "forget":
+		var kept []restic.Snapshot
+		for _, snapshot := range snapshots {
+			if containsString(positional, snapshot.ID) {
+				if err := os.RemoveAll(filepath.Join(repository, snapshot.ID)); err != nil {
+					return err
+				}
+				continue
+			}
+			kept = append(kept, snapshot)
+		}
+		return writeFakeSnapshots(repository, kept)
+	case "dump":
+		var found *restic.Snapshot
+		for i := range snapshots {
+			snapshot := &snapshots[i]
+			if positional[0] == "latest" {
+				if (first("--host") == "" || snapshot.Hostname == first("--host")) &&
+					(first("--path") == "" || containsString(snapshot.Paths, first("--path"))) {
+					found = snapshot
+				}
+			} else if snapshot.ID == positional[0] || strings.HasPrefix(snapshot.ID, positional[0]) {
+				found = snapshot
+			}
+		}
+		if found == nil {
+			return fmt.Errorf("no matching snapshot found for %s", positional[0])
+		}
+		f, err := os.Open(filepath.Join(repository, found.ID, positional[1]))
+		if err != nil {
+			return fmt.Errorf("cannot dump file: path %q not found in snapshot", positional[1])
+		}
+		defer f.Close()
+		_, err = io.Copy(os.Stdout, f)
+		return err
+	}
+	return fmt.Errorf("unsupported command %q", args[0])
+}
+
+// failFakeBackup fails the backup while the count on the first line of the failures file is not down to zero,
+// with the error on the following line
+func failFakeBackup(failures string) error {
+	if failures == "" {
+		return nil
+	}
+	data, err := os.ReadFile(failures)
+	if err != nil {
+		return err
+	}
+	count, message, _ := strings.Cut(string(data), "\n")
+	var remaining int
+	if _, err := fmt.Sscan(count, &remaining); err != nil || remaining <= 0 {
+		return err
+	}
+	if err := os.WriteFile(failures, []byte(fmt.Sprintf("%d\n%s", remaining-1, message)), 0o600); err != nil {
+		return err
+	}
+	return errors.New(message)
+}
+
+func readFakeSnapshots(repository string) ([]restic.Snapshot, error) {
+	var snapshots []restic.Snapshot
+	data, err := os.ReadFile(filepath.Join(repository, "snapshots.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return snapshots, json.Unmarshal(data, &snapshots)
+}
+
+func writeFakeSnapshots(repository string, snapshots []restic.Snapshot) error {
+	data, err := json.Marshal(snapshots)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(repository, "snapshots.json"), data, 0o600)
+}
+
+func writeFakeFile(path string, r io.Reader) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return 0, err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(f, r)
+}
+
+// copyFakeTree copies the files under the absolute path src into the snapshot directory dir
+func copyFakeTree(src, dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		n, err := writeFakeFile(filepath.Join(dir, path), f)
+		size += n
+		return err
+	})
+	return size, err
+}
+
+// failFakeBackups makes the fake restic of session fail its next backups as an unavailable object store
+func failFakeBackups(t *testing.T, session *sessionWrapper, backups int) {
+	t.Helper()
+	failFakeBackupsWith(t, session, backups, "unable to save snapshot: server response unexpected: 503 Service Unavailable")
+}
+
+// failFakeBackupsWith makes the fake restic of session fail its next backups with message
+func failFakeBackupsWith(t *testing.T, session *sessionWrapper, backups int, message string) {
+	t.Helper()
+	failures := filepath.Join(t.TempDir(), "failures")
+	if err := os.WriteFile(failures, []byte(fmt.Sprintf("%d\n%s", backups, message)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	session.sh.SetEnv(fakeResticFailuresEnv, failures)
+}
+
+// fakeSnapshots returns the snapshots of the fake restic repository
+func fakeSnapshots(t *testing.T, repository string) []restic.Snapshot {
+	t.Helper()
+	snapshots, err := readFakeSnapshots(repository)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snapshots
+}
+
+// storeFakeSnapshot backs up data as the file at path with the restic wrapper, the way the per database backups are
+// taken, args are the additional arguments of restic such as the tags
+func storeFakeSnapshot(t *testing.T, resticWrapper *restic.ResticWrapper, path string, data []byte, args ...string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resticWrapper.RunBackup(restic.BackupOptions{Host: restic.DefaultHost, BackupPaths: []string{path}, Args: args}, api_v1beta1.TargetRef{}); err != nil {
+		t.Fatal(err)
+	}
+}
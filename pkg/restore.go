@@ -18,7 +18,13 @@ package pkg
 
 import (
 	"context"
+	"fmt"
+	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	api_v1beta1 "stash.appscode.dev/apimachinery/apis/stash/v1beta1"
 	"stash.appscode.dev/apimachinery/pkg/restic"
@@ -29,6 +35,7 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog/v2"
 	appcatalog "kmodules.xyz/custom-resources/apis/appcatalog/v1alpha1"
 	appcatalog_cs "kmodules.xyz/custom-resources/client/clientset/versioned"
 	v1 "kmodules.xyz/offshoot-api/api/v1"
@@ -43,7 +50,25 @@ func NewCmdRestore() *cobra.Command {
 				ScratchDir:  restic.DefaultScratchDir,
 				EnableCache: false,
 			},
-			waitTimeout: 300,
+			waitTimeout:            300,
+			systemSchemas:          DefaultSystemSchemas,
+			compression:            CompressionNone,
+			readinessPollInterval:  DefaultReadinessPollInterval,
+			readinessBackoffFactor: 1,
+			clientCmd:              MariaDBRestoreCMD,
+			checkSQLMode:           true,
+			defaultCharset:         DefaultCharset,
+			maxAllowedPacket:       DefaultMaxAllowedPacket,
+			terminationGracePeriod: DefaultTerminationGracePeriod,
+			parallelism:            1,
+			tlsOptions: tlsOptions{
+				verifyServerCert: true,
+			},
+			credentialOptions: credentialOptions{
+				userKey:     MariaDBUser,
+				passwordKey: MariaDBPassword,
+				authMode:    AuthModePassword,
+			},
 			dumpOptions: restic.DumpOptions{
 				Host:     restic.DefaultHost,
 				FileName: MariaDBDumpFile,
@@ -55,9 +80,19 @@ func NewCmdRestore() *cobra.Command {
 		Use:               "restore-mariadb",
 		Short:             "Restores MariaDB DB Backup",
 		DisableAutoGenTag: true,
-		RunE: func(cmd *cobra.Command, args []string) error {
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
 			flags.EnsureRequiredFlags(cmd, "appbinding", "provider", "storage-secret-name", "storage-secret-namespace")
 
+			// the summary is written however the restore ends
+			summary := newRunSummary(OperationRestore, cmd)
+			defer func() {
+				summary.Bytes = opt.sqlFilterOptions.totalBytes
+				if opt.dumpOptions.Snapshot != "" {
+					summary.Snapshots = []string{opt.dumpOptions.Snapshot}
+				}
+				opt.writeRunSummary(summary, err)
+			}()
+
 			// prepare client
 			config, err := clientcmd.BuildConfigFromFlags(masterURL, kubeconfigPath)
 			if err != nil {
@@ -81,8 +116,24 @@ func NewCmdRestore() *cobra.Command {
 				Namespace:  opt.appBindingNamespace,
 			}
 
+			opt.metrics = opt.newMetricsRecorder()
+			if err = opt.metrics.start(); err != nil {
+				return err
+			}
+			defer opt.metrics.stop()
+
+			ctx, cancel := opt.startOperation(cmd.Context())
+			defer cancel()
+
 			var restoreOutput *restic.RestoreOutput
-			restoreOutput, err = opt.restoreMariaDB(targetRef)
+			startTime := time.Now()
+			restoreOutput, err = opt.restoreMariaDB(ctx, targetRef)
+			err = opt.operationError(ctx, err)
+			if opt.dryRun {
+				// nothing has been restored, there is no output to write nor metric to observe
+				return err
+			}
+			opt.metrics.observeOperation(OperationRestore, time.Since(startTime), err)
 			if err != nil {
 				restoreOutput = &restic.RestoreOutput{
 					RestoreTargetStatus: api_v1beta1.RestoreMemberStatus{
@@ -108,6 +159,30 @@ func NewCmdRestore() *cobra.Command {
 
 	cmd.Flags().StringVar(&opt.myArgs, "mariadb-args", opt.myArgs, "Additional arguments")
 	cmd.Flags().Int32Var(&opt.waitTimeout, "wait-timeout", opt.waitTimeout, "Time limit to wait for the database to be ready")
+	cmd.Flags().BoolVar(&opt.skipReadinessCheck, "skip-readiness-check", opt.skipReadinessCheck, "Do not wait for the database to be ready, for databases known to be up. The first of several hosts is used as is")
+	cmd.Flags().DurationVar(&opt.readinessPollInterval, "readiness-poll-interval", opt.readinessPollInterval, "Interval between two checks of the database readiness")
+	cmd.Flags().Float64Var(&opt.readinessBackoffFactor, "readiness-backoff-factor", opt.readinessBackoffFactor, "Factor the readiness poll interval is multiplied by after each check (1 polls at a fixed interval)")
+	cmd.Flags().DurationVar(&opt.maxReadinessPollInterval, "max-readiness-poll-interval", opt.maxReadinessPollInterval, "Upper bound of the readiness poll interval when it grows (0 for no bound but the wait timeout)")
+	cmd.Flags().DurationVar(&opt.connectTimeout, "connect-timeout", opt.connectTimeout, "Timeout to connect to the database, rounded up to seconds (0 uses the client default)")
+	cmd.Flags().StringVar(&opt.defaultCharset, "default-charset", opt.defaultCharset, "Character set of the connections to the database (empty uses the client default)")
+	cmd.Flags().StringVar(&opt.maxAllowedPacket, "max-allowed-packet", opt.maxAllowedPacket, "Largest packet exchanged with the database, in bytes or with a K, M or G suffix (empty uses the client default)")
+	cmd.Flags().DurationVar(&opt.operationTimeout, "operation-timeout", opt.operationTimeout, "Time limit of the whole restore, download and import included (0 disables the limit)")
+	cmd.Flags().DurationVar(&opt.terminationGracePeriod, "termination-grace-period", opt.terminationGracePeriod, "Time given to the commands to exit after SIGTERM when the operation times out, before they are killed")
+
+	cmd.Flags().BoolVar(&opt.tlsOptions.verifyServerCert, "tls-verify-server-cert", opt.tlsOptions.verifyServerCert, "Verify the server certificate against the CA bundle of the AppBinding (disable for self-signed internal hosts)")
+	cmd.Flags().StringVar(&opt.tlsOptions.minVersion, "tls-min-version", opt.tlsOptions.minVersion, "Minimum TLS version used to connect to the database (i.e. TLSv1.2)")
+
+	cmd.Flags().StringVar(&opt.credentialOptions.userKey, "user-key", opt.credentialOptions.userKey, "Key of the AppBinding secret holding the database username")
+	cmd.Flags().StringVar(&opt.credentialOptions.passwordKey, "password-key", opt.credentialOptions.passwordKey, "Key of the AppBinding secret holding the database password")
+	cmd.Flags().BoolVar(&opt.credentialOptions.useDefaultsFile, "use-defaults-file", opt.credentialOptions.useDefaultsFile, "Pass the password through a --defaults-extra-file instead of the MYSQL_PWD environment variable")
+	cmd.Flags().StringVar(&opt.credentialOptions.credentialsDir, "credentials-dir", opt.credentialOptions.credentialsDir, "Directory of mounted credential files named after --user-key and --password-key, read instead of the AppBinding secret")
+	cmd.Flags().StringVar(&opt.credentialOptions.authMode, "auth-mode", opt.credentialOptions.authMode, "Authentication of the database user, password (from the AppBinding secret) or aws-iam (RDS/Aurora IAM authentication token, requires TLS)")
+	cmd.Flags().StringVar(&opt.credentialOptions.awsRegion, "aws-region", opt.credentialOptions.awsRegion, "AWS region of the database for IAM authentication (defaults to AWS_REGION)")
+	cmd.Flags().StringVar(&opt.credentialOptions.awsEndpoint, "aws-endpoint", opt.credentialOptions.awsEndpoint, "host:port the IAM authentication token is signed for (defaults to the host and port of the AppBinding)")
+	cmd.Flags().StringToStringVar(&opt.extraEnv, "extra-env", opt.extraEnv, "Environment variables set for the database clients, given as <name>=<value> (i.e. LC_ALL=C.UTF-8). "+EnvMariaDBPassword+" and "+EnvMariaDBLoginFile+" can not be set")
+	cmd.Flags().StringVar(&opt.proxy.address, "socks5-proxy", opt.proxy.address, "Connect to the database through this SOCKS5 proxy, given as <host>:<port>")
+	cmd.Flags().StringVar(&opt.proxy.user, "socks5-user", opt.proxy.user, "User authenticating to the SOCKS5 proxy")
+	cmd.Flags().StringVar(&opt.proxy.password, "socks5-password", opt.proxy.password, "Password authenticating to the SOCKS5 proxy (defaults to "+EnvSOCKS5Password+")")
 
 	cmd.Flags().StringVar(&masterURL, "master", masterURL, "The address of the Kubernetes API server (overrides any value in kubeconfig)")
 	cmd.Flags().StringVar(&kubeconfigPath, "kubeconfig", kubeconfigPath, "Path to kubeconfig file with authorization information (the master location is set by the master flag).")
@@ -123,27 +198,146 @@ func NewCmdRestore() *cobra.Command {
 	cmd.Flags().BoolVar(&opt.setupOptions.InsecureTLS, "insecure-tls", opt.setupOptions.InsecureTLS, "InsecureTLS for TLS secure s3/s3 compatible backend")
 	cmd.Flags().StringVar(&opt.setupOptions.Region, "region", opt.setupOptions.Region, "Region for s3/s3 compatible backend")
 	cmd.Flags().StringVar(&opt.setupOptions.Path, "path", opt.setupOptions.Path, "Directory inside the bucket where backup will be stored")
-	cmd.Flags().StringVar(&opt.setupOptions.ScratchDir, "scratch-dir", opt.setupOptions.ScratchDir, "Temporary directory")
-	cmd.Flags().BoolVar(&opt.setupOptions.EnableCache, "enable-cache", opt.setupOptions.EnableCache, "Specify whether to enable caching for restic")
+	cmd.Flags().StringVar(&opt.setupOptions.ScratchDir, "scratch-dir", opt.setupOptions.ScratchDir, "Temporary directory of the dumps, TLS files and defaults files, created if missing. It must be writable, i.e. an emptyDir volume on a read-only root filesystem")
+	cmd.Flags().BoolVar(&opt.setupOptions.EnableCache, "enable-cache", opt.setupOptions.EnableCache, "Specify whether to enable caching for restic (restic runs with --no-cache otherwise, which suits one-shot jobs)")
+	cmd.Flags().StringVar(&opt.resticCacheDir, "restic-cache-dir", opt.resticCacheDir, "Directory of the restic cache, created if missing, instead of the scratch directory (i.e. a volume that outlives the pod). Requires --enable-cache")
 	cmd.Flags().Int64Var(&opt.setupOptions.MaxConnections, "max-connections", opt.setupOptions.MaxConnections, "Specify maximum concurrent connections for GCS, Azure and B2 backend")
 
 	cmd.Flags().StringVar(&opt.dumpOptions.Host, "hostname", opt.dumpOptions.Host, "Name of the host machine")
 	cmd.Flags().StringVar(&opt.dumpOptions.SourceHost, "source-hostname", opt.dumpOptions.SourceHost, "Name of the host from where data will be restored")
+	cmd.Flags().StringVar(&opt.compression, "compression", opt.compression, "Compression used when the backup was taken (none, gzip or zstd)")
+	cmd.Flags().StringVar(&opt.database, "database", opt.database, "Name of the database to restore from a per database backup")
+	cmd.Flags().StringSliceVar(&opt.databases, "databases", opt.databases, "Names of the databases to restore from their latest per database snapshots, restored concurrently up to --parallelism. The failure of a database does not stop the others")
+	cmd.Flags().IntVar(&opt.parallelism, "parallelism", opt.parallelism, "Maximum number of databases of --databases restored concurrently, each with its own client")
+	cmd.Flags().BoolVar(&opt.skipForeignKeyChecks, "skip-foreign-key-checks", opt.skipForeignKeyChecks, "Restore with foreign_key_checks disabled, required to restore several databases concurrently since a row may reference a database not restored yet. The references are NOT checked: rows left without their parent by a failed or partial restore go unnoticed")
+	cmd.Flags().BoolVar(&opt.fastLoad, "fast-load", opt.fastLoad, "Load the rows faster: the keys of each table are disabled while its rows are loaded (for MyISAM and Aria, unless the dump already does it) "+
+		"and the unique and foreign key checks are disabled for the session of the restore (for InnoDB). The keys left disabled by a failed restore are enabled again")
+	cmd.Flags().StringVar(&opt.sqlFilterOptions.database, "filter-database", opt.sqlFilterOptions.database, "Restore only this database from a dump containing several databases")
+	cmd.Flags().BoolVar(&opt.cleanBeforeRestore, "clean-before-restore", opt.cleanBeforeRestore, "Drop and create again every database the dump writes to before restoring it (DESTROYS the existing data)")
+	cmd.Flags().StringSliceVar(&opt.systemSchemas, "system-schemas", opt.systemSchemas, "Schemas treated as system schemas and never dropped")
+	cmd.Flags().StringVar(&opt.clientCmd, "client-binary", opt.clientCmd, "Name or path of the client binary the dump is restored with (i.e. mysql on images shipping the MySQL compatible client)")
+	cmd.Flags().BoolVar(&opt.continueOnError, "continue-on-error", opt.continueOnError, "Keep restoring past failed statements (--force) and report them all at the end")
+	cmd.Flags().BoolVar(&opt.restoreGrants, "restore-grants", opt.restoreGrants, "Create the accounts and replay the grants recorded by a backup taken with --dump-grants, after the data is restored")
+	cmd.Flags().BoolVar(&opt.verifyAfterRestore, "verify-after-restore", opt.verifyAfterRestore, "Compare the number of tables of the restored databases with the manifest recorded during backup")
+	cmd.Flags().StringToStringVar(&opt.sqlFilterOptions.databaseRename, "rename-database", opt.sqlFilterOptions.databaseRename, "Restore the databases of the dump under another name, given as <from>=<to> (i.e. prod=staging)")
+	cmd.Flags().BoolVar(&opt.sqlFilterOptions.schemaOnly, "schema-only", opt.sqlFilterOptions.schemaOnly, "Restore only the structure of the databases: the tables, views, routines, triggers and events are created, the rows are not loaded")
+	cmd.Flags().StringSliceVar(&opt.sqlFilterOptions.excludeTables, "exclude-tables", opt.sqlFilterOptions.excludeTables, "Do not restore these tables, given as <database>.<table> with the names quoted in backticks when they contain a dot: their CREATE TABLE, rows and triggers are skipped. The views and routines using them are restored")
+	cmd.Flags().StringVar(&opt.sqlFilterOptions.convertCharset, "convert-charset", opt.sqlFilterOptions.convertCharset, "Convert the charset of the restored databases, given as <from>:<to>. Only "+CharsetConversionLatin1+" is supported: the CHARACTER SET and COLLATE declarations are rewritten, the server converts the data")
+	cmd.Flags().BoolVar(&opt.sqlFilterOptions.transcodeData, "transcode-data", opt.sqlFilterOptions.transcodeData, "With --convert-charset, also transcode the bytes of a dump taken with a latin1 connection (SET NAMES latin1) to UTF-8. Binary columns must have been dumped with --hex-blob")
+	cmd.Flags().StringVar(&opt.sqlFilterOptions.definerMode, "definer", opt.sqlFilterOptions.definerMode, "Rewrite the DEFINER clauses of the views, triggers, routines and events, whose users may not exist on the target: strip removes them, current-user replaces them with CURRENT_USER. Empty keeps them")
+	cmd.Flags().DurationVar(&opt.sqlFilterOptions.progressInterval, "progress-interval", opt.sqlFilterOptions.progressInterval, "Interval between two reports of the restore progress (0 disables the reports)")
+	cmd.Flags().BoolVar(&opt.createDatabases, "create-databases", opt.createDatabases, "Create the databases of the dump missing on the target, with the charset recorded at backup time (for dumps taken with --no-create-db)")
+	cmd.Flags().StringVar(&opt.databaseCharset, "database-charset", opt.databaseCharset, "Charset of the created databases when the backup did not record it (empty uses the server default)")
+	cmd.Flags().StringVar(&opt.databaseCollation, "database-collation", opt.databaseCollation, "Collation of the created databases when the backup did not record it (empty uses the default of the charset)")
+	cmd.Flags().BoolVar(&opt.verifyChecksum, "verify-checksum", opt.verifyChecksum, "Verify the SHA-256 of the dump recorded at backup time before restoring it (per database snapshots only, the dump is read twice)")
+	cmd.Flags().StringVar(&opt.restoreSQLMode, "restore-sql-mode", opt.restoreSQLMode, "sql_mode of the restore session, i.e. NO_AUTO_VALUE_ON_ZERO,ALLOW_INVALID_DATES to restore the zero dates of a lax source on a strict target. Empty uses the sql_mode recorded at backup time if any, server keeps the one of the target")
+	cmd.Flags().BoolVar(&opt.checkSQLMode, "check-sql-mode", opt.checkSQLMode, "Warn when the sql_mode of the target differs from the one recorded at backup time")
+	cmd.Flags().BoolVar(&opt.strictVersionCheck, "strict-version-check", opt.strictVersionCheck, "Fail instead of warning when the target server is older than the server the backup was taken from")
+	cmd.Flags().StringVar(&opt.setGTIDPosition, "set-gtid-position", opt.setGTIDPosition, "Whether the GTID position recorded by a backup taken with --record-binlog-position is applied: on (RESET MASTER then apply), off (never apply) or auto (apply only if the target has no binary log GTID). Empty leaves the dump untouched")
+	cmd.Flags().BoolVar(&opt.dryRun, "dry-run", opt.dryRun, "Print the commands the restore would run (with the credentials masked) without restoring anything")
 	// TODO: sliceVar
-	cmd.Flags().StringVar(&opt.dumpOptions.Snapshot, "snapshot", opt.dumpOptions.Snapshot, "Snapshot to dump")
+	cmd.Flags().StringVar(&opt.dumpOptions.Snapshot, "snapshot", opt.dumpOptions.Snapshot, "Snapshot to restore, given by its ID (the latest snapshot of the host is restored if empty)")
+
+	cmd.Flags().StringVar(&opt.metricsAddr, "metrics-addr", opt.metricsAddr, "Address serving the metrics of the restore on /metrics while it runs (i.e. :9090)")
+	cmd.Flags().StringVar(&opt.pushgatewayURL, "pushgateway-url", opt.pushgatewayURL, "URL of a Prometheus pushgateway the metrics are pushed to when the restore completes")
 
 	cmd.Flags().StringVar(&opt.outputDir, "output-dir", opt.outputDir, "Directory where output.json file will be written (keep empty if you don't need to write output in file)")
+	cmd.Flags().BoolVar(&opt.summaryStdout, "summary-stdout", opt.summaryStdout, "Print the JSON summary of the run, also written into "+RunSummaryFileName+" in the output directory, to stdout")
 
 	return cmd
 }
 
-func (opt *mariadbOptions) restoreMariaDB(targetRef api_v1beta1.TargetRef) (*restic.RestoreOutput, error) {
+func (opt *mariadbOptions) restoreMariaDB(ctx context.Context, targetRef api_v1beta1.TargetRef) (*restic.RestoreOutput, error) {
 	var err error
+	binaries := []string{opt.clientCmd}
+	if opt.compression == CompressionZstd {
+		binaries = append(binaries, ZstdCMD)
+	}
+	err = checkBinaries(binaries...)
+	if err != nil {
+		return nil, err
+	}
+
 	err = license.CheckLicenseEndpoint(opt.config, licenseApiService, SupportedProducts)
 	if err != nil {
 		return nil, err
 	}
 
+	err = opt.validateConnectionOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	err = opt.setupResticCache()
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateCompression(opt.compression)
+	if err != nil {
+		return nil, err
+	}
+
+	if opt.sqlFilterOptions.progressInterval != 0 && opt.sqlFilterOptions.progressInterval < MinProgressInterval {
+		return nil, fmt.Errorf("progress interval must be at least %v, got %v", MinProgressInterval, opt.sqlFilterOptions.progressInterval)
+	}
+	if !containsString([]string{"", GTIDPositionAuto, GTIDPositionOn, GTIDPositionOff}, opt.setGTIDPosition) {
+		return nil, fmt.Errorf("invalid set-gtid-position %q, must be one of %s, %s or %s", opt.setGTIDPosition, GTIDPositionAuto, GTIDPositionOn, GTIDPositionOff)
+	}
+	if _, err = parseExcludedTables(opt.sqlFilterOptions.excludeTables); err != nil {
+		return nil, err
+	}
+	if err = validateCharsetConversion(opt.sqlFilterOptions.convertCharset); err != nil {
+		return nil, err
+	}
+	if opt.sqlFilterOptions.transcodeData && opt.sqlFilterOptions.convertCharset == "" {
+		return nil, fmt.Errorf("--transcode-data requires --convert-charset")
+	}
+	if !containsString([]string{"", DefinerStrip, DefinerCurrentUser}, opt.sqlFilterOptions.definerMode) {
+		return nil, fmt.Errorf("invalid definer %q, must be one of %s or %s", opt.sqlFilterOptions.definerMode, DefinerStrip, DefinerCurrentUser)
+	}
+	switch {
+	case opt.database != "":
+		opt.runDatabases = []string{opt.database}
+	case len(opt.databases) > 0:
+		opt.runDatabases = opt.databases
+	case opt.sqlFilterOptions.database != "":
+		opt.runDatabases = []string{opt.sqlFilterOptions.database}
+	}
+	if opt.restoreSQLMode != "" && opt.restoreSQLMode != SQLModeServer {
+		if err = validateSQLMode(opt.restoreSQLMode); err != nil {
+			return nil, err
+		}
+		if hasArg(strings.Fields(opt.myArgs), "--init-command") {
+			return nil, fmt.Errorf("the restore sql_mode is set with --init-command, it can not be combined with the --init-command of the mariadb args")
+		}
+	}
+	if opt.skipForeignKeyChecks && hasArg(strings.Fields(opt.myArgs), "--init-command") {
+		return nil, fmt.Errorf("the foreign key checks are skipped with --init-command, it can not be combined with the --init-command of the mariadb args")
+	}
+	if opt.fastLoad && hasArg(strings.Fields(opt.myArgs), "--init-command") {
+		return nil, fmt.Errorf("the unique and foreign key checks of a fast load are disabled with --init-command, it can not be combined with the --init-command of the mariadb args")
+	}
+	opt.sqlFilterOptions.disableKeys = opt.fastLoad
+	err = opt.validateDatabasesRestore()
+	if err != nil {
+		return nil, err
+	}
+	if opt.verifyChecksum && len(opt.perDatabaseRestores()) == 0 {
+		return nil, fmt.Errorf("--verify-checksum requires --database or --databases, only the per database snapshots record the checksum of their dump")
+	}
+	if opt.database != "" && opt.restoreGrants {
+		return nil, fmt.Errorf("grants can not be restored from a per database backup, they are not recorded")
+	}
+	if opt.database != "" && opt.sqlFilterOptions.database != "" {
+		return nil, fmt.Errorf("database and filter-database can not be used together, a per database snapshot holds a single database")
+	}
+
+	err = opt.validate(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
 	opt.setupOptions.StorageSecret, err = opt.kubeClient.CoreV1().Secrets(opt.storageSecret.Namespace).Get(context.TODO(), opt.storageSecret.Name, metav1.GetOptions{})
 	if err != nil {
 		return nil, err
@@ -163,36 +357,279 @@ func (opt *mariadbOptions) restoreMariaDB(targetRef api_v1beta1.TargetRef) (*res
 		return nil, err
 	}
 
-	session := opt.newSessionWrapper(MariaDBRestoreCMD)
+	session, err := opt.prepareSession(appBinding, opt.clientCmd, opt.setupOptions.ScratchDir)
+	defer session.cleanup()
+	if err != nil {
+		return nil, err
+	}
 
-	err = session.setDatabaseCredentials(opt.kubeClient, appBinding)
+	resticWrapper, err := restic.NewResticWrapperFromShell(opt.setupOptions, session.sh)
 	if err != nil {
 		return nil, err
 	}
 
-	err = session.setDatabaseConnectionParameters(appBinding)
+	// an explicit snapshot is checked before anything runs against the database
+	if opt.dumpOptions.Snapshot != "" && opt.dumpOptions.Snapshot != "latest" {
+		snapshot, err := findSnapshot(resticWrapper, opt.dumpOptions, opt.database)
+		if err != nil {
+			return nil, err
+		}
+		databases, omitted, ok, err := snapshotDatabases(snapshot)
+		switch {
+		case err != nil:
+			klog.Warningf("Unable to list the databases of snapshot %s. Reason: %v", snapshot.ID, err)
+		case ok && omitted > 0:
+			klog.Infof("Snapshot %s holds the databases %v and %d more", snapshot.ID, databases, omitted)
+		case ok:
+			klog.Infof("Snapshot %s holds the databases %v", snapshot.ID, databases)
+		}
+		if ok && opt.database == "" && opt.sqlFilterOptions.database == "" {
+			opt.runDatabases = databases
+		}
+	}
+
+	err = opt.waitForDatabase(ctx, session)
 	if err != nil {
 		return nil, err
 	}
 
-	err = session.setTLSParameters(appBinding, opt.setupOptions.ScratchDir)
+	// the snapshots of the databases are taken from the same server, the first one tells its version
+	compatibilityDB := opt.database
+	if len(opt.databases) > 0 {
+		compatibilityDB = opt.databases[0]
+	}
+	err = checkServerCompatibility(session, resticWrapper, opt.dumpOptions, compatibilityDB, opt.strictVersionCheck)
 	if err != nil {
 		return nil, err
 	}
 
-	err = session.waitForDBReady(opt.waitTimeout)
+	// the snapshot of a single database has no server variables, they are only stored next to the full dumps
+	if opt.checkSQLMode && len(opt.perDatabaseRestores()) == 0 {
+		opt.warnSQLModeMismatch(session, resticWrapper)
+	}
+
+	err = opt.checkRenameTargets(session)
 	if err != nil {
 		return nil, err
 	}
 
-	session.setUserArgs(opt.myArgs)
+	if opt.createDatabases && !opt.dryRun {
+		err = opt.createMissingDatabases(session, resticWrapper)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	// append the restore command to the pipeline
-	opt.dumpOptions.StdoutPipeCommands = append(opt.dumpOptions.StdoutPipeCommands, *session.cmd)
-	resticWrapper, err := restic.NewResticWrapperFromShell(opt.setupOptions, session.sh)
+	initArgs := opt.restoreInitCommandArgs(resticWrapper)
+	opt.setRestoreArgs(session, initArgs)
+
+	// restore the snapshots of several databases taken by a per database backup
+	if len(opt.databases) > 0 {
+		return opt.restoreDatabases(ctx, appBinding, session, resticWrapper, initArgs, targetRef)
+	}
+
+	// restore the snapshot of a single database taken by a per database backup
+	if opt.database != "" {
+		opt.dumpOptions.FileName = opt.databaseDumpFile(filepath.Join(opt.setupOptions.ScratchDir, MariaDBDumpDir), opt.database)
+		opt.dumpOptions.Path = opt.dumpOptions.FileName
+		// a tampered or corrupted dump is rejected before the database is touched
+		if opt.verifyChecksum {
+			err = verifyDumpChecksum(resticWrapper, opt.dumpOptions, opt.database)
+			if err != nil {
+				return nil, err
+			}
+		}
+		// the dump of a single database does not create it, so it is recreated beforehand
+		if opt.cleanBeforeRestore && !opt.dryRun {
+			err = session.recreateDatabase(opt.database, opt.systemSchemas)
+			if err != nil {
+				return nil, err
+			}
+		}
+		session.cmd.Args = append(session.cmd.Args, "--database="+opt.database)
+		// the dump of a single database never switches to it
+		opt.sqlFilterOptions.defaultDatabase = opt.database
+	} else {
+		opt.dumpOptions.FileName += compressionExtension(opt.compression)
+		opt.sqlFilterOptions.recreateDatabases = opt.cleanBeforeRestore
+		opt.sqlFilterOptions.systemSchemas = opt.systemSchemas
+	}
+
+	// decompress the dump before handing it to the restore command, the compression is detected
+	// from the content since dumps made by other tools may not have the expected extension
+	decompress, err := decompressCommand()
 	if err != nil {
 		return nil, err
 	}
+	opt.dumpOptions.StdoutPipeCommands = append(opt.dumpOptions.StdoutPipeCommands, *decompress)
+
+	// the size of the dump recorded at backup time gives the percentage of the restore progress
+	if opt.sqlFilterOptions.progressInterval > 0 {
+		opt.sqlFilterOptions.totalBytes = dumpSize(resticWrapper, opt.dumpOptions, opt.database)
+	}
+
+	opt.sqlFilterOptions.gtidMode, err = session.gtidFilterMode(opt.setGTIDPosition)
+	if err != nil {
+		return nil, err
+	}
+
+	// drop the statements that must not be replayed before they reach the restore command
+	filter, err := sqlFilterCommand(opt.sqlFilterOptions)
+	if err != nil {
+		return nil, err
+	}
+	if filter != nil {
+		opt.dumpOptions.StdoutPipeCommands = append(opt.dumpOptions.StdoutPipeCommands, *filter)
+	}
+
+	// append the restore command to the pipeline
+	restoreCmd := session.cmd
+	errorsFile := filepath.Join(opt.setupOptions.ScratchDir, RestoreErrorsFileName)
+	if opt.continueOnError {
+		// the client reports each failed statement on stderr, keep them all for the summary
+		restoreCmd, err = captureErrorsCommand(*session.cmd, errorsFile)
+		if err != nil {
+			return nil, err
+		}
+		session.tempFiles = append(session.tempFiles, errorsFile)
+	}
+	opt.dumpOptions.StdoutPipeCommands = append(opt.dumpOptions.StdoutPipeCommands, *restoreCmd)
+	if opt.dryRun {
+		return nil, opt.printRestorePlan(os.Stdout, session, opt.dumpOptions, opt.database)
+	}
+
+	// the restore may start long after the session was prepared
+	if err := session.refreshCredentials(); err != nil {
+		return nil, err
+	}
+
 	// Run dump
-	return resticWrapper.Dump(opt.dumpOptions, targetRef)
+	restoreOutput, err := resticWrapper.Dump(opt.dumpOptions, targetRef)
+	if err != nil && opt.fastLoad {
+		opt.enableKeysAfterFailure(session, opt.runDatabases)
+	}
+	if err != nil && opt.continueOnError {
+		return nil, restoreErrorSummary(errorsFile, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if opt.restoreGrants {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		err = opt.replayGrants(session, resticWrapper)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opt.verifyAfterRestore {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		err = opt.verifyRestore(session, resticWrapper)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return restoreOutput, nil
+}
+
+// checkRenameTargets fails if a database of the dump is renamed to a database that exists on the target,
+// unless it is dropped and created again before the restore
+func (opt *mariadbOptions) checkRenameTargets(session *sessionWrapper) error {
+	if len(opt.sqlFilterOptions.databaseRename) == 0 || opt.cleanBeforeRestore {
+		return nil
+	}
+	existing, err := session.getDbNames(nil)
+	if err != nil {
+		return err
+	}
+	var conflicts []string
+	for from, to := range opt.sqlFilterOptions.databaseRename {
+		if opt.sqlFilterOptions.database != "" && from != opt.sqlFilterOptions.database {
+			continue
+		}
+		if existing.has(to) {
+			conflicts = append(conflicts, to)
+		}
+	}
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return fmt.Errorf("databases %s already exist on the target, restore with --clean-before-restore to replace them", strings.Join(conflicts, ", "))
+	}
+	return nil
+}
+
+// enableKeysAfterFailure enables the keys a fast load left disabled when the restore failed midway, in the
+// given databases or all but the system schemas. The tables with disabled keys have the indexes noted as
+// disabled. Failing to enable them is only logged, the restore already failed.
+func (opt *mariadbOptions) enableKeysAfterFailure(session *sessionWrapper, databases []string) {
+	condition, schemas := "NOT IN", opt.systemSchemas
+	if len(databases) > 0 {
+		condition, schemas = "IN", databases
+	}
+	query := "SELECT DISTINCT TABLE_SCHEMA, TABLE_NAME FROM information_schema.STATISTICS WHERE COMMENT = 'disabled'"
+	if len(schemas) > 0 {
+		quoted := make([]string, 0, len(schemas))
+		for _, db := range schemas {
+			quoted = append(quoted, quoteString(db))
+		}
+		query += " AND TABLE_SCHEMA " + condition + " (" + strings.Join(quoted, ", ") + ")"
+	}
+	output, err := session.executeQuery(query + ";")
+	if err != nil {
+		klog.Errorf("Failed to list the tables whose keys are disabled. Reason: %v", err)
+		return
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 2 {
+			continue
+		}
+		table := quoteIdentifier(unescapeBatchValue(fields[0])) + "." + quoteIdentifier(unescapeBatchValue(fields[1]))
+		klog.Infof("Enabling the keys of %s left disabled by the failed restore", table)
+		if _, err = session.executeQuery("ALTER TABLE " + table + " ENABLE KEYS;"); err != nil {
+			klog.Errorf("Failed to enable the keys of %s. Reason: %v", table, err)
+		}
+	}
+}
+
+// dumpSize returns the size of the dump restored from the snapshot, or 0 if it was not recorded
+func dumpSize(resticWrapper *restic.ResticWrapper, dumpOptions restic.DumpOptions, db string) int64 {
+	snapshot, err := findSnapshot(resticWrapper, dumpOptions, db)
+	if err != nil {
+		klog.Warningf("Unable to find the size of the dump, the restore progress will not be reported as a percentage. Reason: %v", err)
+		return 0
+	}
+	value, ok := snapshotTagValue(snapshot, DumpBytesTagPrefix)
+	if !ok {
+		return 0
+	}
+	size, _ := strconv.ParseInt(value, 10, 64)
+	return size
+}
+
+// verifyRestore checks that the restored databases have as many tables as recorded during backup
+func (opt *mariadbOptions) verifyRestore(session *sessionWrapper, resticWrapper *restic.ResticWrapper) error {
+	var (
+		manifest  TableManifest
+		databases []string
+		err       error
+	)
+	if opt.database != "" {
+		manifest, err = readTableCountTag(resticWrapper, opt.dumpOptions, opt.database)
+		databases = []string{opt.database}
+	} else {
+		manifest, err = readTableManifest(resticWrapper, opt.dumpOptions, tableManifestFile(filepath.Join(opt.setupOptions.ScratchDir, MariaDBDumpDir)))
+		if opt.sqlFilterOptions.database != "" {
+			databases = []string{opt.sqlFilterOptions.database}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return session.verifyTableCounts(manifest, databases)
 }
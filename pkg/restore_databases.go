@@ -0,0 +1,277 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	api_v1beta1 "stash.appscode.dev/apimachinery/apis/stash/v1beta1"
+	"stash.appscode.dev/apimachinery/pkg/restic"
+
+	"k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/klog/v2"
+	appcatalog "kmodules.xyz/custom-resources/apis/appcatalog/v1alpha1"
+)
+
+// perDatabaseRestores returns the databases restored from their per database snapshots
+func (opt *mariadbOptions) perDatabaseRestores() []string {
+	if opt.database != "" {
+		return []string{opt.database}
+	}
+	return opt.databases
+}
+
+// validateDatabasesRestore checks the options of a restore of several per database snapshots
+func (opt *mariadbOptions) validateDatabasesRestore() error {
+	if opt.parallelism < 1 {
+		return fmt.Errorf("parallelism must be at least 1, got %d", opt.parallelism)
+	}
+	if len(opt.databases) == 0 {
+		return nil
+	}
+	switch {
+	case opt.database != "":
+		return fmt.Errorf("database and databases can not be used together")
+	case opt.sqlFilterOptions.database != "":
+		return fmt.Errorf("databases and filter-database can not be used together, a per database snapshot holds a single database")
+	case opt.dumpOptions.Snapshot != "" && opt.dumpOptions.Snapshot != "latest":
+		return fmt.Errorf("a snapshot holds a single database, the latest snapshot of each database is restored with --databases")
+	case opt.restoreGrants:
+		return fmt.Errorf("grants can not be restored from a per database backup, they are not recorded")
+	case len(opt.sqlFilterOptions.databaseRename) > 0:
+		return fmt.Errorf("databases can not be renamed when restoring several per database snapshots")
+	}
+	seen := map[string]bool{}
+	for _, db := range opt.databases {
+		if db == "" {
+			return fmt.Errorf("empty database name in databases")
+		}
+		if seen[db] {
+			return fmt.Errorf("database %s is listed twice in databases", db)
+		}
+		seen[db] = true
+	}
+	// a row may reference a table of a database that another worker has not restored yet
+	if len(opt.databases) > 1 && opt.parallelism > 1 && !opt.skipForeignKeyChecks {
+		return fmt.Errorf("databases restored concurrently may reference each other through foreign keys, restore them with --skip-foreign-key-checks or --parallelism=1")
+	}
+	return nil
+}
+
+// setRestoreArgs sets the arguments of the client restoring the dumps
+func (opt *mariadbOptions) setRestoreArgs(session *sessionWrapper, initArgs []interface{}) {
+	session.setUserArgs(opt.myArgs)
+	session.cmd.Args = append(session.cmd.Args, initArgs...)
+	if opt.continueOnError && !hasArg(strings.Fields(opt.myArgs), "--force") && !hasArg(strings.Fields(opt.myArgs), "-f") {
+		session.cmd.Args = append(session.cmd.Args, "--force")
+	}
+}
+
+// newWorkerResticWrapper returns the restic wrapper of a restore worker, running its commands in the shell of the session
+var newWorkerResticWrapper = func(setupOptions restic.SetupOptions, session *sessionWrapper) (*restic.ResticWrapper, error) {
+	return restic.NewResticWrapperFromShell(setupOptions, session.sh)
+}
+
+// restoreDatabases restores the per database snapshots of opt.databases with up to opt.parallelism
+// concurrent clients, each worker with its own session. The failure of a database does not stop the
+// others, the errors of all of them are reported together.
+func (opt *mariadbOptions) restoreDatabases(ctx context.Context, appBinding *appcatalog.AppBinding, session *sessionWrapper, resticWrapper *restic.ResticWrapper, initArgs []interface{}, targetRef api_v1beta1.TargetRef) (*restic.RestoreOutput, error) {
+	startTime := time.Now()
+	filterOptions := opt.sqlFilterOptions
+	var err error
+	filterOptions.gtidMode, err = session.gtidFilterMode(opt.setGTIDPosition)
+	if err != nil {
+		return nil, err
+	}
+
+	errs := make([]error, len(opt.databases))
+	restore := func(session *sessionWrapper, resticWrapper *restic.ResticWrapper, i int) {
+		db := opt.databases[i]
+		errorsFile := filepath.Join(opt.setupOptions.ScratchDir, strconv.Itoa(i)+"-"+RestoreErrorsFileName)
+		if errs[i] = opt.restoreDatabaseSnapshot(ctx, session, resticWrapper, db, filterOptions, errorsFile, targetRef); errs[i] != nil {
+			klog.Errorf("Failed to restore database %s. Reason: %v", db, errs[i])
+		}
+	}
+
+	workers := opt.parallelism
+	if workers > len(opt.databases) {
+		workers = len(opt.databases)
+	}
+	// the plan of a dry run is printed in order
+	if workers <= 1 || opt.dryRun {
+		for i := range opt.databases {
+			restore(session, resticWrapper, i)
+		}
+	} else {
+		sessions := make([]*sessionWrapper, workers)
+		wrappers := make([]*restic.ResticWrapper, workers)
+		defer func() {
+			for _, s := range sessions {
+				if s != nil {
+					s.cleanup()
+				}
+			}
+		}()
+		for w := range sessions {
+			sessions[w], err = opt.prepareSession(appBinding, opt.clientCmd, opt.setupOptions.ScratchDir)
+			if err != nil {
+				return nil, err
+			}
+			// the workers restore into the host selected while waiting for the database
+			sessions[w].useHost(session.host())
+			opt.setRestoreArgs(sessions[w], initArgs)
+			// each restore pipeline runs in the shell of its worker, with the credentials of its session
+			wrappers[w], err = newWorkerResticWrapper(opt.setupOptions, sessions[w])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		jobs := make(chan int)
+		wg := sync.WaitGroup{}
+		for w := range sessions {
+			wg.Add(1)
+			go func(workerSession *sessionWrapper, workerWrapper *restic.ResticWrapper) {
+				defer wg.Done()
+				for i := range jobs {
+					restore(workerSession, workerWrapper, i)
+				}
+			}(sessions[w], wrappers[w])
+		}
+		for i := range opt.databases {
+			jobs <- i
+		}
+		close(jobs)
+		wg.Wait()
+	}
+	if opt.dryRun {
+		return nil, errors.NewAggregate(errs)
+	}
+
+	var (
+		failed   []string
+		failures []error
+	)
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, opt.databases[i])
+			failures = append(failures, fmt.Errorf("failed to restore database %s: %w", opt.databases[i], err))
+		}
+	}
+	if len(failures) > 0 {
+		if opt.fastLoad {
+			opt.enableKeysAfterFailure(session, failed)
+		}
+		return nil, fmt.Errorf("restore failed for %d of %d databases (%s): %w", len(failed), len(opt.databases), strings.Join(failed, ", "), errors.NewAggregate(failures))
+	}
+
+	return &restic.RestoreOutput{
+		RestoreTargetStatus: api_v1beta1.RestoreMemberStatus{
+			Ref: targetRef,
+			Stats: []api_v1beta1.HostRestoreStats{
+				{
+					Hostname: opt.dumpOptions.Host,
+					Phase:    api_v1beta1.HostRestoreSucceeded,
+					Duration: time.Since(startTime).String(),
+				},
+			},
+		},
+	}, nil
+}
+
+// restoreDatabaseSnapshot restores the latest per database snapshot of db with the client of the session
+func (opt *mariadbOptions) restoreDatabaseSnapshot(ctx context.Context, session *sessionWrapper, resticWrapper *restic.ResticWrapper, db string, filterOptions sqlFilterOptions, errorsFile string, targetRef api_v1beta1.TargetRef) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	dumpOptions := opt.dumpOptions
+	dumpOptions.FileName = opt.databaseDumpFile(filepath.Join(opt.setupOptions.ScratchDir, MariaDBDumpDir), db)
+	dumpOptions.Path = dumpOptions.FileName
+	if opt.verifyChecksum {
+		if err := verifyDumpChecksum(resticWrapper, dumpOptions, db); err != nil {
+			return err
+		}
+	}
+	// the dump of a single database does not create it, so it is recreated beforehand
+	if opt.cleanBeforeRestore && !opt.dryRun {
+		if err := session.recreateDatabase(db, opt.systemSchemas); err != nil {
+			return err
+		}
+	}
+
+	decompress, err := decompressCommand()
+	if err != nil {
+		return err
+	}
+	dumpOptions.StdoutPipeCommands = []restic.Command{*decompress}
+	filterOptions.defaultDatabase = db
+	if filterOptions.progressInterval > 0 {
+		filterOptions.totalBytes = dumpSize(resticWrapper, dumpOptions, db)
+	}
+	filter, err := sqlFilterCommand(filterOptions)
+	if err != nil {
+		return err
+	}
+	if filter != nil {
+		dumpOptions.StdoutPipeCommands = append(dumpOptions.StdoutPipeCommands, *filter)
+	}
+
+	// the session restores other databases, the database is selected on a copy of its command
+	restoreCmd := &restic.Command{
+		Name: session.cmd.Name,
+		Args: append(append([]interface{}{}, session.cmd.Args...), "--database="+db),
+	}
+	if opt.continueOnError {
+		restoreCmd, err = captureErrorsCommand(*restoreCmd, errorsFile)
+		if err != nil {
+			return err
+		}
+		session.tempFiles = append(session.tempFiles, errorsFile)
+	}
+	dumpOptions.StdoutPipeCommands = append(dumpOptions.StdoutPipeCommands, *restoreCmd)
+	if opt.dryRun {
+		return opt.printRestorePlan(os.Stdout, session, dumpOptions, db)
+	}
+
+	if err := session.refreshCredentials(); err != nil {
+		return err
+	}
+	klog.Infof("Restoring database %s", db)
+	_, err = resticWrapper.Dump(dumpOptions, targetRef)
+	if err != nil && opt.continueOnError {
+		return restoreErrorSummary(errorsFile, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	if opt.verifyAfterRestore {
+		manifest, err := readTableCountTag(resticWrapper, dumpOptions, db)
+		if err != nil {
+			return err
+		}
+		return session.verifyTableCounts(manifest, []string{db})
+	}
+	return nil
+}
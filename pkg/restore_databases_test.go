@@ -0,0 +1,288 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	api_v1beta1 "stash.appscode.dev/apimachinery/apis/stash/v1beta1"
+	"stash.appscode.dev/apimachinery/pkg/restic"
+)
+
+// useFakeResticInWorkers makes the restic wrappers of the restore workers run the fake restic
+func useFakeResticInWorkers(t *testing.T) {
+	t.Helper()
+	newWrapper := newWorkerResticWrapper
+	newWorkerResticWrapper = func(setupOptions restic.SetupOptions, session *sessionWrapper) (*restic.ResticWrapper, error) {
+		session.sh.Alias(restic.ResticCMD, os.Args[0], "-test.run=^TestFakeRestic$", "--")
+		session.sh.SetEnv(fakeResticEnv, "1")
+		return newWrapper(setupOptions, session)
+	}
+	t.Cleanup(func() { newWorkerResticWrapper = newWrapper })
+}
+
+// fakeDatabasesClient returns a fake mariadb client appending the statements of its stdin to the file of
+// the database selected with --database in the returned directory. The restores of the database broken fail.
+// A client waits a little for another one to run, and records when it did.
+func fakeDatabasesClient(t *testing.T) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	return fakeCommand(t, `for arg; do
+	case "$arg" in
+	--database=*) db=${arg#--database=} ;;
+	esac
+done
+if [ "$db" = broken ]; then
+	echo "ERROR 1146 (42S02) at line 1: Table 'broken.orders' doesn't exist" >&2
+	exit 1
+fi
+touch `+dir+`/$db.running
+i=0
+while [ $i -lt 10 ]; do
+	if [ $(ls `+dir+` | grep -c '[.]running$') -ge 2 ]; then
+		touch `+dir+`/$db.concurrent
+		break
+	fi
+	sleep 0.1
+	i=$((i+1))
+done
+cat >> `+dir+`/$db.sql
+rm `+dir+`/$db.running`), dir
+}
+
+func TestRestoreDatabases(t *testing.T) {
+	tests := []struct {
+		name           string
+		databases      []string
+		parallelism    int
+		wantErr        string
+		wantRestored   []string
+		wantConcurrent bool
+	}{
+		{
+			name:         "one at a time",
+			databases:    []string{"shop", "blog", "crm"},
+			parallelism:  1,
+			wantRestored: []string{"blog", "crm", "shop"},
+		},
+		{
+			name:           "concurrently",
+			databases:      []string{"shop", "blog", "crm"},
+			parallelism:    2,
+			wantRestored:   []string{"blog", "crm", "shop"},
+			wantConcurrent: true,
+		},
+		{
+			name:           "more workers than databases",
+			databases:      []string{"shop", "blog"},
+			parallelism:    8,
+			wantRestored:   []string{"blog", "shop"},
+			wantConcurrent: true,
+		},
+		{
+			name:         "failure of a database",
+			databases:    []string{"shop", "broken", "blog"},
+			parallelism:  1,
+			wantErr:      "restore failed for 1 of 3 databases (broken): failed to restore database broken:",
+			wantRestored: []string{"blog", "shop"},
+		},
+		{
+			name:           "failures of concurrent databases",
+			databases:      []string{"broken", "shop", "blog"},
+			parallelism:    3,
+			wantErr:        "restore failed for 1 of 3 databases (broken): failed to restore database broken:",
+			wantRestored:   []string{"blog", "shop"},
+			wantConcurrent: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFakeResticInWorkers(t)
+			opt := newTestRestoreOptions()
+			opt.databases = tt.databases
+			opt.parallelism = tt.parallelism
+			opt.skipForeignKeyChecks = true
+			client, dir := fakeDatabasesClient(t)
+			opt.clientCmd = client
+			session, err := opt.prepareSession(newTestAppBinding(opt), opt.clientCmd, t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer session.cleanup()
+			resticWrapper, _ := newFakeRestic(t, opt, session)
+			dumpdir := filepath.Join(opt.setupOptions.ScratchDir, MariaDBDumpDir)
+			for _, db := range tt.databases {
+				storeFakeSnapshot(t, resticWrapper, opt.databaseDumpFile(dumpdir, db), []byte("INSERT INTO "+db+".orders VALUES (1);\n"), "--tag", DatabaseTagPrefix+db)
+			}
+			initArgs := opt.restoreInitCommandArgs(resticWrapper)
+			opt.setRestoreArgs(session, initArgs)
+
+			_, err = opt.restoreDatabases(context.Background(), newTestAppBinding(opt), session, resticWrapper, initArgs, api_v1beta1.TargetRef{})
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("restoreDatabases() error = %v, want %q", err, tt.wantErr)
+			}
+			restored, err := filepath.Glob(filepath.Join(dir, "*.sql"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, file := range restored {
+				db := strings.TrimSuffix(filepath.Base(file), ".sql")
+				data, err := os.ReadFile(file)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// each database is restored once, from its own snapshot
+				if want := "INSERT INTO " + db + ".orders VALUES (1);\n"; string(data) != want {
+					t.Errorf("database %s restored:\n%s\nwant:\n%s", db, data, want)
+				}
+				got = append(got, db)
+			}
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(tt.wantRestored, ",") {
+				t.Errorf("restored databases %v, want %v", got, tt.wantRestored)
+			}
+			concurrent, err := filepath.Glob(filepath.Join(dir, "*.concurrent"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (len(concurrent) > 0) != tt.wantConcurrent {
+				t.Errorf("databases restored concurrently %v, want %v", concurrent, tt.wantConcurrent)
+			}
+		})
+	}
+}
+
+func TestValidateDatabasesRestore(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(opt *mariadbOptions)
+		wantErr string
+	}{
+		{
+			name: "single database",
+			prepare: func(opt *mariadbOptions) {
+				opt.database = "shop"
+			},
+		},
+		{
+			name: "databases one at a time",
+			prepare: func(opt *mariadbOptions) {
+				opt.databases = []string{"shop", "blog"}
+			},
+		},
+		{
+			name: "databases concurrently without the foreign key checks",
+			prepare: func(opt *mariadbOptions) {
+				opt.databases = []string{"shop", "blog"}
+				opt.parallelism = 2
+				opt.skipForeignKeyChecks = true
+			},
+		},
+		{
+			name: "single database of several workers",
+			prepare: func(opt *mariadbOptions) {
+				opt.databases = []string{"shop"}
+				opt.parallelism = 4
+			},
+		},
+		{
+			name: "databases concurrently with the foreign key checks",
+			prepare: func(opt *mariadbOptions) {
+				opt.databases = []string{"shop", "blog"}
+				opt.parallelism = 2
+			},
+			wantErr: "restore them with --skip-foreign-key-checks or --parallelism=1",
+		},
+		{
+			name: "no worker",
+			prepare: func(opt *mariadbOptions) {
+				opt.parallelism = 0
+			},
+			wantErr: "parallelism must be at least 1, got 0",
+		},
+		{
+			name: "database and databases",
+			prepare: func(opt *mariadbOptions) {
+				opt.database = "shop"
+				opt.databases = []string{"blog"}
+			},
+			wantErr: "database and databases can not be used together",
+		},
+		{
+			name: "filtered database",
+			prepare: func(opt *mariadbOptions) {
+				opt.databases = []string{"shop"}
+				opt.sqlFilterOptions.database = "shop"
+			},
+			wantErr: "databases and filter-database can not be used together",
+		},
+		{
+			name: "snapshot",
+			prepare: func(opt *mariadbOptions) {
+				opt.databases = []string{"shop"}
+				opt.dumpOptions.Snapshot = "4ac1f2"
+			},
+			wantErr: "the latest snapshot of each database is restored with --databases",
+		},
+		{
+			name: "grants",
+			prepare: func(opt *mariadbOptions) {
+				opt.databases = []string{"shop"}
+				opt.restoreGrants = true
+			},
+			wantErr: "grants can not be restored from a per database backup",
+		},
+		{
+			name: "renamed database",
+			prepare: func(opt *mariadbOptions) {
+				opt.databases = []string{"shop"}
+				opt.sqlFilterOptions.databaseRename = map[string]string{"shop": "shop_v2"}
+			},
+			wantErr: "databases can not be renamed",
+		},
+		{
+			name: "empty name",
+			prepare: func(opt *mariadbOptions) {
+				opt.databases = []string{"shop", ""}
+			},
+			wantErr: "empty database name in databases",
+		},
+		{
+			name: "database listed twice",
+			prepare: func(opt *mariadbOptions) {
+				opt.databases = []string{"shop", "blog", "shop"}
+			},
+			wantErr: "database shop is listed twice in databases",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := newTestRestoreOptions()
+			tt.prepare(opt)
+			err := opt.validateDatabasesRestore()
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validateDatabasesRestore() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
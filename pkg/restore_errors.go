@@ -0,0 +1,159 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"stash.appscode.dev/apimachinery/pkg/restic"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	CaptureErrorsCMD      = "capture-errors"
+	RestoreErrorsFileName = "restore-errors.log"
+
+	// maxReportedStatementErrors is the number of failed statements detailed in the restore error
+	maxReportedStatementErrors = 10
+)
+
+// the client reports a failed statement as "ERROR 1064 (42000) at line 12: <message>"
+var statementErrorRegex = regexp.MustCompile(`^ERROR (\d+)(?: \(\w+\))? at line (\d+)(?: in file: '[^']*')?: (.*)$`)
+
+// statementError is a statement that failed while the client kept going with --force
+type statementError struct {
+	Code    int
+	Line    int
+	Message string
+}
+
+func (e statementError) String() string {
+	return fmt.Sprintf("line %d: ERROR %d: %s", e.Line, e.Code, e.Message)
+}
+
+// NewCmdCaptureErrors returns the hidden command running a command while copying its stderr into a file.
+// The restore command wraps the database client with it, so that the errors of all the statements are
+// kept and not only the last line restic reports.
+func NewCmdCaptureErrors() *cobra.Command {
+	var output string
+
+	cmd := &cobra.Command{
+		Use:               CaptureErrorsCMD + " --output <file> -- <command> [args...]",
+		Short:             "Runs a command and copies its stderr into a file",
+		Hidden:            true,
+		DisableAutoGenTag: true,
+		Args:              cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			out, err := os.OpenFile(output, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+			if err != nil {
+				return err
+			}
+			defer out.Close()
+
+			c := exec.Command(args[0], args[1:]...)
+			c.Stdin = os.Stdin
+			c.Stdout = os.Stdout
+			c.Stderr = io.MultiWriter(os.Stderr, out)
+			if err = c.Start(); err != nil {
+				return err
+			}
+			// pass the termination of the operation on to the command
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+			go func() {
+				for sig := range signals {
+					_ = c.Process.Signal(sig)
+				}
+			}()
+			err = c.Wait()
+			signal.Stop(signals)
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				_ = out.Close()
+				os.Exit(exitErr.ExitCode())
+			}
+			return err
+		},
+	}
+
+	cmd.Flags().StringVar(&output, "output", output, "File where the stderr of the command is copied")
+
+	return cmd
+}
+
+// captureErrorsCommand wraps command so that its stderr is copied into errorsFile
+func captureErrorsCommand(command restic.Command, errorsFile string) (*restic.Command, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate the plugin binary to capture the restore errors: %w", err)
+	}
+	args := []interface{}{CaptureErrorsCMD, "--output", errorsFile, "--", command.Name}
+	return &restic.Command{Name: self, Args: append(args, command.Args...)}, nil
+}
+
+// parseStatementErrors returns the failed statements reported by the client in r
+func parseStatementErrors(r io.Reader) ([]statementError, error) {
+	var stmtErrors []statementError
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		m := statementErrorRegex.FindStringSubmatch(strings.TrimSpace(scanner.Text()))
+		if m == nil {
+			continue
+		}
+		code, _ := strconv.Atoi(m[1])
+		line, _ := strconv.Atoi(m[2])
+		stmtErrors = append(stmtErrors, statementError{Code: code, Line: line, Message: m[3]})
+	}
+	return stmtErrors, scanner.Err()
+}
+
+// restoreErrorSummary builds the error reporting the statements that failed during a restore
+// run with continue-on-error. Line numbers refer to the dump as it was fed to the client.
+// It returns restoreErr unchanged if the failure was not caused by the statements.
+func restoreErrorSummary(errorsFile string, restoreErr error) error {
+	f, err := os.Open(errorsFile)
+	if err != nil {
+		return restoreErr
+	}
+	defer f.Close()
+
+	stmtErrors, err := parseStatementErrors(f)
+	if err != nil || len(stmtErrors) == 0 {
+		return restoreErr
+	}
+
+	details := make([]string, 0, maxReportedStatementErrors)
+	for i, stmtErr := range stmtErrors {
+		if i == maxReportedStatementErrors {
+			details = append(details, fmt.Sprintf("and %d more", len(stmtErrors)-i))
+			break
+		}
+		details = append(details, stmtErr.String())
+	}
+	return fmt.Errorf("restore completed with %d failed statements: %s", len(stmtErrors), strings.Join(details, "; "))
+}
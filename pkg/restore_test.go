@@ -0,0 +1,309 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	api_v1beta1 "stash.appscode.dev/apimachinery/apis/stash/v1beta1"
+	"stash.appscode.dev/apimachinery/pkg/restic"
+)
+
+// newTestRestoreOptions returns the options of a restore with the defaults of the restore command
+func newTestRestoreOptions() *mariadbOptions {
+	return &mariadbOptions{
+		waitTimeout:            300,
+		systemSchemas:          DefaultSystemSchemas,
+		compression:            CompressionNone,
+		readinessPollInterval:  DefaultReadinessPollInterval,
+		readinessBackoffFactor: 1,
+		clientCmd:              MariaDBRestoreCMD,
+		checkSQLMode:           true,
+		defaultCharset:         DefaultCharset,
+		maxAllowedPacket:       DefaultMaxAllowedPacket,
+		terminationGracePeriod: DefaultTerminationGracePeriod,
+		parallelism:            1,
+		tlsOptions: tlsOptions{
+			verifyServerCert: true,
+		},
+		credentialOptions: credentialOptions{
+			userKey:     MariaDBUser,
+			passwordKey: MariaDBPassword,
+			authMode:    AuthModePassword,
+		},
+		dumpOptions: restic.DumpOptions{
+			Host:     restic.DefaultHost,
+			FileName: MariaDBDumpFile,
+		},
+	}
+}
+
+// fakeClientCommand returns a fake mariadb client applying the statements of its stdin, one per line, by
+// appending them to the returned file. Like the client, it reports a broken statement on stderr and stops
+// there unless run with --force, then fails once all the statements are read.
+func fakeClientCommand(t *testing.T) (string, string) {
+	t.Helper()
+	applied := filepath.Join(t.TempDir(), "applied.sql")
+	return fakeCommand(t, `line=0
+failed=0
+while IFS= read -r stmt; do
+	line=$((line+1))
+	case "$stmt" in
+	*BROKEN*)
+		echo "ERROR 1064 (42000) at line $line: You have an error in your SQL syntax near 'BROKEN'" >&2
+		failed=1
+		case " $* " in
+		*" --force "*) continue ;;
+		*) exit 1 ;;
+		esac
+		;;
+	esac
+	printf '%s\n' "$stmt" >> `+applied+`
+done
+exit $failed`), applied
+}
+
+func TestContinueOnErrorRestore(t *testing.T) {
+	const dump = "CREATE TABLE orders (id int);\nINSERT INTO orders VALUES (1);\nBROKEN STATEMENT;\nINSERT INTO orders VALUES (2);\n"
+	tests := []struct {
+		name            string
+		continueOnError bool
+		wantErr         string
+		wantApplied     string
+	}{
+		{
+			name:        "fail fast",
+			wantErr:     "ERROR 1064 (42000) at line 3",
+			wantApplied: "CREATE TABLE orders (id int);\nINSERT INTO orders VALUES (1);\n",
+		},
+		{
+			name:            "continue on error",
+			continueOnError: true,
+			wantErr:         "restore completed with 1 failed statements: line 3: ERROR 1064: You have an error in your SQL syntax near 'BROKEN'",
+			wantApplied:     "CREATE TABLE orders (id int);\nINSERT INTO orders VALUES (1);\nINSERT INTO orders VALUES (2);\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := newTestRestoreOptions()
+			opt.continueOnError = tt.continueOnError
+			client, applied := fakeClientCommand(t)
+			session := newFakeSession(t, opt, client)
+			resticWrapper, _ := newFakeRestic(t, opt, session)
+			storeFakeSnapshot(t, resticWrapper, opt.databaseDumpFile(filepath.Join(opt.setupOptions.ScratchDir, MariaDBDumpDir), "shop"), []byte(dump))
+			opt.setRestoreArgs(session, nil)
+
+			errorsFile := filepath.Join(opt.setupOptions.ScratchDir, RestoreErrorsFileName)
+			err := opt.restoreDatabaseSnapshot(context.Background(), session, resticWrapper, "shop", opt.sqlFilterOptions, errorsFile, api_v1beta1.TargetRef{})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("restoreDatabaseSnapshot() error = %v, want %q", err, tt.wantErr)
+			}
+			data, err := os.ReadFile(applied)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.wantApplied {
+				t.Errorf("the restore applied:\n%s\nwant:\n%s", data, tt.wantApplied)
+			}
+		})
+	}
+}
+
+func TestCheckRenameTargets(t *testing.T) {
+	tests := []struct {
+		name               string
+		rename             map[string]string
+		filterDatabase     string
+		cleanBeforeRestore bool
+		wantErr            string
+		wantQuery          bool
+	}{
+		{
+			name:      "new databases",
+			rename:    map[string]string{"shop": "shop_v2", "crm": "crm_v2"},
+			wantQuery: true,
+		},
+		{
+			name:      "existing databases",
+			rename:    map[string]string{"shop": "shop_copy", "crm": "crm", "hr": "hr_v2"},
+			wantErr:   "databases crm, shop_copy already exist on the target, restore with --clean-before-restore to replace them",
+			wantQuery: true,
+		},
+		{
+			// the system schemas are listed too, a rename must not restore into them
+			name:      "system schema",
+			rename:    map[string]string{"shop": "mysql"},
+			wantErr:   "databases mysql already exist on the target",
+			wantQuery: true,
+		},
+		{
+			name:           "rename of another database than the filtered one",
+			rename:         map[string]string{"shop": "shop_copy", "crm": "crm_v2"},
+			filterDatabase: "crm",
+			wantQuery:      true,
+		},
+		{
+			name:               "existing databases replaced",
+			rename:             map[string]string{"shop": "shop_copy"},
+			cleanBeforeRestore: true,
+		},
+		{
+			name: "no rename",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := newTestRestoreOptions()
+			opt.sqlFilterOptions.databaseRename = tt.rename
+			opt.sqlFilterOptions.database = tt.filterDatabase
+			opt.cleanBeforeRestore = tt.cleanBeforeRestore
+			queried := filepath.Join(t.TempDir(), "queried")
+			session := newFakeSession(t, opt, fakeCommand(t, `touch `+queried+`
+printf 'information_schema\nmysql\nshop\nshop_copy\ncrm\n'`))
+
+			err := opt.checkRenameTargets(session)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("checkRenameTargets() error = %v, want %q", err, tt.wantErr)
+			}
+			if _, err := os.Stat(queried); (err == nil) != tt.wantQuery {
+				t.Errorf("the databases of the target were listed: %v, want %v", err == nil, tt.wantQuery)
+			}
+		})
+	}
+}
+
+func TestRestoreCompressedDumpOfAnotherTool(t *testing.T) {
+	const dump = "CREATE TABLE orders (id int);\nINSERT INTO orders VALUES (1);\n"
+	for _, algo := range []string{CompressionNone, CompressionGzip, CompressionZstd} {
+		t.Run(algo, func(t *testing.T) {
+			data := []byte(dump)
+			if algo != CompressionNone {
+				data = compressWithTool(t, data, algo)
+			}
+			opt := newTestRestoreOptions()
+			client, applied := fakeClientCommand(t)
+			session := newFakeSession(t, opt, client)
+			resticWrapper, _ := newFakeRestic(t, opt, session)
+			// the name of the dump does not tell its compression
+			storeFakeSnapshot(t, resticWrapper, opt.databaseDumpFile(filepath.Join(opt.setupOptions.ScratchDir, MariaDBDumpDir), "shop"), data)
+			opt.setRestoreArgs(session, nil)
+
+			errorsFile := filepath.Join(opt.setupOptions.ScratchDir, RestoreErrorsFileName)
+			if err := opt.restoreDatabaseSnapshot(context.Background(), session, resticWrapper, "shop", opt.sqlFilterOptions, errorsFile, api_v1beta1.TargetRef{}); err != nil {
+				t.Fatal(err)
+			}
+			restored, err := os.ReadFile(applied)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(restored) != dump {
+				t.Errorf("the restore applied:\n%s\nwant:\n%s", restored, dump)
+			}
+		})
+	}
+}
+
+func TestRestoreTruncatedGzipDump(t *testing.T) {
+	opt := newTestRestoreOptions()
+	client, _ := fakeClientCommand(t)
+	session := newFakeSession(t, opt, client)
+	resticWrapper, _ := newFakeRestic(t, opt, session)
+	compressed := compressWithTool(t, sampleDump(1000), CompressionGzip)
+	storeFakeSnapshot(t, resticWrapper, opt.databaseDumpFile(filepath.Join(opt.setupOptions.ScratchDir, MariaDBDumpDir), "shop"), compressed[:len(compressed)/2])
+	opt.setRestoreArgs(session, nil)
+
+	errorsFile := filepath.Join(opt.setupOptions.ScratchDir, RestoreErrorsFileName)
+	err := opt.restoreDatabaseSnapshot(context.Background(), session, resticWrapper, "shop", opt.sqlFilterOptions, errorsFile, api_v1beta1.TargetRef{})
+	if err == nil || !strings.Contains(err.Error(), "failed to decompress the gzip dump: unexpected EOF") {
+		t.Errorf("restoreDatabaseSnapshot() error = %v, want the truncated dump to be rejected", err)
+	}
+}
+
+func TestFastLoadInitCommand(t *testing.T) {
+	tests := []struct {
+		name                 string
+		fastLoad             bool
+		skipForeignKeyChecks bool
+		want                 []interface{}
+	}{
+		{name: "fast load", fastLoad: true, want: []interface{}{"--init-command=SET SESSION unique_checks=0, foreign_key_checks=0"}},
+		{name: "fast load skipping the foreign key checks", fastLoad: true, skipForeignKeyChecks: true, want: []interface{}{"--init-command=SET SESSION unique_checks=0, foreign_key_checks=0"}},
+		{name: "foreign key checks skipped", skipForeignKeyChecks: true, want: []interface{}{"--init-command=SET SESSION foreign_key_checks=0"}},
+		{name: "checked load"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := newTestRestoreOptions()
+			opt.restoreSQLMode = SQLModeServer
+			opt.fastLoad = tt.fastLoad
+			opt.skipForeignKeyChecks = tt.skipForeignKeyChecks
+			session := newFakeSession(t, opt, fakeCommand(t, "true"))
+			resticWrapper, _ := newFakeRestic(t, opt, session)
+			if got := opt.restoreInitCommandArgs(resticWrapper); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("restoreInitCommandArgs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnableKeysAfterFailure(t *testing.T) {
+	tests := []struct {
+		name      string
+		databases []string
+		wantQuery string
+	}{
+		{name: "databases restored", databases: []string{"shop", "crm"}, wantQuery: "AND TABLE_SCHEMA IN ('shop', 'crm');"},
+		{name: "whole dump", wantQuery: "AND TABLE_SCHEMA NOT IN ('information_schema', 'mysql', 'performance_schema', 'sys');"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := newTestRestoreOptions()
+			journal := filepath.Join(t.TempDir(), "journal")
+			// the keys of orders and of my<tab>items were left disabled, enabling those of orders fails
+			session := newFakeSession(t, opt, fakeCommand(t, `eval query=\${$#}
+printf '%s\n' "$query" >> "`+journal+`"
+case "$query" in
+*"information_schema.STATISTICS"*) printf 'shop\torders\nshop\tmy\\titems\n' ;;
+*orders*"ENABLE KEYS;") echo "ERROR 1030 (HY000): Got error 28 from storage engine" >&2; exit 1 ;;
+esac`))
+
+			logs := captureLogs(t, func() {
+				opt.enableKeysAfterFailure(session, tt.databases)
+			})
+			data, err := os.ReadFile(journal)
+			if err != nil {
+				t.Fatal(err)
+			}
+			queries := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+			if len(queries) != 3 || !strings.Contains(queries[0], "WHERE COMMENT = 'disabled' "+tt.wantQuery) {
+				t.Fatalf("the keys were enabled with the queries %q, want the tables with disabled keys listed %s", queries, tt.wantQuery)
+			}
+			want := []string{"ALTER TABLE `shop`.`orders` ENABLE KEYS;", "ALTER TABLE `shop`.`my\titems` ENABLE KEYS;"}
+			if !reflect.DeepEqual(queries[1:], want) {
+				t.Errorf("the keys were enabled with %q, want %q", queries[1:], want)
+			}
+			if !strings.Contains(logs, "Failed to enable the keys of `shop`.`orders`") {
+				t.Errorf("enableKeysAfterFailure() logged:\n%s\nwant the failure of orders", logs)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/armon/circbuf"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+const (
+	DefaultBackupRetryBackoff = 5 * time.Second
+	MaxBackupRetryBackoff     = 2 * time.Minute
+
+	DefaultUploadRetries      = 3
+	DefaultUploadRetryBackoff = 10 * time.Second
+
+	DefaultConnectionErrorRetries = 5
+	// the server refusing connections is loaded, so the wait before retrying is this many times longer than for other errors
+	ConnectionErrorBackoffFactor = 4
+	MaxConnectionErrorBackoff    = 5 * time.Minute
+
+	// ER_CON_COUNT_ERROR, the server reached max_connections
+	errConCountError = 1040
+
+	// stderrBufferSize is the number of bytes of the stderr of a command kept to build its error
+	stderrBufferSize = 4096
+	// stderrErrorLines is the number of the last lines of stderr included in the error of a command
+	stderrErrorLines = 5
+)
+
+// errors caused by the network, they usually succeed when retried
+var retryableErrorPatterns = []string{
+	"connection refused",
+	"connection reset",
+	"broken pipe",
+	"lost connection",
+	"can't connect",
+	"server has gone away",
+	"i/o timeout",
+}
+
+// the clients report the errors of the server as "ERROR 1040 (HY000): Too many connections",
+// mariadb-dump as "Got error: 1040: Too many connections when trying to connect"
+var serverErrorCodeRegex = regexp.MustCompile(`(?:ERROR|[Ee]rror:) (\d{4})\b`)
+
+// the object store or the network failing an upload transiently, i.e. "503 Service Unavailable" or "SlowDown"
+var retryableUploadErrorPatterns = []string{
+	"connection refused",
+	"connection reset",
+	"broken pipe",
+	"timeout",
+	"unexpected eof",
+	"slowdown",
+}
+
+// the status line of a server error, i.e. "503 Service Unavailable", as reported by restic and the object storage sink
+var serverErrorStatusRegex = regexp.MustCompile(`\b5\d{2} [A-Z]`)
+
+// errors that will fail the same way however many times they are retried
+var fatalErrorPatterns = []string{
+	"access denied",
+	"no space left on device",
+	"unknown database",
+}
+
+// commandError is returned when a database command fails. It keeps the last lines the command wrote on stderr.
+type commandError struct {
+	err    error
+	stderr string
+}
+
+func newCommandError(err error, stderr string) error {
+	var lines []string
+	for _, line := range strings.Split(stderr, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) > stderrErrorLines {
+		lines = lines[len(lines)-stderrErrorLines:]
+	}
+	return &commandError{err: err, stderr: strings.Join(lines, "; ")}
+}
+
+// capturedStderr returns the content of buf, without its first line if it was cut by the buffer limit
+func capturedStderr(buf *circbuf.Buffer) string {
+	stderr := buf.String()
+	if buf.TotalWritten() > buf.Size() {
+		if i := strings.Index(stderr, "\n"); i >= 0 {
+			stderr = stderr[i+1:]
+		}
+	}
+	return stderr
+}
+
+func (e *commandError) Error() string {
+	if e.stderr == "" {
+		return e.err.Error()
+	}
+	return fmt.Sprintf("%v: %s", e.err, e.stderr)
+}
+
+func (e *commandError) Unwrap() error {
+	return e.err
+}
+
+// isRetryableError reports whether err is a transient error worth retrying
+func isRetryableError(err error) bool {
+	var cmdErr *commandError
+	if !errors.As(err, &cmdErr) {
+		return false
+	}
+	msg := strings.ToLower(cmdErr.stderr)
+	for _, pattern := range fatalErrorPatterns {
+		if strings.Contains(msg, pattern) {
+			return false
+		}
+	}
+	for _, pattern := range retryableErrorPatterns {
+		if strings.Contains(msg, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// serverErrorCodes returns the codes of the server errors reported in the stderr of a client
+func serverErrorCodes(stderr string) []int {
+	var codes []int
+	for _, m := range serverErrorCodeRegex.FindAllStringSubmatch(stderr, -1) {
+		code, _ := strconv.Atoi(m[1])
+		codes = append(codes, code)
+	}
+	return codes
+}
+
+// isTooManyConnectionsError reports whether a client failed because the server reached max_connections
+func isTooManyConnectionsError(err error) bool {
+	var cmdErr *commandError
+	if !errors.As(err, &cmdErr) {
+		return false
+	}
+	for _, code := range serverErrorCodes(cmdErr.stderr) {
+		if code == errConCountError {
+			return true
+		}
+	}
+	return false
+}
+
+// isRetryableUploadError reports whether a failed upload of the dumps is worth retrying. The object
+// store fails uploads transiently (5xx, timeouts) and restic deduplicates what was already uploaded,
+// the other errors, such as a wrong password of the repository, fail the backup at once.
+func isRetryableUploadError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if serverErrorStatusRegex.MatchString(err.Error()) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	for _, pattern := range retryableUploadErrorPatterns {
+		if strings.Contains(msg, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryPolicy retries the errors isRetryable accepts up to retries times. The wait between two attempts
+// starts at backoff, doubles after each attempt, is jittered and never exceeds maxBackoff.
+type retryPolicy struct {
+	retries     int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	isRetryable func(error) bool
+}
+
+// retryWithBackoff calls fn until it succeeds, fails with an error that isRetryable rejects or retries are exhausted
+func retryWithBackoff(ctx context.Context, retries int, backoff, maxBackoff time.Duration, isRetryable func(error) bool, fn func() error) error {
+	return retryWithPolicies(ctx, fn, retryPolicy{retries: retries, backoff: backoff, maxBackoff: maxBackoff, isRetryable: isRetryable})
+}
+
+// retryWithPolicies calls fn until it succeeds or fails with an error that no policy retries. An error
+// is retried by the first policy accepting it, each policy counting its own retries and backoff.
+func retryWithPolicies(ctx context.Context, fn func() error, policies ...retryPolicy) error {
+	attempts := make([]int, len(policies))
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		i := 0
+		for i < len(policies) && !policies[i].isRetryable(err) {
+			i++
+		}
+		if i == len(policies) {
+			return err
+		}
+		if attempts[i] >= policies[i].retries {
+			if attempts[i] > 0 {
+				return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+			}
+			return err
+		}
+		policy := &policies[i]
+		attempts[i]++
+
+		sleep := wait.Jitter(policy.backoff, 0.2)
+		if sleep > policy.maxBackoff {
+			sleep = policy.maxBackoff
+		}
+		klog.Warningf("Attempt %d failed. Reason: %v. Retrying after %v....", attempt, err, sleep)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(sleep):
+		}
+
+		policy.backoff *= 2
+		if policy.backoff > policy.maxBackoff {
+			policy.backoff = policy.maxBackoff
+		}
+	}
+}
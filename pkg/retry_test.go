@@ -0,0 +1,196 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const tooManyConnections = "mariadb-dump: Got error: 1040: Too many connections when trying to connect"
+
+func TestServerErrorCodes(t *testing.T) {
+	tests := []struct {
+		stderr string
+		want   []int
+	}{
+		{stderr: "ERROR 1040 (HY000): Too many connections", want: []int{1040}},
+		{stderr: tooManyConnections, want: []int{1040}},
+		{stderr: "mariadb-dump: Couldn't execute 'SHOW TABLES': Error: 2013: Lost connection\nmariadb-dump: Got error: 1045: Access denied", want: []int{2013, 1045}},
+		// the codes are only read from the errors of the server
+		{stderr: "mariadb-dump: table orders has 1040 rows"},
+		{stderr: ""},
+	}
+	for _, tt := range tests {
+		if got := serverErrorCodes(tt.stderr); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("serverErrorCodes(%q) = %v, want %v", tt.stderr, got, tt.want)
+		}
+	}
+}
+
+func TestIsTooManyConnectionsError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "client", err: newCommandError(errors.New("exit status 1"), "ERROR 1040 (HY000): Too many connections"), want: true},
+		{name: "dump", err: newCommandError(errors.New("exit status 2"), tooManyConnections), want: true},
+		{name: "wrapped", err: fmt.Errorf("failed to dump database shop: %w", newCommandError(errors.New("exit status 2"), tooManyConnections)), want: true},
+		{name: "other server error", err: newCommandError(errors.New("exit status 2"), "mariadb-dump: Got error: 1045: Access denied for user 'backup'@'%'")},
+		{name: "lost connection", err: newCommandError(errors.New("exit status 2"), "mariadb-dump: Got error: 2013: Lost connection to server during query")},
+		{name: "not a command error", err: errors.New("Got error: 1040: Too many connections")},
+	}
+	for _, tt := range tests {
+		if got := isTooManyConnectionsError(tt.err); got != tt.want {
+			t.Errorf("isTooManyConnectionsError(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIsRetryableUploadError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "unavailable", err: errors.New("unable to save snapshot: server response unexpected: 503 Service Unavailable"), want: true},
+		{name: "internal error", err: errors.New("PUT shop/dump.sql: 500 Internal Server Error: InternalError"), want: true},
+		{name: "slow down", err: errors.New("Save(<data/1f2e>) returned error: SlowDown: Please reduce your request rate"), want: true},
+		{name: "timeout", err: errors.New("Put \"https://s3.amazonaws.com/backups\": net/http: TLS handshake timeout"), want: true},
+		{name: "connection reset", err: errors.New("read tcp 10.0.0.4:43210->52.216.0.1:443: read: connection reset by peer"), want: true},
+		{name: "wrong password", err: errors.New("Fatal: wrong password or no key found")},
+		{name: "forbidden", err: errors.New("PUT shop/dump.sql: 403 Forbidden: AccessDenied")},
+		{name: "missing repository", err: errors.New("Fatal: unable to open config file: Stat: The specified bucket does not exist.")},
+		{name: "canceled", err: fmt.Errorf("upload: %w", context.Canceled)},
+		{name: "deadline", err: fmt.Errorf("503 Service Unavailable: %w", context.DeadlineExceeded)},
+	}
+	for _, tt := range tests {
+		if got := isRetryableUploadError(tt.err); got != tt.want {
+			t.Errorf("isRetryableUploadError(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRetryWithPolicies(t *testing.T) {
+	errA, errB := errors.New("a"), errors.New("b")
+	policy := func(target error, retries int) retryPolicy {
+		return retryPolicy{
+			retries:     retries,
+			backoff:     time.Millisecond,
+			maxBackoff:  time.Millisecond,
+			isRetryable: func(err error) bool { return errors.Is(err, target) },
+		}
+	}
+	// each policy counts its own retries
+	failures := []error{errA, errB, errA, errB, errA}
+	calls := 0
+	err := retryWithPolicies(context.Background(), func() error {
+		calls++
+		if calls <= len(failures) {
+			return failures[calls-1]
+		}
+		return nil
+	}, policy(errA, 3), policy(errB, 2))
+	if err != nil || calls != 6 {
+		t.Errorf("retryWithPolicies() = %v after %d calls, want success after 6", err, calls)
+	}
+
+	calls = 0
+	err = retryWithPolicies(context.Background(), func() error {
+		calls++
+		return errB
+	}, policy(errA, 3), policy(errB, 2))
+	if !errors.Is(err, errB) || calls != 3 {
+		t.Errorf("retryWithPolicies() = %v after %d calls, want %v after 3", err, calls, errB)
+	}
+
+	calls = 0
+	err = retryWithPolicies(context.Background(), func() error {
+		calls++
+		return errors.New("fatal")
+	}, policy(errA, 3))
+	if err == nil || calls != 1 {
+		t.Errorf("retryWithPolicies() = %v after %d calls, want the error not retried", err, calls)
+	}
+}
+
+func TestDumpRetriesTooManyConnections(t *testing.T) {
+	tests := []struct {
+		name      string
+		failures  int
+		retries   int
+		wantRuns  int
+		wantErr   string
+		minWaited time.Duration
+	}{
+		// the backoff of the server under load is 4 times the backup retry backoff, doubled after each retry
+		{name: "server under load", failures: 2, retries: 3, wantRuns: 3, minWaited: 120 * time.Millisecond},
+		{name: "retries run out", failures: 5, retries: 2, wantRuns: 3, wantErr: "Too many connections"},
+		{name: "not retried", failures: 1, wantRuns: 1, wantErr: "Too many connections"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			command, runs := flakyDumpCommand(t, tt.failures, tooManyConnections)
+			opt := newTestBackupOptions()
+			// the other transient errors are not retried
+			opt.maxBackupRetries = 0
+			opt.maxConnectionErrorRetries = tt.retries
+			opt.backupRetryBackoff = 10 * time.Millisecond
+			session := newFakeSession(t, opt, command)
+
+			start := time.Now()
+			_, err := opt.dumpDatabaseWithRetry(context.Background(), session, "shop", filepath.Join(t.TempDir(), "shop.sql"))
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("dumpDatabaseWithRetry() error = %v, want %q", err, tt.wantErr)
+			}
+			if got := countRuns(t, runs); got != tt.wantRuns {
+				t.Errorf("mariadb-dump ran %d times, want %d", got, tt.wantRuns)
+			}
+			if elapsed := time.Since(start); elapsed < tt.minWaited {
+				t.Errorf("the retries waited %v, want at least %v", elapsed, tt.minWaited)
+			}
+		})
+	}
+}
+
+func TestWaitForDBReadyBacksOffWhenTooManyConnections(t *testing.T) {
+	runs := filepath.Join(t.TempDir(), "runs")
+	session := newFakeSession(t, &mariadbOptions{}, fakeCommand(t, `echo run >> `+runs+`
+if [ "$(wc -l < `+runs+`)" -le 1 ]; then
+	echo "ERROR 1040 (HY000): Too many connections" >&2
+	exit 1
+fi`))
+
+	// the probe refused by the loaded server waits 4 times the interval
+	start := time.Now()
+	if err := session.waitForDBReady(context.Background(), 10, readinessBackoff{interval: 100 * time.Millisecond, factor: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("waitForDBReady() probed again after %v, want at least 400ms", elapsed)
+	}
+	if n := countRuns(t, runs); n != 2 {
+		t.Errorf("the database was probed %d times, want 2", n)
+	}
+}
@@ -43,6 +43,13 @@ func NewRootCmd() *cobra.Command {
 	rootCmd.AddCommand(v.NewCmdVersion())
 	rootCmd.AddCommand(NewCmdBackup())
 	rootCmd.AddCommand(NewCmdRestore())
+	rootCmd.AddCommand(NewCmdTestConnection())
+	rootCmd.AddCommand(NewCmdFilterSQL())
+	rootCmd.AddCommand(NewCmdCaptureErrors())
+	rootCmd.AddCommand(NewCmdDecompress())
+	rootCmd.AddCommand(NewCmdVerifyDump())
+	rootCmd.AddCommand(NewCmdChecksumDump())
+	rootCmd.AddCommand(NewCmdThrottle())
 
 	return rootCmd
 }
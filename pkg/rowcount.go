@@ -0,0 +1,174 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// RowCounts holds the number of rows of each backed up database
+type RowCounts map[string]int64
+
+// total returns the number of rows of all the databases
+func (counts RowCounts) total() int64 {
+	var total int64
+	for _, count := range counts {
+		total += count
+	}
+	return total
+}
+
+// tableRows is the approximate number of rows of a table, as estimated by its storage engine
+type tableRows struct {
+	db    string
+	table string
+	rows  int64
+}
+
+// listTableRows returns the base tables of the databases with their approximate number of rows.
+// InnoDB estimates TABLE_ROWS from a sample of the pages, it may be off by 40% or more.
+func (session *sessionWrapper) listTableRows(databases []string) ([]tableRows, error) {
+	if len(databases) == 0 {
+		return nil, nil
+	}
+	schemas := make([]string, 0, len(databases))
+	for _, db := range databases {
+		schemas = append(schemas, quoteString(db))
+	}
+	output, err := session.executeQuery(fmt.Sprintf("SELECT TABLE_SCHEMA, TABLE_NAME, IFNULL(TABLE_ROWS, 0) FROM information_schema.TABLES WHERE TABLE_SCHEMA IN (%s) AND TABLE_TYPE = 'BASE TABLE';", strings.Join(schemas, ",")))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the rows of the tables: %w", err)
+	}
+	return parseTableRows(string(output))
+}
+
+// parseTableRows reads the rows "<database>\t<table>\t<rows>" of the table rows query
+func parseTableRows(output string) ([]tableRows, error) {
+	var tables []tableRows
+	for _, line := range strings.Split(output, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid table rows %q", line)
+		}
+		rows, err := strconv.ParseInt(strings.TrimSpace(fields[2]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid table rows %q", line)
+		}
+		tables = append(tables, tableRows{db: unescapeBatchValue(fields[0]), table: unescapeBatchValue(fields[1]), rows: rows})
+	}
+	return tables, nil
+}
+
+// countRows counts exactly the rows of the tables of db with a single query
+func (session *sessionWrapper) countRows(db string, tables []string) (int64, error) {
+	if len(tables) == 0 {
+		return 0, nil
+	}
+	counts := make([]string, 0, len(tables))
+	for _, table := range tables {
+		counts = append(counts, fmt.Sprintf("SELECT COUNT(*) AS c FROM %s.%s", quoteIdentifier(db), quoteIdentifier(table)))
+	}
+	output, err := session.executeQuery(fmt.Sprintf("SELECT SUM(c) FROM (%s) AS counts;", strings.Join(counts, " UNION ALL ")))
+	if err != nil {
+		return 0, fmt.Errorf("failed to count the rows of database %s: %w", db, err)
+	}
+	rows, err := strconv.ParseInt(strings.TrimSpace(string(output)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid row count %q of database %s", strings.TrimSpace(string(output)), db)
+	}
+	return rows, nil
+}
+
+// dumpedTables keeps the tables the dump writes rows of: the selected tables if any, without the ignored ones
+func (opt *mariadbOptions) dumpedTables(tables []tableRows) []tableRows {
+	ignored, _ := parseTableSelection(opt.ignoreTables)
+	var dumped []tableRows
+	for _, t := range tables {
+		if selected, ok := opt.tables[t.db]; ok && !containsString(selected, t.table) {
+			continue
+		}
+		if containsString(ignored[t.db], t.table) {
+			continue
+		}
+		dumped = append(dumped, t)
+	}
+	return dumped
+}
+
+// rowCounts returns the number of rows of the databases, estimated from TABLE_ROWS unless they are counted precisely
+func (opt *mariadbOptions) rowCounts(session *sessionWrapper, databases []string) (RowCounts, error) {
+	tables, err := session.listTableRows(databases)
+	if err != nil {
+		return nil, err
+	}
+	tables = opt.dumpedTables(tables)
+
+	counts := make(RowCounts, len(databases))
+	for _, db := range databases {
+		counts[db] = 0
+	}
+	if !opt.preciseRowCounts {
+		for _, t := range tables {
+			counts[t.db] += t.rows
+		}
+		return counts, nil
+	}
+
+	byDatabase := map[string][]string{}
+	for _, t := range tables {
+		byDatabase[t.db] = append(byDatabase[t.db], t.table)
+	}
+	for db, names := range byDatabase {
+		if counts[db], err = session.countRows(db, names); err != nil {
+			return nil, err
+		}
+	}
+	return counts, nil
+}
+
+// recordRowCounts logs the number of rows of the backed up databases and keeps them for the summary and the metrics.
+// The counts are informational, failing to get them does not fail the backup.
+func (opt *mariadbOptions) recordRowCounts(session *sessionWrapper, databases []string) {
+	counts, err := opt.rowCounts(session, databases)
+	if err != nil {
+		klog.Warningf("Unable to count the rows of the databases. Reason: %v", err)
+		return
+	}
+	kind := "approximately"
+	if opt.preciseRowCounts {
+		kind = "exactly"
+	}
+	names := make([]string, 0, len(counts))
+	for db := range counts {
+		names = append(names, db)
+	}
+	sort.Strings(names)
+	for _, db := range names {
+		klog.Infof("Database %s has %s %d rows", db, kind, counts[db])
+	}
+	klog.Infof("The databases have %s %d rows in total", kind, counts.total())
+	opt.rowCountsByDatabase = counts
+	opt.metrics.observeRows(counts.total())
+}
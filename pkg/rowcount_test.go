@@ -0,0 +1,156 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeRowsClient returns a fake mariadb client answering the table rows query with the estimates of the
+// tables, and the COUNT(*) queries with the exact counts of the databases. The queries are appended to the
+// returned file.
+func fakeRowsClient(t *testing.T) (string, string) {
+	t.Helper()
+	return fakeQueryClient(t, map[string]string{
+		"*information_schema.TABLES*": "shop\torders\t1000\nshop\tcustomers\t50\ncrm\tcontacts\t7\ncrm\tlogs\t0\n",
+		"* FROM `shop`.*":             "1052\n",
+		"* FROM `crm`.*":              "9\n",
+	})
+}
+
+func TestRowCounts(t *testing.T) {
+	tests := []struct {
+		name             string
+		precise          bool
+		ignoreTables     []string
+		want             RowCounts
+		wantCountQueries int
+	}{
+		{
+			name: "approximate",
+			want: RowCounts{"shop": 1050, "crm": 7, "empty": 0},
+		},
+		{
+			name:             "precise",
+			precise:          true,
+			want:             RowCounts{"shop": 1052, "crm": 9, "empty": 0},
+			wantCountQueries: 2,
+		},
+		{
+			name:         "approximate without the ignored tables",
+			ignoreTables: []string{"shop.customers"},
+			want:         RowCounts{"shop": 1000, "crm": 7, "empty": 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := newTestBackupOptions()
+			opt.preciseRowCounts = tt.precise
+			opt.ignoreTables = tt.ignoreTables
+			client, queries := fakeRowsClient(t)
+			session := newFakeSession(t, opt, client)
+
+			got, err := opt.rowCounts(session, []string{"shop", "crm", "empty"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("rowCounts() = %v, want %v", got, tt.want)
+			}
+			data, err := os.ReadFile(queries)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(data), "TABLE_SCHEMA IN ('shop','crm','empty') AND TABLE_TYPE = 'BASE TABLE'") {
+				t.Errorf("the table rows were queried with %q", data)
+			}
+			// the exact counts take a single query per database with tables
+			if got := strings.Count(string(data), "SELECT SUM(c)"); got != tt.wantCountQueries {
+				t.Errorf("the rows were counted by %d queries, want %d:\n%s", got, tt.wantCountQueries, data)
+			}
+		})
+	}
+}
+
+func TestPreciseRowCountsOfTheDumpedTables(t *testing.T) {
+	opt := newTestBackupOptions()
+	opt.preciseRowCounts = true
+	opt.ignoreTables = []string{"shop.customers"}
+	client, queries := fakeRowsClient(t)
+	session := newFakeSession(t, opt, client)
+
+	if _, err := opt.rowCounts(session, []string{"shop"}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(queries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "SELECT COUNT(*) AS c FROM `shop`.`orders`") || strings.Contains(string(data), "`customers`") {
+		t.Errorf("the rows were counted with %q, want the ignored table to be left out", data)
+	}
+}
+
+func TestParseTableRows(t *testing.T) {
+	got, err := parseTableRows("shop\torders\t1000\nmy\\tdb\tcustomers\t0\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []tableRows{{db: "shop", table: "orders", rows: 1000}, {db: "my\tdb", table: "customers", rows: 0}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseTableRows() = %v, want %v", got, want)
+	}
+
+	for _, output := range []string{"shop\torders\n", "shop\torders\tmany\n"} {
+		if _, err := parseTableRows(output); err == nil || !strings.Contains(err.Error(), "invalid table rows") {
+			t.Errorf("parseTableRows(%q) error = %v, want the rows to be rejected", output, err)
+		}
+	}
+}
+
+func TestRecordRowCounts(t *testing.T) {
+	opt := newTestBackupOptions()
+	opt.preciseRowCounts = true
+	client, _ := fakeRowsClient(t)
+	session := newFakeSession(t, opt, client)
+
+	logs := captureLogs(t, func() { opt.recordRowCounts(session, []string{"shop", "crm"}) })
+	if want := (RowCounts{"shop": 1052, "crm": 9}); !reflect.DeepEqual(opt.rowCountsByDatabase, want) {
+		t.Errorf("recorded the row counts %v, want %v", opt.rowCountsByDatabase, want)
+	}
+	for _, want := range []string{"Database crm has exactly 9 rows", "Database shop has exactly 1052 rows", "The databases have exactly 1061 rows in total"} {
+		if !strings.Contains(logs, want) {
+			t.Errorf("recordRowCounts() logged:\n%s\nwant %q", logs, want)
+		}
+	}
+}
+
+func TestRecordRowCountsFailureDoesNotFailTheBackup(t *testing.T) {
+	opt := newTestBackupOptions()
+	session := newFakeSession(t, opt, fakeCommand(t, `echo "ERROR 1142 (42000): SELECT command denied" >&2; exit 1`))
+
+	logs := captureLogs(t, func() { opt.recordRowCounts(session, []string{"shop"}) })
+	if opt.rowCountsByDatabase != nil {
+		t.Errorf("recorded the row counts %v after a failed query", opt.rowCountsByDatabase)
+	}
+	if !strings.Contains(logs, "Unable to count the rows of the databases") {
+		t.Errorf("recordRowCounts() logged:\n%s\nwant the failure to be reported", logs)
+	}
+}
@@ -0,0 +1,80 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"k8s.io/klog/v2"
+)
+
+// ErrInterrupted is returned when a backup or a restore is aborted by SIGTERM or SIGINT, i.e. when the pod is preempted
+var ErrInterrupted = errors.New("operation interrupted")
+
+// interruptError records the signal that interrupted the operation
+type interruptError struct {
+	sig os.Signal
+}
+
+func (e *interruptError) Error() string {
+	return fmt.Sprintf("%v: received %v", ErrInterrupted, e.sig)
+}
+
+func (e *interruptError) Is(target error) bool {
+	return target == ErrInterrupted
+}
+
+// notifyContext returns a context cancelled with an ErrInterrupted cause when the process receives SIGTERM or SIGINT.
+// Only the operations install it, the helper subcommands of the pipelines keep exiting on these signals.
+func notifyContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(parent)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-signals:
+			// a second signal terminates the process right away
+			signal.Stop(signals)
+			klog.Warningf("Received %v, aborting the operation....", sig)
+			cancel(&interruptError{sig: sig})
+		case <-done:
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(signals)
+		close(done)
+		cancel(context.Canceled)
+	}
+}
+
+// ExitCode returns the exit code of the process failing with err: 128 plus the signal number when
+// the operation was interrupted, like a shell reports a command killed by a signal, 1 otherwise
+func ExitCode(err error) int {
+	var interrupted *interruptError
+	if errors.As(err, &interrupted) {
+		if sig, ok := interrupted.sig.(syscall.Signal); ok {
+			return 128 + int(sig)
+		}
+	}
+	return 1
+}
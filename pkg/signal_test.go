@@ -0,0 +1,117 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	api_v1beta1 "stash.appscode.dev/apimachinery/apis/stash/v1beta1"
+	"stash.appscode.dev/apimachinery/pkg/restic"
+)
+
+// interruptAfter sends sig to the test process after delay, as the kubelet does to a preempted pod
+func interruptAfter(t *testing.T, sig syscall.Signal, delay time.Duration) {
+	t.Helper()
+	timer := time.AfterFunc(delay, func() {
+		if err := syscall.Kill(os.Getpid(), sig); err != nil {
+			panic(err)
+		}
+	})
+	t.Cleanup(func() { timer.Stop() })
+}
+
+func TestInterruptedOperationTerminatesTheCommands(t *testing.T) {
+	tests := []struct {
+		sig      syscall.Signal
+		wantCode int
+	}{
+		{sig: syscall.SIGTERM, wantCode: 143},
+		{sig: syscall.SIGINT, wantCode: 130},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sig.String(), func(t *testing.T) {
+			opt := newTestBackupOptions()
+			opt.terminationGracePeriod = 500 * time.Millisecond
+			session := newFakeSession(t, opt, fakeCommand(t, "exec sleep 30"))
+			ctx, cancel := opt.startOperation(context.Background())
+			defer cancel()
+			interruptAfter(t, tt.sig, 300*time.Millisecond)
+
+			start := time.Now()
+			err := session.newShell().Command(session.cmd.Name).Run()
+			elapsed := time.Since(start)
+			err = opt.operationError(ctx, err)
+			if !errors.Is(err, ErrInterrupted) {
+				t.Errorf("operation error = %v, want %v", err, ErrInterrupted)
+			}
+			if code := ExitCode(err); code != tt.wantCode {
+				t.Errorf("ExitCode() = %d, want %d", code, tt.wantCode)
+			}
+			// the command exits on SIGTERM, before the grace period
+			if elapsed > opt.terminationGracePeriod+5*time.Second {
+				t.Errorf("the command ran for %v, want it to be terminated", elapsed)
+			}
+		})
+	}
+}
+
+func TestInterruptedUploadLeavesNoSnapshot(t *testing.T) {
+	opt := newTestBackupOptions()
+	opt.terminationGracePeriod = 500 * time.Millisecond
+	session := newFakeSession(t, opt, fakeCommand(t, "printf 'CREATE TABLE orders (id int);\\n'\nexec sleep 30"))
+	resticWrapper, repository := newFakeRestic(t, opt, session)
+	ctx, cancel := opt.startOperation(context.Background())
+	defer cancel()
+	interruptAfter(t, syscall.SIGTERM, 500*time.Millisecond)
+
+	_, err := resticWrapper.RunBackup(restic.BackupOptions{
+		Host:              restic.DefaultHost,
+		StdinPipeCommands: []restic.Command{{Name: session.cmd.Name}},
+		StdinFileName:     MariaDBDumpFile,
+	}, api_v1beta1.TargetRef{})
+	err = opt.operationError(ctx, err)
+	if !errors.Is(err, ErrInterrupted) {
+		t.Errorf("operation error = %v, want %v", err, ErrInterrupted)
+	}
+	if snapshots := fakeSnapshots(t, repository); len(snapshots) != 0 {
+		t.Errorf("the interrupted upload left the snapshots %v", snapshots)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "failure", err: errors.New("failed to dump database shop"), want: 1},
+		{name: "timeout", err: fmt.Errorf("%w after 1h0m0s: signal: terminated", ErrOperationTimeout), want: 1},
+		{name: "terminated", err: fmt.Errorf("%w: signal: terminated", &interruptError{sig: syscall.SIGTERM}), want: 143},
+		{name: "interrupted", err: &interruptError{sig: syscall.SIGINT}, want: 130},
+	}
+	for _, tt := range tests {
+		if got := ExitCode(tt.err); got != tt.want {
+			t.Errorf("ExitCode(%s) = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The requests to AWS are signed with Signature Version 4, which is implemented here since the
+// plugin only needs a couple of calls and does not ship the AWS SDK
+const (
+	awsSignAlgorithm = "AWS4-HMAC-SHA256"
+	awsDateFormat    = "20060102T150405Z"
+	awsRequestType   = "aws4_request"
+)
+
+// awsCredentials are the keys signing the requests, read from the standard AWS_* environment variables
+type awsCredentials struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+func awsCredentialsFromEnv() (awsCredentials, error) {
+	credentials := awsCredentials{
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if credentials.accessKey == "" || credentials.secretKey == "" {
+		return credentials, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	return credentials, nil
+}
+
+// resolveAWSRegion returns region, falling back to the region of the environment
+func resolveAWSRegion(region string) (string, error) {
+	for _, r := range []string{region, os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION")} {
+		if r != "" {
+			return r, nil
+		}
+	}
+	return "", errors.New("the AWS region is not set, pass it as an option or set AWS_REGION")
+}
+
+func awsScope(t time.Time, region, service string) string {
+	return strings.Join([]string{t.Format("20060102"), region, service, awsRequestType}, "/")
+}
+
+// sign returns the signature of canonicalRequest issued at t for service in region
+func (c awsCredentials) sign(t time.Time, region, service, canonicalRequest string) string {
+	stringToSign := strings.Join([]string{
+		awsSignAlgorithm,
+		t.Format(awsDateFormat),
+		awsScope(t, region, service),
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := []byte("AWS4" + c.secretKey)
+	for _, part := range []string{t.Format("20060102"), region, service, awsRequestType} {
+		key = hmacSHA256(key, part)
+	}
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// signRequest adds the Authorization header of req, whose body hashes to payloadHash
+func (c awsCredentials) signRequest(req *http.Request, region, service, payloadHash string, t time.Time) {
+	t = t.UTC()
+	req.Header.Set("X-Amz-Date", t.Format(awsDateFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k := range req.Header {
+		if name := strings.ToLower(k); strings.HasPrefix(name, "x-amz-") || name == "content-type" {
+			headers[name] = strings.TrimSpace(req.Header.Get(k))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := map[string]string{}
+	for k, v := range req.URL.Query() {
+		query[k] = v[0]
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQueryString(query),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	signature := c.sign(t, region, service, canonicalRequest)
+	req.Header.Set("Authorization", awsSignAlgorithm+" Credential="+c.accessKey+"/"+awsScope(t, region, service)+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// canonicalQueryString encodes the query sorted by key, with the escaping of the AWS signature
+func canonicalQueryString(query map[string]string) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, awsEscape(k)+"="+awsEscape(query[k]))
+	}
+	return strings.Join(pairs, "&")
+}
+
+func awsEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
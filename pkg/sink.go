@@ -0,0 +1,445 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/armon/circbuf"
+	"k8s.io/klog/v2"
+	api_v1beta1 "stash.appscode.dev/apimachinery/apis/stash/v1beta1"
+	"stash.appscode.dev/apimachinery/pkg/restic"
+)
+
+const (
+	SinkRestic        = "restic"
+	SinkObjectStorage = "object-storage"
+	SinkFIFO          = "fifo"
+
+	DefaultObjectStoragePartSize = "64M"
+	// bounds of the part size of the S3 multipart uploads
+	minObjectPartSize = 5 << 20
+	maxObjectPartSize = 5 << 30
+	// the S3 API allows up to 10000 parts per upload
+	maxObjectParts = 10000
+
+	objectStorageService = "s3"
+	// objects of a backup are grouped under a prefix named after its start time
+	objectStorageRunFormat = "20060102T150405Z"
+)
+
+// dumpSink stores the dumps outside of the restic repository
+type dumpSink interface {
+	// upload stores the content of r as the object name and returns its size
+	upload(ctx context.Context, name string, r io.Reader) (int64, error)
+}
+
+// objectStorageOptions locate the bucket the dumps are uploaded to
+type objectStorageOptions struct {
+	bucket   string
+	prefix   string
+	endpoint string
+	region   string
+	partSize string
+}
+
+// validateSinkOptions checks the sinks the backup is sent to
+func (opt *mariadbOptions) validateSinkOptions() error {
+	if len(opt.sinks) == 0 {
+		return fmt.Errorf("at least one sink is required")
+	}
+	for _, sink := range opt.sinks {
+		if sink != SinkRestic && sink != SinkObjectStorage && sink != SinkFIFO {
+			return fmt.Errorf("invalid sink %q, must be %s, %s or %s", sink, SinkRestic, SinkObjectStorage, SinkFIFO)
+		}
+	}
+	if opt.hasSink(SinkFIFO) {
+		if !opt.streamBackup {
+			return fmt.Errorf("the %s sink requires --stream", SinkFIFO)
+		}
+		if len(opt.sinks) > 1 {
+			return fmt.Errorf("a streamed dump is sent to a single sink, the %s sink can not be combined with others", SinkFIFO)
+		}
+		if opt.fifoPath == "" {
+			return fmt.Errorf("--fifo-path is required by the %s sink", SinkFIFO)
+		}
+	} else if opt.fifoPath != "" {
+		return fmt.Errorf("--fifo-path requires --sink=%s", SinkFIFO)
+	}
+	if !opt.hasSink(SinkObjectStorage) {
+		return nil
+	}
+	if opt.streamBackup && opt.hasSink(SinkRestic) {
+		return fmt.Errorf("a streamed dump is sent to a single sink, choose either %s or %s", SinkRestic, SinkObjectStorage)
+	}
+	if opt.objectStorage.bucket == "" {
+		return fmt.Errorf("--object-storage-bucket is required by the %s sink", SinkObjectStorage)
+	}
+	partSize, err := parseBytes(opt.objectStorage.partSize)
+	if err != nil {
+		return fmt.Errorf("invalid object storage part size: %w", err)
+	}
+	if partSize < minObjectPartSize || partSize > maxObjectPartSize {
+		return fmt.Errorf("object storage part size must be between %s and %s, got %s", formatBytes(minObjectPartSize), formatBytes(maxObjectPartSize), opt.objectStorage.partSize)
+	}
+	return nil
+}
+
+func (opt *mariadbOptions) hasSink(sink string) bool {
+	for _, s := range opt.sinks {
+		if s == sink {
+			return true
+		}
+	}
+	return false
+}
+
+// newObjectStorageSink returns the sink uploading the dumps of this backup into the bucket of the options
+func (opt *mariadbOptions) newObjectStorageSink(startTime time.Time) (*s3Sink, error) {
+	region, err := resolveAWSRegion(opt.objectStorage.region)
+	if err != nil {
+		return nil, fmt.Errorf("object storage: %w", err)
+	}
+	credentials, err := awsCredentialsFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("object storage: %w", err)
+	}
+	endpoint := opt.objectStorage.endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid object storage endpoint %q", endpoint)
+	}
+	partSize, err := parseBytes(opt.objectStorage.partSize)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Sink{
+		client:      http.DefaultClient,
+		endpoint:    u,
+		bucket:      opt.objectStorage.bucket,
+		prefix:      path.Join(opt.objectStorage.prefix, startTime.UTC().Format(objectStorageRunFormat)),
+		region:      region,
+		credentials: credentials,
+		partSize:    partSize,
+	}, nil
+}
+
+// s3Sink uploads the dumps through the S3 API, which is also served by GCS and most object stores.
+// The objects are addressed in path style, endpoint/bucket/prefix/name.
+type s3Sink struct {
+	client      *http.Client
+	endpoint    *url.URL
+	bucket      string
+	prefix      string
+	region      string
+	credentials awsCredentials
+	partSize    int64
+}
+
+// upload streams r into the object name. Content larger than a part is sent as a multipart upload,
+// so that a dump is never held in memory as a whole. The size of the stored object is checked once uploaded.
+func (s *s3Sink) upload(ctx context.Context, name string, r io.Reader) (int64, error) {
+	key := path.Join(s.prefix, name)
+	buf := make([]byte, s.partSize)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return 0, err
+	}
+	var size int64
+	if int64(n) < s.partSize {
+		// everything fits in a single request
+		if _, err = s.do(ctx, http.MethodPut, key, nil, buf[:n], nil); err != nil {
+			return 0, fmt.Errorf("failed to upload %s: %w", key, err)
+		}
+		size = int64(n)
+	} else {
+		size, err = s.multipartUpload(ctx, key, buf, r)
+		if err != nil {
+			return 0, fmt.Errorf("failed to upload %s: %w", key, err)
+		}
+	}
+
+	if err = s.verifySize(ctx, key, size); err != nil {
+		return 0, err
+	}
+	klog.Infof("Uploaded %s (%s) to bucket %s", key, formatBytes(size), s.bucket)
+	return size, nil
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// multipartUpload uploads the full part held in buf followed by the rest of r, one part at a time
+func (s *s3Sink) multipartUpload(ctx context.Context, key string, buf []byte, r io.Reader) (int64, error) {
+	resp, err := s.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err = xml.Unmarshal(resp, &initiated); err != nil || initiated.UploadID == "" {
+		return 0, fmt.Errorf("invalid response to the creation of the multipart upload: %s", resp)
+	}
+	uploadID := initiated.UploadID
+
+	var size int64
+	var parts []completedPart
+	n := len(buf)
+	for n > 0 {
+		if len(parts) == maxObjectParts {
+			err = fmt.Errorf("the dump does not fit in %d parts of %s, raise the part size", maxObjectParts, formatBytes(s.partSize))
+			break
+		}
+		query := url.Values{"partNumber": {strconv.Itoa(len(parts) + 1)}, "uploadId": {uploadID}}
+		var header http.Header
+		header, err = s.doHeader(ctx, http.MethodPut, key, query, buf[:n])
+		if err != nil {
+			break
+		}
+		parts = append(parts, completedPart{PartNumber: len(parts) + 1, ETag: header.Get("ETag")})
+		size += int64(n)
+
+		n, err = io.ReadFull(r, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		var body []byte
+		body, err = xml.Marshal(completeMultipartUpload{Parts: parts})
+		if err == nil {
+			_, err = s.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, body, http.Header{"Content-Type": {"application/xml"}})
+		}
+	}
+	if err != nil {
+		// the parts of an unfinished upload are billed until it is aborted
+		_, abortErr := s.do(context.Background(), http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil)
+		if abortErr != nil {
+			klog.Errorf("Failed to abort the multipart upload of %s. Reason: %v", key, abortErr)
+		}
+		return 0, err
+	}
+	return size, nil
+}
+
+// verifySize checks that the object stored as key has the size of the uploaded content
+func (s *s3Sink) verifySize(ctx context.Context, key string, size int64) error {
+	header, err := s.doHeader(ctx, http.MethodHead, key, nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to verify the upload of %s: %w", key, err)
+	}
+	stored, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("failed to verify the upload of %s: invalid Content-Length %q", key, header.Get("Content-Length"))
+	}
+	if stored != size {
+		return fmt.Errorf("the uploaded object %s holds %d bytes, %d were sent", key, stored, size)
+	}
+	return nil
+}
+
+// do sends a signed request on the object key and returns the body of the response
+func (s *s3Sink) do(ctx context.Context, method, key string, query url.Values, body []byte, header http.Header) ([]byte, error) {
+	resp, err := s.send(ctx, method, key, query, body, header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// doHeader sends a signed request on the object key and returns the header of the response
+func (s *s3Sink) doHeader(ctx context.Context, method, key string, query url.Values, body []byte) (http.Header, error) {
+	resp, err := s.send(ctx, method, key, query, body, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return resp.Header, nil
+}
+
+func (s *s3Sink) send(ctx context.Context, method, key string, query url.Values, body []byte, header http.Header) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = path.Join("/", s.endpoint.Path, s.bucket, key)
+	// the signature expects every character but the unreserved ones escaped in the path
+	segments := strings.Split(u.Path, "/")
+	for i, segment := range segments {
+		segments[i] = awsEscape(segment)
+	}
+	u.RawPath = strings.Join(segments, "/")
+	// the signature is computed on the query encoded with %20 for spaces
+	u.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.ContentLength = int64(len(body))
+	s.credentials.signRequest(req, s.region, objectStorageService, sha256Hex(body), time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%s %s: %s: %s", method, key, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// uploadDumps uploads the successful dumps of results, along with the manifest and the grants written next to them
+func (opt *mariadbOptions) uploadDumps(ctx context.Context, sink dumpSink, dumpdir string, results []dumpResult) error {
+	files := []string{tableManifestFile(dumpdir), filepath.Join(dumpdir, GrantsFileName), serverVariablesFile(dumpdir), databaseCharsetsFile(dumpdir), checksumFile(dumpdir)}
+	for _, result := range results {
+		if result.err == nil {
+			files = append(files, result.dumpfile)
+		}
+	}
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := uploadFile(ctx, sink, dumpdir, file); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func uploadFile(ctx context.Context, sink dumpSink, dir, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	name, err := filepath.Rel(dir, file)
+	if err != nil {
+		return err
+	}
+	_, err = sink.upload(ctx, filepath.ToSlash(name), f)
+	return err
+}
+
+// streamToSink pipes the dump of the databases into the sink, so that it never lands on disk
+func (opt *mariadbOptions) streamToSink(ctx context.Context, session *sessionWrapper, sink dumpSink, databases []string) error {
+	if len(databases) == 0 {
+		return fmt.Errorf("no database to back up")
+	}
+	dump := opt.streamBackupOptions(session, databases).StdinPipeCommands[0]
+	klog.Infof("Streaming : %s %v", dump.Name, sanitizeArgs(dump.Args))
+
+	pr, pw := io.Pipe()
+	hash := sha256.New()
+	compressor, err := newCompressWriter(io.MultiWriter(pw, hash), opt.compression, opt.compressionLevel)
+	if err != nil {
+		return err
+	}
+	errBuff, err := circbuf.NewBuffer(stderrBufferSize)
+	if err != nil {
+		return err
+	}
+	sh := session.newShell()
+	trailer := newTrailerWriter()
+	counter := &countingWriter{w: io.MultiWriter(compressor, trailer)}
+	sh.Stdout = throttle(counter, opt.dumpLimiter)
+	sh.Stderr = errBuff
+
+	startTime := time.Now()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err := sh.Command(dump.Name, dump.Args...).Run()
+		if err != nil {
+			err = newCommandError(err, capturedStderr(errBuff))
+		} else if opt.verifyDump {
+			err = checkDumpCompleted(trailer.Bytes())
+		}
+		if closeErr := compressor.Close(); err == nil && closeErr != nil {
+			err = fmt.Errorf("failed to compress the dump: %w", closeErr)
+		}
+		// a failed dump fails the upload, which aborts it instead of storing a truncated object
+		_ = pw.CloseWithError(err)
+	}()
+
+	name := opt.backupOptions.StdinFileName + compressionExtension(opt.compression)
+	_, err = sink.upload(ctx, name, pr)
+	// stop the dump when the upload failed before reading all of it
+	_ = pr.CloseWithError(err)
+	<-done
+	if err != nil {
+		return err
+	}
+	checksum := fmt.Sprintf("%s  %s\n", hex.EncodeToString(hash.Sum(nil)), name)
+	if _, err = sink.upload(ctx, ChecksumFileName, strings.NewReader(checksum)); err != nil {
+		return fmt.Errorf("failed to upload the checksum of the dump: %w", err)
+	}
+	opt.dumpStats.add(counter.count, time.Since(startTime))
+	opt.metrics.observeDump(counter.count, time.Since(startTime))
+	return nil
+}
+
+// sinkBackupOutput reports the backup as succeeded when no restic snapshot was taken
+func (opt *mariadbOptions) sinkBackupOutput(targetRef api_v1beta1.TargetRef) *restic.BackupOutput {
+	return &restic.BackupOutput{
+		BackupTargetStatus: api_v1beta1.BackupTargetStatus{
+			Ref: targetRef,
+			Stats: []api_v1beta1.HostBackupStats{
+				{
+					Hostname: opt.backupOptions.Host,
+					Phase:    api_v1beta1.HostBackupSucceeded,
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,317 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// memorySink keeps the uploaded objects in memory
+type memorySink struct {
+	objects map[string][]byte
+}
+
+func newMemorySink() *memorySink {
+	return &memorySink{objects: map[string][]byte{}}
+}
+
+func (s *memorySink) upload(_ context.Context, name string, r io.Reader) (int64, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	s.objects[name] = data
+	return int64(len(data)), nil
+}
+
+func (s *memorySink) names() []string {
+	var names []string
+	for name := range s.objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestDefaultSink(t *testing.T) {
+	if got := NewCmdBackup().Flags().Lookup("sink").DefValue; got != "["+SinkRestic+"]" {
+		t.Errorf("--sink defaults to %s, want [%s]", got, SinkRestic)
+	}
+}
+
+func TestUploadDumps(t *testing.T) {
+	dumpdir := t.TempDir()
+	files := map[string]string{
+		"shop.sql":            "CREATE TABLE orders (id int);\n",
+		"crm.sql":             "CREATE TABLE contacts (id int);\n",
+		TableManifestFileName: `{"crm": 1, "shop": 1}`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dumpdir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	results := []dumpResult{
+		{db: "shop", dumpfile: filepath.Join(dumpdir, "shop.sql")},
+		{db: "crm", dumpfile: filepath.Join(dumpdir, "crm.sql")},
+		{db: "hr", dumpfile: filepath.Join(dumpdir, "hr.sql"), err: errors.New("mariadb-dump: Got error: 1049: Unknown database 'hr'")},
+	}
+
+	sink := newMemorySink()
+	if err := newTestBackupOptions().uploadDumps(context.Background(), sink, dumpdir, results); err != nil {
+		t.Fatal(err)
+	}
+	// the failed dump is not uploaded, nor the files the backup did not write
+	if got, want := sink.names(), []string{"crm.sql", "shop.sql", TableManifestFileName}; !reflect.DeepEqual(got, want) {
+		t.Errorf("uploadDumps() uploaded %v, want %v", got, want)
+	}
+	for name, data := range sink.objects {
+		if string(data) != files[name] {
+			t.Errorf("%s was uploaded with %q, want %q", name, data, files[name])
+		}
+	}
+}
+
+func TestStreamToSink(t *testing.T) {
+	dump := sampleDump(100)
+	dumpFile := filepath.Join(t.TempDir(), "dump.sql")
+	if err := os.WriteFile(dumpFile, dump, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, algo := range []string{CompressionNone, CompressionGzip} {
+		t.Run(algo, func(t *testing.T) {
+			opt := newTestBackupOptions()
+			opt.compression = algo
+			session := newFakeSession(t, opt, fakeCommand(t, "cat "+dumpFile))
+
+			sink := newMemorySink()
+			if err := opt.streamToSink(context.Background(), session, sink, []string{"shop"}); err != nil {
+				t.Fatal(err)
+			}
+			name := MariaDBDumpFile + compressionExtension(algo)
+			if got, want := sink.names(), []string{ChecksumFileName, name}; !reflect.DeepEqual(got, want) {
+				t.Fatalf("streamToSink() uploaded %v, want %v", got, want)
+			}
+			var restored bytes.Buffer
+			if err := decompressStream(&restored, bytes.NewReader(sink.objects[name])); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(restored.Bytes(), dump) {
+				t.Errorf("the uploaded dump differs from the dump")
+			}
+			sum := sha256.Sum256(sink.objects[name])
+			if got, want := string(sink.objects[ChecksumFileName]), hex.EncodeToString(sum[:])+"  "+name+"\n"; got != want {
+				t.Errorf("the uploaded checksum is %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestStreamToSinkFailedDump(t *testing.T) {
+	opt := newTestBackupOptions()
+	session := newFakeSession(t, opt, fakeCommand(t, `echo "CREATE TABLE orders (id int);"
+echo "mariadb-dump: Got error: 2013: Lost connection to server during query" >&2
+exit 2`))
+
+	sink := newMemorySink()
+	err := opt.streamToSink(context.Background(), session, sink, []string{"shop"})
+	if err == nil || !strings.Contains(err.Error(), "Lost connection to server during query") {
+		t.Errorf("streamToSink() error = %v, want the failure of the dump", err)
+	}
+	if len(sink.objects) != 0 {
+		t.Errorf("streamToSink() uploaded %v after the dump failed", sink.names())
+	}
+}
+
+// fakeS3 serves the S3 requests of the sink from memory
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	parts    map[int][]byte
+	requests []string
+	// failPart fails the upload of this part
+	failPart int
+	// lengthDelta is added to the size reported for the stored objects
+	lengthDelta int
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	body, _ := io.ReadAll(r.Body)
+	query := r.URL.Query()
+	key := r.URL.Path
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		s.requests = append(s.requests, "create multipart upload")
+		s.parts = map[int][]byte{}
+		fmt.Fprint(w, "<InitiateMultipartUploadResult><UploadId>upload-1</UploadId></InitiateMultipartUploadResult>")
+	case r.Method == http.MethodPut && query.Has("partNumber"):
+		part, _ := strconv.Atoi(query.Get("partNumber"))
+		s.requests = append(s.requests, fmt.Sprintf("upload part %d (%d bytes)", part, len(body)))
+		if part == s.failPart {
+			http.Error(w, "SlowDown", http.StatusServiceUnavailable)
+			return
+		}
+		s.parts[part] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"etag-%d"`, part))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		var complete completeMultipartUpload
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.requests = append(s.requests, fmt.Sprintf("complete multipart upload of %d parts", len(complete.Parts)))
+		var object []byte
+		for i, part := range complete.Parts {
+			if part.PartNumber != i+1 || part.ETag != fmt.Sprintf(`"etag-%d"`, i+1) {
+				http.Error(w, "InvalidPart", http.StatusBadRequest)
+				return
+			}
+			object = append(object, s.parts[part.PartNumber]...)
+		}
+		s.objects[key] = object
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		s.requests = append(s.requests, "abort multipart upload")
+		s.parts = nil
+	case r.Method == http.MethodPut:
+		s.requests = append(s.requests, fmt.Sprintf("put object (%d bytes)", len(body)))
+		s.objects[key] = body
+	case r.Method == http.MethodHead:
+		object, ok := s.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(object)+s.lengthDelta))
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+// newTestS3Sink returns a sink uploading to the fake S3 server with parts of partSize bytes
+func newTestS3Sink(t *testing.T, server *fakeS3, partSize int64) *s3Sink {
+	t.Helper()
+	ts := httptest.NewServer(server)
+	t.Cleanup(ts.Close)
+	endpoint, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &s3Sink{
+		client:      ts.Client(),
+		endpoint:    endpoint,
+		bucket:      "backups",
+		prefix:      "shop/20240101T100000Z",
+		region:      "eu-west-1",
+		credentials: awsCredentials{accessKey: "AKIDEXAMPLE", secretKey: "secret"},
+		partSize:    partSize,
+	}
+}
+
+func TestS3SinkUpload(t *testing.T) {
+	dump := sampleDump(100)
+	tests := []struct {
+		name         string
+		partSize     int64
+		wantRequests []string
+	}{
+		{
+			name:         "single request",
+			partSize:     int64(len(dump)) + 1,
+			wantRequests: []string{fmt.Sprintf("put object (%d bytes)", len(dump))},
+		},
+		{
+			name:     "multipart upload",
+			partSize: 4096,
+			wantRequests: func() []string {
+				requests := []string{"create multipart upload"}
+				parts := (len(dump) + 4095) / 4096
+				for i := 1; i <= parts; i++ {
+					requests = append(requests, fmt.Sprintf("upload part %d (%d bytes)", i, min(4096, len(dump)-(i-1)*4096)))
+				}
+				return append(requests, fmt.Sprintf("complete multipart upload of %d parts", parts))
+			}(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &fakeS3{objects: map[string][]byte{}}
+			sink := newTestS3Sink(t, server, tt.partSize)
+
+			size, err := sink.upload(context.Background(), MariaDBDumpFile, bytes.NewReader(dump))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size != int64(len(dump)) {
+				t.Errorf("upload() = %d, want %d", size, len(dump))
+			}
+			if !bytes.Equal(server.objects["/backups/shop/20240101T100000Z/"+MariaDBDumpFile], dump) {
+				t.Errorf("the stored object differs from the dump")
+			}
+			if !reflect.DeepEqual(server.requests, tt.wantRequests) {
+				t.Errorf("upload() sent %q, want %q", server.requests, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestS3SinkFailedPartAbortsTheUpload(t *testing.T) {
+	server := &fakeS3{objects: map[string][]byte{}, failPart: 2}
+	sink := newTestS3Sink(t, server, 4096)
+
+	_, err := sink.upload(context.Background(), MariaDBDumpFile, bytes.NewReader(sampleDump(1000)))
+	if err == nil || !strings.Contains(err.Error(), "503 Service Unavailable: SlowDown") {
+		t.Errorf("upload() error = %v, want the failure of the part", err)
+	}
+	want := []string{"create multipart upload", "upload part 1 (4096 bytes)", "upload part 2 (4096 bytes)", "abort multipart upload"}
+	if !reflect.DeepEqual(server.requests, want) {
+		t.Errorf("upload() sent %q, want %q", server.requests, want)
+	}
+	if len(server.objects) != 0 {
+		t.Errorf("an object was stored by the failed upload")
+	}
+}
+
+func TestS3SinkVerifiesTheUploadedSize(t *testing.T) {
+	server := &fakeS3{objects: map[string][]byte{}, lengthDelta: -1}
+	sink := newTestS3Sink(t, server, 1<<20)
+
+	_, err := sink.upload(context.Background(), MariaDBDumpFile, strings.NewReader("CREATE TABLE orders (id int);\n"))
+	want := "the uploaded object shop/20240101T100000Z/dumpfile.sql holds 29 bytes, 30 were sent"
+	if err == nil || err.Error() != want {
+		t.Errorf("upload() error = %v, want %q", err, want)
+	}
+}
@@ -0,0 +1,199 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"stash.appscode.dev/apimachinery/pkg/restic"
+)
+
+const (
+	DumpBytesTagPrefix = "dump-bytes="
+	// the databases held by a snapshot, escaped and separated by semicolons, and how many of them did not fit
+	DatabasesTagPrefix        = "databases="
+	DatabasesOmittedTagPrefix = "databases-omitted="
+	// maxDatabasesTagLength bounds the length of the databases tag, so that the snapshot listings stay readable
+	maxDatabasesTagLength = 1024
+	databasesSeparator    = ";"
+	// the number of databases held by a snapshot
+	DatabaseCountTagPrefix = "database-count="
+	// whether the snapshot holds the dumps of a whole backup or the dump of one of its databases
+	DumpModeTagPrefix   = "dump-mode="
+	DumpModeFull        = "full"
+	DumpModePerDatabase = "per-database"
+)
+
+// derivedTagPrefixes are the prefixes of the tags set by the backup, which the restores look up
+var derivedTagPrefixes = []string{
+	DumpBytesTagPrefix, DatabasesTagPrefix, DatabasesOmittedTagPrefix, DatabaseCountTagPrefix, DumpModeTagPrefix,
+	DatabaseTagPrefix, HostTagPrefix, ServerVersionTagPrefix, BackupTypeTagPrefix, TableCountTagPrefix,
+	ChecksumTagPrefix, CharsetTagPrefix,
+}
+
+// findSnapshot returns the snapshot a restore dumps. Without an explicit snapshot, it is the latest
+// snapshot taken for the source host, restricted to the snapshots of db if it is not empty.
+func findSnapshot(resticWrapper *restic.ResticWrapper, dumpOptions restic.DumpOptions, db string) (*restic.Snapshot, error) {
+	var ids []string
+	if dumpOptions.Snapshot != "" && dumpOptions.Snapshot != "latest" {
+		ids = []string{dumpOptions.Snapshot}
+	}
+	host := dumpOptions.SourceHost
+	if host == "" {
+		host = dumpOptions.Host
+	}
+	snapshots, err := resticWrapper.ListSnapshots(ids)
+	if err != nil {
+		if ids != nil {
+			return nil, fmt.Errorf("failed to find snapshot %s: %w", dumpOptions.Snapshot, err)
+		}
+		return nil, err
+	}
+
+	var latest *restic.Snapshot
+	for i, snapshot := range snapshots {
+		if ids == nil && (snapshot.Hostname != host || (db != "" && !containsString(snapshot.Tags, DatabaseTagPrefix+db))) {
+			continue
+		}
+		if latest == nil || snapshot.Time.After(latest.Time) {
+			latest = &snapshots[i]
+		}
+	}
+	if ids != nil {
+		if latest == nil {
+			return nil, fmt.Errorf("snapshot %s not found in the repository", dumpOptions.Snapshot)
+		}
+		if db != "" && !containsString(latest.Tags, DatabaseTagPrefix+db) {
+			return nil, fmt.Errorf("snapshot %s does not hold a backup of database %s", dumpOptions.Snapshot, db)
+		}
+		return latest, nil
+	}
+	if latest == nil && db != "" {
+		return nil, fmt.Errorf("no snapshot found for database %s", db)
+	}
+	if latest == nil {
+		return nil, fmt.Errorf("no snapshot found for host %s", host)
+	}
+	return latest, nil
+}
+
+// readSnapshotFile returns the content of a file of the snapshot the restore dumps
+func readSnapshotFile(resticWrapper *restic.ResticWrapper, dumpOptions restic.DumpOptions, fileName string) ([]byte, error) {
+	dumpOptions.FileName = fileName
+	dumpOptions.Path = ""
+	dumpOptions.StdoutPipeCommands = nil
+	if dumpOptions.SourceHost == "" {
+		dumpOptions.SourceHost = dumpOptions.Host
+	}
+	return resticWrapper.DumpOnce(dumpOptions)
+}
+
+// snapshotTagValue returns the value of the first tag of the snapshot with the given prefix
+func snapshotTagValue(snapshot *restic.Snapshot, prefix string) (string, bool) {
+	for _, tag := range snapshot.Tags {
+		if strings.HasPrefix(tag, prefix) {
+			return strings.TrimPrefix(tag, prefix), true
+		}
+	}
+	return "", false
+}
+
+// validateSnapshotTags checks the custom tags of the snapshots. restic splits the tags on commas and
+// the tags set by the backup must not be overridden, since the restores select the snapshots by them.
+func validateSnapshotTags(tags []string) error {
+	for _, tag := range tags {
+		if tag == "" {
+			return fmt.Errorf("snapshot tags must not be empty")
+		}
+		if strings.ContainsAny(tag, ", \t\n\r") {
+			return fmt.Errorf("invalid snapshot tag %q, it must not contain commas or whitespace", tag)
+		}
+		for _, prefix := range derivedTagPrefixes {
+			if strings.HasPrefix(tag, prefix) {
+				return fmt.Errorf("invalid snapshot tag %q, the %s tags are set by the backup", tag, strings.TrimSuffix(prefix, "="))
+			}
+		}
+	}
+	return nil
+}
+
+// snapshotTagArgs returns the restic arguments tagging the snapshots of the backup with the custom tags and its dump mode
+func (opt *mariadbOptions) snapshotTagArgs() []string {
+	var args []string
+	for _, tag := range opt.snapshotTags {
+		args = append(args, "--tag", tag)
+	}
+	mode := DumpModeFull
+	if opt.perDatabaseBackup {
+		mode = DumpModePerDatabase
+	}
+	return append(args, "--tag", DumpModeTagPrefix+mode)
+}
+
+// databasesTags returns the restic arguments tagging a snapshot with the databases it holds.
+// restic splits the tags on commas, so the names are path escaped, which escapes the commas and the separator.
+// When the list is too long, the databases that do not fit are only counted.
+func databasesTags(databases []string) []string {
+	var (
+		value   strings.Builder
+		omitted int
+	)
+	for i, db := range databases {
+		escaped := url.PathEscape(db)
+		if value.Len()+len(databasesSeparator)+len(escaped) > maxDatabasesTagLength {
+			omitted = len(databases) - i
+			break
+		}
+		if value.Len() > 0 {
+			value.WriteString(databasesSeparator)
+		}
+		value.WriteString(escaped)
+	}
+	tags := []string{"--tag", DatabasesTagPrefix + value.String(), "--tag", fmt.Sprintf("%s%d", DatabaseCountTagPrefix, len(databases))}
+	if omitted > 0 {
+		tags = append(tags, "--tag", fmt.Sprintf("%s%d", DatabasesOmittedTagPrefix, omitted))
+	}
+	return tags
+}
+
+// snapshotDatabases returns the databases listed in the tags of the snapshot, along with the number
+// of databases left out of the list. ok is false for the snapshots taken without the list.
+func snapshotDatabases(snapshot *restic.Snapshot) (databases []string, omitted int, ok bool, err error) {
+	value, ok := snapshotTagValue(snapshot, DatabasesTagPrefix)
+	if !ok {
+		return nil, 0, false, nil
+	}
+	if value != "" {
+		for _, escaped := range strings.Split(value, databasesSeparator) {
+			db, err := url.PathUnescape(escaped)
+			if err != nil {
+				return nil, 0, true, fmt.Errorf("invalid database %q in the tags of snapshot %s: %w", escaped, snapshot.ID, err)
+			}
+			databases = append(databases, db)
+		}
+	}
+	if count, found := snapshotTagValue(snapshot, DatabasesOmittedTagPrefix); found {
+		omitted, err = strconv.Atoi(count)
+		if err != nil {
+			return nil, 0, true, fmt.Errorf("invalid tag %s%s of snapshot %s", DatabasesOmittedTagPrefix, count, snapshot.ID)
+		}
+	}
+	return databases, omitted, true, nil
+}
@@ -0,0 +1,228 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"stash.appscode.dev/apimachinery/pkg/restic"
+
+	api_v1beta1 "stash.appscode.dev/apimachinery/apis/stash/v1beta1"
+)
+
+func TestFindSnapshot(t *testing.T) {
+	opt := newTestRestoreOptions()
+	session := newFakeSession(t, opt, "mariadb")
+	resticWrapper, repository := newFakeRestic(t, opt, session)
+	dumpdir := filepath.Join(opt.setupOptions.ScratchDir, MariaDBDumpDir)
+	storeFakeSnapshot(t, resticWrapper, opt.databaseDumpFile(dumpdir, "shop"), sampleDump(1), "--tag", DatabaseTagPrefix+"shop")
+	storeFakeSnapshot(t, resticWrapper, opt.databaseDumpFile(dumpdir, "crm"), sampleDump(1), "--tag", DatabaseTagPrefix+"crm")
+	storeFakeSnapshot(t, resticWrapper, opt.databaseDumpFile(dumpdir, "shop"), sampleDump(2), "--tag", DatabaseTagPrefix+"shop")
+	snapshots := fakeSnapshots(t, repository)
+
+	tests := []struct {
+		name     string
+		snapshot string
+		db       string
+		want     string
+		wantErr  string
+	}{
+		{name: "latest", snapshot: "latest", want: snapshots[2].ID},
+		{name: "latest of a database", db: "crm", want: snapshots[1].ID},
+		{name: "explicit", snapshot: snapshots[0].ID, db: "shop", want: snapshots[0].ID},
+		{name: "short id", snapshot: snapshots[0].ID[:8], want: snapshots[0].ID},
+		{name: "unknown", snapshot: "deadbeef", wantErr: "snapshot deadbeef not found in the repository"},
+		{name: "other database", snapshot: snapshots[1].ID, db: "shop", wantErr: "does not hold a backup of database shop"},
+		{name: "no snapshot of the database", db: "billing", wantErr: "no snapshot found for database billing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dumpOptions := opt.dumpOptions
+			dumpOptions.Snapshot = tt.snapshot
+			snapshot, err := findSnapshot(resticWrapper, dumpOptions, tt.db)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("findSnapshot() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if snapshot.ID != tt.want {
+				t.Errorf("findSnapshot() = %s, want %s", snapshot.ID, tt.want)
+			}
+		})
+	}
+}
+
+func TestRestoreExplicitSnapshot(t *testing.T) {
+	opt := newTestRestoreOptions()
+	client, applied := fakeClientCommand(t)
+	session := newFakeSession(t, opt, client)
+	resticWrapper, repository := newFakeRestic(t, opt, session)
+	dumpfile := opt.databaseDumpFile(filepath.Join(opt.setupOptions.ScratchDir, MariaDBDumpDir), "shop")
+	storeFakeSnapshot(t, resticWrapper, dumpfile, []byte("INSERT INTO orders VALUES (1);\n"), "--tag", DatabaseTagPrefix+"shop")
+	storeFakeSnapshot(t, resticWrapper, dumpfile, []byte("INSERT INTO orders VALUES (2);\n"), "--tag", DatabaseTagPrefix+"shop")
+
+	opt.dumpOptions.Snapshot = fakeSnapshots(t, repository)[0].ID
+	if err := opt.restoreDatabaseSnapshot(context.Background(), session, resticWrapper, "shop", opt.sqlFilterOptions, "", api_v1beta1.TargetRef{}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(applied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "INSERT INTO orders VALUES (1);\n" {
+		t.Errorf("the restore applied %q, want the dump of the first snapshot", data)
+	}
+}
+
+func TestValidateSnapshotTags(t *testing.T) {
+	if err := validateSnapshotTags([]string{"keep-monthly", "team=billing", "tier:gold"}); err != nil {
+		t.Errorf("validateSnapshotTags() error = %v", err)
+	}
+	tests := []struct {
+		tag     string
+		wantErr string
+	}{
+		{tag: "", wantErr: "snapshot tags must not be empty"},
+		{tag: "keep,monthly", wantErr: "it must not contain commas or whitespace"},
+		{tag: "keep monthly", wantErr: "it must not contain commas or whitespace"},
+		{tag: "keep\tmonthly", wantErr: "it must not contain commas or whitespace"},
+		{tag: DatabaseCountTagPrefix + "3", wantErr: "the database-count tags are set by the backup"},
+		{tag: DumpModeTagPrefix + DumpModeFull, wantErr: "the dump-mode tags are set by the backup"},
+		{tag: DatabaseTagPrefix + "shop", wantErr: "are set by the backup"},
+		{tag: ServerVersionTagPrefix + "10.11.6-MariaDB", wantErr: "are set by the backup"},
+	}
+	for _, tt := range tests {
+		if err := validateSnapshotTags([]string{"keep-monthly", tt.tag}); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("validateSnapshotTags(%q) error = %v, want %q", tt.tag, err, tt.wantErr)
+		}
+	}
+
+	opt := newTestBackupOptions()
+	opt.snapshotTags = []string{"keep,monthly"}
+	if err := opt.validateDumpOptions(); err == nil {
+		t.Errorf("validateDumpOptions() accepted the snapshot tag %q", opt.snapshotTags[0])
+	}
+}
+
+func TestSnapshotTagArgs(t *testing.T) {
+	opt := newTestBackupOptions()
+	if got, want := opt.snapshotTagArgs(), []string{"--tag", DumpModeTagPrefix + DumpModeFull}; !reflect.DeepEqual(got, want) {
+		t.Errorf("snapshotTagArgs() = %q, want %q", got, want)
+	}
+	opt.snapshotTags = []string{"keep-monthly", "team=billing"}
+	opt.perDatabaseBackup = true
+	want := []string{"--tag", "keep-monthly", "--tag", "team=billing", "--tag", DumpModeTagPrefix + DumpModePerDatabase}
+	if got := opt.snapshotTagArgs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("snapshotTagArgs() = %q, want %q", got, want)
+	}
+}
+
+func TestDatabasesTagsCountTheDatabases(t *testing.T) {
+	tags := databasesTags([]string{"shop", "crm", "hr"})
+	if !containsString(tags, DatabaseCountTagPrefix+"3") {
+		t.Errorf("databasesTags() = %q, want %s3", tags, DatabaseCountTagPrefix)
+	}
+	// the databases left out of a long databases tag are still counted
+	var databases []string
+	for i := 0; i < 200; i++ {
+		databases = append(databases, fmt.Sprintf("database_with_a_long_name_%03d", i))
+	}
+	tags = databasesTags(databases)
+	omitted := false
+	for _, tag := range tags {
+		omitted = omitted || strings.HasPrefix(tag, DatabasesOmittedTagPrefix)
+	}
+	if !containsString(tags, DatabaseCountTagPrefix+"200") || !omitted {
+		t.Errorf("databasesTags() = %q, want %s200 and the omitted databases", tags, DatabaseCountTagPrefix)
+	}
+}
+
+func TestSnapshotsAreTaggedWithTheCustomAndDerivedTags(t *testing.T) {
+	version, err := parseServerVersion("10.11.6-MariaDB-1:10.11.6+maria~ubu2204-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("full", func(t *testing.T) {
+		opt := newTestBackupOptions()
+		opt.snapshotTags = []string{"keep-monthly", "team=billing"}
+		session := newFakeSession(t, opt, MariaDBDumpCMD)
+		resticWrapper, repository := newFakeRestic(t, opt, session)
+		dumpdir := t.TempDir()
+		for _, db := range []string{"shop", "crm"} {
+			if err := os.WriteFile(opt.databaseDumpFile(dumpdir, db), sampleDump(10), 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// the tags of the snapshot, as set by backupMariaDB
+		args := append(serverVersionTag(version), opt.snapshotTagArgs()...)
+		args = append(args, databasesTags([]string{"shop", "crm"})...)
+		backupOptions := restic.BackupOptions{Host: restic.DefaultHost, BackupPaths: []string{dumpdir}, Args: args}
+		if _, err := opt.runBackupWithRetry(context.Background(), resticWrapper, backupOptions, api_v1beta1.TargetRef{}); err != nil {
+			t.Fatal(err)
+		}
+		snapshots := fakeSnapshots(t, repository)
+		if len(snapshots) != 1 {
+			t.Fatalf("the backup took %d snapshots, want 1", len(snapshots))
+		}
+		for _, tag := range []string{"keep-monthly", "team=billing", DumpModeTagPrefix + DumpModeFull, DatabaseCountTagPrefix + "2", ServerVersionTagPrefix + version.raw} {
+			if !containsString(snapshots[0].Tags, tag) {
+				t.Errorf("the snapshot is tagged %q, want %s", snapshots[0].Tags, tag)
+			}
+		}
+	})
+
+	t.Run("per database", func(t *testing.T) {
+		opt := newTestBackupOptions()
+		opt.perDatabaseBackup = true
+		opt.snapshotTags = []string{"keep-monthly"}
+		session := newFakeSession(t, opt, fakeCommand(t, `eval query=\${$#}
+case "$query" in
+"SHOW DATABASES;") printf 'shop\ncrm\n' ;;
+*"information_schema.TABLES"*) for db in shop crm; do case "$query" in *"'$db'"*) printf '%s\t2\n' $db ;; esac; done ;;
+*) exit 1 ;;
+esac`))
+		resticWrapper, repository := newFakeRestic(t, opt, session)
+		opt.backupOptions.Args = append(serverVersionTag(version), opt.snapshotTagArgs()...)
+
+		if _, err := opt.backupPerDatabase(context.Background(), session, resticWrapper, api_v1beta1.TargetRef{}, perDatabaseResults(t, []string{"shop", "crm"}, nil)); err != nil {
+			t.Fatal(err)
+		}
+		snapshots := fakeSnapshots(t, repository)
+		if len(snapshots) != 2 {
+			t.Fatalf("the backup took %d snapshots, want one per database", len(snapshots))
+		}
+		for _, snapshot := range snapshots {
+			for _, tag := range []string{"keep-monthly", DumpModeTagPrefix + DumpModePerDatabase, ServerVersionTagPrefix + version.raw} {
+				if !containsString(snapshot.Tags, tag) {
+					t.Errorf("the snapshot is tagged %q, want %s", snapshot.Tags, tag)
+				}
+			}
+		}
+	})
+}
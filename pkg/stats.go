@@ -0,0 +1,95 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	DumpStatsFileName = "dump-stats.json"
+	// dumpHeaderSize is the number of bytes of the dump kept in memory to parse the header comments
+	dumpHeaderSize = 64 * 1024
+)
+
+// DumpStats holds the statistics of the dumps taken during a backup
+type DumpStats struct {
+	BytesWritten  int64  `json:"bytesWritten"`
+	DatabaseCount int    `json:"databaseCount"`
+	Duration      string `json:"duration"`
+
+	elapsed time.Duration
+}
+
+// add records a successful dump of a database
+func (stats *DumpStats) add(bytes int64, elapsed time.Duration) {
+	stats.BytesWritten += bytes
+	stats.DatabaseCount++
+	stats.elapsed += elapsed
+	stats.Duration = stats.elapsed.String()
+}
+
+// snapshotTags returns the restic arguments to tag a snapshot with the statistics.
+// restic snapshots do not have a description, so the statistics are stored as tags.
+func (stats *DumpStats) snapshotTags() []string {
+	return []string{
+		"--tag", fmt.Sprintf("%s%d", DumpBytesTagPrefix, stats.BytesWritten),
+		"--tag", fmt.Sprintf("dump-databases=%d", stats.DatabaseCount),
+		"--tag", fmt.Sprintf("dump-duration=%s", stats.elapsed.Round(time.Second)),
+	}
+}
+
+func (stats *DumpStats) writeToFile(fileName string) error {
+	data, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fileName, data, 0o644)
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w     io.Writer
+	count int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.count += int64(n)
+	return n, err
+}
+
+// headerWriter keeps the first limit bytes written through it
+type headerWriter struct {
+	buf   bytes.Buffer
+	limit int
+}
+
+func (hw *headerWriter) Write(p []byte) (int, error) {
+	if remaining := hw.limit - hw.buf.Len(); remaining > 0 {
+		if len(p) < remaining {
+			remaining = len(p)
+		}
+		hw.buf.Write(p[:remaining])
+	}
+	return len(p), nil
+}
@@ -0,0 +1,143 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"stash.appscode.dev/apimachinery/pkg/restic"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"k8s.io/klog/v2"
+)
+
+const (
+	RunSummaryFileName = "run-summary.json"
+
+	OutcomeSucceeded = "succeeded"
+	OutcomeFailed    = "failed"
+)
+
+// the values of the flags whose name matches are never written into the summary
+var sensitiveFlagRegex = regexp.MustCompile(`(?i)password|secret|token|credential`)
+
+// RunSummary is the single structured record of a backup or restore, written whether it succeeded or not
+type RunSummary struct {
+	Operation string            `json:"operation"`
+	Outcome   string            `json:"outcome"`
+	Error     string            `json:"error,omitempty"`
+	Databases []string          `json:"databases,omitempty"`
+	Flags     map[string]string `json:"flags,omitempty"`
+	StartTime time.Time         `json:"startTime"`
+	Duration  string            `json:"duration"`
+	Bytes     int64             `json:"bytes"`
+	// the rows of each database, approximate unless RowCountsPrecise
+	Rows             RowCounts `json:"rows,omitempty"`
+	TotalRows        int64     `json:"totalRows,omitempty"`
+	RowCountsPrecise bool      `json:"rowCountsPrecise,omitempty"`
+	Snapshots        []string  `json:"snapshots,omitempty"`
+}
+
+func newRunSummary(operation string, cmd *cobra.Command) *RunSummary {
+	return &RunSummary{
+		Operation: operation,
+		Flags:     summaryFlags(cmd.Flags()),
+		StartTime: time.Now(),
+	}
+}
+
+// summaryFlags returns the flags set on the command line, with the secrets redacted
+func summaryFlags(flags *pflag.FlagSet) map[string]string {
+	values := map[string]string{}
+	flags.Visit(func(f *pflag.Flag) {
+		value := f.Value.String()
+		switch {
+		case sensitiveFlagRegex.MatchString(f.Name):
+			value = "****"
+		case f.Name == "mariadb-args":
+			var args []interface{}
+			for _, arg := range strings.Fields(value) {
+				args = append(args, arg)
+			}
+			value = strings.TrimSpace(fmt.Sprintln(sanitizeArgs(args)...))
+		case f.Name == "extra-env":
+			// the environment of the clients may hold secrets, only the names are kept
+			env, _ := flags.GetStringToString(f.Name)
+			names := make([]string, 0, len(env))
+			for name := range env {
+				names = append(names, name+"=****")
+			}
+			sort.Strings(names)
+			value = "[" + strings.Join(names, ",") + "]"
+		}
+		values[f.Name] = value
+	})
+	return values
+}
+
+// backupSnapshots returns the names of the snapshots taken by a backup
+func backupSnapshots(backupOutput *restic.BackupOutput) []string {
+	if backupOutput == nil {
+		return nil
+	}
+	var snapshots []string
+	for _, stats := range backupOutput.BackupTargetStatus.Stats {
+		for _, snapshot := range stats.Snapshots {
+			snapshots = append(snapshots, snapshot.Name)
+		}
+	}
+	return snapshots
+}
+
+// writeRunSummary completes the summary with the outcome of the operation and writes it into the output
+// directory and, if requested, to stdout. A failure to write it is only logged, it must not hide the outcome.
+func (opt *mariadbOptions) writeRunSummary(summary *RunSummary, err error) {
+	if opt.dryRun || (opt.outputDir == "" && !opt.summaryStdout) {
+		return
+	}
+	summary.Outcome = OutcomeSucceeded
+	if err != nil {
+		summary.Outcome = OutcomeFailed
+		summary.Error = err.Error()
+	}
+	summary.Duration = time.Since(summary.StartTime).Round(time.Millisecond).String()
+	if summary.Databases == nil {
+		summary.Databases = opt.runDatabases
+	}
+
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		klog.Errorf("Failed to encode the run summary. Reason: %v", err)
+		return
+	}
+	if opt.outputDir != "" {
+		if err = os.WriteFile(filepath.Join(opt.outputDir, RunSummaryFileName), data, 0o644); err != nil {
+			klog.Errorf("Failed to write the run summary. Reason: %v", err)
+		}
+	}
+	if opt.summaryStdout {
+		fmt.Println(string(data))
+	}
+}
@@ -0,0 +1,171 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	api_v1beta1 "stash.appscode.dev/apimachinery/apis/stash/v1beta1"
+	"stash.appscode.dev/apimachinery/pkg/restic"
+)
+
+// readRunSummary reads the run summary written into dir
+func readRunSummary(t *testing.T, dir string) RunSummary {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, RunSummaryFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summary RunSummary
+	if err = json.Unmarshal(data, &summary); err != nil {
+		t.Fatal(err)
+	}
+	return summary
+}
+
+func TestSummaryFlags(t *testing.T) {
+	cmd := NewCmdBackup()
+	if err := cmd.Flags().Parse([]string{
+		"--appbinding=demo",
+		"--mariadb-args=--all-databases --password=s3cret -ps3cret",
+		"--socks5-password=s3cret",
+		"--extra-env=LC_ALL=C.UTF-8,API_TOKEN=s3cret",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"appbinding":      "demo",
+		"mariadb-args":    "--all-databases --password=**** -p****",
+		"socks5-password": "****",
+		"extra-env":       "[API_TOKEN=****,LC_ALL=****]",
+	}
+	got := summaryFlags(cmd.Flags())
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("summaryFlags() = %v, want %v", got, want)
+	}
+	for name, value := range got {
+		if strings.Contains(value, "s3cret") {
+			t.Errorf("the summary of --%s holds the secret: %s", name, value)
+		}
+	}
+}
+
+func TestWriteRunSummary(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         error
+		wantOutcome string
+	}{
+		{name: "success", wantOutcome: OutcomeSucceeded},
+		{name: "failure", err: errors.New("failed to dump database shop"), wantOutcome: OutcomeFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := newTestBackupOptions()
+			opt.outputDir = t.TempDir()
+			opt.runDatabases = []string{"shop", "crm"}
+			summary := &RunSummary{Operation: OperationBackup, StartTime: time.Now().Add(-time.Second), Bytes: 1024, Snapshots: []string{"demo-1a2b3c"}}
+
+			opt.writeRunSummary(summary, tt.err)
+			got := readRunSummary(t, opt.outputDir)
+			if got.Operation != OperationBackup || got.Outcome != tt.wantOutcome || got.Bytes != 1024 ||
+				!reflect.DeepEqual(got.Databases, opt.runDatabases) || !reflect.DeepEqual(got.Snapshots, summary.Snapshots) {
+				t.Errorf("the summary is %+v", got)
+			}
+			if tt.err != nil && got.Error != tt.err.Error() || tt.err == nil && got.Error != "" {
+				t.Errorf("the summary reports the error %q, want %v", got.Error, tt.err)
+			}
+			if d, err := time.ParseDuration(got.Duration); err != nil || d < time.Second {
+				t.Errorf("the summary reports the duration %q", got.Duration)
+			}
+		})
+	}
+}
+
+func TestWriteRunSummaryToStdout(t *testing.T) {
+	opt := newTestBackupOptions()
+	opt.summaryStdout = true
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+	opt.writeRunSummary(&RunSummary{Operation: OperationRestore, StartTime: time.Now()}, nil)
+	os.Stdout = stdout
+	_ = w.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summary RunSummary
+	if err = json.Unmarshal(data, &summary); err != nil || summary.Operation != OperationRestore || summary.Outcome != OutcomeSucceeded {
+		t.Errorf("the summary printed is %q, %v", data, err)
+	}
+
+	// a dry run has nothing to report
+	opt.summaryStdout = false
+	opt.outputDir = t.TempDir()
+	opt.dryRun = true
+	opt.writeRunSummary(&RunSummary{Operation: OperationBackup, StartTime: time.Now()}, nil)
+	if _, err := os.Stat(filepath.Join(opt.outputDir, RunSummaryFileName)); !os.IsNotExist(err) {
+		t.Errorf("a dry run wrote a summary")
+	}
+}
+
+func TestRunSummaryIsWrittenOnFailure(t *testing.T) {
+	outputDir := t.TempDir()
+	cmd := NewCmdBackup()
+	cmd.SetArgs([]string{
+		"--appbinding=demo", "--provider=local", "--storage-secret-name=repo", "--storage-secret-namespace=demo",
+		"--kubeconfig=" + filepath.Join(t.TempDir(), "missing"), "--output-dir=" + outputDir,
+	})
+	cmd.SetOut(io.Discard)
+	cmd.SetErr(io.Discard)
+	if err := cmd.Execute(); err == nil {
+		t.Fatal("the backup succeeded without a kubeconfig")
+	}
+
+	summary := readRunSummary(t, outputDir)
+	if summary.Operation != OperationBackup || summary.Outcome != OutcomeFailed || !strings.Contains(summary.Error, "missing") {
+		t.Errorf("the summary of the failed backup is %+v", summary)
+	}
+	if summary.Flags["appbinding"] != "demo" {
+		t.Errorf("the summary reports the flags %v", summary.Flags)
+	}
+}
+
+func TestBackupSnapshots(t *testing.T) {
+	output := &restic.BackupOutput{BackupTargetStatus: api_v1beta1.BackupTargetStatus{Stats: []api_v1beta1.HostBackupStats{
+		{Snapshots: []api_v1beta1.SnapshotStats{{Name: "demo-1a2b3c"}, {Name: "demo-4d5e6f"}}},
+	}}}
+	if got, want := backupSnapshots(output), []string{"demo-1a2b3c", "demo-4d5e6f"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("backupSnapshots() = %v, want %v", got, want)
+	}
+	if got := backupSnapshots(nil); got != nil {
+		t.Errorf("backupSnapshots(nil) = %v", got)
+	}
+}
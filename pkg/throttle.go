@@ -0,0 +1,122 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/time/rate"
+	"stash.appscode.dev/apimachinery/pkg/restic"
+)
+
+const (
+	ThrottleCMD = "throttle"
+
+	// maxThrottleBurst bounds the bytes written at once by a throttled writer, so that the rate is smooth
+	maxThrottleBurst = 64 << 10
+)
+
+// validateDumpRate checks the maximum rate of the dump, 0 leaves it unlimited
+func validateDumpRate(maxRate string) error {
+	if _, err := parseBytes(maxRate); err != nil {
+		return fmt.Errorf("invalid maximum dump rate: %w", err)
+	}
+	return nil
+}
+
+// newDumpLimiter returns the token bucket shared by the dumps of a backup, so that parallel dumps
+// do not exceed the rate together, or nil if the rate is not limited
+func newDumpLimiter(maxRate string) (*rate.Limiter, error) {
+	bytesPerSecond, err := parseBytes(maxRate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid maximum dump rate: %w", err)
+	}
+	if bytesPerSecond == 0 {
+		return nil, nil
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), int(min(bytesPerSecond, maxThrottleBurst))), nil
+}
+
+// throttledWriter writes into w no faster than its limiter allows
+type throttledWriter struct {
+	w       io.Writer
+	limiter *rate.Limiter
+}
+
+// throttle returns a writer writing into w at the rate of limiter, w itself when limiter is nil
+func throttle(w io.Writer, limiter *rate.Limiter) io.Writer {
+	if limiter == nil {
+		return w
+	}
+	return &throttledWriter{w: w, limiter: limiter}
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		chunk := min(len(p)-written, tw.limiter.Burst())
+		if err := tw.limiter.WaitN(context.Background(), chunk); err != nil {
+			return written, err
+		}
+		n, err := tw.w.Write(p[written : written+chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// NewCmdThrottle returns the hidden command copying stdin into stdout at a limited rate.
+// It is inserted by the streaming backup into the pipeline right after mariadb-dump.
+func NewCmdThrottle() *cobra.Command {
+	var maxRate string
+	cmd := &cobra.Command{
+		Use:               ThrottleCMD,
+		Short:             "Copies stdin into stdout at a limited rate",
+		Hidden:            true,
+		DisableAutoGenTag: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			limiter, err := newDumpLimiter(maxRate)
+			if err != nil {
+				return err
+			}
+			out := bufio.NewWriter(os.Stdout)
+			if _, err = io.Copy(throttle(out, limiter), os.Stdin); err != nil {
+				return err
+			}
+			return out.Flush()
+		},
+	}
+	cmd.Flags().StringVar(&maxRate, "rate", "0", "Maximum number of bytes per second, with a K, M or G suffix (0 does not limit the rate)")
+	return cmd
+}
+
+// throttleCommand returns the command limiting the rate of the dump stream to bytesPerSecond
+func throttleCommand(bytesPerSecond int64) (*restic.Command, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate the plugin binary to throttle the dump: %w", err)
+	}
+	return &restic.Command{Name: self, Args: []interface{}{ThrottleCMD, "--rate", strconv.FormatInt(bytesPerSecond, 10)}}, nil
+}
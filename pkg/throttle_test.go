@@ -0,0 +1,173 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestValidateDumpRate(t *testing.T) {
+	for _, maxRate := range []string{"0", "1048576", "512k", "50M", "1G"} {
+		if err := validateDumpRate(maxRate); err != nil {
+			t.Errorf("validateDumpRate(%q) error = %v", maxRate, err)
+		}
+	}
+	for _, maxRate := range []string{"", "-1", "fast", "10T", "1.5M"} {
+		if err := validateDumpRate(maxRate); err == nil {
+			t.Errorf("validateDumpRate(%q) accepted the invalid rate", maxRate)
+		}
+	}
+	opt := newTestBackupOptions()
+	opt.maxDumpRate = "50 MB/s"
+	if err := opt.validateDumpOptions(); err == nil {
+		t.Errorf("validateDumpOptions() accepted the maximum dump rate %q", opt.maxDumpRate)
+	}
+}
+
+func TestNewDumpLimiter(t *testing.T) {
+	limiter, err := newDumpLimiter("0")
+	if err != nil || limiter != nil {
+		t.Errorf("newDumpLimiter(0) = %v, %v, want the rate not to be limited", limiter, err)
+	}
+	tests := []struct {
+		maxRate   string
+		wantLimit float64
+		wantBurst int
+	}{
+		{maxRate: "50M", wantLimit: 50 << 20, wantBurst: maxThrottleBurst},
+		{maxRate: "1K", wantLimit: 1 << 10, wantBurst: 1 << 10},
+	}
+	for _, tt := range tests {
+		limiter, err := newDumpLimiter(tt.maxRate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if float64(limiter.Limit()) != tt.wantLimit || limiter.Burst() != tt.wantBurst {
+			t.Errorf("newDumpLimiter(%s) limits to %v bytes per second with bursts of %d, want %v and %d", tt.maxRate, limiter.Limit(), limiter.Burst(), tt.wantLimit, tt.wantBurst)
+		}
+	}
+}
+
+// checkThrottledDuration fails the test unless writes of a burst and 512K more, at 512K per second, took about a second
+func checkThrottledDuration(t *testing.T, elapsed time.Duration) {
+	t.Helper()
+	if elapsed < 900*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("the throttled writes took %v, want about 1s", elapsed)
+	}
+}
+
+func TestThrottledWriterCapsTheThroughput(t *testing.T) {
+	limiter, err := newDumpLimiter("512K")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first burst is written at once, the rest at 512K per second
+	data := bytes.Repeat([]byte("INSERT INTO orders VALUES (1);\n"), (maxThrottleBurst+512<<10)/31+1)
+	var out bytes.Buffer
+
+	startTime := time.Now()
+	n, err := throttle(&out, limiter).Write(data)
+	if err != nil || n != len(data) {
+		t.Fatalf("Write() = %d, %v, want %d bytes written", n, err, len(data))
+	}
+	checkThrottledDuration(t, time.Since(startTime))
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Errorf("the throttled writer altered the data")
+	}
+
+	var unlimited bytes.Buffer
+	if w := throttle(&unlimited, nil); w != &unlimited {
+		t.Errorf("throttle() wrapped the writer without a limiter")
+	}
+}
+
+func TestThrottledWritersShareTheRate(t *testing.T) {
+	limiter, err := newDumpLimiter("512K")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the parallel dumps write together as much as a single one
+	data := make([]byte, (maxThrottleBurst+512<<10)/2)
+	startTime := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var out bytes.Buffer
+			if _, err := throttle(&out, limiter).Write(data); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	checkThrottledDuration(t, time.Since(startTime))
+}
+
+func TestThrottledDump(t *testing.T) {
+	opt := newTestBackupOptions()
+	var err error
+	opt.dumpLimiter, err = newDumpLimiter("512K")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dump := sampleDump((maxThrottleBurst + 512<<10) / 60)
+	source := filepath.Join(t.TempDir(), "dump.sql")
+	if err := os.WriteFile(source, dump, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	session := newFakeSession(t, opt, fakeCommand(t, `cat "`+source+`"`))
+	dumpfile := filepath.Join(t.TempDir(), "shop.sql")
+
+	startTime := time.Now()
+	if _, err := opt.dumpDatabase(session, "shop", dumpfile); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(startTime); elapsed < 900*time.Millisecond {
+		t.Errorf("the dump of %d bytes took %v, want it throttled to 512K per second", len(dump), elapsed)
+	}
+	data, err := os.ReadFile(dumpfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, dump) {
+		t.Errorf("the throttled dump holds %d bytes, want the %d bytes of the dump", len(data), len(dump))
+	}
+}
+
+func TestThrottleCommand(t *testing.T) {
+	throttler, err := throttleCommand(50 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if throttler.Name != self || !reflect.DeepEqual(throttler.Args, []interface{}{ThrottleCMD, "--rate", "52428800"}) {
+		t.Errorf("throttleCommand() = %s %v, want the plugin throttling to 52428800 bytes per second", throttler.Name, throttler.Args)
+	}
+	if cmd, _, err := NewRootCmd().Find([]string{ThrottleCMD}); err != nil || cmd.Name() != ThrottleCMD || !cmd.Hidden {
+		t.Errorf("the root command has no hidden %s command", ThrottleCMD)
+	}
+}
@@ -0,0 +1,146 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	DefaultTerminationGracePeriod = 10 * time.Second
+)
+
+// ErrOperationTimeout is returned when a backup or a restore does not complete within the operation timeout
+var ErrOperationTimeout = errors.New("operation timed out")
+
+// childProcesses returns the processes started by the plugin. They are read from /proc rather than from the
+// shell sessions running them, whose commands can not be inspected while the sessions start them.
+func childProcesses() ([]int, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	self := os.Getpid()
+	var pids []int
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		// the process may have exited since the directory was read
+		stat, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		if ppid, ok := parentPID(stat); ok && ppid == self {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// parentPID returns the parent process id of a /proc/<pid>/stat line. The command name before it is
+// enclosed in parentheses and may contain spaces and parentheses, so the fields after the last one are read.
+func parentPID(stat []byte) (int, bool) {
+	i := bytes.LastIndexByte(stat, ')')
+	if i < 0 {
+		return 0, false
+	}
+	// the state of the process, then its parent
+	fields := strings.Fields(string(stat[i+1:]))
+	if len(fields) < 2 {
+		return 0, false
+	}
+	ppid, err := strconv.Atoi(fields[1])
+	return ppid, err == nil
+}
+
+// signalCommands sends sig to the running commands of the plugin. Signalling a command that has
+// already exited is harmless.
+func signalCommands(sig syscall.Signal) {
+	pids, err := childProcesses()
+	if err != nil {
+		klog.Errorf("Failed to list the running commands. Reason: %v", err)
+		return
+	}
+	for _, pid := range pids {
+		if err := syscall.Kill(pid, sig); err != nil && !errors.Is(err, syscall.ESRCH) {
+			klog.Warningf("Failed to signal process %d. Reason: %v", pid, err)
+		}
+	}
+}
+
+// startOperation bounds the operation with the operation timeout and aborts it on SIGTERM or SIGINT. When it
+// expires or is interrupted, the running commands receive SIGTERM, then SIGKILL if they are still running
+// after the termination grace period.
+func (opt *mariadbOptions) startOperation(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, stopNotify := notifyContext(ctx)
+	var cancel context.CancelFunc
+	if opt.operationTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, opt.operationTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		switch {
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			klog.Warningf("Operation did not complete within %v, terminating the running commands....", opt.operationTimeout)
+		case errors.Is(context.Cause(ctx), ErrInterrupted):
+			klog.Warningln("Operation interrupted, terminating the running commands....")
+		default:
+			return
+		}
+		signalCommands(syscall.SIGTERM)
+		select {
+		case <-done:
+		case <-time.After(opt.terminationGracePeriod):
+			klog.Warningf("Commands still running after %v, killing them....", opt.terminationGracePeriod)
+			signalCommands(syscall.SIGKILL)
+		}
+	}()
+	return ctx, func() {
+		close(done)
+		cancel()
+		stopNotify()
+	}
+}
+
+// operationError returns an ErrOperationTimeout error if the operation failed because ctx expired,
+// an ErrInterrupted error if it was aborted by a signal
+func (opt *mariadbOptions) operationError(ctx context.Context, err error) error {
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w after %v: %v", ErrOperationTimeout, opt.operationTimeout, err)
+	}
+	if cause := context.Cause(ctx); err != nil && errors.Is(cause, ErrInterrupted) {
+		return fmt.Errorf("%w: %v", cause, err)
+	}
+	return err
+}
@@ -0,0 +1,80 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParentPID(t *testing.T) {
+	tests := []struct {
+		stat string
+		want int
+		ok   bool
+	}{
+		{stat: "4242 (mariadb-dump) S 17 4242 17 0 -1 4194560 1234", want: 17, ok: true},
+		{stat: "4243 (evil) S 9 (name) R 17 4243 17 0", want: 17, ok: true},
+		{stat: "4244 (sh)", ok: false},
+		{stat: "garbage", ok: false},
+	}
+	for _, tt := range tests {
+		got, ok := parentPID([]byte(tt.stat))
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parentPID(%q) = %d, %t, want %d, %t", tt.stat, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestOperationTimeoutKillsTheCommands(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		// the command exits once it receives SIGTERM, otherwise once it receives SIGKILL after the grace period
+		ignoresSIGTERM bool
+	}{
+		{name: "terminated", script: "exec sleep 30"},
+		{name: "killed", script: "trap '' TERM\nexec sleep 30", ignoresSIGTERM: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := newTestBackupOptions()
+			opt.operationTimeout = 300 * time.Millisecond
+			opt.terminationGracePeriod = 500 * time.Millisecond
+			session := newFakeSession(t, opt, fakeCommand(t, tt.script))
+			ctx, cancel := opt.startOperation(context.Background())
+			defer cancel()
+
+			start := time.Now()
+			err := session.newShell().Command(session.cmd.Name).Run()
+			elapsed := time.Since(start)
+			err = opt.operationError(ctx, err)
+			if !errors.Is(err, ErrOperationTimeout) {
+				t.Errorf("operation error = %v, want %v", err, ErrOperationTimeout)
+			}
+			deadline := opt.operationTimeout
+			if tt.ignoresSIGTERM {
+				deadline += opt.terminationGracePeriod
+			}
+			if elapsed < deadline || elapsed > deadline+5*time.Second {
+				t.Errorf("the command ran for %v, want it to stop at %v", elapsed, deadline)
+			}
+		})
+	}
+}
@@ -18,18 +18,27 @@ package pkg
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math"
+	"net"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	stash "stash.appscode.dev/apimachinery/client/clientset/versioned"
 	"stash.appscode.dev/apimachinery/pkg/restic"
 
+	"github.com/armon/circbuf"
+	"golang.org/x/time/rate"
 	shell "gomodules.xyz/go-sh"
+	core "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 	restclient "k8s.io/client-go/rest"
 	"k8s.io/klog/v2"
@@ -39,70 +48,569 @@ import (
 )
 
 const (
-	MariaDBUser        = "username"
-	MariaDBPassword    = "password"
-	MariaDBDumpFile    = "dumpfile.sql"
-	MariaDBDumpCMD     = "mariadb-dump"
-	MariaDBRestoreCMD  = "mariadb"
-	EnvMariaDBPassword = "MYSQL_PWD"
+	MariaDBUser          = "username"
+	MariaDBPassword      = "password"
+	MariaDBDumpFile      = "dumpfile.sql"
+	MariaDBDumpCMD       = "mariadb-dump"
+	MariaDBRestoreCMD    = "mariadb"
+	DefaultCharset       = "utf8mb4"
+	EnvMariaDBPassword   = "MYSQL_PWD"
+	MariaDBDefaultsFile  = "client-defaults.cnf"
+	UnixSocketScheme     = "unix://"
+	MariaDBTLSClientCert = "client.crt"
+	MariaDBTLSClientKey  = "client.key"
+	MariaDBDumpDir       = "dumpsql"
+	EnvMariaDBLoginFile  = "MYSQL_TEST_LOGIN_FILE"
+	DatabaseTagPrefix    = "database="
+	HostTagPrefix        = "host="
+	MariaDBDefaultPort   = 3306
+	// DumpArgsAnnotation holds the mariadb-dump arguments recommended for the database of an AppBinding
+	DumpArgsAnnotation = "mariadb.backup/dump-args"
+	// ResticCacheDirName is the cache directory the restic wrapper passes to restic, under the scratch directory
+	ResticCacheDirName = "restic-cache"
 )
 
+const (
+	NoTablespacesAuto = "auto"
+	NoTablespacesOn   = "on"
+	NoTablespacesOff  = "off"
+)
+
+const (
+	HexBlobAuto = "auto"
+	HexBlobOn   = "on"
+	HexBlobOff  = "off"
+)
+
+// binaryDataTypes are the column types mariadb-dump writes in hexadecimal with --hex-blob
+var binaryDataTypes = []string{"binary", "varbinary", "tinyblob", "blob", "mediumblob", "longblob", "bit"}
+
+const (
+	// DefaultMaxAllowedPacket is larger than the 16M of the client, too small for the rows of large BLOBs
+	DefaultMaxAllowedPacket = "64M"
+	// bounds of max_allowed_packet accepted by the server
+	minPacketSize = 1 << 10
+	maxPacketSize = 1 << 30
+)
+
+// DefaultReadinessPollInterval is the interval between two readiness probes of the database
+const DefaultReadinessPollInterval = 5 * time.Second
+
+// DefaultSystemSchemas are the schemas that are never dumped as user databases
+var DefaultSystemSchemas = []string{"information_schema", "mysql", "performance_schema", "sys"}
+
 type mariadbOptions struct {
 	kubeClient    kubernetes.Interface
 	stashClient   stash.Interface
 	catalogClient appcatalog_cs.Interface
 
-	namespace           string
-	backupSessionName   string
-	appBindingName      string
-	appBindingNamespace string
-	myArgs              string
-	waitTimeout         int32
-	outputDir           string
-	storageSecret       kmapi.ObjectReference
+	namespace                 string
+	backupSessionName         string
+	appBindingName            string
+	appBindingNamespace       string
+	myArgs                    string
+	waitTimeout               int32
+	outputDir                 string
+	storageSecret             kmapi.ObjectReference
+	systemSchemas             []string
+	perDatabaseBackup         bool
+	database                  string
+	consistentSnapshot        bool
+	includeRoutines           bool
+	includeTriggers           bool
+	includeEvents             bool
+	recordBinlogPosition      bool
+	gtidEnabled               bool
+	binlogPositions           map[string]BinlogPosition
+	dumpChecksums             DumpChecksums
+	excludeDatabases          []string
+	includeDatabases          []string
+	readinessPollInterval     time.Duration
+	dumpStats                 DumpStats
+	compression               string
+	connectTimeout            time.Duration
+	maxBackupRetries          int
+	backupRetryBackoff        time.Duration
+	maxUploadRetries          int
+	uploadRetryBackoff        time.Duration
+	parallelism               int
+	streamBackup              bool
+	tableSelection            []string
+	tables                    map[string][]string
+	cleanBeforeRestore        bool
+	continueOnError           bool
+	verifyAfterRestore        bool
+	strictVersionCheck        bool
+	setGTIDPosition           string
+	dryRun                    bool
+	dumpCmd                   string
+	clientCmd                 string
+	operationTimeout          time.Duration
+	terminationGracePeriod    time.Duration
+	metricsAddr               string
+	pushgatewayURL            string
+	metrics                   *metricsRecorder
+	disableColumnStatistics   bool
+	defaultCharset            string
+	dumpGrants                bool
+	restoreGrants             bool
+	maxAllowedPacket          string
+	maxAllowedPacketBytes     int64
+	noTablespaces             string
+	skipTablespaces           bool
+	compressionLevel          int
+	readinessBackoffFactor    float64
+	maxReadinessPollInterval  time.Duration
+	sinks                     []string
+	objectStorage             objectStorageOptions
+	skipEmptyDatabases        bool
+	emptyDatabases            databaseNames
+	whereClause               string
+	ignoreTables              []string
+	allowReadOnlySource       bool
+	abortOnFirstFailure       bool
+	proxy                     proxyOptions
+	dumpLockWaitTimeout       time.Duration
+	serverVariables           []string
+	checkSQLMode              bool
+	createDatabases           bool
+	databaseCharset           string
+	databaseCollation         string
+	extraEnv                  map[string]string
+	verifyDump                bool
+	hexBlob                   string
+	useHexBlob                bool
+	verifyChecksum            bool
+	incremental               bool
+	tableUpdateTimes          *TableUpdateTimesRecord
+	backupType                string
+	skipReadinessCheck        bool
+	summaryStdout             bool
+	runDatabases              []string
+	orderByPrimary            bool
+	orderByPrimaryDatabases   []string
+	skipDumpDate              bool
+	restoreSQLMode            string
+	databases                 []string
+	skipForeignKeyChecks      bool
+	dumpNetReadTimeout        int
+	dumpNetWriteTimeout       int
+	resticCacheDir            string
+	preciseRowCounts          bool
+	rowCountsByDatabase       RowCounts
+	fifoPath                  string
+	maxConnectionErrorRetries int
+	replicaBackup             bool
+	maxReplicaLag             time.Duration
+	snapshotTags              []string
+	preBackupHook             string
+	postBackupHook            string
+	snapshotReadyHook         string
+	readLockTimeout           time.Duration
+	maxDumpRate               string
+	dumpLimiter               *rate.Limiter
+	fastLoad                  bool
+
+	setupOptions      restic.SetupOptions
+	backupOptions     restic.BackupOptions
+	dumpOptions       restic.DumpOptions
+	tlsOptions        tlsOptions
+	credentialOptions credentialOptions
+	sqlFilterOptions  sqlFilterOptions
+	config            *restclient.Config
+
+	// protects the results shared by concurrent dumps
+	mu sync.Mutex
+}
 
-	setupOptions  restic.SetupOptions
-	backupOptions restic.BackupOptions
-	dumpOptions   restic.DumpOptions
-	config        *restclient.Config
+type credentialOptions struct {
+	userKey         string
+	passwordKey     string
+	useDefaultsFile bool
+	// authMode selects between the password of the AppBinding secret and an AWS IAM authentication token
+	authMode    string
+	awsRegion   string
+	awsEndpoint string
+	// credentialsDir is a directory of mounted credential files, named after the keys, read instead of the AppBinding secret
+	credentialsDir string
+}
+
+// SupportedTLSVersions are the TLS protocol versions accepted by the MariaDB client, in ascending order
+var SupportedTLSVersions = []string{"TLSv1.0", "TLSv1.1", "TLSv1.2", "TLSv1.3"}
+
+// reservedEnv are the environment variables of the sessions carrying credentials, they can not be set with --extra-env
+var reservedEnv = []string{EnvMariaDBPassword, EnvMariaDBLoginFile}
+
+func isReservedEnv(key string) bool {
+	for _, reserved := range reservedEnv {
+		if strings.EqualFold(key, reserved) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateScratchDir creates the scratch directory if missing and checks that files can be written into it
+func validateScratchDir(dir string) error {
+	if dir == "" {
+		return fmt.Errorf("the scratch directory must be set")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create scratch directory %s, set --scratch-dir to a writable directory: %w", dir, err)
+	}
+	if err := checkWritable(dir); err != nil {
+		return fmt.Errorf("scratch directory %s is not writable, set --scratch-dir to a writable directory (i.e. an emptyDir volume on a read-only root filesystem): %w", dir, err)
+	}
+	return nil
+}
+
+// checkWritable checks that files can be written into dir
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".write-check-")
+	if err != nil {
+		return err
+	}
+	_ = f.Close()
+	return os.Remove(f.Name())
+}
+
+// setupResticCache makes restic keep its cache in the cache directory of the options, instead of the scratch directory.
+// The restic wrapper always passes --cache-dir=<scratch dir>/restic-cache, which is made a link to the cache directory.
+func (opt *mariadbOptions) setupResticCache() error {
+	if opt.resticCacheDir == "" {
+		return nil
+	}
+	if !opt.setupOptions.EnableCache {
+		return fmt.Errorf("the restic cache directory is set but the cache is disabled, set --enable-cache to use it")
+	}
+	dir, err := filepath.Abs(opt.resticCacheDir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create restic cache directory %s: %w", dir, err)
+	}
+	if err := checkWritable(dir); err != nil {
+		return fmt.Errorf("restic cache directory %s is not writable: %w", dir, err)
+	}
+
+	link := filepath.Join(opt.setupOptions.ScratchDir, ResticCacheDirName)
+	if target, err := os.Readlink(link); err == nil && target == dir {
+		return nil
+	}
+	// the cache left in the scratch directory by an earlier run is only a cache, it is replaced
+	if err := os.RemoveAll(link); err != nil {
+		return fmt.Errorf("failed to replace the restic cache of the scratch directory: %w", err)
+	}
+	if err := os.Symlink(dir, link); err != nil {
+		return fmt.Errorf("failed to link the restic cache directory %s: %w", dir, err)
+	}
+	klog.Infof("Using restic cache directory %s", dir)
+	return nil
+}
+
+// validateConnectionOptions checks the options shared by the backup and restore sessions
+func (opt *mariadbOptions) validateConnectionOptions() error {
+	// the dumps, the TLS files and the defaults files of the sessions are all written into the scratch directory
+	if err := validateScratchDir(opt.setupOptions.ScratchDir); err != nil {
+		return err
+	}
+	if opt.connectTimeout < 0 {
+		return fmt.Errorf("connect timeout must not be negative, got %v", opt.connectTimeout)
+	}
+	if opt.operationTimeout < 0 {
+		return fmt.Errorf("operation timeout must not be negative, got %v", opt.operationTimeout)
+	}
+	if opt.terminationGracePeriod < 0 {
+		return fmt.Errorf("termination grace period must not be negative, got %v", opt.terminationGracePeriod)
+	}
+	if opt.maxAllowedPacket != "" {
+		size, err := parseBytes(opt.maxAllowedPacket)
+		if err != nil {
+			return fmt.Errorf("invalid max allowed packet: %w", err)
+		}
+		if size < minPacketSize || size > maxPacketSize {
+			return fmt.Errorf("max allowed packet must be between %s and %s, got %s", formatBytes(minPacketSize), formatBytes(maxPacketSize), opt.maxAllowedPacket)
+		}
+		opt.maxAllowedPacketBytes = size
+	}
+	if err := opt.proxy.validate(); err != nil {
+		return err
+	}
+	for key := range opt.extraEnv {
+		if key == "" || strings.Contains(key, "=") {
+			return fmt.Errorf("invalid environment variable name %q", key)
+		}
+		if isReservedEnv(key) {
+			return fmt.Errorf("environment variable %s carries credentials and can not be set", key)
+		}
+	}
+	switch opt.credentialOptions.authMode {
+	case AuthModePassword, AuthModeAWSIAM:
+	default:
+		return fmt.Errorf("invalid auth mode %q, must be %s or %s", opt.credentialOptions.authMode, AuthModePassword, AuthModeAWSIAM)
+	}
+	if opt.readinessPollInterval <= 0 {
+		return fmt.Errorf("readiness poll interval must be positive, got %v", opt.readinessPollInterval)
+	}
+	if opt.readinessBackoffFactor < 1 {
+		return fmt.Errorf("readiness backoff factor must be at least 1, got %v", opt.readinessBackoffFactor)
+	}
+	if opt.maxReadinessPollInterval != 0 && opt.maxReadinessPollInterval < opt.readinessPollInterval {
+		return fmt.Errorf("max readiness poll interval %v must not be smaller than the readiness poll interval %v", opt.maxReadinessPollInterval, opt.readinessPollInterval)
+	}
+	if opt.readinessPollInterval > time.Duration(opt.waitTimeout)*time.Second {
+		return fmt.Errorf("readiness poll interval %v must not be larger than the wait timeout %ds", opt.readinessPollInterval, opt.waitTimeout)
+	}
+	return nil
+}
+
+type tlsOptions struct {
+	verifyServerCert bool
+	minVersion       string
 }
 
 type sessionWrapper struct {
-	sh  *shell.Session
-	cmd *restic.Command
+	sh        *shell.Session
+	cmd       *restic.Command
+	tempFiles []string
+	socket    string
+	// client binary running the queries of the session
+	clientCmd string
+	// candidate hosts of the database, tried in order, and the index of the -h value in cmd.Args
+	hosts   []string
+	hostArg int
+	// private directory holding the credentials and TLS files of the session
+	dir string
+	// option file holding the password, when it is not passed through the environment
+	defaultsFile string
+	// renews the password of sessions authenticated with an IAM token
+	auth *iamAuth
+	// local forward to the database through a SOCKS5 proxy, when one is used
+	proxy *socksForward
 }
 
 func (opt *mariadbOptions) newSessionWrapper(cmd string) *sessionWrapper {
-	return &sessionWrapper{
+	session := &sessionWrapper{
 		sh: shell.NewSession(),
 		cmd: &restic.Command{
 			Name: cmd,
 		},
+		clientCmd: opt.clientCmd,
 	}
+	for key, value := range opt.extraEnv {
+		// the credentials are only ever set by the session itself
+		if isReservedEnv(key) {
+			continue
+		}
+		session.sh.SetEnv(key, value)
+	}
+	// the client only accepts whole seconds, so sub-second timeouts are rounded up
+	if opt.connectTimeout > 0 {
+		seconds := int64(math.Ceil(opt.connectTimeout.Seconds()))
+		session.cmd.Args = append(session.cmd.Args, fmt.Sprintf("--connect-timeout=%d", seconds))
+	}
+	if opt.defaultCharset != "" {
+		session.cmd.Args = append(session.cmd.Args, "--default-character-set="+opt.defaultCharset)
+	}
+	if opt.maxAllowedPacketBytes > 0 {
+		session.cmd.Args = append(session.cmd.Args, fmt.Sprintf("--max-allowed-packet=%d", opt.maxAllowedPacketBytes))
+	}
+	return session
 }
 
-func (session *sessionWrapper) setDatabaseCredentials(kubeClient kubernetes.Interface, appBinding *appcatalog.AppBinding) error {
-	appBindingSecret, err := kubeClient.CoreV1().Secrets(appBinding.Namespace).Get(context.TODO(), appBinding.Spec.Secret.Name, metav1.GetOptions{})
+// prepareSession builds a session for cmd with the credentials, connection and TLS parameters of the AppBinding.
+// The sensitive files of the session are written into its own directory under scratchDir.
+// The session must be cleaned up even on error.
+func (opt *mariadbOptions) prepareSession(appBinding *appcatalog.AppBinding, cmd, scratchDir string) (*sessionWrapper, error) {
+	session := opt.newSessionWrapper(cmd)
+
+	err := session.setDatabaseCredentials(opt.kubeClient, appBinding, scratchDir, opt.credentialOptions)
+	if err != nil {
+		return session, err
+	}
+
+	err = session.setDatabaseConnectionParameters(appBinding)
+	if err != nil {
+		return session, err
+	}
+
+	port, err := appBinding.Port()
+	if err != nil {
+		return session, err
+	}
+	err = session.setProxy(opt.proxy, port)
+	if err != nil {
+		return session, err
+	}
+
+	// the IAM token is signed for the host and port, so it can only be generated once they are known
+	if session.auth != nil {
+		session.auth.port = port
+		err = session.refreshCredentials()
+		if err != nil {
+			return session, err
+		}
+	}
+
+	err = session.setTLSParameters(opt.kubeClient, appBinding, scratchDir, opt.tlsOptions)
+	if err != nil {
+		return session, err
+	}
+	return session, nil
+}
+
+// secretTransformTypes returns the type of each secret transform of the AppBinding, in the order they are applied
+func secretTransformTypes(appBinding *appcatalog.AppBinding) []string {
+	types := make([]string, 0, len(appBinding.Spec.SecretTransforms))
+	for _, t := range appBinding.Spec.SecretTransforms {
+		switch {
+		case t.AddKey != nil:
+			types = append(types, "addKey")
+		case t.RenameKey != nil:
+			types = append(types, "renameKey")
+		case t.AddKeysFrom != nil && t.AddKeysFrom.SecretRef != nil:
+			types = append(types, "addKeysFrom secret "+t.AddKeysFrom.SecretRef.Name)
+		case t.AddKeysFrom != nil:
+			types = append(types, "addKeysFrom")
+		case t.RemoveKey != nil:
+			types = append(types, "removeKey")
+		}
+	}
+	return types
+}
+
+func (session *sessionWrapper) setDatabaseCredentials(kubeClient kubernetes.Interface, appBinding *appcatalog.AppBinding, scratchDir string, credOpt credentialOptions) error {
+	var credentials map[string][]byte
+	var err error
+	if credOpt.credentialsDir != "" {
+		credentials, err = readCredentialFiles(credOpt.credentialsDir, credOpt.credentialKeys())
+	} else {
+		credentials, err = secretCredentials(kubeClient, appBinding, credOpt)
+	}
 	if err != nil {
 		return err
 	}
 
+	user := string(credentials[credOpt.userKey])
+	session.cmd.Args = append(session.cmd.Args, "-u", user)
+	if credOpt.authMode == AuthModeAWSIAM {
+		provider, err := newRDSTokenProvider(credOpt.awsRegion)
+		if err != nil {
+			return err
+		}
+		session.auth = &iamAuth{
+			provider:        provider,
+			user:            user,
+			endpoint:        credOpt.awsEndpoint,
+			scratchDir:      scratchDir,
+			useDefaultsFile: credOpt.useDefaultsFile,
+		}
+		return nil
+	}
+	return session.setPassword(scratchDir, string(credentials[credOpt.passwordKey]), credOpt.useDefaultsFile)
+}
+
+// secretCredentials returns the data of the AppBinding secret once transformed, with the credential keys checked
+func secretCredentials(kubeClient kubernetes.Interface, appBinding *appcatalog.AppBinding, credOpt credentialOptions) (map[string][]byte, error) {
+	appBindingSecret, err := kubeClient.CoreV1().Secrets(appBinding.Namespace).Get(context.TODO(), appBinding.Spec.Secret.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	if transforms := secretTransformTypes(appBinding); len(transforms) > 0 {
+		klog.Infof("Applying the secret transforms of AppBinding %s/%s: %s", appBinding.Namespace, appBinding.Name, strings.Join(transforms, ", "))
+	}
 	err = appBinding.TransformSecret(kubeClient, appBindingSecret.Data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to transform secret %s/%s of AppBinding %s/%s, check the secretTransforms of the AppBinding and the secrets they read: %w",
+			appBinding.Namespace, appBinding.Spec.Secret.Name, appBinding.Namespace, appBinding.Name, err)
+	}
+
+	for _, key := range credOpt.credentialKeys() {
+		if _, ok := appBindingSecret.Data[key]; !ok {
+			return nil, fmt.Errorf("key %q is missing in secret %s/%s", key, appBinding.Namespace, appBinding.Spec.Secret.Name)
+		}
+	}
+	return appBindingSecret.Data, nil
+}
+
+// setPassword passes password to the commands of the session, either through MYSQL_PWD or an option file
+func (session *sessionWrapper) setPassword(scratchDir, password string, useDefaultsFile bool) error {
+	if useDefaultsFile {
+		return session.setPasswordFile(scratchDir, password)
+	}
+	session.sh.SetEnv(EnvMariaDBPassword, password)
+	return nil
+}
+
+// sessionDir returns the private directory of the session under scratchDir, created on first use,
+// so that sessions sharing a scratch directory do not overwrite each other's files
+func (session *sessionWrapper) sessionDir(scratchDir string) (string, error) {
+	if session.dir != "" {
+		return session.dir, nil
+	}
+	if err := os.MkdirAll(scratchDir, 0o700); err != nil {
+		return "", fmt.Errorf("failed to create scratch directory %s: %w", scratchDir, err)
+	}
+	dir, err := os.MkdirTemp(scratchDir, "session-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create session directory in %s: %w", scratchDir, err)
+	}
+	session.dir = dir
+	return dir, nil
+}
+
+// setPasswordFile writes the password in an option file read with --defaults-extra-file,
+// so that it is not visible in the environment of the processes
+func (session *sessionWrapper) setPasswordFile(scratchDir, password string) error {
+	dir, err := session.sessionDir(scratchDir)
 	if err != nil {
 		return err
 	}
+	defaultsFile := filepath.Join(dir, MariaDBDefaultsFile)
+	escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(password)
+	content := fmt.Sprintf("[client]\npassword=\"%s\"\n", escaped)
+	if err := os.WriteFile(defaultsFile, []byte(content), 0o600); err != nil {
+		return fmt.Errorf("failed to write defaults file %s: %w", defaultsFile, err)
+	}
 
-	session.cmd.Args = append(session.cmd.Args, "-u", string(appBindingSecret.Data[MariaDBUser]))
-	session.sh.SetEnv(EnvMariaDBPassword, string(appBindingSecret.Data[MariaDBPassword]))
+	if session.defaultsFile != "" {
+		// the file is already passed to the commands, a new password only rewrites it
+		return nil
+	}
+	session.defaultsFile = defaultsFile
+	// --defaults-extra-file is only honored as the first argument
+	session.cmd.Args = append([]interface{}{"--defaults-extra-file=" + defaultsFile}, session.cmd.Args...)
+	if session.hostArg != 0 {
+		session.hostArg++
+	}
 	return nil
 }
 
 func (session *sessionWrapper) setDatabaseConnectionParameters(appBinding *appcatalog.AppBinding) error {
+	// connect through the unix socket when the database runs on the same host
+	if socket := socketPath(appBinding); socket != "" {
+		session.socket = socket
+		session.cmd.Args = append(session.cmd.Args, "--socket="+socket)
+		return nil
+	}
+
 	hostname, err := appBinding.Hostname()
 	if err != nil {
 		return err
 	}
-	session.cmd.Args = append(session.cmd.Args, "-h", hostname)
+	// the database may be reachable through several hosts, given as a comma separated list
+	for _, host := range strings.Split(hostname, ",") {
+		host, err = normalizeHostname(host)
+		if err != nil {
+			return fmt.Errorf("AppBinding %s/%s: %w", appBinding.Namespace, appBinding.Name, err)
+		}
+		session.hosts = append(session.hosts, host)
+	}
+	session.cmd.Args = append(session.cmd.Args, "-h")
+	session.hostArg = len(session.cmd.Args)
+	session.cmd.Args = append(session.cmd.Args, session.hosts[0])
 
 	port, err := appBinding.Port()
 	if err != nil {
@@ -115,69 +623,667 @@ func (session *sessionWrapper) setDatabaseConnectionParameters(appBinding *appca
 	return nil
 }
 
+// normalizeHostname returns the host passed to the client with -h. IPv6 literals are given
+// without the brackets of their URL form, since the port is passed separately.
+func normalizeHostname(hostname string) (string, error) {
+	hostname = strings.TrimSpace(hostname)
+	if strings.HasPrefix(hostname, "[") && strings.HasSuffix(hostname, "]") {
+		hostname = hostname[1 : len(hostname)-1]
+	}
+	if hostname == "" {
+		return "", errors.New("the hostname of the database is empty, set it in the client config or use a unix socket")
+	}
+	if strings.Contains(hostname, ":") {
+		// the zone of a link-local address (fe80::1%eth0) is not part of the IP
+		ip := hostname
+		if i := strings.Index(ip, "%"); i >= 0 {
+			ip = ip[:i]
+		}
+		if net.ParseIP(ip) == nil {
+			return "", fmt.Errorf("invalid hostname %q, it is neither a hostname nor an IPv6 address", hostname)
+		}
+	}
+	return hostname, nil
+}
+
+// socketPath returns the unix socket of the AppBinding, given either as an
+// unix:///path/to/mysqld.sock url or as an unix(/path/to/mysqld.sock) DSN address
+func socketPath(appBinding *appcatalog.AppBinding) string {
+	if appBinding.Spec.ClientConfig.URL == nil {
+		return ""
+	}
+	u := *appBinding.Spec.ClientConfig.URL
+	if strings.HasPrefix(u, UnixSocketScheme) {
+		return strings.TrimPrefix(u, UnixSocketScheme)
+	}
+	if i := strings.Index(u, "unix("); i >= 0 {
+		if j := strings.Index(u[i:], ")"); j >= 0 {
+			return u[i+len("unix(") : i+j]
+		}
+	}
+	return ""
+}
+
 func (session *sessionWrapper) setUserArgs(args string) {
 	for _, arg := range strings.Fields(args) {
 		session.cmd.Args = append(session.cmd.Args, arg)
 	}
 }
 
-func (session *sessionWrapper) setTLSParameters(appBinding *appcatalog.AppBinding, scratchDir string) error {
+func (session *sessionWrapper) setTLSParameters(kubeClient kubernetes.Interface, appBinding *appcatalog.AppBinding, scratchDir string, tlsOpt tlsOptions) error {
+	// restrict the TLS protocol versions the client may negotiate
+	if tlsOpt.minVersion != "" {
+		versions, err := tlsVersionsFrom(tlsOpt.minVersion)
+		if err != nil {
+			return err
+		}
+		session.cmd.Args = append(session.cmd.Args, "--tls-version="+strings.Join(versions, ","))
+	}
+
+	if appBinding.Spec.ClientConfig.CABundle == nil && appBinding.Spec.TLSSecret == nil {
+		return nil
+	}
+	dir, err := session.sessionDir(scratchDir)
+	if err != nil {
+		return err
+	}
+
 	// if ssl enabled, add ca.crt in the arguments
 	if appBinding.Spec.ClientConfig.CABundle != nil {
-		if err := os.WriteFile(filepath.Join(scratchDir, MariaDBTLSRootCA), appBinding.Spec.ClientConfig.CABundle, os.ModePerm); err != nil {
-			return err
+		caFile := filepath.Join(dir, MariaDBTLSRootCA)
+		if err := os.WriteFile(caFile, appBinding.Spec.ClientConfig.CABundle, 0o600); err != nil {
+			return fmt.Errorf("failed to write CA bundle to %s: %w", caFile, err)
 		}
 		tlsCreds := []interface{}{
-			fmt.Sprintf("--ssl-ca=%v", filepath.Join(scratchDir, MariaDBTLSRootCA)),
+			fmt.Sprintf("--ssl-ca=%v", caFile),
+		}
+		// verify the server certificate against the CA unless the operator disabled it (i.e. self-signed internal hosts)
+		if tlsOpt.verifyServerCert {
+			tlsCreds = append(tlsCreds, "--ssl-verify-server-cert")
 		}
 
 		session.cmd.Args = append(session.cmd.Args, tlsCreds...)
 	}
+
+	// if the server requires mutual TLS, add the client certificate and key in the arguments
+	if appBinding.Spec.TLSSecret != nil {
+		tlsSecret, err := kubeClient.CoreV1().Secrets(appBinding.Namespace).Get(context.TODO(), appBinding.Spec.TLSSecret.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		for _, key := range []string{core.TLSCertKey, core.TLSPrivateKeyKey} {
+			if len(tlsSecret.Data[key]) == 0 {
+				return fmt.Errorf("key %q is missing in TLS secret %s/%s", key, tlsSecret.Namespace, tlsSecret.Name)
+			}
+		}
+
+		certFile := filepath.Join(dir, MariaDBTLSClientCert)
+		if err := os.WriteFile(certFile, tlsSecret.Data[core.TLSCertKey], 0o600); err != nil {
+			return fmt.Errorf("failed to write client certificate to %s: %w", certFile, err)
+		}
+
+		keyFile := filepath.Join(dir, MariaDBTLSClientKey)
+		if err := os.WriteFile(keyFile, tlsSecret.Data[core.TLSPrivateKeyKey], 0o600); err != nil {
+			return fmt.Errorf("failed to write client key to %s: %w", keyFile, err)
+		}
+
+		session.cmd.Args = append(session.cmd.Args,
+			fmt.Sprintf("--ssl-cert=%v", certFile),
+			fmt.Sprintf("--ssl-key=%v", keyFile),
+		)
+	}
 	return nil
 }
 
-func (session *sessionWrapper) waitForDBReady(waitTimeout int32) error {
+// tlsVersionsFrom returns the supported TLS versions starting from minVersion
+func tlsVersionsFrom(minVersion string) ([]string, error) {
+	for i, v := range SupportedTLSVersions {
+		if v == minVersion {
+			return SupportedTLSVersions[i:], nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported TLS version %q, must be one of %s", minVersion, strings.Join(SupportedTLSVersions, ", "))
+}
+
+// cleanup removes the sensitive files written for the session and its private directory
+func (session *sessionWrapper) cleanup() {
+	for _, f := range session.tempFiles {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			klog.Warningf("Failed to remove %s. Reason: %v", f, err)
+		}
+	}
+	session.tempFiles = nil
+
+	if session.proxy != nil {
+		session.proxy.close()
+		session.proxy = nil
+	}
+
+	if session.dir != "" {
+		if err := os.RemoveAll(session.dir); err != nil {
+			klog.Warningf("Failed to remove %s. Reason: %v", session.dir, err)
+		}
+		session.dir = ""
+	}
+}
+
+// readinessBackoff is the interval between two readiness probes of the database. It starts at interval
+// and is multiplied by factor after each probe, up to max. A factor of 1 polls at a fixed interval.
+type readinessBackoff struct {
+	interval time.Duration
+	factor   float64
+	max      time.Duration
+}
+
+func (opt *mariadbOptions) readinessBackoff() readinessBackoff {
+	return readinessBackoff{interval: opt.readinessPollInterval, factor: opt.readinessBackoffFactor, max: opt.maxReadinessPollInterval}
+}
+
+// loaded returns the interval to wait after the database refused the probe with "Too many connections":
+// the server is under load, so it is probed less often
+func (b readinessBackoff) loaded(interval time.Duration) time.Duration {
+	loaded := interval * ConnectionErrorBackoffFactor
+	if b.max > 0 && loaded > b.max {
+		loaded = max(b.max, interval)
+	}
+	return loaded
+}
+
+// next returns the interval following interval
+func (b readinessBackoff) next(interval time.Duration) time.Duration {
+	if b.factor <= 1 {
+		return interval
+	}
+	next := time.Duration(float64(interval) * b.factor)
+	if b.max > 0 && next > b.max {
+		next = b.max
+	}
+	return next
+}
+
+// waitForDatabase waits for the database to accept connections, unless the readiness check is skipped.
+// Without the check, a database that is not reachable fails the first query with the error of the client.
+func (opt *mariadbOptions) waitForDatabase(ctx context.Context, session *sessionWrapper) error {
+	if opt.skipReadinessCheck {
+		klog.Infoln("Skipping the readiness check of the database")
+		return nil
+	}
+	return session.waitForDBReady(ctx, opt.waitTimeout, opt.readinessBackoff())
+}
+
+// waitForDBReady polls the database until it accepts connections, waitTimeout expires or ctx is cancelled
+func (session *sessionWrapper) waitForDBReady(ctx context.Context, waitTimeout int32, backoff readinessBackoff) error {
 	klog.Infoln("Waiting for the database to be ready....")
+	klog.Infof("Database arguments %v", sanitizeArgs(session.cmd.Args))
 
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(waitTimeout)*time.Second)
+	defer cancel()
+	for interval := backoff.interval; ; interval = backoff.next(interval) {
+		err := session.pingHosts()
+		if err == nil {
+			klog.Infoln("Database is accepting connection....")
+			return nil
+		}
+		sleep := interval
+		if isTooManyConnectionsError(err) {
+			sleep = backoff.loaded(interval)
+		}
+		klog.Infof("Unable to connect with the database. Reason: %v.\nRetrying after %v....", err, sleep)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("database is not ready: %w", ctx.Err())
+		case <-time.After(sleep):
+		}
+	}
+}
+
+// newShell returns a shell session with the environment of the session, renewing its IAM token first when needed
+func (session *sessionWrapper) newShell() *shell.Session {
+	if err := session.refreshCredentials(); err != nil {
+		klog.Warningf("Failed to renew the database credentials. Reason: %v", err)
+	}
 	sh := shell.NewSession()
 	for k, v := range session.sh.Env {
 		sh.SetEnv(k, v)
 	}
+	return sh
+}
 
-	// Execute "SELECT 1" query to the database. It should return an error when mysqld is not ready.
-	args := append(session.cmd.Args, "-e", "SELECT 1;")
+// host returns the host the session connects to, or an empty string when it uses a unix socket
+func (session *sessionWrapper) host() string {
+	// with a proxy, the clients connect to the local forward
+	if session.proxy != nil {
+		host, _ := session.proxy.target()
+		return host
+	}
+	if session.hostArg == 0 {
+		return ""
+	}
+	return session.cmd.Args[session.hostArg].(string)
+}
 
-	klog.Infof("Database arguments %v", args)
+// useHost makes the session connect to host
+func (session *sessionWrapper) useHost(host string) {
+	if session.proxy != nil {
+		session.proxy.setHost(host)
+		return
+	}
+	if session.hostArg != 0 {
+		session.cmd.Args[session.hostArg] = host
+	}
+}
+
+// pingHosts pings the candidate hosts in order and keeps the first one that accepts the connection
+func (session *sessionWrapper) pingHosts() error {
+	if len(session.hosts) < 2 {
+		return session.ping()
+	}
+	var err error
+	for _, host := range session.hosts {
+		session.useHost(host)
+		if err = session.ping(); err == nil {
+			klog.Infof("Selected database host %s", host)
+			return nil
+		}
+		klog.Infof("Unable to connect with the database host %s. Reason: %v", host, err)
+	}
+	return err
+}
+
+// ping executes "SELECT 1" once. It returns an error when mysqld is not ready or refuses the connection.
+func (session *sessionWrapper) ping() error {
+	sh := session.newShell()
+	args := append(append([]interface{}{}, session.cmd.Args...), "-e", "SELECT 1;")
 
 	// don't show the output of the query
 	sh.Stdout = nil
+	errBuff, err := circbuf.NewBuffer(stderrBufferSize)
+	if err != nil {
+		return err
+	}
+	sh.Stderr = errBuff
+	if err = sh.Command(session.clientCmd, args...).Run(); err != nil {
+		return newCommandError(err, capturedStderr(errBuff))
+	}
+	return nil
+}
 
-	return wait.PollUntilContextTimeout(context.Background(), 5*time.Second, time.Duration(waitTimeout)*time.Second, true, func(ctx context.Context) (done bool, err error) {
-		if err := sh.Command("mariadb", args...).Run(); err == nil {
-			klog.Infoln("Database is accepting connection....")
-			return true, nil
+// checkBinaries fails if any of the commands is not found in PATH
+func checkBinaries(names ...string) error {
+	for _, name := range names {
+		if _, err := exec.LookPath(name); err != nil {
+			return fmt.Errorf("binary %q not found in PATH (%s), make sure the image ships the MariaDB client", name, os.Getenv("PATH"))
+		}
+	}
+	return nil
+}
+
+// executeQuery runs a query with the mariadb client and returns its output without the column names
+func (session *sessionWrapper) executeQuery(query string) ([]byte, error) {
+	sh := session.newShell()
+
+	args := append([]interface{}{}, session.cmd.Args...)
+	args = append(args, "-s", "-N", "-e", query)
+
+	// the error carries what the client reported, i.e. why it could not connect
+	errBuff, err := circbuf.NewBuffer(stderrBufferSize)
+	if err != nil {
+		return nil, err
+	}
+	sh.Stderr = errBuff
+	output, err := sh.Command(session.clientCmd, args...).Output()
+	if err != nil {
+		return output, newCommandError(err, capturedStderr(errBuff))
+	}
+	return output, nil
+}
+
+// recreateDatabase drops the database and creates it again empty, system schemas are never dropped
+func (session *sessionWrapper) recreateDatabase(db string, systemSchemas []string) error {
+	if containsString(systemSchemas, db) {
+		return fmt.Errorf("refusing to drop system schema %s", db)
+	}
+	klog.Warningf("Dropping database %s before restore", db)
+	_, err := session.executeQuery(recreateDatabaseStatements(db))
+	if err != nil {
+		return fmt.Errorf("failed to recreate database %s: %w", db, err)
+	}
+	return nil
+}
+
+// recreateDatabaseStatements returns the statements dropping and creating the database again
+func recreateDatabaseStatements(db string) string {
+	return fmt.Sprintf("DROP DATABASE IF EXISTS %[1]s;\nCREATE DATABASE %[1]s;\n", quoteIdentifier(db))
+}
+
+// quoteIdentifier quotes a database or table name with backticks
+func quoteIdentifier(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// unescapeBatchValue reverts the escaping of the special characters in the values printed by the client in batch mode
+func unescapeBatchValue(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case '0':
+			b.WriteByte(0)
+		default:
+			b.WriteByte(s[i])
 		}
-		klog.Infof("Unable to connect with the database. Reason: %v.\nRetrying after 5 seconds....", err)
+	}
+	return b.String()
+}
+
+// quoteString returns s as a SQL string literal
+func quoteString(s string) string {
+	return "'" + strings.ReplaceAll(strings.ReplaceAll(s, `\`, `\\`), "'", "''") + "'"
+}
+
+// hasBinaryColumns reports whether any table of the databases has a binary column
+func (session *sessionWrapper) hasBinaryColumns(databases []string) (bool, error) {
+	if len(databases) == 0 {
 		return false, nil
-	})
+	}
+	schemas := make([]string, 0, len(databases))
+	for _, db := range databases {
+		schemas = append(schemas, quoteString(db))
+	}
+	types := make([]string, 0, len(binaryDataTypes))
+	for _, t := range binaryDataTypes {
+		types = append(types, quoteString(t))
+	}
+	output, err := session.executeQuery(fmt.Sprintf("SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA IN (%s) AND DATA_TYPE IN (%s);", strings.Join(schemas, ","), strings.Join(types, ",")))
+	if err != nil {
+		return false, fmt.Errorf("failed to look for binary columns: %w", err)
+	}
+	return strings.TrimSpace(string(output)) != "0", nil
+}
+
+// currentGrantee is the account of the session in the 'user'@'host' form of the GRANTEE columns of information_schema
+const currentGrantee = `CONCAT('''', SUBSTRING_INDEX(CURRENT_USER(), '@', 1), '''@''', SUBSTRING_INDEX(CURRENT_USER(), '@', -1), '''')`
+
+// hasGlobalPrivilege reports whether the user of the session holds a global privilege, i.e. PROCESS.
+// A user reading the mysql schema sees the privileges of the other accounts too, so only its own rows are counted.
+func (session *sessionWrapper) hasGlobalPrivilege(privilege string) (bool, error) {
+	output, err := session.executeQuery(fmt.Sprintf("SELECT COUNT(*) FROM information_schema.USER_PRIVILEGES WHERE PRIVILEGE_TYPE = %s AND GRANTEE = %s;", quoteString(privilege), currentGrantee))
+	if err != nil {
+		return false, fmt.Errorf("failed to query the %s privilege: %w", privilege, err)
+	}
+	return strings.TrimSpace(string(output)) != "0", nil
+}
+
+// readOnlyVariables returns which of read_only and super_read_only are enabled on the server.
+// super_read_only only exists on MySQL, SHOW VARIABLES skips it on MariaDB instead of failing.
+func (session *sessionWrapper) readOnlyVariables() ([]string, error) {
+	output, err := session.executeQuery("SHOW GLOBAL VARIABLES WHERE Variable_name IN ('read_only', 'super_read_only');")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the read-only state of the database: %w", err)
+	}
+	return parseReadOnlyVariables(string(output)), nil
+}
+
+// parseReadOnlyVariables returns the variables of the "<name>\t<value>" rows that are enabled
+func parseReadOnlyVariables(output string) []string {
+	var enabled []string
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && (strings.EqualFold(fields[1], "ON") || fields[1] == "1") {
+			enabled = append(enabled, fields[0])
+		}
+	}
+	return enabled
+}
+
+// databaseNames is the list of the databases of a server
+type databaseNames []string
+
+// has reports whether the database exists
+func (names databaseNames) has(db string) bool {
+	return containsString(names, db)
 }
 
-func (session *sessionWrapper) getDbNames() ([]string, error) {
+// getDbNames returns the databases of the server, skipping empty lines and the given system schemas.
+// It is used by backups to select the databases and by restores to inspect the target.
+func (session *sessionWrapper) getDbNames(systemSchemas []string) (databaseNames, error) {
 	klog.Infoln("Querying databases names...")
 
-	sh := shell.NewSession()
-	for k, v := range session.sh.Env {
-		sh.SetEnv(k, v)
+	output, err := session.executeQuery("SHOW DATABASES;")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database names: %w", err)
+	}
+	excluded := make(map[string]bool, len(systemSchemas))
+	for _, schema := range systemSchemas {
+		excluded[schema] = true
 	}
 
-	args := append(session.cmd.Args, "-s", "-e", "SHOW DATABASES;")
+	var databases databaseNames
+	for _, line := range strings.Split(string(output), "\n") {
+		db := unescapeBatchValue(strings.TrimSpace(line))
+		if db != "" && !excluded[db] {
+			databases = append(databases, db)
+		}
+	}
 
-	if output, err := sh.Command("mariadb", args...).Output(); err == nil {
-		// Diviser la sortie par les lignes
-		databases := strings.Split(string(output), "\n")
+	klog.Infof("Databases : %v", databases)
+	return databases, nil
+}
 
-		klog.Infof("Databases : %v", databases)
+// includeDatabases keeps only the requested databases. An empty list keeps every database.
+// It fails if a requested database does not exist on the server.
+func includeDatabases(databases, requested []string) ([]string, error) {
+	if len(requested) == 0 {
 		return databases, nil
 	}
-	return nil, nil
+	var missing []string
+	for _, db := range requested {
+		if !containsString(databases, db) {
+			missing = append(missing, db)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("requested databases do not exist: %s", strings.Join(missing, ", "))
+	}
+
+	var result []string
+	for _, db := range databases {
+		if containsString(requested, db) {
+			result = append(result, db)
+		}
+	}
+	return result, nil
+}
+
+// parseTableSelection groups the <database>.<table> entries by database.
+// The database name ends at the first dot, so the table name may contain dots.
+// A database name containing dots is quoted with backticks, i.e. `my-db.test`.orders
+func parseTableSelection(entries []string) (map[string][]string, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	tables := map[string][]string{}
+	for _, entry := range entries {
+		db, table, ok := splitQualifiedTable(entry)
+		if !ok {
+			return nil, fmt.Errorf("invalid table %q, must be of the form <database>.<table>", entry)
+		}
+		if !containsString(tables[db], table) {
+			tables[db] = append(tables[db], table)
+		}
+	}
+	return tables, nil
+}
+
+// splitQualifiedTable splits <database>.<table>, where the database may be quoted with backticks
+func splitQualifiedTable(entry string) (string, string, bool) {
+	var db, rest string
+	if strings.HasPrefix(entry, "`") {
+		i := 1
+		for ; i < len(entry); i++ {
+			if entry[i] != '`' {
+				continue
+			}
+			if i+1 < len(entry) && entry[i+1] == '`' {
+				i++
+				continue
+			}
+			break
+		}
+		if i >= len(entry) || i+1 >= len(entry) || entry[i+1] != '.' {
+			return "", "", false
+		}
+		db, rest = unquoteIdentifier(entry[:i+1]), entry[i+2:]
+	} else {
+		var found bool
+		db, rest, found = strings.Cut(entry, ".")
+		if !found {
+			return "", "", false
+		}
+	}
+	if db == "" || rest == "" {
+		return "", "", false
+	}
+	return db, rest, true
+}
+
+// tableDatabases returns the sorted names of the databases of the selected tables
+func tableDatabases(tables map[string][]string) []string {
+	databases := make([]string, 0, len(tables))
+	for db := range tables {
+		databases = append(databases, db)
+	}
+	sort.Strings(databases)
+	return databases
+}
+
+// excludeDatabases removes the databases matching any of the glob patterns.
+// A pattern that does not match any database is reported but is not an error.
+func excludeDatabases(databases, patterns []string) ([]string, error) {
+	matched := make(map[string]bool, len(patterns))
+	var result []string
+	for _, db := range databases {
+		excluded := false
+		for _, pattern := range patterns {
+			ok, err := path.Match(pattern, db)
+			if err != nil {
+				return nil, fmt.Errorf("invalid database exclusion pattern %q: %w", pattern, err)
+			}
+			if ok {
+				matched[pattern] = true
+				excluded = true
+			}
+		}
+		if !excluded {
+			result = append(result, db)
+		}
+	}
+	for _, pattern := range patterns {
+		if !matched[pattern] {
+			klog.Warningf("Excluded database %q does not match any database", pattern)
+		}
+	}
+	return result, nil
+}
+
+// databaseDumpFile returns the path of the dump file of a database inside dumpdir
+func (opt *mariadbOptions) databaseDumpFile(dumpdir, db string) string {
+	return filepath.Join(dumpdir, db+".sql"+compressionExtension(opt.compression))
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeUserArgs returns the default arguments followed by the explicit ones, without the defaults setting
+// an option the explicit arguments set too, either way (i.e. --skip-lock-tables for --lock-tables).
+// The value of a default given as a separate argument is dropped along with it.
+func mergeUserArgs(defaults, explicit string) string {
+	explicitArgs := strings.Fields(explicit)
+	explicitOptions := map[string]bool{}
+	for _, arg := range explicitArgs {
+		if strings.HasPrefix(arg, "-") {
+			explicitOptions[optionName(arg)] = true
+		}
+	}
+	var merged []string
+	keep := true
+	for _, arg := range strings.Fields(defaults) {
+		if strings.HasPrefix(arg, "-") {
+			keep = !explicitOptions[optionName(arg)]
+			if !keep {
+				klog.Infof("Ignoring the default argument %s, overridden by the mariadb args", sanitizeArgs([]interface{}{arg})...)
+			}
+		}
+		if keep {
+			merged = append(merged, arg)
+		}
+	}
+	return strings.Join(append(merged, explicitArgs...), " ")
+}
+
+// optionName returns the option an argument sets, without its value nor the prefixes negating or enabling it.
+// The client accepts dashes and underscores alike in option names.
+func optionName(arg string) string {
+	name := arg
+	if i := strings.Index(name, "="); i >= 0 {
+		name = name[:i]
+	}
+	if !strings.HasPrefix(name, "--") {
+		return name
+	}
+	name = strings.ReplaceAll(strings.TrimPrefix(name, "--"), "_", "-")
+	for _, prefix := range []string{"skip-", "disable-", "enable-"} {
+		name = strings.TrimPrefix(name, prefix)
+	}
+	return "--" + name
+}
+
+// hasArg reports whether the flag is present in args, either alone or in the --flag=value form
+func hasArg(args []string, flag string) bool {
+	for _, arg := range args {
+		if arg == flag || strings.HasPrefix(arg, flag+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeArgs returns a copy of args suitable for logging, with the values of sensitive flags masked
+func sanitizeArgs(args []interface{}) []interface{} {
+	sanitized := make([]interface{}, len(args))
+	maskNext := false
+	for i, a := range args {
+		arg := fmt.Sprint(a)
+		switch {
+		case maskNext:
+			arg = "****"
+			maskNext = false
+		case arg == "--ssl-key":
+			// the key path is given as the next argument
+			maskNext = true
+		case strings.HasPrefix(arg, "--password="), strings.HasPrefix(arg, "--ssl-key="):
+			arg = arg[:strings.Index(arg, "=")+1] + "****"
+		case strings.HasPrefix(arg, "-p") && !strings.HasPrefix(arg, "--") && len(arg) > 2:
+			arg = "-p****"
+		}
+		sanitized[i] = arg
+	}
+	return sanitized
 }
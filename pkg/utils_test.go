@@ -0,0 +1,1128 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	appcatalog "kmodules.xyz/custom-resources/apis/appcatalog/v1alpha1"
+)
+
+// fakeCommand writes an executable shell script standing in for a command and returns its path
+func fakeCommand(t *testing.T, script string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "fake-command")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// fakeQueryClient returns a fake mariadb client printing the output of the pattern matching the query it runs,
+// and the file recording the queries it ran. In the patterns * matches any text and the other characters match
+// themselves. The patterns must not overlap but for "*", answering the queries no other pattern matches. Without
+// it, these queries fail.
+func fakeQueryClient(t *testing.T, outputs map[string]string) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	patterns := make([]string, 0, len(outputs))
+	for pattern := range outputs {
+		if pattern != "*" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	sort.Strings(patterns)
+	if _, ok := outputs["*"]; ok {
+		patterns = append(patterns, "*")
+	}
+
+	var cases strings.Builder
+	for i, pattern := range patterns {
+		output := filepath.Join(dir, fmt.Sprintf("output-%d", i))
+		if err := os.WriteFile(output, []byte(outputs[pattern]), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		// the text between the wildcards is quoted, so that the backticks and the quotes of the queries match literally
+		literals := strings.Split(pattern, "*")
+		for j, literal := range literals {
+			literals[j] = "'" + strings.ReplaceAll(literal, "'", `'\''`) + "'"
+		}
+		fmt.Fprintf(&cases, "%s) cat %s ;;\n", strings.Join(literals, "*"), output)
+	}
+	queries := filepath.Join(dir, "queries")
+	return fakeCommand(t, `eval query=\${$#}
+printf '%s\n' "$query" >> `+queries+`
+case "$query" in
+`+cases.String()+`*) exit 1 ;;
+esac`), queries
+}
+
+// newFakeSession returns a session running its commands and queries with the given fake command
+func newFakeSession(t *testing.T, opt *mariadbOptions, command string) *sessionWrapper {
+	t.Helper()
+	opt.clientCmd = command
+	return opt.newSessionWrapper(command)
+}
+
+func TestGetDbNames(t *testing.T) {
+	tests := []struct {
+		name          string
+		script        string
+		systemSchemas []string
+		want          databaseNames
+		wantErr       string
+	}{
+		{
+			name:          "lists the databases",
+			script:        `printf 'mysql\nshop\n\nmy\\tdb\n'`,
+			systemSchemas: []string{"mysql"},
+			want:          databaseNames{"shop", "my\tdb"},
+		},
+		{
+			name:   "no database",
+			script: `exit 0`,
+		},
+		{
+			name:    "connection lost",
+			script:  `echo "ERROR 2013 (HY000): Lost connection to server during query" >&2; exit 1`,
+			wantErr: "Lost connection to server during query",
+		},
+		{
+			name:    "access denied",
+			script:  `echo "ERROR 1045 (28000): Access denied for user 'backup'@'%'" >&2; exit 1`,
+			wantErr: "Access denied for user",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newFakeSession(t, &mariadbOptions{}, fakeCommand(t, tt.script))
+			got, err := session.getDbNames(tt.systemSchemas)
+			if tt.wantErr != "" {
+				if err == nil {
+					t.Fatalf("getDbNames() returned %v, want an error", got)
+				}
+				if !strings.Contains(err.Error(), "failed to query database names") || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("getDbNames() error = %v, want it to report %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getDbNames() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getDbNames() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnescapeBatchValue(t *testing.T) {
+	tests := map[string]string{
+		"my-db.test":  "my-db.test",
+		`my\tdb`:      "my\tdb",
+		`line\nbreak`: "line\nbreak",
+		`back\\slash`: `back\slash`,
+		`nul\0byte`:   "nul\x00byte",
+		`trailing\`:   `trailing\`,
+	}
+	for value, want := range tests {
+		if got := unescapeBatchValue(value); got != want {
+			t.Errorf("unescapeBatchValue(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestExcludeDatabases(t *testing.T) {
+	databases := []string{"shop", "tmp_cache", "tmp_sessions", "tmp", "users"}
+	tests := []struct {
+		name     string
+		patterns []string
+		want     []string
+		wantErr  bool
+	}{
+		{name: "no pattern", want: databases},
+		{name: "exact names", patterns: []string{"shop", "tmp"}, want: []string{"tmp_cache", "tmp_sessions", "users"}},
+		{name: "glob", patterns: []string{"tmp_*"}, want: []string{"shop", "tmp", "users"}},
+		{name: "single character glob", patterns: []string{"tm?"}, want: []string{"shop", "tmp_cache", "tmp_sessions", "users"}},
+		{name: "pattern matching nothing", patterns: []string{"archive_*", "users"}, want: []string{"shop", "tmp_cache", "tmp_sessions", "tmp"}},
+		{name: "invalid pattern", patterns: []string{"tmp_["}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := excludeDatabases(databases, tt.patterns)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("excludeDatabases() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("excludeDatabases() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExcludeDatabasesAfterSystemSchemas(t *testing.T) {
+	session := newFakeSession(t, &mariadbOptions{}, fakeCommand(t, `printf 'information_schema\nmysql\nperformance_schema\nsys\nshop\ntmp_cache\n'`))
+	databases, err := session.getDbNames(DefaultSystemSchemas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the system schemas are gone already, excluding one of them again is harmless
+	got, err := excludeDatabases(databases, []string{"tmp_*", "mysql"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"shop"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("databases to dump = %v, want %v", got, want)
+	}
+}
+
+func TestCABundlePermissions(t *testing.T) {
+	scratchDir := filepath.Join(t.TempDir(), "scratch")
+	appBinding := &appcatalog.AppBinding{}
+	appBinding.Spec.ClientConfig.CABundle = []byte("-----BEGIN CERTIFICATE-----\n")
+
+	session := newFakeSession(t, &mariadbOptions{}, "mariadb")
+	if err := session.setTLSParameters(nil, appBinding, scratchDir, tlsOptions{}); err != nil {
+		t.Fatalf("setTLSParameters() error = %v", err)
+	}
+	defer session.cleanup()
+
+	for path, want := range map[string]os.FileMode{
+		scratchDir:  0o700,
+		session.dir: 0o700,
+		filepath.Join(session.dir, MariaDBTLSRootCA): 0o600,
+	} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.Mode().Perm(); got != want {
+			t.Errorf("mode of %s = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestCABundleWriteErrorNamesThePath(t *testing.T) {
+	appBinding := &appcatalog.AppBinding{}
+	appBinding.Spec.ClientConfig.CABundle = []byte("-----BEGIN CERTIFICATE-----\n")
+
+	session := newFakeSession(t, &mariadbOptions{}, "mariadb")
+	// the directory of the session was removed behind its back
+	session.dir = filepath.Join(t.TempDir(), "removed")
+	err := session.setTLSParameters(nil, appBinding, t.TempDir(), tlsOptions{})
+	caFile := filepath.Join(session.dir, MariaDBTLSRootCA)
+	if err == nil || !strings.Contains(err.Error(), caFile) {
+		t.Errorf("setTLSParameters() error = %v, want it to name %s", err, caFile)
+	}
+}
+
+func TestConcurrentSessionsKeepTheirCAFiles(t *testing.T) {
+	scratchDir := t.TempDir()
+	sessions := make([]*sessionWrapper, 8)
+	bundles := make([]string, len(sessions))
+	errs := make([]error, len(sessions))
+	var wg sync.WaitGroup
+	for i := range sessions {
+		sessions[i] = newFakeSession(t, &mariadbOptions{}, "mariadb")
+		bundles[i] = fmt.Sprintf("-----BEGIN CERTIFICATE-----\nsession %d\n", i)
+		appBinding := &appcatalog.AppBinding{}
+		appBinding.Spec.ClientConfig.CABundle = []byte(bundles[i])
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = sessions[i].setTLSParameters(nil, appBinding, scratchDir, tlsOptions{})
+		}(i)
+	}
+	wg.Wait()
+
+	for i, session := range sessions {
+		if errs[i] != nil {
+			t.Fatalf("setTLSParameters() error = %v", errs[i])
+		}
+		data, err := os.ReadFile(filepath.Join(session.dir, MariaDBTLSRootCA))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != bundles[i] {
+			t.Errorf("session %d has the CA bundle %q, want %q", i, data, bundles[i])
+		}
+	}
+
+	// the cleanup of a session leaves the files of the others
+	dir := sessions[0].dir
+	sessions[0].cleanup()
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("the directory of the session is kept after its cleanup")
+	}
+	for _, session := range sessions[1:] {
+		if _, err := os.Stat(filepath.Join(session.dir, MariaDBTLSRootCA)); err != nil {
+			t.Errorf("the cleanup of another session removed a CA file: %v", err)
+		}
+		session.cleanup()
+	}
+}
+
+func TestNormalizeHostname(t *testing.T) {
+	tests := []struct {
+		hostname string
+		want     string
+		wantErr  bool
+	}{
+		{hostname: "10.0.0.12", want: "10.0.0.12"},
+		{hostname: "db.demo.svc", want: "db.demo.svc"},
+		{hostname: " db.demo.svc ", want: "db.demo.svc"},
+		{hostname: "fd00::12", want: "fd00::12"},
+		{hostname: "[fd00::12]", want: "fd00::12"},
+		{hostname: "fe80::1%eth0", want: "fe80::1%eth0"},
+		{hostname: "", wantErr: true},
+		{hostname: "[]", wantErr: true},
+		{hostname: "db:3306", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := normalizeHostname(tt.hostname)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("normalizeHostname(%q) = %q, %v, want %q", tt.hostname, got, err, tt.want)
+		}
+	}
+}
+
+func TestConnectionParametersOfTheHost(t *testing.T) {
+	tests := []struct {
+		url      string
+		wantArgs []interface{}
+		wantErr  string
+	}{
+		{url: "mysql://10.0.0.12:3306/", wantArgs: []interface{}{"-h", "10.0.0.12", "--port=3306"}},
+		{url: "mysql://[fd00::12]:3306/", wantArgs: []interface{}{"-h", "fd00::12", "--port=3306"}},
+		{url: "mysql://db.demo.svc:3306/", wantArgs: []interface{}{"-h", "db.demo.svc", "--port=3306"}},
+		{url: "mysql://:3306/", wantErr: "hostname of the database is empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			// the fake client records the arguments it is run with
+			argsFile := filepath.Join(t.TempDir(), "args")
+			opt := &mariadbOptions{}
+			session := newFakeSession(t, opt, fakeCommand(t, `printf '%s\n' "$@" > `+argsFile))
+			appBinding := &appcatalog.AppBinding{}
+			url := tt.url
+			appBinding.Spec.ClientConfig.URL = &url
+
+			err := session.setDatabaseConnectionParameters(appBinding)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("setDatabaseConnectionParameters() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(session.cmd.Args, tt.wantArgs) {
+				t.Errorf("client arguments = %v, want %v", session.cmd.Args, tt.wantArgs)
+			}
+
+			// the readiness probe connects to the same host
+			if err = session.waitForDBReady(context.Background(), 5, readinessBackoff{interval: time.Millisecond}); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(argsFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			host := fmt.Sprint(tt.wantArgs[1])
+			if !strings.Contains(string(data), "-h\n"+host+"\n") {
+				t.Errorf("the readiness probe ran with %q, want -h %s", data, host)
+			}
+		})
+	}
+}
+
+func TestEmptyHostname(t *testing.T) {
+	for _, url := range []string{"mysql://:3306/", "mysql://db-0.demo.svc,,db-2.demo.svc:3306/"} {
+		session := newFakeSession(t, &mariadbOptions{}, "mariadb")
+		appBinding := &appcatalog.AppBinding{}
+		appBinding.Name, appBinding.Namespace = "shop-db", "demo"
+		appBinding.Spec.ClientConfig.URL = &url
+		err := session.setDatabaseConnectionParameters(appBinding)
+		if err == nil || !strings.Contains(err.Error(), "AppBinding demo/shop-db: the hostname of the database is empty") {
+			t.Errorf("setDatabaseConnectionParameters(%s) error = %v, want the hostname to be empty", url, err)
+		}
+		if len(session.cmd.Args) != 0 {
+			t.Errorf("setDatabaseConnectionParameters(%s) set the arguments %v", url, session.cmd.Args)
+		}
+	}
+
+	// a unix socket needs no hostname
+	url := "unix:///run/mysqld/mysqld.sock"
+	session := newFakeSession(t, &mariadbOptions{}, "mariadb")
+	appBinding := &appcatalog.AppBinding{}
+	appBinding.Spec.ClientConfig.URL = &url
+	if err := session.setDatabaseConnectionParameters(appBinding); err != nil {
+		t.Fatal(err)
+	}
+	if want := []interface{}{"--socket=/run/mysqld/mysqld.sock"}; !reflect.DeepEqual(session.cmd.Args, want) {
+		t.Errorf("client arguments = %v, want %v", session.cmd.Args, want)
+	}
+}
+
+func TestDefaultCharset(t *testing.T) {
+	for _, cmd := range []*cobra.Command{NewCmdBackup(), NewCmdRestore(), NewCmdTestConnection()} {
+		if got := cmd.Flags().Lookup("default-charset").DefValue; got != "utf8mb4" {
+			t.Errorf("%s --default-charset defaults to %q, want utf8mb4", cmd.Name(), got)
+		}
+	}
+
+	for _, charset := range []string{DefaultCharset, "latin1", ""} {
+		calls := filepath.Join(t.TempDir(), "calls")
+		opt := &mariadbOptions{defaultCharset: charset, systemSchemas: DefaultSystemSchemas}
+		session := newFakeSession(t, opt, fakeCommand(t, `echo "$@" >> `+calls+`
+echo shop`))
+		if err := session.waitForDBReady(context.Background(), 5, readinessBackoff{interval: time.Millisecond}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := session.getDbNames(opt.systemSchemas); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := opt.dumpDatabase(session, "shop", filepath.Join(t.TempDir(), "shop.sql")); err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := os.ReadFile(calls)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		if len(lines) != 3 {
+			t.Fatalf("the client ran %d times, want 3", len(lines))
+		}
+		for _, line := range lines {
+			has := strings.Contains(line, "--default-character-set=")
+			if charset == "" && has || charset != "" && !strings.Contains(line, "--default-character-set="+charset+" ") {
+				t.Errorf("with the charset %q, the client ran with %q", charset, line)
+			}
+		}
+	}
+}
+
+func TestVerifyServerCertFlag(t *testing.T) {
+	tests := []struct {
+		name             string
+		caBundle         []byte
+		verifyServerCert bool
+		want             int
+	}{
+		{name: "verified", caBundle: []byte("ca"), verifyServerCert: true, want: 1},
+		{name: "disabled for a self-signed host", caBundle: []byte("ca"), verifyServerCert: false, want: 0},
+		{name: "no TLS", verifyServerCert: true, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			appBinding := &appcatalog.AppBinding{}
+			appBinding.Spec.ClientConfig.CABundle = tt.caBundle
+
+			session := newFakeSession(t, &mariadbOptions{}, "mariadb")
+			defer session.cleanup()
+			if err := session.setTLSParameters(nil, appBinding, t.TempDir(), tlsOptions{verifyServerCert: tt.verifyServerCert}); err != nil {
+				t.Fatalf("setTLSParameters() error = %v", err)
+			}
+			if got := countArg(session.cmd.Args, "--ssl-verify-server-cert"); got != tt.want {
+				t.Errorf("arguments %v have --ssl-verify-server-cert %d times, want %d", session.cmd.Args, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWaitForDBReadyStopsWhenCancelled(t *testing.T) {
+	session := newFakeSession(t, &mariadbOptions{}, fakeCommand(t, `echo "ERROR 2002 (HY000): Can't connect to server" >&2; exit 1`))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	start := time.Now()
+	err := session.waitForDBReady(ctx, 300, readinessBackoff{interval: time.Minute, factor: 1})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("waitForDBReady() error = %v, want the cancellation of the context", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("waitForDBReady() returned %v after the cancellation", elapsed)
+	}
+}
+
+func TestReadinessBackoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		backoff readinessBackoff
+		want    []time.Duration
+	}{
+		{
+			name:    "fixed interval",
+			backoff: readinessBackoff{interval: DefaultReadinessPollInterval, factor: 1},
+			want:    []time.Duration{5 * time.Second, 5 * time.Second, 5 * time.Second, 5 * time.Second},
+		},
+		{
+			name:    "growing interval",
+			backoff: readinessBackoff{interval: time.Second, factor: 2},
+			want:    []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second},
+		},
+		{
+			name:    "capped interval",
+			backoff: readinessBackoff{interval: time.Second, factor: 1.5, max: 3 * time.Second},
+			want:    []time.Duration{time.Second, 1500 * time.Millisecond, 2250 * time.Millisecond, 3 * time.Second, 3 * time.Second},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []time.Duration
+			for interval := tt.backoff.interval; len(got) < len(tt.want); interval = tt.backoff.next(interval) {
+				got = append(got, interval)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("the readiness probes are %v apart, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWaitForDBReadyBackoffRespectsTheWaitTimeout(t *testing.T) {
+	runs := filepath.Join(t.TempDir(), "runs")
+	session := newFakeSession(t, &mariadbOptions{}, fakeCommand(t, `echo run >> `+runs+`
+echo "ERROR 2002 (HY000): Can't connect to server" >&2; exit 1`))
+
+	// the second probe waits 3s, past the wait timeout
+	start := time.Now()
+	err := session.waitForDBReady(context.Background(), 1, readinessBackoff{interval: 300 * time.Millisecond, factor: 10})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("waitForDBReady() error = %v, want the wait timeout to expire", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("waitForDBReady() returned after %v, past the wait timeout of 1s", elapsed)
+	}
+	if n := countRuns(t, runs); n != 2 {
+		t.Errorf("the database was probed %d times, want 2", n)
+	}
+}
+
+func TestSkipReadinessCheck(t *testing.T) {
+	for _, cmd := range []*cobra.Command{NewCmdBackup(), NewCmdRestore()} {
+		if got := cmd.Flags().Lookup("skip-readiness-check").DefValue; got != "false" {
+			t.Errorf("%s --skip-readiness-check defaults to %s, want the readiness to be checked", cmd.Name(), got)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		skip     bool
+		wantRuns int
+	}{
+		{name: "readiness checked", wantRuns: 1},
+		{name: "readiness check skipped", skip: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runs := filepath.Join(t.TempDir(), "runs")
+			opt := newTestBackupOptions()
+			opt.skipReadinessCheck = tt.skip
+			session := newFakeSession(t, opt, fakeCommand(t, `echo run >> `+runs))
+
+			if err := opt.waitForDatabase(context.Background(), session); err != nil {
+				t.Fatal(err)
+			}
+			if n := countRuns(t, runs); n != tt.wantRuns {
+				t.Errorf("the database was probed %d times, want %d", n, tt.wantRuns)
+			}
+		})
+	}
+}
+
+func TestSkipReadinessCheckReportsTheConnectionError(t *testing.T) {
+	runs := filepath.Join(t.TempDir(), "runs")
+	opt := newTestBackupOptions()
+	opt.skipReadinessCheck = true
+	session := newFakeSession(t, opt, fakeCommand(t, `echo run >> `+runs+`
+echo "ERROR 2002 (HY000): Can't connect to server on 'db.demo.svc' (115)" >&2; exit 1`))
+
+	// the unreachable database is not waited for, the first query reports why it failed
+	if err := opt.waitForDatabase(context.Background(), session); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.getDbNames(opt.systemSchemas); err == nil || !strings.Contains(err.Error(), "Can't connect to server on 'db.demo.svc'") {
+		t.Errorf("getDbNames() error = %v, want the connection error of the client", err)
+	}
+	if n := countRuns(t, runs); n != 1 {
+		t.Errorf("the client ran %d times, want 1", n)
+	}
+}
+
+func TestReadinessBackoffOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		factor   float64
+		max      time.Duration
+		wantErr  string
+	}{
+		{name: "default", interval: DefaultReadinessPollInterval, factor: 1},
+		{name: "growing", interval: time.Second, factor: 2, max: time.Minute},
+		{name: "no interval", factor: 1, wantErr: "readiness poll interval must be positive"},
+		{name: "shrinking", interval: time.Second, factor: 0.5, wantErr: "readiness backoff factor must be at least 1"},
+		{name: "max below the interval", interval: 10 * time.Second, factor: 2, max: time.Second, wantErr: "must not be smaller than the readiness poll interval"},
+		{name: "interval above the wait timeout", interval: time.Hour, factor: 1, wantErr: "must not be larger than the wait timeout 300s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := newTestBackupOptions()
+			opt.setupOptions.ScratchDir = t.TempDir()
+			opt.readinessPollInterval = tt.interval
+			opt.readinessBackoffFactor = tt.factor
+			opt.maxReadinessPollInterval = tt.max
+			err := opt.validateConnectionOptions()
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validateConnectionOptions() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSanitizeArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		args []interface{}
+		want []interface{}
+	}{
+		{name: "long password", args: []interface{}{"-u", "root", "--password=s3cret"}, want: []interface{}{"-u", "root", "--password=****"}},
+		{name: "short password", args: []interface{}{"-ps3cret", "-h", "db"}, want: []interface{}{"-p****", "-h", "db"}},
+		{name: "password prompt", args: []interface{}{"-p", "shop"}, want: []interface{}{"-p", "shop"}},
+		{name: "ssl key", args: []interface{}{"--ssl-key=/tmp/client.key", "--ssl-key", "/tmp/client.key"}, want: []interface{}{"--ssl-key=****", "--ssl-key", "****"}},
+		{name: "other flags", args: []interface{}{"--port=3306", "--ssl-ca=/tmp/ca.crt", "--protocol", "tcp"}, want: []interface{}{"--port=3306", "--ssl-ca=/tmp/ca.crt", "--protocol", "tcp"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			original := append([]interface{}{}, tt.args...)
+			if got := sanitizeArgs(tt.args); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sanitizeArgs() = %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(tt.args, original) {
+				t.Errorf("sanitizeArgs() modified the arguments: %v", tt.args)
+			}
+		})
+	}
+}
+
+func TestConnectTimeoutArg(t *testing.T) {
+	tests := []struct {
+		timeout time.Duration
+		want    []interface{}
+	}{
+		{timeout: 0, want: nil},
+		{timeout: 10 * time.Second, want: []interface{}{"--connect-timeout=10"}},
+		{timeout: 1500 * time.Millisecond, want: []interface{}{"--connect-timeout=2"}},
+		{timeout: time.Millisecond, want: []interface{}{"--connect-timeout=1"}},
+	}
+	for _, tt := range tests {
+		session := (&mariadbOptions{connectTimeout: tt.timeout}).newSessionWrapper("mariadb")
+		var got []interface{}
+		for _, arg := range session.cmd.Args {
+			if strings.HasPrefix(arg.(string), "--connect-timeout") {
+				got = append(got, arg)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("connect timeout %v gives the arguments %v, want %v", tt.timeout, got, tt.want)
+		}
+	}
+}
+
+func TestNegativeConnectTimeout(t *testing.T) {
+	opt := newTestBackupOptions()
+	opt.setupOptions.ScratchDir = t.TempDir()
+	if err := opt.validateConnectionOptions(); err != nil {
+		t.Fatalf("validateConnectionOptions() error = %v", err)
+	}
+	opt.connectTimeout = -time.Second
+	if err := opt.validateConnectionOptions(); err == nil || !strings.Contains(err.Error(), "connect timeout") {
+		t.Errorf("validateConnectionOptions() error = %v, want the connect timeout to be rejected", err)
+	}
+}
+
+func TestParseBytes(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "1048576", want: 1 << 20},
+		{in: "512K", want: 512 << 10},
+		{in: "256M", want: 256 << 20},
+		{in: "256m", want: 256 << 20},
+		{in: " 1G ", want: 1 << 30},
+		{in: "0", want: 0},
+		{in: "", wantErr: true},
+		{in: "M", wantErr: true},
+		{in: "-1M", wantErr: true},
+		{in: "1.5G", wantErr: true},
+		{in: "64MB", wantErr: true},
+		{in: "lots", wantErr: true},
+		{in: "9223372036854775807G", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseBytes(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseBytes(%q) = %d, %v, want %d (error %v)", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestMaxAllowedPacket(t *testing.T) {
+	tests := []struct {
+		packet  string
+		want    []interface{}
+		wantErr string
+	}{
+		{packet: DefaultMaxAllowedPacket, want: []interface{}{"--max-allowed-packet=67108864"}},
+		{packet: "256M", want: []interface{}{"--max-allowed-packet=268435456"}},
+		{packet: "1024", want: []interface{}{"--max-allowed-packet=1024"}},
+		{packet: "1G", want: []interface{}{"--max-allowed-packet=1073741824"}},
+		{packet: ""},
+		{packet: "1023", wantErr: "max allowed packet must be between 1.0 KiB and 1.0 GiB, got 1023"},
+		{packet: "2G", wantErr: "max allowed packet must be between 1.0 KiB and 1.0 GiB, got 2G"},
+		{packet: "big", wantErr: "invalid max allowed packet"},
+	}
+	for _, tt := range tests {
+		opt := newTestBackupOptions()
+		opt.setupOptions.ScratchDir = t.TempDir()
+		opt.maxAllowedPacket = tt.packet
+		err := opt.validateConnectionOptions()
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("max allowed packet %q: validateConnectionOptions() error = %v, want %q", tt.packet, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("max allowed packet %q: validateConnectionOptions() error = %v", tt.packet, err)
+		}
+
+		// the dump and the restore commands both run with the arguments of their session
+		for _, command := range []string{MariaDBDumpCMD, MariaDBRestoreCMD} {
+			session := opt.newSessionWrapper(command)
+			var got []interface{}
+			for _, arg := range session.cmd.Args {
+				if strings.HasPrefix(arg.(string), "--max-allowed-packet") {
+					got = append(got, arg)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("max allowed packet %q gives %s the arguments %v, want %v", tt.packet, command, got, tt.want)
+			}
+		}
+	}
+}
+
+// newCredentialsAppBinding returns an AppBinding whose secret holds data, and the client serving the secret
+func newCredentialsAppBinding(data map[string][]byte) (*appcatalog.AppBinding, kubernetes.Interface) {
+	appBinding := &appcatalog.AppBinding{ObjectMeta: metav1.ObjectMeta{Name: "shop-db", Namespace: "demo"}}
+	appBinding.Spec.Secret = &core.LocalObjectReference{Name: "shop-db-auth"}
+	secret := &core.Secret{ObjectMeta: metav1.ObjectMeta{Name: "shop-db-auth", Namespace: "demo"}, Data: data}
+	return appBinding, fake.NewSimpleClientset(secret)
+}
+
+func TestExtraEnvValidation(t *testing.T) {
+	tests := []struct {
+		key     string
+		wantErr string
+	}{
+		{key: "LC_ALL"},
+		{key: "MYSQL_HOST"},
+		{key: EnvMariaDBPassword, wantErr: "carries credentials"},
+		{key: "mysql_pwd", wantErr: "carries credentials"},
+		{key: EnvMariaDBLoginFile, wantErr: "carries credentials"},
+		{key: "", wantErr: "invalid environment variable name"},
+		{key: "LC_ALL=C", wantErr: "invalid environment variable name"},
+	}
+	for _, tt := range tests {
+		opt := newTestBackupOptions()
+		opt.setupOptions.ScratchDir = t.TempDir()
+		opt.extraEnv = map[string]string{tt.key: "value"}
+		err := opt.validateConnectionOptions()
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("validateConnectionOptions() with --extra-env %q = %v, want %q", tt.key, err, tt.wantErr)
+		}
+	}
+}
+
+func TestExtraEnvOfTheSessions(t *testing.T) {
+	opt := newTestBackupOptions()
+	opt.setupOptions.ScratchDir = t.TempDir()
+	opt.clientCmd = fakeCommand(t, `echo "$LC_ALL|$MYSQL_HOST|$MYSQL_PWD|${MYSQL_TEST_LOGIN_FILE-unset}"`)
+	// the reserved keys are skipped by the sessions even when the validation is bypassed
+	opt.extraEnv = map[string]string{
+		"LC_ALL":            "C.UTF-8",
+		"MYSQL_HOST":        "db.other.svc",
+		EnvMariaDBPassword:  "leaked",
+		EnvMariaDBLoginFile: "/tmp/login.cnf",
+	}
+	session, err := opt.prepareSession(newTestAppBinding(opt), opt.dumpCmd, opt.setupOptions.ScratchDir)
+	defer session.cleanup()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := session.executeQuery("SELECT 1;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.TrimSpace(string(output)), "C.UTF-8|db.other.svc|s3cret|unset"; got != want {
+		t.Errorf("the client ran with %q, want %q", got, want)
+	}
+}
+
+func TestValidateScratchDir(t *testing.T) {
+	// a missing directory is created private
+	dir := filepath.Join(t.TempDir(), "scratch", "mariadb")
+	if err := validateScratchDir(dir); err != nil {
+		t.Fatalf("validateScratchDir() error = %v", err)
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsDir() || info.Mode().Perm() != 0o700 {
+		t.Errorf("the scratch directory was created with mode %v, want a directory with 0700", info.Mode())
+	}
+	// the write check leaves nothing behind
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Errorf("the scratch directory holds %v, %v after the check", entries, err)
+	}
+
+	if err := validateScratchDir(""); err == nil || !strings.Contains(err.Error(), "the scratch directory must be set") {
+		t.Errorf("validateScratchDir() of an empty path = %v", err)
+	}
+
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateScratchDir(filepath.Join(file, "scratch")); err == nil || !strings.Contains(err.Error(), "failed to create scratch directory") {
+		t.Errorf("validateScratchDir() under a file = %v, want the creation to fail", err)
+	}
+}
+
+func TestUnwritableScratchDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0o500); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(dir, 0o700)
+	if os.Geteuid() == 0 {
+		// root writes into read-only directories, not into procfs
+		dir = "/proc/self"
+		if _, err := os.Stat(dir); err != nil {
+			t.Skip("root writes into read-only directories")
+		}
+	}
+
+	opt := newTestBackupOptions()
+	opt.setupOptions.ScratchDir = dir
+	if err := opt.validateConnectionOptions(); err == nil || !strings.Contains(err.Error(), "scratch directory "+dir+" is not writable, set --scratch-dir") {
+		t.Errorf("validateConnectionOptions() error = %v, want the scratch directory to be rejected", err)
+	}
+}
+
+func TestSessionFilesAreWrittenIntoTheScratchDir(t *testing.T) {
+	opt := newTestBackupOptions()
+	opt.setupOptions.ScratchDir = t.TempDir()
+	opt.credentialOptions.useDefaultsFile = true
+	opt.clientCmd = fakeCommand(t, `:`)
+	session, err := opt.prepareSession(newTestAppBinding(opt), opt.dumpCmd, opt.setupOptions.ScratchDir)
+	defer session.cleanup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(session.dir) != opt.setupOptions.ScratchDir || filepath.Dir(session.defaultsFile) != session.dir {
+		t.Errorf("the defaults file %s is not in a session directory of the scratch directory %s", session.defaultsFile, opt.setupOptions.ScratchDir)
+	}
+}
+
+func TestResticCacheDir(t *testing.T) {
+	tests := []struct {
+		name        string
+		enableCache bool
+		cacheDir    bool
+	}{
+		{name: "cache directory", enableCache: true, cacheDir: true},
+		{name: "cache of the scratch directory", enableCache: true},
+		{name: "cache disabled"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := newTestBackupOptions()
+			session := newFakeSession(t, opt, fakeCommand(t, "true"))
+			opt.setupOptions.EnableCache = tt.enableCache
+			resticWrapper, _ := newFakeRestic(t, opt, session)
+			if tt.cacheDir {
+				opt.resticCacheDir = filepath.Join(t.TempDir(), "cache")
+			}
+			// the cache directory is set up again by every run
+			for i := 0; i < 2; i++ {
+				if err := opt.setupResticCache(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			storeFakeSnapshot(t, resticWrapper, filepath.Join(opt.setupOptions.ScratchDir, MariaDBDumpDir, MariaDBDumpFile), sampleDump(1))
+
+			scratchCache := filepath.Join(opt.setupOptions.ScratchDir, ResticCacheDirName)
+			_, err := os.Stat(filepath.Join(scratchCache, "CACHEDIR.TAG"))
+			if (err == nil) != tt.enableCache {
+				t.Errorf("restic kept its cache in the scratch directory: %v, want %v", err == nil, tt.enableCache)
+			}
+			if !tt.cacheDir {
+				return
+			}
+			if _, err := os.Stat(filepath.Join(opt.resticCacheDir, "CACHEDIR.TAG")); err != nil {
+				t.Errorf("restic did not keep its cache in the cache directory: %v", err)
+			}
+			if target, err := os.Readlink(scratchCache); err != nil || target != opt.resticCacheDir {
+				t.Errorf("the cache of the scratch directory links to %q (%v), want %s", target, err, opt.resticCacheDir)
+			}
+		})
+	}
+}
+
+func TestInvalidResticCacheDir(t *testing.T) {
+	opt := newTestBackupOptions()
+	opt.setupOptions.ScratchDir = t.TempDir()
+	opt.resticCacheDir = t.TempDir()
+	if err := opt.setupResticCache(); err == nil || !strings.Contains(err.Error(), "the restic cache directory is set but the cache is disabled") {
+		t.Errorf("setupResticCache() error = %v, want the cache directory to require the cache", err)
+	}
+
+	opt.setupOptions.EnableCache = true
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	opt.resticCacheDir = filepath.Join(file, "cache")
+	if err := opt.setupResticCache(); err == nil || !strings.Contains(err.Error(), "failed to create restic cache directory") {
+		t.Errorf("setupResticCache() under a file = %v, want the creation to fail", err)
+	}
+
+	if os.Geteuid() == 0 {
+		// root writes into read-only directories, not into procfs
+		opt.resticCacheDir = "/proc/self"
+	} else {
+		opt.resticCacheDir = t.TempDir()
+		if err := os.Chmod(opt.resticCacheDir, 0o500); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Chmod(opt.resticCacheDir, 0o700)
+	}
+	if err := opt.setupResticCache(); err == nil || !strings.Contains(err.Error(), "restic cache directory "+opt.resticCacheDir+" is not writable") {
+		t.Errorf("setupResticCache() error = %v, want the cache directory to be rejected", err)
+	}
+}
+
+func TestMergeUserArgs(t *testing.T) {
+	tests := []struct {
+		name     string
+		defaults string
+		explicit string
+		want     string
+	}{
+		{
+			name:     "no conflict",
+			defaults: "--quick --max-allowed-packet=64M",
+			explicit: "--all-databases",
+			want:     "--quick --max-allowed-packet=64M --all-databases",
+		},
+		{
+			name:     "explicit value",
+			defaults: "--quick --max-allowed-packet=64M",
+			explicit: "--max-allowed-packet=1G",
+			want:     "--quick --max-allowed-packet=1G",
+		},
+		{
+			name:     "value of the default as a separate argument",
+			defaults: "--max-allowed-packet 64M --quick",
+			explicit: "--max-allowed-packet=1G",
+			want:     "--quick --max-allowed-packet=1G",
+		},
+		{
+			name:     "negated option",
+			defaults: "--lock-tables --routines",
+			explicit: "--skip-lock-tables",
+			want:     "--routines --skip-lock-tables",
+		},
+		{
+			name:     "enabled option",
+			defaults: "--disable-keys",
+			explicit: "--enable-keys",
+			want:     "--enable-keys",
+		},
+		{
+			name:     "underscores",
+			defaults: "--net_buffer_length=16384",
+			explicit: "--net-buffer-length=32768",
+			want:     "--net-buffer-length=32768",
+		},
+		{
+			name:     "short option",
+			defaults: "-q --events",
+			explicit: "-q",
+			want:     "--events -q",
+		},
+		{
+			name:     "no explicit args",
+			defaults: "--quick",
+			want:     "--quick",
+		},
+		{
+			name:     "no defaults",
+			explicit: "--all-databases",
+			want:     "--all-databases",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergeUserArgs(tt.defaults, tt.explicit); got != tt.want {
+				t.Errorf("mergeUserArgs(%q, %q) = %q, want %q", tt.defaults, tt.explicit, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergedUserArgsOfTheDump(t *testing.T) {
+	opt := newTestBackupOptions()
+	opt.myArgs = mergeUserArgs("--max-allowed-packet=64M --skip-lock-tables", "--max-allowed-packet=1G --lock-tables")
+	session := newFakeSession(t, opt, MariaDBDumpCMD)
+	session.setUserArgs(opt.myArgs)
+
+	// the client applies the last value of an option, the explicit one must be the only one
+	args := session.cmd.Args
+	if countArg(args, "--max-allowed-packet=1G") != 1 || countArg(args, "--max-allowed-packet=64M") != 0 ||
+		countArg(args, "--lock-tables") != 1 || countArg(args, "--skip-lock-tables") != 0 {
+		t.Errorf("the dump runs with %q, want the explicit args only", args)
+	}
+}
+
+func TestSecretKeyNames(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     map[string][]byte
+		userKey  string
+		passKey  string
+		wantUser string
+		wantPass string
+		wantErr  string
+	}{
+		{
+			name:     "default keys",
+			data:     map[string][]byte{"username": []byte("root"), "password": []byte("s3cret")},
+			userKey:  MariaDBUser,
+			passKey:  MariaDBPassword,
+			wantUser: "root",
+			wantPass: "s3cret",
+		},
+		{
+			name:     "overridden keys",
+			data:     map[string][]byte{"db-user": []byte("backup"), "db-pass": []byte("p4ss"), "username": []byte("root")},
+			userKey:  "db-user",
+			passKey:  "db-pass",
+			wantUser: "backup",
+			wantPass: "p4ss",
+		},
+		{
+			name:    "missing overridden key",
+			data:    map[string][]byte{"username": []byte("root"), "password": []byte("s3cret")},
+			userKey: "db-user",
+			passKey: "db-pass",
+			wantErr: `key "db-user" is missing in secret demo/shop-db-auth`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			appBinding, kubeClient := newCredentialsAppBinding(tt.data)
+			session := newFakeSession(t, &mariadbOptions{}, "mariadb")
+			err := session.setDatabaseCredentials(kubeClient, appBinding, t.TempDir(), credentialOptions{userKey: tt.userKey, passwordKey: tt.passKey, authMode: AuthModePassword})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("setDatabaseCredentials() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("setDatabaseCredentials() error = %v", err)
+			}
+			if want := []interface{}{"-u", tt.wantUser}; !reflect.DeepEqual(session.cmd.Args, want) {
+				t.Errorf("arguments = %v, want %v", session.cmd.Args, want)
+			}
+			if got := session.sh.Env[EnvMariaDBPassword]; got != tt.wantPass {
+				t.Errorf("%s = %q, want %q", EnvMariaDBPassword, got, tt.wantPass)
+			}
+		})
+	}
+}
+
+func TestSecretTransforms(t *testing.T) {
+	appBinding, _ := newCredentialsAppBinding(map[string][]byte{"user": []byte("root")})
+	appBinding.Spec.SecretTransforms = []appcatalog.SecretTransform{
+		{RenameKey: &appcatalog.RenameKeyTransform{From: "user", To: MariaDBUser}},
+		{AddKeysFrom: &appcatalog.AddKeysFromTransform{SecretRef: &core.LocalObjectReference{Name: "shop-db-password"}}},
+		{RemoveKey: &appcatalog.RemoveKeyTransform{Key: "user"}},
+	}
+	if got, want := secretTransformTypes(appBinding), []string{"renameKey", "addKeysFrom secret shop-db-password", "removeKey"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("secretTransformTypes() = %q, want %q", got, want)
+	}
+
+	secret := &core.Secret{ObjectMeta: metav1.ObjectMeta{Name: "shop-db-auth", Namespace: "demo"}, Data: map[string][]byte{"user": []byte("root")}}
+	password := &core.Secret{ObjectMeta: metav1.ObjectMeta{Name: "shop-db-password", Namespace: "demo"}, Data: map[string][]byte{MariaDBPassword: []byte("s3cret")}}
+	session := newFakeSession(t, &mariadbOptions{}, "mariadb")
+	var err error
+	logs := captureLogs(t, func() {
+		err = session.setDatabaseCredentials(fake.NewSimpleClientset(secret, password), appBinding, t.TempDir(), credentialOptions{userKey: MariaDBUser, passwordKey: MariaDBPassword, authMode: AuthModePassword})
+	})
+	if err != nil {
+		t.Fatalf("setDatabaseCredentials() error = %v", err)
+	}
+	if !strings.Contains(logs, "Applying the secret transforms of AppBinding demo/shop-db: renameKey, addKeysFrom secret shop-db-password, removeKey") {
+		t.Errorf("setDatabaseCredentials() logged:\n%s\nwant the transforms of the AppBinding", logs)
+	}
+	if want := []interface{}{"-u", "root"}; !reflect.DeepEqual(session.cmd.Args, want) || session.sh.Env[EnvMariaDBPassword] != "s3cret" {
+		t.Errorf("the transformed credentials are %v with the password %q", session.cmd.Args, session.sh.Env[EnvMariaDBPassword])
+	}
+
+	// the secret the transform reads is missing
+	session = newFakeSession(t, &mariadbOptions{}, "mariadb")
+	err = session.setDatabaseCredentials(fake.NewSimpleClientset(secret), appBinding, t.TempDir(), credentialOptions{userKey: MariaDBUser, passwordKey: MariaDBPassword, authMode: AuthModePassword})
+	want := "failed to transform secret demo/shop-db-auth of AppBinding demo/shop-db, check the secretTransforms of the AppBinding and the secrets they read: "
+	if err == nil || !strings.HasPrefix(err.Error(), want) || !strings.Contains(err.Error(), `secrets "shop-db-password" not found`) {
+		t.Errorf("setDatabaseCredentials() error = %v, want %q followed by the failure of the transform", err, want)
+	}
+}
@@ -0,0 +1,80 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/errors"
+	appcatalog "kmodules.xyz/custom-resources/apis/appcatalog/v1alpha1"
+)
+
+// validate checks that the AppBinding, its secret (or the credential files) and the credential keys exist before any dump or restore starts,
+// so that a misconfiguration fails fast with all the problems reported at once.
+func (opt *mariadbOptions) validate(ctx context.Context) error {
+	var errs []error
+
+	if opt.storageSecret.Name != "" {
+		_, err := opt.kubeClient.CoreV1().Secrets(opt.storageSecret.Namespace).Get(ctx, opt.storageSecret.Name, metav1.GetOptions{})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("storage secret %s/%s: %w", opt.storageSecret.Namespace, opt.storageSecret.Name, err))
+		}
+	}
+
+	appBinding, err := opt.catalogClient.AppcatalogV1alpha1().AppBindings(opt.appBindingNamespace).Get(ctx, opt.appBindingName, metav1.GetOptions{})
+	if err != nil {
+		errs = append(errs, fmt.Errorf("AppBinding %s/%s: %w", opt.appBindingNamespace, opt.appBindingName, err))
+		return errors.NewAggregate(errs)
+	}
+
+	errs = append(errs, opt.validateCredentials(ctx, appBinding)...)
+	return errors.NewAggregate(errs)
+}
+
+// validateCredentials checks the credential files, or the secret of the AppBinding, hold the credential keys
+func (opt *mariadbOptions) validateCredentials(ctx context.Context, appBinding *appcatalog.AppBinding) []error {
+	if opt.credentialOptions.credentialsDir != "" {
+		if _, err := readCredentialFiles(opt.credentialOptions.credentialsDir, opt.credentialOptions.credentialKeys()); err != nil {
+			return []error{err}
+		}
+		return nil
+	}
+
+	if appBinding.Spec.Secret == nil || appBinding.Spec.Secret.Name == "" {
+		return []error{fmt.Errorf("AppBinding %s/%s does not reference any secret", appBinding.Namespace, appBinding.Name)}
+	}
+
+	secret, err := opt.kubeClient.CoreV1().Secrets(appBinding.Namespace).Get(ctx, appBinding.Spec.Secret.Name, metav1.GetOptions{})
+	if err != nil {
+		return []error{fmt.Errorf("secret %s/%s of AppBinding %s: %w", appBinding.Namespace, appBinding.Spec.Secret.Name, appBinding.Name, err)}
+	}
+
+	// the keys may be produced by the secret transforms of the AppBinding
+	if err = appBinding.TransformSecret(opt.kubeClient, secret.Data); err != nil {
+		return []error{fmt.Errorf("failed to transform secret %s/%s of AppBinding %s: %w", secret.Namespace, secret.Name, appBinding.Name, err)}
+	}
+	// the password of the IAM authentication is a token, only the user is read from the secret
+	var errs []error
+	for _, key := range opt.credentialOptions.credentialKeys() {
+		if len(secret.Data[key]) == 0 {
+			errs = append(errs, fmt.Errorf("key %q is missing or empty in secret %s/%s", key, secret.Namespace, secret.Name))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,90 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestValidateCredentials(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     map[string][]byte
+		files    map[string]string
+		authMode string
+		wantErrs []string
+	}{
+		{
+			name: "user and password",
+			data: map[string][]byte{MariaDBUser: []byte("root"), MariaDBPassword: []byte("s3cret")},
+		},
+		{
+			name:     "missing password",
+			data:     map[string][]byte{MariaDBUser: []byte("root")},
+			wantErrs: []string{`key "password" is missing or empty in secret demo/shop-db-auth`},
+		},
+		{
+			name:     "empty user and password",
+			data:     map[string][]byte{MariaDBUser: {}},
+			wantErrs: []string{`key "username" is missing or empty`, `key "password" is missing or empty`},
+		},
+		{
+			name:     "IAM authentication",
+			data:     map[string][]byte{MariaDBUser: []byte("iam_user")},
+			authMode: AuthModeAWSIAM,
+		},
+		{
+			name:     "IAM authentication without user",
+			data:     map[string][]byte{MariaDBPassword: []byte("unused")},
+			authMode: AuthModeAWSIAM,
+			wantErrs: []string{`key "username" is missing or empty`},
+		},
+		{
+			name:     "IAM authentication with credential files",
+			files:    map[string]string{MariaDBUser: "iam_user"},
+			authMode: AuthModeAWSIAM,
+		},
+		{
+			name:     "credential files without password",
+			files:    map[string]string{MariaDBUser: "root"},
+			wantErrs: []string{"password: no such file or directory"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := newTestBackupOptions()
+			appBinding, kubeClient := newCredentialsAppBinding(tt.data)
+			opt.kubeClient = kubeClient
+			opt.credentialOptions = credentialOptions{userKey: MariaDBUser, passwordKey: MariaDBPassword, authMode: tt.authMode}
+			if tt.files != nil {
+				opt.credentialOptions.credentialsDir = writeCredentialFiles(t, tt.files)
+			}
+
+			errs := opt.validateCredentials(context.Background(), appBinding)
+			if len(errs) != len(tt.wantErrs) {
+				t.Fatalf("validateCredentials() = %v, want %d errors", errs, len(tt.wantErrs))
+			}
+			for i, err := range errs {
+				if !strings.Contains(err.Error(), tt.wantErrs[i]) {
+					t.Errorf("validateCredentials() error = %v, want %q", err, tt.wantErrs[i])
+				}
+			}
+		})
+	}
+}
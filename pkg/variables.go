@@ -0,0 +1,229 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"k8s.io/klog/v2"
+	"stash.appscode.dev/apimachinery/pkg/restic"
+)
+
+const (
+	ServerVariablesFileName = "server-variables.json"
+
+	// SQLModeServer restores with the sql_mode of the target server
+	SQLModeServer = "server"
+)
+
+var sqlModeNameRegex = regexp.MustCompile(`^[A-Za-z_]+$`)
+
+// DefaultServerVariables are the variables recorded at backup time, the ones that change how the dump is replayed
+var DefaultServerVariables = []string{
+	"sql_mode",
+	"character_set_server",
+	"collation_server",
+	"time_zone",
+	"lower_case_table_names",
+	"explicit_defaults_for_timestamp",
+	"innodb_file_per_table",
+	"innodb_default_row_format",
+	"innodb_strict_mode",
+}
+
+// ServerVariables holds the global variables of the server a backup was taken from
+type ServerVariables map[string]string
+
+// serverVariablesFile returns the path of the server variables written into the dump directory
+func serverVariablesFile(dumpdir string) string {
+	return filepath.Join(dumpdir, ServerVariablesFileName)
+}
+
+// serverVariables queries the global value of the variables. The variables the server does not have are left out.
+func (session *sessionWrapper) serverVariables(names []string) (ServerVariables, error) {
+	quoted := make([]string, 0, len(names))
+	for _, name := range names {
+		quoted = append(quoted, quoteString(name))
+	}
+	output, err := session.executeQuery(fmt.Sprintf("SHOW GLOBAL VARIABLES WHERE Variable_name IN (%s);", strings.Join(quoted, ",")))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the server variables: %w", err)
+	}
+	return parseServerVariables(string(output)), nil
+}
+
+// parseServerVariables reads the rows "<name>\t<value>" of SHOW VARIABLES, the value may be empty
+func parseServerVariables(output string) ServerVariables {
+	variables := ServerVariables{}
+	for _, line := range strings.Split(output, "\n") {
+		name, value, _ := strings.Cut(line, "\t")
+		if name = strings.TrimSpace(name); name != "" {
+			variables[name] = strings.TrimSpace(value)
+		}
+	}
+	return variables
+}
+
+func (variables ServerVariables) writeToFile(fileName string) error {
+	data, err := json.MarshalIndent(variables, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fileName, data, 0o644)
+}
+
+// readServerVariables reads the server variables stored in the snapshot next to the dump
+func readServerVariables(resticWrapper *restic.ResticWrapper, dumpOptions restic.DumpOptions, fileName string) (ServerVariables, error) {
+	data, err := readSnapshotFile(resticWrapper, dumpOptions, fileName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the server variables %s from the snapshot: %w", fileName, err)
+	}
+	variables := ServerVariables{}
+	if err = json.Unmarshal(data, &variables); err != nil {
+		return nil, fmt.Errorf("failed to parse the server variables %s: %w", fileName, err)
+	}
+	return variables, nil
+}
+
+// sqlModeDiff returns the modes enabled only on the source and only on the target. The modes are
+// compared as sets, since the server may list the same modes in a different order.
+func sqlModeDiff(source, target string) (missing, extra []string) {
+	modes := func(sqlMode string) map[string]bool {
+		set := map[string]bool{}
+		for _, mode := range strings.Split(sqlMode, ",") {
+			if mode = strings.ToUpper(strings.TrimSpace(mode)); mode != "" {
+				set[mode] = true
+			}
+		}
+		return set
+	}
+	sourceModes, targetModes := modes(source), modes(target)
+	for mode := range sourceModes {
+		if !targetModes[mode] {
+			missing = append(missing, mode)
+		}
+	}
+	for mode := range targetModes {
+		if !sourceModes[mode] {
+			extra = append(extra, mode)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(extra)
+	return missing, extra
+}
+
+// validateSQLMode checks that sqlMode is a comma separated list of modes, i.e. NO_AUTO_VALUE_ON_ZERO,ALLOW_INVALID_DATES
+func validateSQLMode(sqlMode string) error {
+	for _, mode := range strings.Split(sqlMode, ",") {
+		if !sqlModeNameRegex.MatchString(strings.TrimSpace(mode)) {
+			return fmt.Errorf("invalid sql_mode %q, must be a comma separated list of modes", sqlMode)
+		}
+	}
+	return nil
+}
+
+// restoreInitCommandArgs returns the argument setting the session variables of the restore: the sql_mode
+// given, otherwise the one recorded at backup time if any, and foreign_key_checks when they are skipped.
+// mariadb-dump sets its own sql_mode in the header of its dumps, this one applies to the statements
+// before it and to the dumps of other tools. The client takes a single --init-command, so they share it.
+func (opt *mariadbOptions) restoreInitCommandArgs(resticWrapper *restic.ResticWrapper) []interface{} {
+	var assignments []string
+	if sqlMode, ok := opt.restoreSQLModeValue(resticWrapper); ok {
+		klog.Infof("Restoring with sql_mode %q", sqlMode)
+		assignments = append(assignments, "sql_mode="+quoteString(sqlMode))
+	}
+	if opt.skipForeignKeyChecks {
+		klog.Warningln("Restoring with the foreign key checks disabled, the rows referencing missing rows are not detected")
+	}
+	// the session variables end with the connection of the client, so they never outlive a failed restore
+	if opt.fastLoad {
+		klog.Infoln("Restoring with the unique and foreign key checks disabled during the load")
+		assignments = append(assignments, "unique_checks=0")
+	}
+	if opt.skipForeignKeyChecks || opt.fastLoad {
+		assignments = append(assignments, "foreign_key_checks=0")
+	}
+	if len(assignments) == 0 {
+		return nil
+	}
+	return []interface{}{"--init-command=SET SESSION " + strings.Join(assignments, ", ")}
+}
+
+// restoreSQLModeValue returns the sql_mode of the restore session, false to keep the one of the target
+func (opt *mariadbOptions) restoreSQLModeValue(resticWrapper *restic.ResticWrapper) (string, bool) {
+	sqlMode := opt.restoreSQLMode
+	switch sqlMode {
+	case SQLModeServer:
+		return "", false
+	case "":
+		// the snapshots of single databases have no server variables
+		if opt.database != "" || len(opt.databases) > 0 {
+			return "", false
+		}
+		source, err := readServerVariables(resticWrapper, opt.dumpOptions, serverVariablesFile(filepath.Join(opt.setupOptions.ScratchDir, MariaDBDumpDir)))
+		if err != nil {
+			klog.V(4).Infof("Restoring with the sql_mode of the target. Reason: %v", err)
+			return "", false
+		}
+		var ok bool
+		if sqlMode, ok = source["sql_mode"]; !ok {
+			return "", false
+		}
+		if hasArg(strings.Fields(opt.myArgs), "--init-command") {
+			klog.Warningf("The sql_mode of the backup source (%q) is not set, the mariadb args already hold an --init-command", sqlMode)
+			return "", false
+		}
+		// the recorded mode may be empty, which is a valid mode
+		if sqlMode != "" && validateSQLMode(sqlMode) != nil {
+			klog.Warningf("Ignoring the invalid sql_mode %q recorded at backup time", sqlMode)
+			return "", false
+		}
+	}
+	return sqlMode, true
+}
+
+// warnSQLModeMismatch warns when the sql_mode of the target differs from the one of the server the dump
+// was taken from, since the statements of the dump may then be replayed differently or fail.
+// Snapshots without recorded variables are not checked.
+func (opt *mariadbOptions) warnSQLModeMismatch(session *sessionWrapper, resticWrapper *restic.ResticWrapper) {
+	source, err := readServerVariables(resticWrapper, opt.dumpOptions, serverVariablesFile(filepath.Join(opt.setupOptions.ScratchDir, MariaDBDumpDir)))
+	if err != nil {
+		klog.V(4).Infof("Skipping the sql_mode check. Reason: %v", err)
+		return
+	}
+	sourceMode, ok := source["sql_mode"]
+	if !ok {
+		return
+	}
+	target, err := session.serverVariables([]string{"sql_mode"})
+	if err != nil {
+		klog.Warningf("Skipping the sql_mode check. Reason: %v", err)
+		return
+	}
+	missing, extra := sqlModeDiff(sourceMode, target["sql_mode"])
+	if len(missing) == 0 && len(extra) == 0 {
+		return
+	}
+	klog.Warningf("The sql_mode of the target differs from the one of the backup source (%q), missing %v, additional %v", sourceMode, missing, extra)
+}
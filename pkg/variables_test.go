@@ -0,0 +1,254 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/klog/v2"
+)
+
+// captureLogs returns what f logs
+func captureLogs(t *testing.T, f func()) string {
+	t.Helper()
+	var logs bytes.Buffer
+	klog.LogToStderr(false)
+	klog.SetOutput(&logs)
+	defer func() {
+		klog.SetOutput(os.Stderr)
+		klog.LogToStderr(true)
+	}()
+	f()
+	klog.Flush()
+	return logs.String()
+}
+
+func TestServerVariablesFlag(t *testing.T) {
+	cmd := NewCmdBackup()
+	if got := cmd.Flags().Lookup("server-variables").DefValue; got != "["+strings.Join(DefaultServerVariables, ",")+"]" {
+		t.Errorf("--server-variables defaults to %s", got)
+	}
+	if err := cmd.Flags().Parse([]string{"--server-variables=sql_mode,wait_timeout"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := cmd.Flags().GetStringSlice("server-variables"); err != nil || !reflect.DeepEqual(got, []string{"sql_mode", "wait_timeout"}) {
+		t.Errorf("--server-variables = %v, %v, want the variables given", got, err)
+	}
+}
+
+func TestCaptureServerVariables(t *testing.T) {
+	queries := filepath.Join(t.TempDir(), "queries")
+	session := newFakeSession(t, &mariadbOptions{}, fakeCommand(t, `eval query=\${$#}
+printf '%s\n' "$query" >> `+queries+`
+printf 'character_set_server\tutf8mb4\nsql_mode\t\ntime_zone\tSYSTEM\n'`))
+
+	variables, err := session.serverVariables([]string{"sql_mode", "character_set_server", "time_zone", "innodb_strict_mode"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the empty sql_mode is recorded, the variables the server does not have are left out
+	want := ServerVariables{"character_set_server": "utf8mb4", "sql_mode": "", "time_zone": "SYSTEM"}
+	if !reflect.DeepEqual(variables, want) {
+		t.Errorf("serverVariables() = %v, want %v", variables, want)
+	}
+	data, err := os.ReadFile(queries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "SHOW GLOBAL VARIABLES WHERE Variable_name IN ('sql_mode','character_set_server','time_zone','innodb_strict_mode');\n"; got != want {
+		t.Errorf("serverVariables() ran %q, want %q", got, want)
+	}
+
+	// the variables are stored next to the dumps and read back from the snapshot at restore time
+	opt := newTestRestoreOptions()
+	resticWrapper, _ := newFakeRestic(t, opt, session)
+	fileName := serverVariablesFile(filepath.Join(opt.setupOptions.ScratchDir, MariaDBDumpDir))
+	written := filepath.Join(t.TempDir(), "server-variables.json")
+	if err = variables.writeToFile(written); err != nil {
+		t.Fatal(err)
+	}
+	if data, err = os.ReadFile(written); err != nil {
+		t.Fatal(err)
+	}
+	storeFakeSnapshot(t, resticWrapper, fileName, data)
+	got, err := readServerVariables(resticWrapper, opt.dumpOptions, fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readServerVariables() = %v, want %v", got, want)
+	}
+}
+
+func TestSQLModeDiff(t *testing.T) {
+	tests := []struct {
+		source, target string
+		missing, extra []string
+	}{
+		{source: "STRICT_TRANS_TABLES,NO_ZERO_DATE", target: "NO_ZERO_DATE,STRICT_TRANS_TABLES"},
+		{source: "strict_trans_tables", target: "STRICT_TRANS_TABLES"},
+		{source: "", target: ""},
+		{source: "STRICT_TRANS_TABLES,NO_ZERO_DATE", target: "STRICT_TRANS_TABLES,ANSI_QUOTES", missing: []string{"NO_ZERO_DATE"}, extra: []string{"ANSI_QUOTES"}},
+		{source: "", target: "STRICT_ALL_TABLES", extra: []string{"STRICT_ALL_TABLES"}},
+	}
+	for _, tt := range tests {
+		missing, extra := sqlModeDiff(tt.source, tt.target)
+		if !reflect.DeepEqual(missing, tt.missing) || !reflect.DeepEqual(extra, tt.extra) {
+			t.Errorf("sqlModeDiff(%q, %q) = %v, %v, want %v, %v", tt.source, tt.target, missing, extra, tt.missing, tt.extra)
+		}
+	}
+}
+
+func TestWarnSQLModeMismatch(t *testing.T) {
+	tests := []struct {
+		name       string
+		source     []byte
+		targetMode string
+		wantWarn   string
+	}{
+		{
+			name:       "same modes",
+			source:     []byte(`{"sql_mode": "STRICT_TRANS_TABLES,NO_ZERO_DATE"}`),
+			targetMode: "NO_ZERO_DATE,STRICT_TRANS_TABLES",
+		},
+		{
+			name:       "different modes",
+			source:     []byte(`{"sql_mode": "STRICT_TRANS_TABLES,NO_ZERO_DATE"}`),
+			targetMode: "STRICT_TRANS_TABLES,ANSI_QUOTES",
+			wantWarn:   `The sql_mode of the target differs from the one of the backup source ("STRICT_TRANS_TABLES,NO_ZERO_DATE"), missing [NO_ZERO_DATE], additional [ANSI_QUOTES]`,
+		},
+		{
+			name:       "sql_mode not recorded",
+			source:     []byte(`{"time_zone": "SYSTEM"}`),
+			targetMode: "ANSI_QUOTES",
+		},
+		{
+			name:       "backup without variables",
+			targetMode: "ANSI_QUOTES",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := newTestRestoreOptions()
+			session := newFakeSession(t, opt, fakeCommand(t, `printf 'sql_mode\t`+tt.targetMode+`\n'`))
+			resticWrapper, _ := newFakeRestic(t, opt, session)
+			dumpdir := filepath.Join(opt.setupOptions.ScratchDir, MariaDBDumpDir)
+			if tt.source != nil {
+				storeFakeSnapshot(t, resticWrapper, serverVariablesFile(dumpdir), tt.source)
+			} else {
+				storeFakeSnapshot(t, resticWrapper, filepath.Join(dumpdir, MariaDBDumpFile), sampleDump(1))
+			}
+
+			logs := captureLogs(t, func() { opt.warnSQLModeMismatch(session, resticWrapper) })
+			warned := strings.Contains(logs, "The sql_mode of the target differs")
+			if tt.wantWarn == "" && warned || tt.wantWarn != "" && !strings.Contains(logs, tt.wantWarn) {
+				t.Errorf("warnSQLModeMismatch() logged:\n%s\nwant the warning %q", logs, tt.wantWarn)
+			}
+		})
+	}
+}
+
+func TestValidateSQLMode(t *testing.T) {
+	tests := []struct {
+		sqlMode string
+		wantErr bool
+	}{
+		{sqlMode: "ANSI_QUOTES"},
+		{sqlMode: "NO_AUTO_VALUE_ON_ZERO,ALLOW_INVALID_DATES"},
+		{sqlMode: "STRICT_TRANS_TABLES, NO_ZERO_DATE"},
+		{sqlMode: "ANSI'; DROP DATABASE db; --", wantErr: true},
+		{sqlMode: "ANSI_QUOTES,,NO_ZERO_DATE", wantErr: true},
+		{sqlMode: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := validateSQLMode(tt.sqlMode); (err != nil) != tt.wantErr {
+			t.Errorf("validateSQLMode(%q) error = %v, wantErr %v", tt.sqlMode, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRestoreSQLModeInitCommand(t *testing.T) {
+	tests := []struct {
+		name           string
+		restoreSQLMode string
+		myArgs         string
+		source         []byte
+		want           []interface{}
+	}{
+		{
+			name:           "mode given",
+			restoreSQLMode: "NO_AUTO_VALUE_ON_ZERO,ALLOW_INVALID_DATES",
+			source:         []byte(`{"sql_mode": "ANSI_QUOTES"}`),
+			want:           []interface{}{"--init-command=SET SESSION sql_mode='NO_AUTO_VALUE_ON_ZERO,ALLOW_INVALID_DATES'"},
+		},
+		{
+			name:           "mode of the server",
+			restoreSQLMode: SQLModeServer,
+			source:         []byte(`{"sql_mode": "ANSI_QUOTES"}`),
+		},
+		{
+			name:   "mode recorded at backup time",
+			source: []byte(`{"sql_mode": "STRICT_TRANS_TABLES,NO_ZERO_DATE"}`),
+			want:   []interface{}{"--init-command=SET SESSION sql_mode='STRICT_TRANS_TABLES,NO_ZERO_DATE'"},
+		},
+		{
+			name:   "empty mode recorded at backup time",
+			source: []byte(`{"sql_mode": ""}`),
+			want:   []interface{}{"--init-command=SET SESSION sql_mode=''"},
+		},
+		{
+			name:   "invalid mode recorded at backup time",
+			source: []byte(`{"sql_mode": "ANSI'; DROP DATABASE db; --"}`),
+		},
+		{
+			name:   "sql_mode not recorded",
+			source: []byte(`{"time_zone": "SYSTEM"}`),
+		},
+		{
+			name: "backup without variables",
+		},
+		{
+			name:   "init command of the mariadb args",
+			myArgs: "--init-command=SET\\ NAMES\\ utf8mb4",
+			source: []byte(`{"sql_mode": "ANSI_QUOTES"}`),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := newTestRestoreOptions()
+			opt.restoreSQLMode = tt.restoreSQLMode
+			opt.myArgs = tt.myArgs
+			session := newFakeSession(t, opt, fakeCommand(t, "true"))
+			resticWrapper, _ := newFakeRestic(t, opt, session)
+			dumpdir := filepath.Join(opt.setupOptions.ScratchDir, MariaDBDumpDir)
+			if tt.source != nil {
+				storeFakeSnapshot(t, resticWrapper, serverVariablesFile(dumpdir), tt.source)
+			} else {
+				storeFakeSnapshot(t, resticWrapper, filepath.Join(dumpdir, MariaDBDumpFile), sampleDump(1))
+			}
+
+			if got := opt.restoreInitCommandArgs(resticWrapper); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("restoreInitCommandArgs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
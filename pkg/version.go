@@ -0,0 +1,136 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"stash.appscode.dev/apimachinery/pkg/restic"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	ServerVersionTagPrefix = "server-version="
+)
+
+// MariaDB reports "5.5.5-" before its version to old MySQL clients, it is skipped
+var serverVersionRegex = regexp.MustCompile(`^(?:5\.5\.5-)?(\d+)\.(\d+)(?:\.(\d+))?(?:[-+~](.*))?$`)
+
+// serverVersion is the version of a MariaDB or MySQL server
+type serverVersion struct {
+	Major   int
+	Minor   int
+	Patch   int
+	MariaDB bool
+	raw     string
+}
+
+// parseServerVersion parses the output of SELECT VERSION(), i.e. 10.11.6-MariaDB-1:10.11.6+maria~ubu2204,
+// 5.5.5-10.6.12-MariaDB, 11.2.2-MariaDB-log or 8.0.35
+func parseServerVersion(version string) (*serverVersion, error) {
+	version = strings.TrimSpace(version)
+	m := serverVersionRegex.FindStringSubmatch(version)
+	if m == nil {
+		return nil, fmt.Errorf("invalid server version %q", version)
+	}
+	v := &serverVersion{
+		MariaDB: strings.Contains(strings.ToLower(m[4]), "mariadb"),
+		raw:     version,
+	}
+	v.Major, _ = strconv.Atoi(m[1])
+	v.Minor, _ = strconv.Atoi(m[2])
+	if m[3] != "" {
+		v.Patch, _ = strconv.Atoi(m[3])
+	}
+	return v, nil
+}
+
+func (v *serverVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+func (v *serverVersion) flavor() string {
+	if v.MariaDB {
+		return "MariaDB"
+	}
+	return "MySQL"
+}
+
+// olderRelease reports whether v is an older release series than other. MariaDB numbers its
+// major releases with the first two components (10.6, 10.11, 11.2), so both are compared.
+func (v *serverVersion) olderRelease(other *serverVersion) bool {
+	if v.Major != other.Major {
+		return v.Major < other.Major
+	}
+	return v.Minor < other.Minor
+}
+
+// serverVersion queries the version of the server
+func (session *sessionWrapper) serverVersion() (*serverVersion, error) {
+	output, err := session.executeQuery("SELECT VERSION();")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the server version: %w", err)
+	}
+	return parseServerVersion(string(output))
+}
+
+// serverVersionTag returns the restic arguments tagging a snapshot with the server version.
+// restic splits tags on commas, so they are removed from the version.
+func serverVersionTag(v *serverVersion) []string {
+	return []string{"--tag", ServerVersionTagPrefix + strings.ReplaceAll(v.raw, ",", "")}
+}
+
+// checkServerCompatibility compares the version of the server the snapshot was taken from with the
+// target server. Restoring into an older release series or another flavor is reported, and fails if strict.
+func checkServerCompatibility(session *sessionWrapper, resticWrapper *restic.ResticWrapper, dumpOptions restic.DumpOptions, db string, strict bool) error {
+	snapshot, err := findSnapshot(resticWrapper, dumpOptions, db)
+	if err != nil {
+		return err
+	}
+	value, ok := snapshotTagValue(snapshot, ServerVersionTagPrefix)
+	if !ok {
+		klog.Warningf("Snapshot %s does not record the version of its server, skipping the compatibility check", snapshot.ID)
+		return nil
+	}
+	source, err := parseServerVersion(value)
+	if err != nil {
+		return err
+	}
+	target, err := session.serverVersion()
+	if err != nil {
+		return err
+	}
+
+	var problem string
+	switch {
+	case source.MariaDB != target.MariaDB:
+		problem = fmt.Sprintf("the dump was taken from %s %s and is restored into %s %s", source.flavor(), source, target.flavor(), target)
+	case target.olderRelease(source):
+		problem = fmt.Sprintf("the dump was taken from %s %s and is restored into the older %s", source.flavor(), source, target)
+	default:
+		return nil
+	}
+	if strict {
+		return fmt.Errorf("incompatible server version, %s", problem)
+	}
+	klog.Warningf("Server version mismatch, %s. The restore may fail or lose data", problem)
+	return nil
+}
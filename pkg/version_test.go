@@ -0,0 +1,114 @@
+/*
+Copyright AppsCode Inc. and Contributors
+
+Licensed under the AppsCode Free Trial License 1.0.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://github.com/appscode/licenses/raw/1.0.0/AppsCode-Free-Trial-1.0.0.md
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pkg
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseServerVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    string
+		mariadb bool
+		wantErr bool
+	}{
+		{version: "10.11.6-MariaDB-1:10.11.6+maria~ubu2204", want: "10.11.6", mariadb: true},
+		{version: "5.5.5-10.6.12-MariaDB", want: "10.6.12", mariadb: true},
+		{version: "11.2.2-MariaDB-log\n", want: "11.2.2", mariadb: true},
+		{version: "10.4.32-MariaDB-1:10.4.32+maria~deb10-log", want: "10.4.32", mariadb: true},
+		{version: "8.0.35", want: "8.0.35"},
+		{version: "5.7.44-log", want: "5.7.44"},
+		{version: "8.0.35-0ubuntu0.22.04.1", want: "8.0.35"},
+		{version: "10.6", want: "10.6.0"},
+		{version: "MariaDB", wantErr: true},
+		{version: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		v, err := parseServerVersion(tt.version)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseServerVersion(%q) = %v, want an error", tt.version, v)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseServerVersion(%q) error = %v", tt.version, err)
+			continue
+		}
+		if v.String() != tt.want || v.MariaDB != tt.mariadb {
+			t.Errorf("parseServerVersion(%q) = %s %s, want %s (MariaDB %t)", tt.version, v.flavor(), v, tt.want, tt.mariadb)
+		}
+	}
+}
+
+func TestOlderRelease(t *testing.T) {
+	tests := []struct {
+		v, other string
+		want     bool
+	}{
+		{v: "10.6.12-MariaDB", other: "10.11.6-MariaDB", want: true},
+		{v: "10.11.6-MariaDB", other: "10.6.12-MariaDB"},
+		{v: "10.11.2-MariaDB", other: "10.11.6-MariaDB"},
+		{v: "10.11.6-MariaDB", other: "11.2.2-MariaDB", want: true},
+		{v: "5.7.44", other: "8.0.35", want: true},
+	}
+	for _, tt := range tests {
+		v, _ := parseServerVersion(tt.v)
+		other, _ := parseServerVersion(tt.other)
+		if got := v.olderRelease(other); got != tt.want {
+			t.Errorf("%s olderRelease(%s) = %t, want %t", tt.v, tt.other, got, tt.want)
+		}
+	}
+}
+
+func TestCheckServerCompatibility(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  string
+		target  string
+		strict  bool
+		wantErr string
+	}{
+		{name: "same release", source: "10.11.6-MariaDB", target: "10.11.2-MariaDB", strict: true},
+		{name: "newer target", source: "10.6.12-MariaDB", target: "11.2.2-MariaDB", strict: true},
+		{name: "downgrade", source: "11.2.2-MariaDB", target: "10.11.6-MariaDB"},
+		{name: "strict downgrade", source: "11.2.2-MariaDB", target: "10.11.6-MariaDB", strict: true, wantErr: "taken from MariaDB 11.2.2 and is restored into the older 10.11.6"},
+		{name: "other flavor", source: "10.11.6-MariaDB", target: "8.0.35", strict: true, wantErr: "taken from MariaDB 10.11.6 and is restored into MySQL 8.0.35"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := newTestRestoreOptions()
+			session := newFakeSession(t, opt, fakeCommand(t, "echo "+tt.target))
+			resticWrapper, _ := newFakeRestic(t, opt, session)
+			storeFakeSnapshot(t, resticWrapper, filepath.Join(opt.setupOptions.ScratchDir, MariaDBDumpFile), sampleDump(1), "--tag", ServerVersionTagPrefix+tt.source)
+
+			err := checkServerCompatibility(session, resticWrapper, opt.dumpOptions, "", tt.strict)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkServerCompatibility() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("checkServerCompatibility() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}